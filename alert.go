@@ -0,0 +1,87 @@
+package nozzle
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+const (
+	// AlertEnvelopeOrigin is the origin of envelopes injected into
+	// Consumer.Events() for slowConsumerAlerts by Config.AlertAsEnvelope.
+	AlertEnvelopeOrigin = "go-nozzle"
+
+	// AlertEnvelopeName is the name of CounterEvent of envelopes injected
+	// for slowConsumerAlerts. SlowAlert.Reason is set as "reason" tag.
+	AlertEnvelopeName = "nozzle.slowConsumerAlert"
+)
+
+// alertEnvelope converts alert to a CounterEvent envelope. total is the
+// number of alerts reported so far including this one.
+func alertEnvelope(alert SlowAlert, total int64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String(AlertEnvelopeOrigin),
+		EventType: events.Envelope_CounterEvent.Enum(),
+		Timestamp: proto.Int64(alert.Time.UnixNano()),
+		CounterEvent: &events.CounterEvent{
+			Name:  proto.String(AlertEnvelopeName),
+			Delta: proto.Uint64(1),
+			Total: proto.Uint64(uint64(total)),
+		},
+		Tags: map[string]string{"reason": alert.Reason},
+	}
+}
+
+// injectAlerts forwards events to downstream and injects envelopes of
+// slowConsumerAlerts sent to alertEnvCh by forwardSlowAlerts between
+// them. Since they're injected after forwardEvents, they're not
+// filtered. It stops when eventCh is closed and alertEnvDoneCh is closed
+// then so that forwardSlowAlerts doesn't block on alertEnvCh.
+func (c *consumer) injectAlerts(eventCh <-chan *events.Envelope) <-chan *events.Envelope {
+	forwardCh := make(chan *events.Envelope, c.eventBufferSize)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(forwardCh)
+		defer close(c.alertEnvDoneCh)
+
+		for {
+			var event *events.Envelope
+			select {
+			case e, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				if c.heartbeatReached(stageAlerts, e) {
+					continue
+				}
+				event = e
+			case event = <-c.alertEnvCh:
+			case <-c.doneCh:
+				return
+			}
+
+			select {
+			case forwardCh <- event:
+				c.sent(stageAlerts, forwardCh)
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return forwardCh
+}
+
+// sendAlertEnvelope sends the envelope of alert to injectAlerts. It
+// returns false if forwarding is stopped.
+func (c *consumer) sendAlertEnvelope(alert SlowAlert, total int64) bool {
+	select {
+	case c.alertEnvCh <- alertEnvelope(alert, total):
+		return true
+	case <-c.alertEnvDoneCh:
+		// Events() is closed, the alert is still sent to Detects().
+		return true
+	case <-c.doneCh:
+		return false
+	}
+}
@@ -0,0 +1,68 @@
+package nozzle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlertEnvelope(t *testing.T) {
+	alert := SlowAlert{
+		Reason: SlowAlertReasonTruncated,
+		Time:   time.Unix(100, 0),
+	}
+
+	e := alertEnvelope(alert, 3)
+	if got, expect := e.GetOrigin(), AlertEnvelopeOrigin; got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+
+	if got, expect := e.GetCounterEvent().GetName(), AlertEnvelopeName; got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+
+	if got, expect := e.GetCounterEvent().GetTotal(), uint64(3); got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+
+	if got, expect := e.GetTags()["reason"], SlowAlertReasonTruncated; got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+
+	if got, expect := e.GetTimestamp(), alert.Time.UnixNano(); got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+}
+
+func TestConsumer_alertAsEnvelope(t *testing.T) {
+	rc := &testRawConsumer{}
+	sd := &testSlowDetector{}
+	c := &consumer{
+		rawConsumer:        rc,
+		customSlowDetector: sd,
+		logger:             &stdLogger{logger: defaultLogger},
+		alertAsEnvelope:    true,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	sd.detectCh <- SlowAlert{Reason: SlowAlertReasonPolicyViolation, Time: time.Now()}
+
+	// Alert is still notified on Detects()
+	select {
+	case <-c.Detects():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect alert to be notified")
+	}
+
+	select {
+	case e := <-c.Events():
+		if got, expect := e.GetCounterEvent().GetName(), AlertEnvelopeName; got != expect {
+			t.Fatalf("expect %q to be eq %q", got, expect)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect alert envelope to be injected")
+	}
+}
@@ -0,0 +1,99 @@
+package nozzle
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// instanceReconnectStep is the offset added to reconnection delay
+	// per Config.InstanceIndex.
+	instanceReconnectStep = 500 * time.Millisecond
+
+	// instanceReconnectSlots is the number of distinct offsets. The
+	// offset wraps around so that it's bounded with many instances.
+	instanceReconnectSlots = 20
+)
+
+// Backoff is the interface for reconnect strategy. It's used via
+// Config.ReconnectBackoff when noaa gives up retrying connection with
+// firehose (after its retry count is exhausted).
+type Backoff interface {
+	// Next returns the duration to wait before next reconnection.
+	Next() time.Duration
+
+	// Reset is called when connection is established.
+	Reset()
+}
+
+// ConstantBackoff waits same Interval before every reconnection.
+type ConstantBackoff struct {
+	Interval time.Duration
+}
+
+// Next returns Interval.
+func (b *ConstantBackoff) Next() time.Duration {
+	return b.Interval
+}
+
+// Reset does nothing.
+func (b *ConstantBackoff) Reset() {}
+
+// ExponentialBackoff doubles the duration to wait from Min up to Max
+// on every reconnection. It's reset to Min when connection is established.
+type ExponentialBackoff struct {
+	// Min is the first duration to wait. It must be positive.
+	Min time.Duration
+
+	// Max is the upper bound of the duration to wait. If it's 0,
+	// the duration is not bounded.
+	Max time.Duration
+
+	// Jitter is the ratio (0 to 1) of random duration to subtract from
+	// the duration to wait. It spreads reconnections of multiple nozzles.
+	// If it's 0, no jitter is applied.
+	Jitter float64
+
+	mu      sync.Mutex
+	current time.Duration
+}
+
+// Next returns the duration to wait and doubles it for the next time.
+func (b *ExponentialBackoff) Next() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.current < b.Min {
+		b.current = b.Min
+	}
+
+	d := b.current
+	b.current *= 2
+	if b.Max > 0 && b.current > b.Max {
+		b.current = b.Max
+	}
+
+	if b.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * b.Jitter * float64(d))
+	}
+
+	return d
+}
+
+// Reset resets the duration to wait to Min.
+func (b *ExponentialBackoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.current = b.Min
+}
+
+// instanceReconnectOffset returns the offset added to reconnection delay
+// for the instance index. It spreads reconnections of instances sharing
+// the subscription after doppler restarts.
+func instanceReconnectOffset(index int) time.Duration {
+	if index <= 0 {
+		return 0
+	}
+	return time.Duration(index%instanceReconnectSlots) * instanceReconnectStep
+}
@@ -0,0 +1,86 @@
+package nozzle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff_implement(t *testing.T) {
+	var _ Backoff = &ConstantBackoff{}
+	var _ Backoff = &ExponentialBackoff{}
+}
+
+func TestConstantBackoff(t *testing.T) {
+	b := &ConstantBackoff{Interval: 3 * time.Second}
+	for i := 0; i < 3; i++ {
+		if got := b.Next(); got != 3*time.Second {
+			t.Fatalf("#%d expect %s to be eq %s", i, got, 3*time.Second)
+		}
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := &ExponentialBackoff{
+		Min: 1 * time.Second,
+		Max: 5 * time.Second,
+	}
+
+	expects := []time.Duration{
+		1 * time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		5 * time.Second,
+		5 * time.Second,
+	}
+
+	for i, expect := range expects {
+		if got := b.Next(); got != expect {
+			t.Fatalf("#%d expect %s to be eq %s", i, got, expect)
+		}
+	}
+
+	b.Reset()
+	if got := b.Next(); got != 1*time.Second {
+		t.Fatalf("expect %s to be eq %s", got, 1*time.Second)
+	}
+}
+
+func TestExponentialBackoff_jitter(t *testing.T) {
+	b := &ExponentialBackoff{
+		Min:    1 * time.Second,
+		Max:    8 * time.Second,
+		Jitter: 0.5,
+	}
+
+	for i := 0; i < 5; i++ {
+		max := time.Duration(1<<uint(i)) * time.Second
+		if max > 8*time.Second {
+			max = 8 * time.Second
+		}
+
+		got := b.Next()
+		if got < max/2 || got > max {
+			t.Fatalf("#%d expect %s to be between %s and %s", i, got, max/2, max)
+		}
+	}
+}
+
+func TestInstanceReconnectOffset(t *testing.T) {
+	cases := []struct {
+		index  int
+		expect time.Duration
+	}{
+		{0, 0},
+		{1, 500 * time.Millisecond},
+		{3, 1500 * time.Millisecond},
+
+		// Wraps around
+		{instanceReconnectSlots + 1, 500 * time.Millisecond},
+	}
+
+	for i, tc := range cases {
+		if got := instanceReconnectOffset(tc.index); got != tc.expect {
+			t.Fatalf("#%d expect %s to be eq %s", i, got, tc.expect)
+		}
+	}
+}
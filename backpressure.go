@@ -0,0 +1,75 @@
+package nozzle
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// BackpressurePolicy defines what to do with envelopes when the channel
+// returned by Consumer.Events() is full.
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock blocks reading envelopes from firehose until the
+	// reader catches up. No envelope is dropped by consumer but doppler
+	// may drop envelopes (or close connection) by its slow consumer
+	// policy. This is the default.
+	BackpressureBlock BackpressurePolicy = iota
+
+	// BackpressureDropOldest drops the oldest envelope buffered in the
+	// channel to make room for the new one, so that the channel always
+	// holds the newest Config.EventBufferSize envelopes and firehose is
+	// read without blocking.
+	BackpressureDropOldest
+)
+
+// String returns the name of policy.
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case BackpressureBlock:
+		return "Block"
+	case BackpressureDropOldest:
+		return "DropOldest"
+	default:
+		return fmt.Sprintf("BackpressurePolicy(%d)", int(p))
+	}
+}
+
+// sendEvent sends event to forwardCh by backpressurePolicy. It returns
+// false if forwarding is stopped.
+func (c *consumer) sendEvent(forwardCh chan *events.Envelope, event *events.Envelope) bool {
+	if c.backpressurePolicy == BackpressureDropOldest {
+		// Only this goroutine sends to forwardCh, so there is room
+		// after the oldest one is dropped.
+		for {
+			select {
+			case forwardCh <- event:
+				c.sent(stageForward, forwardCh)
+				return true
+			case <-c.doneCh:
+				return false
+			default:
+			}
+
+			select {
+			case dropped := <-forwardCh:
+				if dropped == heartbeatMarker {
+					c.heartbeatDone(false)
+					continue
+				}
+				atomic.AddInt64(&c.eventDropped, 1)
+			default:
+			}
+		}
+	}
+
+	select {
+	case forwardCh <- event:
+		c.sent(stageForward, forwardCh)
+		return true
+	case <-c.doneCh:
+		return false
+	}
+}
@@ -0,0 +1,66 @@
+package nozzle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestConsumer_backpressureDropOldest(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:        rc,
+		logger:             &stdLogger{logger: defaultLogger},
+		eventBufferSize:    2,
+		backpressurePolicy: BackpressureDropOldest,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	// Upstream is not blocked while Events() is not read
+	for ts := int64(1); ts <= 5; ts++ {
+		select {
+		case rc.eventCh <- &events.Envelope{Timestamp: proto.Int64(ts)}:
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect upstream not to be blocked")
+		}
+	}
+
+	deadline := time.Now().Add(1 * time.Second)
+	for c.Stats().EventsDropped < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got, expect := c.Stats().EventsDropped, int64(3); got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+
+	// The newest ones are kept
+	for _, expect := range []int64{4, 5} {
+		if got := (<-c.Events()).GetTimestamp(); got != expect {
+			t.Fatalf("expect %d to be eq %d", got, expect)
+		}
+	}
+}
+
+func TestBackpressurePolicy_String(t *testing.T) {
+	cases := []struct {
+		in     BackpressurePolicy
+		expect string
+	}{
+		{BackpressureBlock, "Block"},
+		{BackpressureDropOldest, "DropOldest"},
+		{BackpressurePolicy(10), "BackpressurePolicy(10)"},
+	}
+
+	for _, tc := range cases {
+		if got := tc.in.String(); got != tc.expect {
+			t.Fatalf("expect %q to be eq %q", got, tc.expect)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package nozzle
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// batchEvents coalesces events into batches of up to batchSize and
+// forwards them to downstream. A partial batch is flushed when
+// batchFlushInterval elapses after its first event is added, or when
+// eventCh is closed (e.g., ctx passed to StartWithContext is canceled)
+// so that no events are left in the batch.
+func (c *consumer) batchEvents(eventCh <-chan *events.Envelope) <-chan []*events.Envelope {
+	batchCh := make(chan []*events.Envelope)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(batchCh)
+
+		batch := make([]*events.Envelope, 0, c.batchSize)
+
+		// timerCh is started when the first event is added to batch.
+		// It's nil while batch is empty.
+		clock := orRealClock(c.clock)
+		var timerCh <-chan time.Time
+
+		// flush forwards batch to downstream. It returns false if
+		// forwarding is stopped.
+		flush := func() bool {
+			timerCh = nil
+
+			if len(batch) == 0 {
+				return true
+			}
+
+			select {
+			case batchCh <- batch:
+				c.sentBatch(batchCh, len(batch))
+			case <-c.doneCh:
+				return false
+			}
+
+			batch = make([]*events.Envelope, 0, c.batchSize)
+			return true
+		}
+
+		for {
+			select {
+			case event, ok := <-eventCh:
+				if !ok {
+					flush()
+					return
+				}
+
+				if c.heartbeatReached(stageBatch, event) {
+					continue
+				}
+
+				batch = append(batch, event)
+				if len(batch) == 1 && c.batchFlushInterval > 0 {
+					timerCh = clock.After(c.batchFlushInterval)
+				}
+
+				if len(batch) >= c.batchSize && !flush() {
+					return
+				}
+			case <-timerCh:
+				if !flush() {
+					return
+				}
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return batchCh
+}
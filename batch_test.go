@@ -0,0 +1,103 @@
+package nozzle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func TestConsumerBatchEvents_size(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		batchSize:   2,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	if c.Events() != nil {
+		t.Fatalf("expect Events() to be nil with batching")
+	}
+
+	go func() {
+		for i := 0; i < 4; i++ {
+			rc.eventCh <- &events.Envelope{}
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case batch := <-c.BatchEvents():
+			if got, expect := len(batch), 2; got != expect {
+				t.Fatalf("#%d expect %d to be eq %d", i, got, expect)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("#%d expect not timeout", i)
+		}
+	}
+}
+
+func TestConsumerBatchEvents_flushInterval(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:        rc,
+		logger:             &stdLogger{logger: defaultLogger},
+		batchSize:          100,
+		batchFlushInterval: 50 * time.Millisecond,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		rc.eventCh <- &events.Envelope{}
+	}()
+
+	select {
+	case batch := <-c.BatchEvents():
+		if got, expect := len(batch), 1; got != expect {
+			t.Fatalf("expect %d to be eq %d", got, expect)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect partial batch to be flushed")
+	}
+}
+
+func TestConsumerBatchEvents_flushOnCancel(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		batchSize:   100,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := c.StartWithContext(ctx); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	rc.eventCh <- &events.Envelope{}
+	cancel()
+
+	// Upstream is closed after ctx is canceled
+	close(rc.eventCh)
+	rc.eventCh = nil
+
+	select {
+	case batch := <-c.BatchEvents():
+		if got, expect := len(batch), 1; got != expect {
+			t.Fatalf("expect %d to be eq %d", got, expect)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect partial batch to be flushed")
+	}
+}
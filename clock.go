@@ -0,0 +1,39 @@
+package nozzle
+
+import (
+	"time"
+)
+
+// Clock provides the current time and timers to consumer. It can be
+// replaced by Config.Clock (e.g., with a fake one to advance time in
+// tests deterministically).
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for d to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock implements Clock by time package.
+type realClock struct{}
+
+// Now returns time.Now().
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// After returns time.After(d).
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// orRealClock returns clock if it's not nil. Otherwise, it returns
+// realClock.
+func orRealClock(clock Clock) Clock {
+	if clock == nil {
+		return realClock{}
+	}
+	return clock
+}
@@ -0,0 +1,145 @@
+package nozzle
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// fakeClock is Clock which time is advanced only by Advance.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance advances time by d and fires waiters which are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+// BlockUntil waits until n waiters are pending so that Advance fires
+// them. It fails t if they're not pending within 1 second.
+func (c *fakeClock) BlockUntil(t *testing.T, n int) {
+	deadline := time.Now().Add(1 * time.Second)
+	for {
+		c.mu.Lock()
+		pending := len(c.waiters)
+		c.mu.Unlock()
+
+		if pending >= n {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d waiters to be pending: %d", n, pending)
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func TestClock_implement(t *testing.T) {
+	var _ Clock = realClock{}
+	var _ Clock = &fakeClock{}
+}
+
+func TestOrRealClock(t *testing.T) {
+	if _, ok := orRealClock(nil).(realClock); !ok {
+		t.Fatalf("expect realClock to be used by default")
+	}
+
+	clock := newFakeClock()
+	if got := orRealClock(clock); got != clock {
+		t.Fatalf("expect %v to be eq %v", got, clock)
+	}
+}
+
+func TestDefaultDetect_clock(t *testing.T) {
+	clock := newFakeClock()
+	testDetector := &defaultSlowDetector{
+		logger:    &stdLogger{logger: defaultLogger},
+		threshold: 2,
+		window:    1 * time.Minute,
+		clock:     clock,
+	}
+
+	eventCh := make(chan *events.Envelope)
+	outCh, _, detectCh := testDetector.Detect(eventCh, make(chan error))
+	defer testDetector.Stop()
+
+	truncated := func() *events.Envelope {
+		return &events.Envelope{
+			Origin:    &TR_Origin,
+			EventType: &TR_EventType,
+			CounterEvent: &events.CounterEvent{
+				Name: &TR_EventName,
+			},
+		}
+	}
+
+	// Second one is out of window
+	eventCh <- truncated()
+	<-outCh
+	clock.Advance(2 * time.Minute)
+	eventCh <- truncated()
+	<-outCh
+
+	select {
+	case <-detectCh:
+		t.Fatalf("expect not to be detected")
+	default:
+	}
+
+	// Third one is within window of second one
+	clock.Advance(30 * time.Second)
+	go func() {
+		eventCh <- truncated()
+		<-outCh
+	}()
+
+	select {
+	case alert := <-detectCh:
+		if got, expect := alert.Time, clock.Now(); !got.Equal(expect) {
+			t.Fatalf("expect %s to be eq %s", got, expect)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect to be detected")
+	}
+}
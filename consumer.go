@@ -1,14 +1,44 @@
 package nozzle
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	noaaConsumer "github.com/cloudfoundry/noaa/consumer"
 	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gorilla/websocket"
 )
 
+const (
+	// MaxSubscriptionIDLength is the maximum length of SubscriptionID
+	// accepted by doppler.
+	MaxSubscriptionIDLength = 256
+
+	// SubscriptionIDPattern is the pattern of SubscriptionID accepted by
+	// doppler. It's a part of firehose URL path, so only alphanumeric,
+	// '.', '_' and '-' can be used.
+	SubscriptionIDPattern = `^[A-Za-z0-9._-]+$`
+)
+
+// subscriptionIDRegexp is compiled SubscriptionIDPattern.
+var subscriptionIDRegexp = regexp.MustCompile(SubscriptionIDPattern)
+
+// ErrCloseTimeout is returned by CloseWithTimeout when events remaining
+// in the pipeline are not read before timeout.
+var ErrCloseTimeout = errors.New("timeout while draining remaining events")
+
+// drainTimeout is the timeout Drain waits for events remaining in the
+// pipeline.
+const drainTimeout = 30 * time.Second
+
 // Consumer defines the interface of consumer it receives
 // upstream firehose events and slowConsumerAlerts events and errors.
 type Consumer interface {
@@ -16,9 +46,38 @@ type Consumer interface {
 	// rawConsumer(by default Noaa).
 	Events() <-chan *events.Envelope
 
+	// EventsContext is same as Events but the returned channel is closed
+	// when ctx is done, so that callers don't need to select on ctx.
+	EventsContext(ctx context.Context) <-chan *events.Envelope
+
+	// Tee fans out Events() to n channels which receive every envelope.
+	// A slow reader of a channel doesn't block the others beyond
+	// Config.TeeBufferSize, envelopes are dropped for it instead.
+	Tee(n int) []<-chan *events.Envelope
+
+	// Flush blocks until every channel of Tee has been read up to the
+	// envelopes passed to it before Flush is called, or ctx is done.
+	Flush(ctx context.Context) error
+
+	// BatchEvents returns the read channel for the events coalesced into
+	// batches by Config.BatchSize and Config.BatchFlushInterval. It's nil
+	// if batching is disabled. When it's enabled, Events() returns nil
+	// and all events are delivered to this channel.
+	BatchEvents() <-chan []*events.Envelope
+
+	// Metrics returns the read channel for ValueMetric and CounterEvent
+	// envelopes decoded as Metric. It reads Events(), so Events() must
+	// not be read by others once it's called.
+	Metrics() <-chan Metric
+
+	// JSONEvents returns the read channel for the events marshaled to
+	// JSON by the JSON tags of sonde-go. It reads Events(), so Events()
+	// must not be read by others once it's called.
+	JSONEvents() <-chan []byte
+
 	// Detects returns the read channel that is notified slowConsumerAlerts
 	// handled by SlowDetector.
-	Detects() <-chan error
+	Detects() <-chan SlowAlert
 
 	// Error returns the read channel of erros that occured during consuming.
 	Errors() <-chan error
@@ -27,19 +86,413 @@ type Consumer interface {
 	// If any, returns error.
 	Start() error
 
+	// StartWithContext is same as Start but consuming and background
+	// processes (e.g., refreshing access token) are stopped when ctx is
+	// canceled.
+	StartWithContext(ctx context.Context) error
+
+	// Run dispatches events, errors and slowConsumerAlerts to Handler
+	// instead of reading the channels above. It blocks until ctx is
+	// canceled or consumer is closed. Start must be called before Run.
+	Run(ctx context.Context, h Handler) error
+
+	// RunParallel passes events to handler on the given number of worker
+	// goroutines. If Config.PreserveOrderBy is set, events with the same
+	// key are passed to the same worker in order. Errors returned by
+	// handler are sent to Errors(). It blocks until ctx is canceled or
+	// consumer is closed. Start must be called before RunParallel.
+	RunParallel(ctx context.Context, workers int, handler func(*events.Envelope) error) error
+
+	// Pause stops forwarding events to Events() (and reading them from
+	// firehose) without closing connection until Resume is called. Note
+	// that doppler may drop events or close connection by its slow
+	// consumer policy when paused for long.
+	Pause()
+
+	// Resume restarts forwarding events paused by Pause.
+	Resume()
+
 	// Close stop consuming upstream events by RawConsumer and stop SlowDetector.
 	// If any, returns error.
 	Close() error
+
+	// CloseContext is same as Close but it returns ctx.Err() when ctx is
+	// done before closing is completed (e.g., closing connection hangs on
+	// dead socket). Closing is continued in background.
+	CloseContext(ctx context.Context) error
+
+	// CloseWithTimeout is same as Close but it keeps delivering events
+	// remaining in the pipeline until they are read or timeout d is exceeded.
+	// If timeout is exceeded, it returns ErrCloseTimeout.
+	CloseWithTimeout(d time.Duration) error
+
+	// Drain closes consumer same as CloseWithTimeout but returns events
+	// remaining in the pipeline as a slice instead of delivering them
+	// on Events() (or BatchEvents()).
+	Drain() []*events.Envelope
+
+	// TokenExpiry returns the time when the access token of the current
+	// connection expires. It's zero if it's unknown (e.g., RLP is used or
+	// the token is provided by user and it's not JWT).
+	TokenExpiry() time.Time
+
+	// Resubscribe re-establishes firehose connection under the given
+	// subscription ID without rebuilding consumer. Events keep flowing on
+	// the same Events() channel.
+	Resubscribe(subscriptionID string) error
+
+	// Handoff closes consumer gracefully after Config.DrainDelay so that
+	// a replacement instance can take over the subscription during it.
+	Handoff(ctx context.Context) error
+
+	// ConnectionState returns the current state of connection with firehose
+	// and how many times reconnect is attempted.
+	ConnectionState() ConnectionState
+
+	// Config returns a copy of the configuration consumer is constructed
+	// with. Secrets (Password, Token and ClientSecret) are redacted.
+	Config() Config
+
+	// Lifecycle returns the read channel that is notified when the phase
+	// of connection (connecting, connected, token refreshed, reconnecting
+	// and closed) changes. Events are dropped if nobody reads them. It's
+	// not closed, LifecycleClosed is the last event. It's nil before
+	// consumer is started.
+	Lifecycle() <-chan LifecycleEvent
+
+	// Heartbeats returns the read channel that is notified every
+	// Config.HeartbeatInterval while consumer is running, even when no
+	// envelope arrives. Each heartbeat passes through the pipeline after
+	// the envelopes before it, so it's not notified while the pipeline
+	// (or the reader of Events()) is stuck. It's nil if HeartbeatInterval
+	// is 0. It's closed when consumer is closed.
+	Heartbeats() <-chan Heartbeat
+
+	// Stats returns the saturation (current and maximum length) of the
+	// channels returned by Events() (or BatchEvents()), Errors() and
+	// Detects() and the overview of consuming (uptime, totals and lag).
+	Stats() Stats
+
+	// DebugMessages returns the read channel of request and response
+	// dumps of noaa. It's nil if Config.CaptureDebug is false. It's
+	// closed when consumer is closed.
+	DebugMessages() <-chan string
+
+	// DetectorStats returns the number of slowConsumerAlerts detected by
+	// each reason since consumer is started.
+	DetectorStats() DetectorStats
+
+	// LastEventTime returns the time when the last envelope is delivered
+	// to Events(). It's zero time if no envelope is delivered yet.
+	LastEventTime() time.Time
+
+	// Healthy reports whether an envelope is delivered to Events() within
+	// Config.HealthStaleThreshold. Before the first envelope, it's measured
+	// from the time when consumer is started.
+	Healthy() bool
+
+	// Lag returns how far behind real-time consuming is, i.e., the
+	// difference between now and Timestamp of the newest envelope
+	// received. It grows before doppler starts dropping envelopes for
+	// slow consumer. It's 0 if no envelope is received yet.
+	Lag() time.Duration
+
+	// EventCounts returns the number of envelopes received from upstream
+	// for each event type (before EventTypes, Filter and so on are
+	// applied). Types which are not received are not included.
+	EventCounts() map[events.Envelope_EventType]uint64
+
+	// ErrorCount returns the number of errors forwarded to Errors() since
+	// consumer is started. It only increases, so the error rate can be
+	// computed by polling it.
+	ErrorCount() uint64
+
+	// WaitReady blocks until the first connection with firehose is
+	// established after consumer is started, or ctx is done. If consumer
+	// stops before connecting, the error which caused it is returned.
+	WaitReady(ctx context.Context) error
+
+	// Wait blocks until consumer terminates. It returns nil when Close
+	// is called, otherwise the error which terminated consumer.
+	Wait() error
 }
 
 type consumer struct {
-	rawConsumer  rawConsumer
-	slowDetector slowDetector
-	logger       *log.Logger
+	// startedAt and lastEventAt are unix nano times when consumer is
+	// started and the last event is delivered. They're accessed
+	// atomically and placed first for 64-bit alignment.
+	startedAt   int64
+	lastEventAt int64
+
+	// newestTimestamp is the newest Timestamp (unix nano) of envelopes
+	// received from upstream. It's also accessed atomically.
+	newestTimestamp int64
+
+	// The maximum lengths of eventCh, batchCh, errCh and detectCh
+	// observed after sending. They're also accessed atomically.
+	eventMaxLen  int64
+	batchMaxLen  int64
+	errMaxLen    int64
+	detectMaxLen int64
+
+	// errDropped is the number of errors dropped by errorOverflowPolicy
+	// and eventDropped is the number of events dropped by
+	// backpressurePolicy. They're also accessed atomically.
+	errDropped   int64
+	eventDropped int64
+
+	// invalidEvents is the number of events dropped since they're
+	// invalid. It's also accessed atomically.
+	invalidEvents int64
+
+	// The numbers of events delivered to downstream and errors and
+	// slowConsumerAlerts reported. They're also accessed atomically.
+	totalEvents int64
+	totalErrors int64
+	totalAlerts int64
+
+	// errorCount is the number of errors forwarded to Errors(). It's
+	// also accessed atomically.
+	errorCount uint64
+
+	// slowHandlers is the number of Handler calls which exceeded
+	// handlerTimeout. It's also accessed atomically.
+	slowHandlers int64
+
+	// lateEvents is the number of events which arrived after newer
+	// ones are released by reorderEvents. It's also accessed atomically.
+	lateEvents int64
+
+	// spilledEvents is the number of events written to spill files by
+	// spillEvents. It's also accessed atomically.
+	spilledEvents int64
+
+	// suppressedErrors is the number of errors suppressed by errorDedup.
+	// It's also accessed atomically.
+	suppressedErrors int64
+
+	// eventCounts is the number of envelopes received for each event
+	// type indexed by its value. It's also accessed atomically.
+	eventCounts [maxEventType + 1]uint64
+
+	// healthStaleThreshold is how long consumer is regarded as
+	// healthy after the last event is delivered.
+	healthStaleThreshold time.Duration
+
+	rawConsumer  RawConsumer
+	slowDetector SlowDetector
+	logger       leveledLogger
+
+	// customSlowDetector is SlowDetector provided by user. If it's nil,
+	// defaultSlowDetector is used.
+	customSlowDetector SlowDetector
+
+	// tokenRefresher refreshes access token before it expires.
+	// It's nil when token can not be refreshed (e.g., Token is
+	// provided by user).
+	tokenRefresher *tokenRefresher
+
+	// cancel stops background processes started by StartWithContext.
+	cancel context.CancelFunc
+
+	// errorContext is true to attach the context passed to
+	// StartWithContext to errors by ContextError. startCtx is it.
+	errorContext bool
+	startCtx     context.Context
+
+	// retriableErrors is true to wrap errors sent to errCh in
+	// RetriableError.
+	retriableErrors bool
+
+	// errorDedup collapses identical consecutive errors. It's nil when
+	// Config.DedupErrors is false.
+	errorDedup *errorDeduplicator
+
+	// closeOnce ensures Close tears down consumer only once.
+	closeOnce sync.Once
+
+	// doneCh is closed by Close to stop forwarding events to downstream.
+	doneCh chan struct{}
+
+	// wg waits forwarding goroutines to finish.
+	wg sync.WaitGroup
+
+	// eventTypes is the set of event types forwarded to eventCh.
+	// If it's empty, all events are forwarded.
+	eventTypes map[events.Envelope_EventType]struct{}
+
+	// filter drops events for which it returns false.
+	// If it's nil, all events are forwarded.
+	filter func(*events.Envelope) bool
+
+	// transform replaces events just before forwarding. If it returns
+	// nil, the event is dropped. If it's nil, events are not changed.
+	transform func(*events.Envelope) *events.Envelope
+
+	// rateLimiter limits the rate of events forwarded to eventCh.
+	// It's nil when rate limit is disabled.
+	rateLimiter   *rateLimiter
+	rateLimitMode RateLimitMode
+
+	// deduplicator skips duplicated events (e.g., replayed after
+	// reconnecting). It's nil when deduplication is disabled.
+	deduplicator *deduplicator
+
+	// debugPrinter sends noaa dumps to DebugMessages(). It's nil
+	// when Config.CaptureDebug is false.
+	debugPrinter *debugChannelPrinter
+
+	// metrics is prometheus metrics of consumer. It's nil when
+	// Config.MetricsRegisterer is not set.
+	metrics *metrics
 
 	eventCh  <-chan *events.Envelope
 	errCh    <-chan error
-	detectCh <-chan error
+	detectCh <-chan SlowAlert
+
+	// finalStage is the stage of the pipeline which sends events to
+	// eventCh (or batchCh). Events are recorded as delivered there.
+	finalStage pipelineStage
+
+	// heartbeatCh is notified every heartbeatInterval. It's nil
+	// when heartbeatInterval is 0. heartbeatMarkCh tells forwardEvents
+	// to inject heartbeatMarker and heartbeatDoneCh is notified when it
+	// reaches the last stage (or it's dropped).
+	heartbeatCh       <-chan Heartbeat
+	heartbeatInterval time.Duration
+	heartbeatMarkCh   chan struct{}
+	heartbeatDoneCh   chan bool
+
+	// resumeCh is open while consumer is paused and closed by Resume.
+	// It's nil when consumer is not paused. It's protected by pauseMu.
+	resumeCh chan struct{}
+	pauseMu  sync.Mutex
+
+	// config is the snapshot of Config consumer is constructed with.
+	// Token is the one fetched (if it's empty in Config).
+	config Config
+
+	// lifecycleCh receives lifecycle events from rawConsumer.
+	lifecycleCh chan LifecycleEvent
+
+	// rebalance detects rebalance of subscription by origins of
+	// events. It's nil if Config.RebalanceWindow is 0.
+	rebalance *rebalanceDetector
+
+	// readyCh is closed when the first connection is established.
+	// readyErr is the last error reported before it (protected by
+	// readyMu). errDoneCh is closed when forwarding errors is finished,
+	// i.e., upstream is stopped.
+	readyCh   chan struct{}
+	readyOnce sync.Once
+	readyErr  error
+	readyMu   sync.Mutex
+	errDoneCh chan struct{}
+
+	// closedCh is closed when Close is called and terminalCh is closed
+	// when consumer doesn't recover from an error. lastErr is the last
+	// error reported (protected by readyMu). They're used by Wait.
+	closedCh     chan struct{}
+	terminalCh   chan struct{}
+	terminalOnce sync.Once
+	lastErr      error
+
+	// metricCh is the channel returned by Metrics. It's created when
+	// Metrics is called first.
+	metricCh   <-chan Metric
+	metricOnce sync.Once
+
+	// jsonCh is the channel returned by JSONEvents. It's created when
+	// JSONEvents is called first.
+	jsonCh   <-chan []byte
+	jsonOnce sync.Once
+
+	// teeBufferSize is the queue size of each channel of Tee.
+	// teeDropped is the dropped counts of them (accessed atomically)
+	// and teeBranches are them, which are set by Tee (protected by
+	// teeMu).
+	teeBufferSize int
+	teeDropped    []int64
+	teeBranches   []*teeBranch
+	teeMu         sync.Mutex
+
+	// clock is used for time-based features. If it's nil, real time
+	// is used.
+	clock Clock
+
+	// errorOverflowPolicy is what to do with errors when errCh is full.
+	errorOverflowPolicy ErrorOverflowPolicy
+
+	// backpressurePolicy is what to do with events when eventCh is full.
+	backpressurePolicy BackpressurePolicy
+
+	// reorderWindow is how long events are held to sort them by
+	// timestamp. 0 means events are not reordered. dropLateEvents is
+	// true to drop events which arrive too late to be sorted.
+	reorderWindow  time.Duration
+	dropLateEvents bool
+
+	// diskSpillDir is the directory to spill events which overflow
+	// maxMemoryBuffer. Empty means events are not spilled. spillDoneCh
+	// is closed after spill files are removed.
+	diskSpillDir    string
+	maxMemoryBuffer int
+	spillDoneCh     chan struct{}
+
+	// drainDelay is how long Handoff keeps consuming before closing.
+	drainDelay time.Duration
+
+	// handlerTimeout is the deadline of each event dispatched by Run.
+	// 0 means no deadline.
+	handlerTimeout time.Duration
+
+	// validateEnvelopes is true to drop events which don't have
+	// the payload of their event type.
+	validateEnvelopes bool
+
+	// recorder writes every consumed event to Config.RecordFile.
+	// It's nil if recording is not enabled.
+	recorder *recorder
+
+	// handlerErrCh receives errors returned by handlers of RunParallel
+	// to forward them to errCh.
+	handlerErrCh chan error
+
+	// preserveOrderBy returns the key of events which must be processed
+	// in order by RunParallel. If it's nil, order is not preserved.
+	preserveOrderBy func(*events.Envelope) string
+
+	// batchCh is used instead of eventCh when batchSize is set.
+	batchCh            <-chan []*events.Envelope
+	batchSize          int
+	batchFlushInterval time.Duration
+
+	// Buffer sizes of the channels above. 0 means unbuffered.
+	eventBufferSize  int
+	errBufferSize    int
+	detectBufferSize int
+
+	// slowDetectThreshold, slowDetectWindow, truncatedPredicate and
+	// classifyError are passed to slowDetector.
+	slowDetectThreshold int
+	slowDetectWindow    time.Duration
+	truncatedPredicate  func(*events.Envelope) bool
+	classifyError       func(error) (bool, string)
+
+	// dropAlerts is passed to slowDetector. It's true unless
+	// Config.BlockOnAlert is set.
+	dropAlerts bool
+
+	// alertAsEnvelope is true to inject envelopes of slowConsumerAlerts
+	// into eventCh. They're sent to alertEnvCh by forwardSlowAlerts and
+	// alertEnvDoneCh is closed when injectAlerts stops reading it.
+	alertAsEnvelope bool
+	alertEnvCh      chan *events.Envelope
+	alertEnvDoneCh  chan struct{}
+
+	// disableSlowDetector is true to use nopSlowDetector instead of
+	// the default one.
+	disableSlowDetector bool
 }
 
 // Events returns the read channel for the events that consumed by rawConsumer
@@ -47,8 +500,56 @@ func (c *consumer) Events() <-chan *events.Envelope {
 	return c.eventCh
 }
 
+// EventsContext returns the channel which forwards Events() until ctx is
+// done. The channel is closed when ctx is done or Events() is closed,
+// and the goroutine forwarding events exits at the same time.
+func (c *consumer) EventsContext(ctx context.Context) <-chan *events.Envelope {
+	eventCh := c.Events()
+	forwardCh := make(chan *events.Envelope)
+	go func() {
+		defer close(forwardCh)
+		for {
+			select {
+			case event, ok := <-eventCh:
+				if !ok {
+					return
+				}
+
+				select {
+				case forwardCh <- event:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return forwardCh
+}
+
+// Heartbeats returns the read channel of heartbeats.
+func (c *consumer) Heartbeats() <-chan Heartbeat {
+	return c.heartbeatCh
+}
+
+// DebugMessages returns the read channel of noaa dumps.
+func (c *consumer) DebugMessages() <-chan string {
+	if c.debugPrinter == nil {
+		return nil
+	}
+
+	return c.debugPrinter.ch
+}
+
+// BatchEvents returns the read channel for the batches of events.
+func (c *consumer) BatchEvents() <-chan []*events.Envelope {
+	return c.batchCh
+}
+
 // Detects returns the read channel that is notified slowConsumerAlerts
-func (c *consumer) Detects() <-chan error {
+func (c *consumer) Detects() <-chan SlowAlert {
 	return c.detectCh
 }
 
@@ -57,14 +558,144 @@ func (c *consumer) Errors() <-chan error {
 	return c.errCh
 }
 
+// ConnectionState returns the current state of connection with firehose.
+// If rawConsumer doesn't track its state, it always returns StateIdle.
+func (c *consumer) ConnectionState() ConnectionState {
+	if sr, ok := c.rawConsumer.(stateReporter); ok {
+		return sr.connectionState()
+	}
+
+	return ConnectionState{}
+}
+
+// DetectorStats returns the number of slowConsumerAlerts by reason.
+// If consumer is not started or slowDetector doesn't count alerts, it
+// always returns zero values.
+func (c *consumer) DetectorStats() DetectorStats {
+	if r, ok := c.slowDetector.(detectorStatsReporter); ok {
+		return r.DetectorStats()
+	}
+
+	return DetectorStats{}
+}
+
+// TokenExpiry returns the time when the current access token expires.
+// The expiry is updated when the token is refreshed. If the token is not
+// refreshed, it's read from the token itself.
+func (c *consumer) TokenExpiry() time.Time {
+	if c.tokenRefresher != nil {
+		return c.tokenRefresher.expiry()
+	}
+
+	exp, _ := tokenExpiry(c.config.Token)
+	return exp
+}
+
+// LastEventTime returns the time when the last event is delivered.
+func (c *consumer) LastEventTime() time.Time {
+	last := atomic.LoadInt64(&c.lastEventAt)
+	if last == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, last)
+}
+
+// Healthy reports whether an event is delivered within healthStaleThreshold.
+// It's always false if consumer is not started.
+func (c *consumer) Healthy() bool {
+	last := atomic.LoadInt64(&c.lastEventAt)
+	if last == 0 {
+		last = atomic.LoadInt64(&c.startedAt)
+	}
+
+	if last == 0 {
+		return false
+	}
+
+	return orRealClock(c.clock).Now().Sub(time.Unix(0, last)) <= c.healthStaleThreshold
+}
+
+// Lag returns the difference between now and the newest envelope
+// timestamp received.
+func (c *consumer) Lag() time.Duration {
+	newest := atomic.LoadInt64(&c.newestTimestamp)
+	if newest == 0 {
+		return 0
+	}
+
+	return orRealClock(c.clock).Now().Sub(time.Unix(0, newest))
+}
+
+// observeTimestamp records Timestamp of event if it's newer than
+// the ones received before. It's only called from forwardEvents.
+func (c *consumer) observeTimestamp(event *events.Envelope) {
+	if ts := event.GetTimestamp(); ts > atomic.LoadInt64(&c.newestTimestamp) {
+		atomic.StoreInt64(&c.newestTimestamp, ts)
+	}
+}
+
 // Start starts consuming & slowDetector
 func (c *consumer) Start() error {
-	// Start consuming events from firehose.
-	eventsCh, errCh := c.rawConsumer.Consume()
+	return c.StartWithContext(context.Background())
+}
+
+// StartWithContext starts consuming & slowDetector. Consuming and token
+// refreshing are stopped when ctx is canceled. It returns error if ctx
+// is nil.
+func (c *consumer) StartWithContext(ctx context.Context) error {
+	if ctx == nil {
+		return fmt.Errorf("context must not be nil")
+	}
+
+	c.startCtx = ctx
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.doneCh = make(chan struct{})
+	c.handlerErrCh = make(chan error)
+	c.readyCh = make(chan struct{})
+	c.errDoneCh = make(chan struct{})
+	c.closedCh = make(chan struct{})
+	c.terminalCh = make(chan struct{})
+	atomic.StoreInt64(&c.startedAt, orRealClock(c.clock).Now().UnixNano())
 
-	// Construct default slowDetector
-	sd := &defaultSlowDetector{
-		logger: c.logger,
+	// Notify lifecycle events if rawConsumer supports it. The hook
+	// must be set before connecting.
+	c.lifecycleCh = make(chan LifecycleEvent, lifecycleBufferSize)
+	if ln, ok := c.rawConsumer.(lifecycleNotifier); ok {
+		ln.setLifecycleHook(c.emitLifecycle)
+	}
+
+	// Start consuming events from firehose. It's stopped when
+	// ctx is canceled.
+	eventsCh, errCh := c.rawConsumer.ConsumeContext(ctx)
+
+	// Start refreshing token in background if rawConsumer supports
+	// reconnecting with new token.
+	if c.tokenRefresher != nil {
+		if tr, ok := c.rawConsumer.(tokenReceiver); ok {
+			go c.tokenRefresher.run(ctx, tr)
+		}
+	}
+
+	// Construct default slowDetector if it's not provided
+	sd := c.customSlowDetector
+	switch {
+	case sd != nil:
+	case c.disableSlowDetector:
+		sd = nopSlowDetector{}
+	default:
+		sd = &defaultSlowDetector{
+			logger:           c.logger,
+			eventBufferSize:  c.eventBufferSize,
+			errBufferSize:    c.errBufferSize,
+			detectBufferSize: c.detectBufferSize,
+			threshold:        c.slowDetectThreshold,
+			window:           c.slowDetectWindow,
+			isTruncated:      c.truncatedPredicate,
+			classifyError:    c.classifyError,
+			dropAlerts:       c.dropAlerts,
+			clock:            c.clock,
+		}
 	}
 
 	// Store slowDetector (for Close() fucntion)
@@ -73,112 +704,1152 @@ func (c *consumer) Start() error {
 	// Start reading events from firehose and detect `slowConsumerAlert`.
 	// The detection is notified by detectCh.
 	c.eventCh, c.errCh, c.detectCh = sd.Detect(eventsCh, errCh)
+	c.finalStage = c.lastStage()
+
+	// Heartbeat markers are passed through the stages below, so they
+	// must be ready before starting them.
+	if c.heartbeatInterval > 0 {
+		c.heartbeatMarkCh = make(chan struct{}, 1)
+		c.heartbeatDoneCh = make(chan bool, 1)
+	}
+
+	// Forward them to downstream. Events are filtered after detection
+	// so that slowDetector can inspect all events including the ones
+	// which are not forwarded.
+	c.eventCh = c.forwardEvents(c.eventCh)
+	if c.alertAsEnvelope && c.detectCh != nil {
+		c.alertEnvCh = make(chan *events.Envelope)
+		c.alertEnvDoneCh = make(chan struct{})
+		c.eventCh = c.injectAlerts(c.eventCh)
+	}
+	if c.reorderWindow > 0 {
+		c.eventCh = c.reorderEvents(c.eventCh)
+	}
+	if c.diskSpillDir != "" {
+		c.eventCh = c.spillEvents(c.eventCh)
+	}
+	c.errCh = c.forwardErrors(c.errCh)
+	if c.detectCh != nil {
+		c.detectCh = c.forwardSlowAlerts(c.detectCh)
+	}
+
+	if c.heartbeatInterval > 0 {
+		c.heartbeatCh = c.runHeartbeat(ctx)
+	}
+
+	// All events are delivered as batches when batching is enabled.
+	if c.batchSize > 0 {
+		c.batchCh = c.batchEvents(c.eventCh)
+		c.eventCh = nil
+	}
 
-	// In current implementation no errors are happened.
-	//
-	// This is for preventing interfance change in future when
-	// we need to put some other function here and it returns error.
 	return nil
 }
 
 // Close closes connection with firehose and stop slowDetector.
+// It's safe to call Close multiple times. Only the first call closes
+// the connection and the others return nil.
 func (c *consumer) Close() error {
+	return c.CloseWithTimeout(0)
+}
+
+// CloseContext closes consumer same as Close but it doesn't wait closing
+// beyond ctx. If ctx is done first, it returns ctx.Err() and closing is
+// continued in a detached goroutine.
+func (c *consumer) CloseContext(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Close()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CloseWithTimeout closes connection with firehose and keeps forwarding
+// the events remaining in the pipeline until all of them are read or
+// timeout d is exceeded. If timeout is exceeded, the remaining events
+// are dropped and ErrCloseTimeout is returned. If d is 0, it's same as
+// Close.
+func (c *consumer) CloseWithTimeout(d time.Duration) error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.close(d)
+	})
+
+	return err
+}
+
+// Drain stops upstream and returns all events remaining in the pipeline.
+// Events() (or BatchEvents()) must not be read by others while draining.
+// Errors() and Detects() should be read until they're closed, otherwise
+// draining may wait for them up to drainTimeout. If it's not started, it
+// just closes consumer and returns nil.
+func (c *consumer) Drain() []*events.Envelope {
+	eventCh, batchCh := c.eventCh, c.batchCh
+	if eventCh == nil && batchCh == nil {
+		c.Close()
+		return nil
+	}
+
+	remainingCh := make(chan []*events.Envelope, 1)
+	go func() {
+		// Only one of them is used.
+		var remaining []*events.Envelope
+		if batchCh != nil {
+			for batch := range batchCh {
+				remaining = append(remaining, batch...)
+			}
+		} else {
+			for event := range eventCh {
+				remaining = append(remaining, event)
+			}
+		}
+
+		remainingCh <- remaining
+	}()
+
+	if err := c.CloseWithTimeout(drainTimeout); err != nil {
+		c.logger.Error("Failed to drain all events", "error", err)
+	}
+
+	return <-remainingCh
+}
+
+func (c *consumer) close(d time.Duration) error {
+	c.markClosed()
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	// Flush recorded events after forwarding is stopped.
+	if c.recorder != nil {
+		defer func() {
+			if err := c.recorder.close(); err != nil {
+				c.logger.Error("Failed to close record file", "error", err)
+			}
+		}()
+	}
+
+	if c.debugPrinter != nil {
+		defer c.debugPrinter.close()
+	}
+
+	// Wait spill files are removed after forwarding is stopped.
+	if c.spillDoneCh != nil {
+		defer func() { <-c.spillDoneCh }()
+	}
+
+	// Without timeout, stop forwarding before closing upstream.
+	// Otherwise, it's stopped after draining.
+	if d == 0 {
+		c.stopForwarding()
+	}
+	defer c.stopForwarding()
+
 	if err := c.rawConsumer.Close(); err != nil {
 		return err
 	}
 
-	return c.slowDetector.Stop()
+	// slowDetector is nil when consumer is not started.
+	if c.slowDetector == nil {
+		return nil
+	}
+
+	var err error
+	if d > 0 {
+		err = c.drain(d)
+		c.stopForwarding()
+	}
+
+	if serr := c.slowDetector.Stop(); serr != nil && err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+// stopForwarding stops forwarding events to downstream.
+func (c *consumer) stopForwarding() {
+	if c.doneCh == nil {
+		return
+	}
+
+	select {
+	case <-c.doneCh:
+	default:
+		close(c.doneCh)
+	}
 }
 
-// rawConsumer defines the interface for consuming events from doppler firehose.
+// drain waits all events in pipeline are forwarded to downstream after
+// upstream is closed. It returns ErrCloseTimeout if it takes more than d.
+func (c *consumer) drain(d time.Duration) error {
+	c.logger.Info("Draining remaining events", "timeout", d)
+	drainedCh := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(drainedCh)
+	}()
+
+	select {
+	case <-drainedCh:
+		return nil
+	case <-time.After(d):
+		return ErrCloseTimeout
+	}
+}
+
+// forwardEvents forwards events to downstream. It counts events
+// for metrics and drops events whose type is not in eventTypes or
+// which filter rejects.
+// Then the rate of events is limited by rateLimiter.
+func (c *consumer) forwardEvents(eventCh <-chan *events.Envelope) <-chan *events.Envelope {
+	forwardCh := make(chan *events.Envelope, c.eventBufferSize)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(forwardCh)
+		for {
+			var event *events.Envelope
+			select {
+			case e, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				event = e
+			case <-c.heartbeatMarkCh:
+				// The marker is not counted nor filtered.
+				if !c.heartbeatReached(stageForward, heartbeatMarker) &&
+					!c.sendEvent(forwardCh, heartbeatMarker) {
+					return
+				}
+				continue
+			}
+
+			// The event read is held until resumed. Since the next
+			// one is not read, upstream is also stopped.
+			if !c.waitResume() {
+				return
+			}
+
+			c.markReady()
+			c.observeTimestamp(event)
+			c.countEvent(event)
+
+			if c.rebalance != nil {
+				c.observeRebalance(event)
+			}
+
+			if c.recorder != nil {
+				c.record(event)
+			}
+
+			if c.metrics != nil {
+				c.metrics.incEnvelope(event)
+			}
+
+			if c.validateEnvelopes && !c.isValid(event) {
+				continue
+			}
+
+			if len(c.eventTypes) > 0 {
+				if _, ok := c.eventTypes[event.GetEventType()]; !ok {
+					continue
+				}
+			}
+
+			if c.filter != nil && !c.filter(event) {
+				continue
+			}
+
+			if c.deduplicator != nil && c.deduplicator.isDuplicate(event) {
+				continue
+			}
+
+			if c.rateLimiter != nil {
+				switch c.rateLimitMode {
+				case RateLimitDrop:
+					if !c.rateLimiter.allow() {
+						if c.metrics != nil {
+							c.metrics.rateLimited.Inc()
+						}
+						continue
+					}
+				default:
+					if !c.waitRateLimit() {
+						return
+					}
+				}
+			}
+
+			if c.transform != nil {
+				if event = c.transform(event); event == nil {
+					continue
+				}
+			}
+
+			if !c.sendEvent(forwardCh, event) {
+				return
+			}
+		}
+	}()
+
+	return forwardCh
+}
+
+// waitRateLimit blocks until rateLimiter allows next event. It returns
+// false if forwarding is stopped while waiting.
+func (c *consumer) waitRateLimit() bool {
+	d := c.rateLimiter.reserve()
+	if d == 0 {
+		return true
+	}
+
+	select {
+	case <-orRealClock(c.clock).After(d):
+		return true
+	case <-c.doneCh:
+		return false
+	}
+}
+
+// forwardErrors forwards errors to downstream and counts them for metrics.
+func (c *consumer) forwardErrors(errCh <-chan error) <-chan error {
+	forwardCh := make(chan error, c.errBufferSize)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(forwardCh)
+		defer close(c.errDoneCh)
+		for {
+			// Errors of handlers of RunParallel are also forwarded
+			// until upstream is closed.
+			var err error
+			select {
+			case e, ok := <-errCh:
+				if !ok {
+					// Report repeats suppressed until the end
+					if c.errorDedup != nil {
+						if summary := c.errorDedup.flush(); summary != nil {
+							c.forwardError(forwardCh, summary)
+						}
+					}
+					return
+				}
+				err = e
+			case err = <-c.handlerErrCh:
+			}
+
+			atomic.AddInt64(&c.totalErrors, 1)
+			if c.metrics != nil {
+				c.metrics.errors.Inc()
+			}
+
+			c.observeReadyErr(err)
+			c.observeTerminalErr(err)
+
+			errs := []error{err}
+			if c.errorDedup != nil {
+				errs = c.errorDedup.filter(err)
+				if len(errs) == 0 {
+					atomic.AddInt64(&c.suppressedErrors, 1)
+				}
+			}
+
+			for _, err := range errs {
+				if !c.forwardError(forwardCh, err) {
+					return
+				}
+			}
+		}
+	}()
+
+	return forwardCh
+}
+
+// forwardError wraps err by RetriableErrors and ErrorContext and sends
+// it to forwardCh. It returns false if forwarding is stopped.
+func (c *consumer) forwardError(forwardCh chan error, err error) bool {
+	if c.retriableErrors {
+		err = &RetriableError{Retriable: isRetriable(err, c.reconnects()), Err: err}
+	}
+
+	if c.errorContext {
+		err = &ContextError{Ctx: c.startCtx, Err: err}
+	}
+
+	return c.sendError(forwardCh, err)
+}
+
+// sendError sends err to forwardCh by errorOverflowPolicy. It returns
+// false if forwarding is stopped.
+func (c *consumer) sendError(forwardCh chan error, err error) bool {
+	if c.errorOverflowPolicy == ErrorOverflowBlock {
+		select {
+		case forwardCh <- err:
+			c.errorForwarded(forwardCh)
+			return true
+		case <-c.doneCh:
+			return false
+		}
+	}
+
+	select {
+	case forwardCh <- err:
+		c.errorForwarded(forwardCh)
+		return true
+	default:
+	}
+
+	// Only this goroutine sends to forwardCh, so there is room after
+	// the oldest one is dropped unless the channel is unbuffered.
+	if c.errorOverflowPolicy == ErrorOverflowDropOldest {
+		select {
+		case <-forwardCh:
+			atomic.AddInt64(&c.errDropped, 1)
+			select {
+			case forwardCh <- err:
+				c.errorForwarded(forwardCh)
+				return true
+			default:
+			}
+		default:
+		}
+	}
+
+	c.logger.Warn("Dropped error since Errors() is full", "error", err)
+	atomic.AddInt64(&c.errDropped, 1)
+	return true
+}
+
+// reconnects reports whether consumer reconnects after noaa gives up
+// retrying by Config.ReconnectBackoff or DopplerAddrs failover.
+func (c *consumer) reconnects() bool {
+	return c.config.ReconnectBackoff != nil || len(c.config.DopplerAddrs) > 0
+}
+
+// errorForwarded records an error is sent to forwardCh.
+func (c *consumer) errorForwarded(forwardCh chan error) {
+	atomic.AddUint64(&c.errorCount, 1)
+	observeLen(&c.errMaxLen, len(forwardCh))
+}
+
+// forwardSlowAlerts forwards slowConsumerAlerts to downstream and
+// counts them for metrics.
+func (c *consumer) forwardSlowAlerts(detectCh <-chan SlowAlert) <-chan SlowAlert {
+	forwardCh := make(chan SlowAlert, c.detectBufferSize)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(forwardCh)
+		for alert := range detectCh {
+			total := atomic.AddInt64(&c.totalAlerts, 1)
+			if c.metrics != nil {
+				c.metrics.slowAlerts.Inc()
+			}
+
+			if c.alertEnvCh != nil && !c.sendAlertEnvelope(alert, total) {
+				return
+			}
+
+			select {
+			case forwardCh <- alert:
+				observeLen(&c.detectMaxLen, len(forwardCh))
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return forwardCh
+}
+
+// RawConsumer defines the interface for consuming events from doppler firehose.
 // The events pulled by RawConsumer pass to slowDetector and check slowDetector.
 //
-// By default, it uses https://github.com/cloudfoundry/noaa
-type rawConsumer interface {
+// By default, it uses https://github.com/cloudfoundry/noaa. Use NewRawConsumer
+// to construct it (e.g., to wrap it with your own RawConsumer).
+type RawConsumer interface {
 	// Consume starts cosuming firehose events. It must return 2 channel.
 	// The one is for sending the events from firehose
 	// and the other is for error occured while consuming.
 	// These channels are used donwstream process (SlowConsumer).
 	Consume() (<-chan *events.Envelope, <-chan error)
 
+	// ConsumeContext is same as Consume but connection with firehose
+	// (including the initial connection attempts) is closed when ctx is
+	// canceled. The returned channels are closed after that.
+	ConsumeContext(ctx context.Context) (<-chan *events.Envelope, <-chan error)
+
 	// Close closes connection with firehose. If any, returns error.
 	Close() error
 }
 
 type rawDefaultConsumer struct {
+	// lastReceivedAt is unix nano time when the last event is received
+	// or connection is established. It's accessed atomically and placed
+	// first for 64-bit alignment.
+	lastReceivedAt int64
+
+	// attempts is the number of reconnect attempts since connection is
+	// established last. It's also accessed atomically.
+	attempts int64
+
 	noaaConsumer *noaaConsumer.Consumer
 
-	dopplerAddr    string
+	// customNoaaConsumer is noaa consumer provided by user. If it's set,
+	// it's used for every connection instead of constructing new one.
+	customNoaaConsumer *noaaConsumer.Consumer
+
+	// dopplerAddr is the address of current connection. It's replaced
+	// by failover (protected by mu).
+	dopplerAddr string
+
+	// dopplerAddrs are addresses to fail over and addrIndex is the
+	// index of dopplerAddr in them. Failover is disabled when it has
+	// less than 2 addresses.
+	dopplerAddrs []string
+	addrIndex    int
+
 	token          string
 	subscriptionID string
-	insecure       bool
+	tlsConfig      *tls.Config
 	debugPrinter   noaaConsumer.DebugPrinter
 
-	logger *log.Logger
+	// policyViolationBackoff is the cooldown to reconnect after doppler
+	// closes connection by ClosePolicyViolation. If it's 0, consumer
+	// doesn't reconnect for it.
+	policyViolationBackoff time.Duration
+
+	// instanceIndex is Config.InstanceIndex. It's used to shift
+	// reconnection timing from other instances.
+	instanceIndex int
+
+	// proxy is used for connection with doppler. If it's nil,
+	// no proxy is used.
+	proxy func(*http.Request) (*url.URL, error)
+
+	// userAgent is sent as User-Agent of the websocket handshake.
+	userAgent string
+
+	// idleTimeout is passed to noaa to close connection which doesn't
+	// receive any message within it. 0 means noaa default.
+	idleTimeout time.Duration
+
+	// staleTimeout forces reconnecting when nothing is received within
+	// it. If it's 0, stale connection is not detected.
+	staleTimeout time.Duration
+
+	// refreshOverlap is how long the previous connection is kept
+	// after reconnecting with refreshed token.
+	refreshOverlap time.Duration
+
+	// maxRetries is passed to noaa as the number of retries before
+	// it gives up. 0 means noaa default.
+	maxRetries int
+
+	// appGUID is set to consume the stream of the application
+	// instead of firehose.
+	appGUID string
+
+	// tokenFetcher is used by noaa to get a fresh token when
+	// reconnection is rejected as unauthorized. It's nil when
+	// Token is provided by user.
+	tokenFetcher tokenFetcher
+
+	// backoff is used to reconnect after noaa gives up retrying.
+	// If it's nil, consumer doesn't reconnect by itself.
+	backoff Backoff
+
+	// onReconnect is called before each reconnect attempt. It may be nil.
+	onReconnect func(attempt int, err error)
+
+	// clock is used for reconnect delays and detecting stale
+	// connection. If it's nil, real time is used.
+	clock Clock
+
+	logger leveledLogger
+
+	// mu protects noaaConsumer and token which are replaced
+	// when reconnecting with a new token.
+	mu sync.Mutex
+
+	// eventCh and errCh are returned by Consume. Events and errors from
+	// the current noaa connection are forwarded to them so that
+	// downstream keeps reading same channels across reconnection.
+	eventCh chan *events.Envelope
+	errCh   chan error
+
+	// doneCh is closed by Close to stop forwarding.
+	doneCh chan struct{}
+
+	// wg waits forwarding goroutines before closing eventCh and errCh.
+	wg sync.WaitGroup
+
+	// state tracks connection state with firehose.
+	state connectionState
+
+	// lifecycleHook is notified when token is refreshed. Changes of
+	// state are notified via state.onChange.
+	lifecycleHook func(LifecyclePhase)
 }
 
 // Consume consumes firehose events from doppler.
-// Retry function is handled in noaa library (It will retry 5 times).
+// Retry function is handled in noaa library (It will retry 5 times
+// by default, or maxRetries times).
 func (c *rawDefaultConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
-	c.logger.Printf(
-		"[INFO] Start consuming firehose events from Doppler (%s) with subscription ID %q",
-		c.dopplerAddr, c.subscriptionID)
+	return c.ConsumeContext(context.Background())
+}
+
+// ConsumeContext consumes firehose events from doppler until ctx is
+// canceled. Canceling ctx aborts noaa retrying connection, e.g., when
+// DopplerAddr is unreachable.
+func (c *rawDefaultConsumer) ConsumeContext(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
+	if c.appGUID != "" {
+		c.logger.Info("Start consuming app stream events from Doppler",
+			"doppler_addr", c.currentAddr(), "app_guid", c.appGUID)
+	} else {
+		c.logger.Info("Start consuming firehose events from Doppler",
+			"doppler_addr", c.currentAddr(), "subscription_id", c.currentSubscriptionID())
+	}
+
+	c.eventCh = make(chan *events.Envelope)
+	c.errCh = make(chan error)
+	c.doneCh = make(chan struct{})
+
+	c.state.set(StateConnecting)
+	c.connect(c.token, 0)
+
+	if c.staleTimeout > 0 {
+		go c.watchStale()
+	}
+
+	// Close connection when ctx is canceled. Since noaa connects
+	// in background, this also stops its retrying.
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.logger.Info("Context is done", "error", ctx.Err())
+				if err := c.Close(); err != nil {
+					c.logger.Warn("Failed to close firehose connection", "error", err)
+				}
+			case <-c.doneCh:
+			}
+		}()
+	}
 
+	return c.eventCh, c.errCh
+}
+
+// connect starts a new noaa connection with the given token and forwards
+// its events and errors to the channels returned by Consume. If there is
+// a previous connection, it's closed overlap after the new one is started.
+// Both of them are read while overlapping.
+func (c *rawDefaultConsumer) connect(token string, overlap time.Duration) {
 	// Setup Noaa Consumer
-	tlsConfig := tls.Config{
-		InsecureSkipVerify: c.insecure,
+	nc := c.customNoaaConsumer
+	if nc == nil {
+		nc = c.newNoaaConsumer(c.currentAddr())
 	}
-	nc := noaaConsumer.New(c.dopplerAddr, &tlsConfig, nil)
 
 	if c.debugPrinter != nil {
 		nc.SetDebugPrinter(c.debugPrinter)
 	}
 
+	if c.idleTimeout > 0 {
+		nc.SetIdleTimeout(c.idleTimeout)
+	}
+
+	if c.maxRetries > 0 {
+		nc.SetMaxRetryCount(c.maxRetries)
+	}
+
+	if c.tokenFetcher != nil {
+		nc.RefreshTokenFrom(&noaaTokenRefresher{
+			fetcher: c.tokenFetcher,
+		})
+	}
+
+	// noaa calls this callback whenever connection (including
+	// retried one) is established.
+	nc.SetOnConnectCallback(func() {
+		atomic.StoreInt64(&c.lastReceivedAt, orRealClock(c.clock).Now().UnixNano())
+		atomic.StoreInt64(&c.attempts, 0)
+		c.state.set(StateConnected)
+		if c.backoff != nil {
+			c.backoff.Reset()
+		}
+	})
+
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
+		return
+	}
+
+	// Provided noaa consumer is reused for new connection,
+	// so current connection must be closed before.
+	old := c.noaaConsumer
+	if old == nc {
+		if err := old.Close(); err != nil {
+			c.logger.Warn("Failed to close previous firehose connection", "error", err)
+		}
+		old = nil
+	}
+
 	// Start connection
-	eventChan, errChan := nc.Firehose(c.subscriptionID, c.token)
+	var eventChan <-chan *events.Envelope
+	var errChan <-chan error
+	if c.appGUID != "" {
+		eventChan, errChan = nc.Stream(c.appGUID, token)
+	} else {
+		eventChan, errChan = nc.Firehose(c.subscriptionID, token)
+	}
 
 	// Store noaaConsumer in rawConsumer struct
 	// to close it from other function
 	c.noaaConsumer = nc
+	c.token = token
+
+	c.wg.Add(2)
+	c.mu.Unlock()
+
+	go c.forwardEvents(eventChan)
+	go c.forwardErrors(errChan)
+
+	if old != nil {
+		c.closeAfter(old, overlap)
+	}
+}
+
+// closeAfter closes the previous noaa connection after overlap. It's
+// closed immediately if overlap is 0 or consumer is closed.
+func (c *rawDefaultConsumer) closeAfter(nc *noaaConsumer.Consumer, overlap time.Duration) {
+	closeFn := func() {
+		if err := nc.Close(); err != nil {
+			c.logger.Warn("Failed to close previous firehose connection", "error", err)
+		}
+	}
+
+	if overlap <= 0 {
+		closeFn()
+		return
+	}
+
+	go func() {
+		select {
+		case <-orRealClock(c.clock).After(overlap):
+		case <-c.doneCh:
+		}
+		closeFn()
+	}()
+}
+
+// forwardEvents forwards events from noaa connection to eventCh.
+func (c *rawDefaultConsumer) forwardEvents(eventCh <-chan *events.Envelope) {
+	defer c.wg.Done()
+	clock := orRealClock(c.clock)
+	for event := range eventCh {
+		atomic.StoreInt64(&c.lastReceivedAt, clock.Now().UnixNano())
+		select {
+		case c.eventCh <- event:
+		case <-c.doneCh:
+			return
+		}
+	}
+}
+
+// forwardErrors forwards errors from noaa connection to errCh.
+// Since noaa retries connection after it reports error, each error
+// is recorded as reconnect attempt. When noaa gives up retrying,
+// it reconnects with backoff.
+func (c *rawDefaultConsumer) forwardErrors(errCh <-chan error) {
+	defer c.wg.Done()
+	for err := range errCh {
+		c.state.reconnect()
+		consumeErr := &ConsumeError{
+			Addr:           c.currentAddr(),
+			SubscriptionID: c.currentSubscriptionID(),
+			AppGUID:        c.appGUID,
+			Err:            err,
+		}
+		c.notifyReconnect(consumeErr)
+		c.sendError(consumeErr)
+
+		switch {
+		case err == noaaConsumer.ErrMaxRetriesReached && c.failover():
+			go c.reconnectAfter(0)
+		case err == noaaConsumer.ErrMaxRetriesReached && c.backoff != nil:
+			go c.reconnect()
+		case c.policyViolationBackoff > 0 && isPolicyViolation(err):
+			go c.reconnectAfter(c.policyViolationBackoff)
+		}
+	}
+}
+
+// failover switches dopplerAddr to the next address of dopplerAddrs.
+// It returns false if failover is disabled or it wraps around to the
+// first address, i.e., all addresses are tried.
+func (c *rawDefaultConsumer) failover() bool {
+	if len(c.dopplerAddrs) < 2 {
+		return false
+	}
+
+	c.mu.Lock()
+	from := c.dopplerAddr
+	c.addrIndex = (c.addrIndex + 1) % len(c.dopplerAddrs)
+	c.dopplerAddr = c.dopplerAddrs[c.addrIndex]
+	to, wrapped := c.dopplerAddr, c.addrIndex == 0
+	c.mu.Unlock()
+
+	c.state.failover()
+	c.logger.Warn("Failing over to next doppler", "from", from, "to", to)
+
+	return !wrapped
+}
+
+// consumerUserAgent returns User-Agent sent to doppler by config.
+func consumerUserAgent(config *Config) string {
+	if config.ConsumerName != "" {
+		return config.ConsumerName
+	}
+	return "go-nozzle/" + Version
+}
+
+// newNoaaConsumer constructs noaa consumer for addr with TLS config,
+// proxy and User-Agent of c.
+func (c *rawDefaultConsumer) newNoaaConsumer(addr string) *noaaConsumer.Consumer {
+	return noaaConsumer.New(addr, c.tlsConfig, withUserAgent(c.proxy, c.userAgent))
+}
+
+// withUserAgent returns proxy func which sets User-Agent of the request
+// before calling proxy. noaa has no API to set headers of the websocket
+// handshake (consumer.New only takes TLS config and proxy, and its
+// dialer is not exposed). gorilla/websocket passes the handshake request
+// to Dialer.Proxy before writing it, so it's set there. It's not a
+// documented behavior, so TestRawConsumer_userAgent checks the header
+// received by the server to catch it being changed by dependency updates.
+func withUserAgent(proxy func(*http.Request) (*url.URL, error), userAgent string) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		req.Header.Set("User-Agent", userAgent)
+		if proxy == nil {
+			return nil, nil
+		}
+		return proxy(req)
+	}
+}
+
+// currentAddr returns the address of current connection.
+func (c *rawDefaultConsumer) currentAddr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dopplerAddr
+}
+
+// currentSubscriptionID returns the subscription ID of current
+// connection. It's changed by resubscribe.
+func (c *rawDefaultConsumer) currentSubscriptionID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subscriptionID
+}
+
+// resubscribe re-establishes firehose connection under id with the
+// current token. The previous connection is closed after the new one
+// is started and events of both are sent to the same channel. If it's
+// not consuming yet, id is used when it starts.
+func (c *rawDefaultConsumer) resubscribe(id string) error {
+	if c.appGUID != "" {
+		return fmt.Errorf("Resubscribe can not be used with AppGUID")
+	}
+
+	if err := validateSubscriptionID(id); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
+		return fmt.Errorf("consumer is closed")
+	}
+
+	from := c.subscriptionID
+	c.subscriptionID = id
+	token, started := c.token, c.noaaConsumer != nil
+	c.mu.Unlock()
+
+	if !started {
+		return nil
+	}
+
+	c.logger.Info("Reconnecting firehose with new subscription ID",
+		"from", from, "to", id)
+	c.state.set(StateReconnecting)
+	c.connect(token, 0)
+	return nil
+}
+
+// isPolicyViolation returns true if err is websocket close
+// by ClosePolicyViolation (1008), i.e., nozzle is too slow.
+func isPolicyViolation(err error) bool {
+	var closeErr *websocket.CloseError
+	return errors.As(err, &closeErr) && closeErr.Code == websocket.ClosePolicyViolation
+}
+
+// notifyReconnect calls onReconnect with the number of attempts since
+// connection is established last. A panic in it is recovered not to stop
+// consuming.
+func (c *rawDefaultConsumer) notifyReconnect(err error) {
+	attempt := atomic.AddInt64(&c.attempts, 1)
+	if c.onReconnect == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			c.logger.Error("Recovered from panic in OnReconnect", "panic", r)
+		}
+	}()
 
-	return eventChan, errChan
+	c.onReconnect(int(attempt), err)
 }
 
+// reconnect waits the duration by backoff and then re-establishes
+// firehose connection. Waiting is stopped when Close is called.
+func (c *rawDefaultConsumer) reconnect() {
+	c.reconnectAfter(c.backoff.Next())
+}
+
+// reconnectAfter waits d and then re-establishes firehose connection.
+// The offset by instanceIndex is added to d. Waiting is stopped when
+// Close is called (or ctx passed to ConsumeContext is canceled).
+func (c *rawDefaultConsumer) reconnectAfter(d time.Duration) {
+	d += instanceReconnectOffset(c.instanceIndex)
+	c.logger.Info("Reconnecting firehose", "delay", d)
+	c.state.set(StateReconnecting)
+
+	select {
+	case <-orRealClock(c.clock).After(d):
+	case <-c.doneCh:
+		return
+	}
+
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+
+	c.connect(token, 0)
+}
+
+// watchStale forces reconnecting when nothing is received within
+// staleTimeout while connected (TCP connection may stay open without
+// receiving anything). It's stopped when Close is called.
+func (c *rawDefaultConsumer) watchStale() {
+	clock := orRealClock(c.clock)
+	interval := c.staleTimeout / 2
+	for {
+		select {
+		case <-clock.After(interval):
+		case <-c.doneCh:
+			return
+		}
+
+		if c.state.snapshot().State != StateConnected {
+			continue
+		}
+
+		last := time.Unix(0, atomic.LoadInt64(&c.lastReceivedAt))
+		if clock.Now().Sub(last) < c.staleTimeout {
+			continue
+		}
+
+		c.logger.Warn("Reconnecting stale firehose connection",
+			"last_received_at", last, "timeout", c.staleTimeout)
+		c.state.staleReconnect()
+		if c.lifecycleHook != nil {
+			c.lifecycleHook(LifecycleStaleReconnecting)
+		}
+		c.notifyReconnect(ErrStaleConnection)
+
+		// Not to detect again until reconnected
+		atomic.StoreInt64(&c.lastReceivedAt, clock.Now().UnixNano())
+
+		c.mu.Lock()
+		token := c.token
+		c.mu.Unlock()
+
+		c.state.set(StateReconnecting)
+		c.connect(token, 0)
+	}
+}
+
+// refreshToken re-establishes firehose connection with the given token.
+// The previous connection is kept for refreshOverlap not to lose events
+// in flight while switching.
+func (c *rawDefaultConsumer) refreshToken(token string) {
+	c.logger.Info("Reconnecting firehose with refreshed auth token",
+		"token", maskString(token))
+	if c.lifecycleHook != nil {
+		c.lifecycleHook(LifecycleTokenRefreshed)
+	}
+	c.state.set(StateReconnecting)
+	c.connect(token, c.refreshOverlap)
+}
+
+// connectionState returns the current connection state.
+func (c *rawDefaultConsumer) connectionState() ConnectionState {
+	return c.state.snapshot()
+}
+
+// sendError sends err to the channel returned by Consume.
+// It's dropped if the consumer is closed.
+func (c *rawDefaultConsumer) sendError(err error) {
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
+		return
+	}
+	c.wg.Add(1)
+	c.mu.Unlock()
+	defer c.wg.Done()
+
+	select {
+	case c.errCh <- err:
+	case <-c.doneCh:
+	}
+}
+
+// isClosed returns true if Close is called. c.mu must be held.
+func (c *rawDefaultConsumer) isClosed() bool {
+	select {
+	case <-c.doneCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes connection with firehose. If it's already closed
+// (e.g., context passed to ConsumeContext is canceled), it does nothing.
 func (c *rawDefaultConsumer) Close() error {
-	c.logger.Printf("[INFO] Stop consuming firehose events")
-	if c.noaaConsumer == nil {
+	c.logger.Info("Stop consuming firehose events",
+		"doppler_addr", c.currentAddr(), "subscription_id", c.currentSubscriptionID())
+
+	c.mu.Lock()
+	nc := c.noaaConsumer
+	if nc == nil {
+		c.mu.Unlock()
 		return fmt.Errorf("no connection with firehose")
 	}
 
-	return c.noaaConsumer.Close()
+	if c.isClosed() {
+		c.mu.Unlock()
+		return nil
+	}
+
+	close(c.doneCh)
+	c.state.set(StateClosed)
+
+	// Close channels returned by Consume after all
+	// forwarding goroutines are stopped.
+	go func() {
+		c.wg.Wait()
+		close(c.eventCh)
+		close(c.errCh)
+	}()
+	c.mu.Unlock()
+
+	return nc.Close()
 }
 
 // validate validates struct has requirement fields or not
 func (c *rawDefaultConsumer) validate() error {
 	if c.dopplerAddr == "" {
-		return fmt.Errorf("DopplerAddr must not be empty")
+		return ErrMissingDopplerAddr
+	}
+
+	for _, addr := range c.dopplerAddrs {
+		if addr == "" {
+			return ErrMissingDopplerAddr
+		}
 	}
 
 	if c.token == "" {
-		return fmt.Errorf("Token must not be empty")
+		return ErrMissingToken
 	}
 
-	if c.subscriptionID == "" {
-		return fmt.Errorf("SubscriptionID must not be empty")
+	// App stream is not shared with other clients,
+	// so subscription ID is not used for it.
+	if c.appGUID != "" {
+		if c.subscriptionID != "" {
+			return fmt.Errorf("SubscriptionID must be empty when AppGUID is set")
+		}
+		return nil
+	}
+
+	return validateSubscriptionID(c.subscriptionID)
+}
+
+// validateSubscriptionID validates id is accepted by doppler.
+func validateSubscriptionID(id string) error {
+	if id == "" {
+		return ErrMissingSubscriptionID
+	}
+
+	if len(id) > MaxSubscriptionIDLength {
+		return fmt.Errorf("SubscriptionID must not be longer than %d characters",
+			MaxSubscriptionIDLength)
+	}
+
+	if !subscriptionIDRegexp.MatchString(id) {
+		return fmt.Errorf("SubscriptionID %q must match %s", id,
+			SubscriptionIDPattern)
 	}
 
 	return nil
 }
 
-// newRawConsumer constructs new rawConsumer.
+// newRawDefaultConsumer constructs new rawDefaultConsumer.
 func newRawDefaultConsumer(config *Config) (*rawDefaultConsumer, error) {
+	// DopplerAddr is regarded as the first address to fail over.
+	addrs := config.DopplerAddrs
+	if config.DopplerAddr != "" {
+		addrs = append([]string{config.DopplerAddr}, addrs...)
+	}
+
+	var addr string
+	if len(addrs) > 0 {
+		addr = addrs[0]
+	}
+
 	c := &rawDefaultConsumer{
-		dopplerAddr:    config.DopplerAddr,
-		token:          config.Token,
-		subscriptionID: config.SubscriptionID,
-		insecure:       config.Insecure,
-		debugPrinter:   config.DebugPrinter,
-		logger:         config.Logger,
+		customNoaaConsumer: config.NoaaConsumer,
+		dopplerAddr:        addr,
+		dopplerAddrs:       addrs,
+		token:              config.Token,
+		subscriptionID:     config.SubscriptionID,
+		appGUID:            config.AppGUID,
+		idleTimeout:        config.IdleTimeout,
+		maxRetries:         config.MaxRetries,
+		refreshOverlap:     config.RefreshOverlap,
+		staleTimeout:       config.StaleConnectionTimeout,
+		proxy:              config.Proxy,
+		userAgent:          consumerUserAgent(config),
+		tlsConfig:          newTLSConfig(config),
+		debugPrinter:       config.DebugPrinter,
+		backoff:            config.ReconnectBackoff,
+		onReconnect:        config.OnReconnect,
+		clock:              config.Clock,
+		logger:             newLogger(config),
+
+		policyViolationBackoff: config.PolicyViolationBackoff,
+		instanceIndex:          config.InstanceIndex,
 	}
 
 	if err := c.validate(); err != nil {
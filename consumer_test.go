@@ -1,45 +1,763 @@
 package nozzle
 
 import (
-	"io/ioutil"
-	"log"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 
+	noaaConsumer "github.com/cloudfoundry/noaa/consumer"
 	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
 )
 
-type testRawConsumer struct{}
+type testRawConsumer struct {
+	// eventCh and errCh are returned by Consume(). If they are nil,
+	// new channels are returned.
+	eventCh chan *events.Envelope
+	errCh   chan error
+
+	// closed is the number of times Close() is called.
+	closed int
+}
 
 func (c *testRawConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
-	eventCh, errCh := make(chan *events.Envelope), make(chan error)
-	return eventCh, errCh
+	if c.eventCh == nil {
+		c.eventCh = make(chan *events.Envelope)
+	}
+
+	if c.errCh == nil {
+		c.errCh = make(chan error)
+	}
+
+	return c.eventCh, c.errCh
+}
+
+func (c *testRawConsumer) ConsumeContext(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
+	return c.Consume()
 }
 
 func (c *testRawConsumer) Close() error {
+	c.closed++
+	if c.eventCh != nil {
+		close(c.eventCh)
+	}
+
+	if c.errCh != nil {
+		close(c.errCh)
+	}
+
+	return nil
+}
+
+type testSlowDetector struct {
+	detectCh chan SlowAlert
+	stopped  bool
+}
+
+func (sd *testSlowDetector) Detect(eventCh <-chan *events.Envelope, errCh <-chan error) (<-chan *events.Envelope, <-chan error, <-chan SlowAlert) {
+	sd.detectCh = make(chan SlowAlert, 1)
+	return eventCh, errCh, sd.detectCh
+}
+
+func (sd *testSlowDetector) Stop() error {
+	sd.stopped = true
 	return nil
 }
 
-func TestConsumer_implement(t *testing.T) {
-	var _ Consumer = &consumer{}
+func TestConsumer_implement(t *testing.T) {
+	var _ Consumer = &consumer{}
+}
+
+func TestConsumerStartWithContext_nil(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	err := c.StartWithContext(nil)
+	if err == nil {
+		t.Fatalf("expect to be failed")
+	}
+
+	expect := "context must not be nil"
+	if !strings.Contains(err.Error(), expect) {
+		t.Fatalf("expects error message %q to contain %q", err.Error(), expect)
+	}
+
+	if rc.eventCh != nil {
+		t.Fatalf("expect rawConsumer not to be started")
+	}
+
+	// Close is still safe
+	if err := c.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestConsumerClose_twice(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Close(); err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+	}
+
+	if rc.closed != 1 {
+		t.Fatalf("expect rawConsumer to be closed once but %d", rc.closed)
+	}
+}
+
+func TestConsumerCloseWithTimeout(t *testing.T) {
+	t.Parallel()
+
+	rc := &testRawConsumer{
+		eventCh: make(chan *events.Envelope, 3),
+	}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	for i := 0; i < 3; i++ {
+		rc.eventCh <- &events.Envelope{}
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- c.CloseWithTimeout(1 * time.Second)
+	}()
+
+	// All remaining events must be delivered before close
+	count := 0
+	for range c.Events() {
+		count++
+	}
+
+	if count != 3 {
+		t.Fatalf("expect %d to be eq %d", count, 3)
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestConsumerDrain(t *testing.T) {
+	t.Parallel()
+
+	rc := &testRawConsumer{
+		eventCh: make(chan *events.Envelope, 3),
+	}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		batchSize:   2,
+	}
+
+	for i := 0; i < 3; i++ {
+		rc.eventCh <- &events.Envelope{}
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Partial batch is also returned
+	if got, expect := len(c.Drain()), 3; got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+
+	if rc.closed != 1 {
+		t.Fatalf("expect upstream to be closed")
+	}
+}
+
+func TestConsumerCloseWithTimeout_timeout(t *testing.T) {
+	t.Parallel()
+
+	rc := &testRawConsumer{
+		eventCh: make(chan *events.Envelope, 1),
+	}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	rc.eventCh <- &events.Envelope{}
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Nobody reads events
+	if err := c.CloseWithTimeout(50 * time.Millisecond); err != ErrCloseTimeout {
+		t.Fatalf("expect %v to be eq %v", err, ErrCloseTimeout)
+	}
+}
+
+// hangingRawConsumer is testRawConsumer which Close blocks until
+// releaseCh is closed.
+type hangingRawConsumer struct {
+	testRawConsumer
+	releaseCh chan struct{}
+}
+
+func (c *hangingRawConsumer) Close() error {
+	<-c.releaseCh
+	return c.testRawConsumer.Close()
+}
+
+func TestConsumerCloseContext(t *testing.T) {
+	rc := &hangingRawConsumer{releaseCh: make(chan struct{})}
+	defer close(rc.releaseCh)
+
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := c.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect %v to be eq %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestConsumer_customSlowDetector(t *testing.T) {
+	sd := &testSlowDetector{}
+	c := &consumer{
+		rawConsumer:        &testRawConsumer{},
+		customSlowDetector: sd,
+		logger:             &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	sd.detectCh <- SlowAlert{
+		Reason: "QueueFull",
+		Err:    fmt.Errorf("downstream queue is full"),
+		Time:   time.Now(),
+	}
+	select {
+	case alert := <-c.Detects():
+		if alert.Reason != "QueueFull" {
+			t.Fatalf("expect %q to be eq %q", alert.Reason, "QueueFull")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect alert from custom detector")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !sd.stopped {
+		t.Fatalf("expect custom detector to be stopped")
+	}
+}
+
+func TestConsumer_eventTypes(t *testing.T) {
+	t.Parallel()
+
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		eventTypes: map[events.Envelope_EventType]struct{}{
+			events.Envelope_ValueMetric: struct{}{},
+		},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		rc.eventCh <- &events.Envelope{
+			EventType: events.Envelope_LogMessage.Enum(),
+		}
+		rc.eventCh <- &events.Envelope{
+			EventType: events.Envelope_ValueMetric.Enum(),
+		}
+	}()
+
+	select {
+	case event := <-c.Events():
+		if got := event.GetEventType(); got != events.Envelope_ValueMetric {
+			t.Fatalf("expect %s to be eq %s", got, events.Envelope_ValueMetric)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestConsumer_filter(t *testing.T) {
+	t.Parallel()
+
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		filter: func(e *events.Envelope) bool {
+			return e.GetOrigin() != "gorouter"
+		},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		rc.eventCh <- &events.Envelope{
+			Origin: proto.String("gorouter"),
+		}
+
+		// Filtered envelope is still inspected by slow detector
+		rc.eventCh <- &events.Envelope{
+			Origin:    proto.String("doppler"),
+			EventType: events.Envelope_CounterEvent.Enum(),
+			CounterEvent: &events.CounterEvent{
+				Name: proto.String("TruncatingBuffer.DroppedMessages"),
+			},
+		}
+	}()
+
+	select {
+	case alert := <-c.Detects():
+		if alert.Reason != SlowAlertReasonTruncated {
+			t.Fatalf("expect %q to be eq %q", alert.Reason, SlowAlertReasonTruncated)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect slowConsumerAlert to be detected")
+	}
+
+	select {
+	case event := <-c.Events():
+		if got := event.GetOrigin(); got != "doppler" {
+			t.Fatalf("expect %q to be eq %q", got, "doppler")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestConsumer_transform(t *testing.T) {
+	t.Parallel()
+
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		transform: func(e *events.Envelope) *events.Envelope {
+			if e.GetOrigin() == "gorouter" {
+				return nil
+			}
+			e.Tags = map[string]string{"datacenter": "tokyo"}
+			return e
+		},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		rc.eventCh <- &events.Envelope{Origin: proto.String("gorouter")}
+		rc.eventCh <- &events.Envelope{Origin: proto.String("rep")}
+	}()
+
+	select {
+	case event := <-c.Events():
+		if got := event.GetOrigin(); got != "rep" {
+			t.Fatalf("expect %q to be eq %q", got, "rep")
+		}
+
+		if got := event.GetTags()["datacenter"]; got != "tokyo" {
+			t.Fatalf("expect %q to be eq %q", got, "tokyo")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestConsumerErrors_errorContext(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:  rc,
+		logger:       &stdLogger{logger: defaultLogger},
+		errorContext: true,
+	}
+
+	ctx := context.WithValue(context.Background(), testCtxKey{}, "span-A")
+	if err := c.StartWithContext(ctx); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	origErr := errors.New("connection refused")
+	go func() {
+		rc.errCh <- origErr
+	}()
+
+	select {
+	case err := <-c.Errors():
+		got, ok := ErrorContext(err)
+		if !ok {
+			t.Fatalf("expect context to be attached to %v", err)
+		}
+
+		if v := got.Value(testCtxKey{}); v != "span-A" {
+			t.Fatalf("expect %v to be eq %v", v, "span-A")
+		}
+
+		if !errors.Is(err, origErr) {
+			t.Fatalf("expect %v to be %v", err, origErr)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestConsumerHealthy(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:          rc,
+		logger:               &stdLogger{logger: defaultLogger},
+		healthStaleThreshold: 100 * time.Millisecond,
+	}
+
+	if c.Healthy() {
+		t.Fatalf("expect not to be healthy before start")
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	// Measured from start time before the first event
+	if !c.Healthy() {
+		t.Fatalf("expect to be healthy just after start")
+	}
+
+	if !c.LastEventTime().IsZero() {
+		t.Fatalf("expect last event time to be zero")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if c.Healthy() {
+		t.Fatalf("expect not to be healthy without events")
+	}
+
+	go func() {
+		rc.eventCh <- &events.Envelope{}
+	}()
+
+	select {
+	case <-c.Events():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	// lastEventAt is stamped after the event is delivered
+	time.Sleep(10 * time.Millisecond)
+	if !c.Healthy() {
+		t.Fatalf("expect to be healthy after event is delivered")
+	}
+
+	if c.LastEventTime().IsZero() {
+		t.Fatalf("expect last event time not to be zero")
+	}
+}
+
+func TestConsumerEventsContext(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	eventCh := c.EventsContext(ctx)
+
+	go func() {
+		rc.eventCh <- &events.Envelope{}
+	}()
+
+	select {
+	case <-eventCh:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect event to be forwarded")
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-eventCh:
+		if ok {
+			t.Fatalf("expect channel to be closed")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect channel to be closed after ctx is canceled")
+	}
+}
+
+func TestConsumerLag(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	if got := c.Lag(); got != 0 {
+		t.Fatalf("expect %s to be eq 0", got)
+	}
+
+	now := time.Now()
+	go func() {
+		// Older envelope doesn't decrease lag
+		rc.eventCh <- &events.Envelope{Timestamp: proto.Int64(now.Add(-5 * time.Second).UnixNano())}
+		rc.eventCh <- &events.Envelope{Timestamp: proto.Int64(now.Add(-10 * time.Second).UnixNano())}
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-c.Events():
+		case <-time.After(1 * time.Second):
+			t.Fatalf("#%d expect not timeout", i)
+		}
+	}
+
+	if got := c.Lag(); got < 5*time.Second || got >= 10*time.Second {
+		t.Fatalf("expect %s to be around 5s", got)
+	}
+}
+
+func TestRawConsumer_implement(t *testing.T) {
+	// Test rawConsumer implements consumer
+	var _ RawConsumer = &rawDefaultConsumer{}
+
+	// Test rawConsumer can receive refreshed token
+	var _ tokenReceiver = &rawDefaultConsumer{}
+
+	// Test rawConsumer reports its connection state
+	var _ stateReporter = &rawDefaultConsumer{}
+}
+
+func TestConsumerConnectionState_unknown(t *testing.T) {
+	c := &consumer{
+		rawConsumer: &testRawConsumer{},
+	}
+
+	if got := c.ConnectionState().State; got != StateIdle {
+		t.Fatalf("expect %s to be eq %s", got, StateIdle)
+	}
+}
+
+func TestRawConsumer_consume(t *testing.T) {
+	t.Parallel()
+
+	// inputCh is used to send message from test web socket server
+	inputCh := make(chan []byte)
+
+	// authToken is valid auth token used for authorizing web socket connection
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+
+	// Setup web socket server
+	ts := NewDopplerServer(t, inputCh, authToken)
+	defer ts.Close()
+
+	consumer := &rawDefaultConsumer{
+		dopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
+		token:          authToken,
+		subscriptionID: "test-go-nozzle-A",
+		tlsConfig:      &tls.Config{InsecureSkipVerify: true},
+		logger:         &stdLogger{logger: defaultLogger},
+	}
+	eventCh, _ := consumer.Consume()
+
+	// Create test message send from web socket.
+	// It will be encoded to protocol buffer.
+	timestamp := time.Now().UnixNano()
+	message := "Hello from fake loggregator"
+
+	eventBytes, err := NewEvent(message, timestamp)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Send event to websocket
+	inputCh <- eventBytes
+
+	// Receive event from websocket(via raw consumer)
+	event := <-eventCh
+	got := string(event.GetLogMessage().Message)
+	if got != message {
+		t.Fatalf("expect %q to be eq %q", got, message)
+	}
+}
+
+func TestRawConsumer_appStream(t *testing.T) {
+	t.Parallel()
+
+	inputCh := make(chan []byte)
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+
+	ts := NewDopplerServer(t, inputCh, authToken)
+	defer ts.Close()
+
+	consumer := &rawDefaultConsumer{
+		dopplerAddr: strings.Replace(ts.URL, "http:", "ws:", 1),
+		token:       authToken,
+		appGUID:     "my-app-guid",
+		tlsConfig:   &tls.Config{InsecureSkipVerify: true},
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := consumer.validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	eventCh, _ := consumer.Consume()
+
+	message := "Hello from fake loggregator"
+	eventBytes, err := NewEvent(message, time.Now().UnixNano())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	inputCh <- eventBytes
+
+	event := <-eventCh
+	if got := event.GetLogMessage().GetAppId(); got != "my-app-guid" {
+		t.Fatalf("expect %q to be eq %q", got, "my-app-guid")
+	}
+}
+
+func TestRawConsumer_proxy(t *testing.T) {
+	t.Parallel()
+
+	inputCh := make(chan []byte)
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+
+	ts := NewDopplerServer(t, inputCh, authToken)
+	defer ts.Close()
+
+	// Proxy is asked for every connection. Returning nil URL
+	// connects directly.
+	proxyCh := make(chan string, 1)
+	consumer := &rawDefaultConsumer{
+		dopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
+		token:          authToken,
+		subscriptionID: "test-go-nozzle-A",
+		tlsConfig:      &tls.Config{InsecureSkipVerify: true},
+		proxy: func(r *http.Request) (*url.URL, error) {
+			select {
+			case proxyCh <- r.URL.Host:
+			default:
+			}
+			return nil, nil
+		},
+		logger: &stdLogger{logger: defaultLogger},
+	}
+
+	eventCh, _ := consumer.Consume()
+
+	eventBytes, err := NewEvent("Hello from fake loggregator", time.Now().UnixNano())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	inputCh <- eventBytes
+	<-eventCh
+
+	select {
+	case host := <-proxyCh:
+		if expect := strings.TrimPrefix(ts.URL, "http://"); host != expect {
+			t.Fatalf("expect %q to be eq %q", host, expect)
+		}
+	default:
+		t.Fatalf("expect proxy to be used")
+	}
 }
 
-func TestRawConsumer_implement(t *testing.T) {
-	// Test rawConsumer implements consumer
-	var _ rawConsumer = &rawDefaultConsumer{}
+func TestRawConsumer_maxRetries(t *testing.T) {
+	t.Parallel()
+
+	// Nothing listens on this address, so noaa gives up after retries.
+	consumer := &rawDefaultConsumer{
+		dopplerAddr:    "ws://127.0.0.1:1",
+		token:          "n98ubNOIUog9gOPUbvqiur",
+		subscriptionID: "test-go-nozzle-A",
+		tlsConfig:      &tls.Config{InsecureSkipVerify: true},
+		maxRetries:     1,
+		logger:         &stdLogger{logger: defaultLogger},
+	}
+
+	_, errCh := consumer.Consume()
+	defer consumer.Close()
+
+	timeoutCh := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-errCh:
+			if errors.Is(err, noaaConsumer.ErrMaxRetriesReached) {
+				return
+			}
+		case <-timeoutCh:
+			t.Fatalf("expect noaa to give up retrying")
+		}
+	}
 }
 
-func TestRawConsumer_consume(t *testing.T) {
+func TestRawConsumer_idleTimeout(t *testing.T) {
 	t.Parallel()
 
-	// inputCh is used to send message from test web socket server
+	// Server never sends message
 	inputCh := make(chan []byte)
+	defer close(inputCh)
 
-	// authToken is valid auth token used for authorizing web socket connection
 	authToken := "n98ubNOIUog9gOPUbvqiur"
-
-	// Setup web socket server
 	ts := NewDopplerServer(t, inputCh, authToken)
 	defer ts.Close()
 
@@ -47,35 +765,451 @@ func TestRawConsumer_consume(t *testing.T) {
 		dopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
 		token:          authToken,
 		subscriptionID: "test-go-nozzle-A",
-		insecure:       true,
-		logger:         log.New(ioutil.Discard, "", log.LstdFlags),
+		idleTimeout:    100 * time.Millisecond,
+		tlsConfig:      &tls.Config{InsecureSkipVerify: true},
+		logger:         &stdLogger{logger: defaultLogger},
 	}
-	eventCh, _ := consumer.Consume()
 
-	// Create test message send from web socket.
-	// It will be encoded to protocol buffer.
-	timestamp := time.Now().UnixNano()
-	message := "Hello from fake loggregator"
+	_, errCh := consumer.Consume()
+	defer consumer.Close()
 
-	eventBytes, err := NewEvent(message, timestamp)
+	select {
+	case err := <-errCh:
+		var consumeErr *ConsumeError
+		if !errors.As(err, &consumeErr) {
+			t.Fatalf("expect %v to be *ConsumeError", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expect idle timeout error")
+	}
+}
+
+func TestRawConsumer_consumeContext(t *testing.T) {
+	t.Parallel()
+
+	// Nothing listens on this address, so noaa keeps retrying
+	// until ctx is canceled.
+	consumer := &rawDefaultConsumer{
+		dopplerAddr:    "ws://127.0.0.1:1",
+		token:          "n98ubNOIUog9gOPUbvqiur",
+		subscriptionID: "test-go-nozzle-A",
+		tlsConfig:      &tls.Config{InsecureSkipVerify: true},
+		logger:         &stdLogger{logger: defaultLogger},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	eventCh, errCh := consumer.ConsumeContext(ctx)
+	go func() {
+		for range errCh {
+		}
+	}()
+
+	cancel()
+
+	select {
+	case _, ok := <-eventCh:
+		if ok {
+			t.Fatalf("expect eventCh to be closed")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expect eventCh to be closed after ctx is canceled")
+	}
+
+	if got := consumer.connectionState().State; got != StateClosed {
+		t.Fatalf("expect %s to be eq %s", got, StateClosed)
+	}
+
+	// Close after ctx is canceled does nothing
+	if err := consumer.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestRawConsumer_failover(t *testing.T) {
+	consumer, err := newRawDefaultConsumer(&Config{
+		DopplerAddr:    "wss://a.cloudfoundry.com",
+		DopplerAddrs:   []string{"wss://b.cloudfoundry.com", "wss://c.cloudfoundry.com"},
+		Token:          "n98ubNOIUog9gOPUbvqiur",
+		SubscriptionID: "test-go-nozzle-A",
+	})
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
-	// Send event to websocket
-	inputCh <- eventBytes
+	if got, expect := consumer.currentAddr(), "wss://a.cloudfoundry.com"; got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
 
-	// Receive event from websocket(via raw consumer)
-	event := <-eventCh
-	got := string(event.GetLogMessage().Message)
-	if got != message {
-		t.Fatalf("expect %q to be eq %q", got, message)
+	cases := []struct {
+		addr   string
+		expect bool
+	}{
+		{"wss://b.cloudfoundry.com", true},
+		{"wss://c.cloudfoundry.com", true},
+
+		// Wraps around to the first one
+		{"wss://a.cloudfoundry.com", false},
+	}
+
+	for i, tc := range cases {
+		if got := consumer.failover(); got != tc.expect {
+			t.Fatalf("#%d expect %v to be eq %v", i, got, tc.expect)
+		}
+
+		if got := consumer.currentAddr(); got != tc.addr {
+			t.Fatalf("#%d expect %q to be eq %q", i, got, tc.addr)
+		}
+	}
+
+	if got, expect := consumer.connectionState().Failovers, uint64(3); got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+}
+
+func TestRawConsumer_failoverSingleAddr(t *testing.T) {
+	consumer, err := newRawDefaultConsumer(&Config{
+		DopplerAddr:    "wss://a.cloudfoundry.com",
+		Token:          "n98ubNOIUog9gOPUbvqiur",
+		SubscriptionID: "test-go-nozzle-A",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if consumer.failover() {
+		t.Fatalf("expect failover to be disabled")
+	}
+
+	if got := consumer.connectionState().Failovers; got != 0 {
+		t.Fatalf("expect %d to be eq 0", got)
+	}
+}
+
+type testBackoff struct {
+	d    time.Duration
+	next int
+}
+
+func (b *testBackoff) Next() time.Duration {
+	b.next++
+	return b.d
+}
+
+func (b *testBackoff) Reset() {}
+
+func TestRawConsumer_onReconnect(t *testing.T) {
+	var attempts []int
+	consumer := &rawDefaultConsumer{
+		subscriptionID: "test-go-nozzle-A",
+		logger:         &stdLogger{logger: defaultLogger},
+		errCh:          make(chan error, 2),
+		doneCh:         make(chan struct{}),
+		onReconnect: func(attempt int, err error) {
+			attempts = append(attempts, attempt)
+
+			// Panic must not stop forwarding errors
+			panic("unexpected")
+		},
+	}
+
+	noaaErrCh := make(chan error, 2)
+	noaaErrCh <- errors.New("connection lost")
+	noaaErrCh <- errors.New("connection refused")
+	close(noaaErrCh)
+
+	consumer.wg.Add(1)
+	consumer.forwardErrors(noaaErrCh)
+
+	if len(attempts) != 2 || attempts[0] != 1 || attempts[1] != 2 {
+		t.Fatalf("expect %v to be [1 2]", attempts)
+	}
+
+	if got, expect := len(consumer.errCh), 2; got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+}
+
+func TestRawConsumer_reconnect(t *testing.T) {
+	backoff := &testBackoff{d: 10 * time.Millisecond}
+	consumer := &rawDefaultConsumer{
+		dopplerAddr:    "ws://127.0.0.1:1",
+		token:          "n98ubNOIUog9gOPUbvqiur",
+		subscriptionID: "test-go-nozzle-A",
+		tlsConfig:      &tls.Config{InsecureSkipVerify: true},
+		backoff:        backoff,
+		logger:         &stdLogger{logger: defaultLogger},
+	}
+
+	_, errCh := consumer.Consume()
+	go func() {
+		for range errCh {
+		}
+	}()
+	defer consumer.Close()
+
+	consumer.mu.Lock()
+	old := consumer.noaaConsumer
+	consumer.mu.Unlock()
+
+	consumer.reconnect()
+
+	consumer.mu.Lock()
+	nc := consumer.noaaConsumer
+	consumer.mu.Unlock()
+
+	if nc == old {
+		t.Fatalf("expect new connection to be established")
+	}
+
+	if backoff.next != 1 {
+		t.Fatalf("expect %d to be eq %d", backoff.next, 1)
+	}
+}
+
+func TestRawConsumer_reconnectPolicyViolation(t *testing.T) {
+	consumer := &rawDefaultConsumer{
+		dopplerAddr:    "ws://127.0.0.1:1",
+		token:          "n98ubNOIUog9gOPUbvqiur",
+		subscriptionID: "test-go-nozzle-A",
+		tlsConfig:      &tls.Config{InsecureSkipVerify: true},
+		logger:         &stdLogger{logger: defaultLogger},
+
+		policyViolationBackoff: 10 * time.Millisecond,
+	}
+
+	_, errCh := consumer.Consume()
+	go func() {
+		for range errCh {
+		}
+	}()
+	defer consumer.Close()
+
+	consumer.mu.Lock()
+	old := consumer.noaaConsumer
+	consumer.wg.Add(1)
+	consumer.mu.Unlock()
+
+	// Emulate noaa reports ClosePolicyViolation
+	noaaErrCh := make(chan error, 1)
+	noaaErrCh <- &websocket.CloseError{Code: websocket.ClosePolicyViolation}
+	close(noaaErrCh)
+	go consumer.forwardErrors(noaaErrCh)
+
+	deadline := time.Now().Add(1 * time.Second)
+	for time.Now().Before(deadline) {
+		consumer.mu.Lock()
+		nc := consumer.noaaConsumer
+		consumer.mu.Unlock()
+
+		if nc != old {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("expect new connection to be established")
+}
+
+func TestIsPolicyViolation(t *testing.T) {
+	cases := []struct {
+		in     error
+		expect bool
+	}{
+		{&websocket.CloseError{Code: websocket.ClosePolicyViolation}, true},
+		{&ConsumeError{Err: &websocket.CloseError{Code: websocket.ClosePolicyViolation}}, true},
+		{&websocket.CloseError{Code: websocket.CloseNormalClosure}, false},
+		{errors.New("connection refused"), false},
+	}
+
+	for i, tc := range cases {
+		if got := isPolicyViolation(tc.in); got != tc.expect {
+			t.Fatalf("#%d expects %v to be eq %v", i, got, tc.expect)
+		}
+	}
+}
+
+func TestRawConsumer_reconnectClose(t *testing.T) {
+	consumer := &rawDefaultConsumer{
+		dopplerAddr:    "ws://127.0.0.1:1",
+		token:          "n98ubNOIUog9gOPUbvqiur",
+		subscriptionID: "test-go-nozzle-A",
+		tlsConfig:      &tls.Config{InsecureSkipVerify: true},
+		backoff:        &testBackoff{d: 1 * time.Hour},
+		logger:         &stdLogger{logger: defaultLogger},
+	}
+
+	_, errCh := consumer.Consume()
+	go func() {
+		for range errCh {
+		}
+	}()
+
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		consumer.reconnect()
+	}()
+
+	if err := consumer.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	select {
+	case <-doneCh:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect reconnect to be stopped by Close")
+	}
+}
+
+func TestRawConsumer_customNoaaConsumer(t *testing.T) {
+	nc := noaaConsumer.New("ws://127.0.0.1:1", &tls.Config{InsecureSkipVerify: true}, nil)
+	consumer := &rawDefaultConsumer{
+		customNoaaConsumer: nc,
+		dopplerAddr:        "ws://127.0.0.1:1",
+		token:              "n98ubNOIUog9gOPUbvqiur",
+		subscriptionID:     "test-go-nozzle-A",
+		logger:             &stdLogger{logger: defaultLogger},
+	}
+
+	_, errCh := consumer.Consume()
+	go func() {
+		for range errCh {
+		}
+	}()
+	defer consumer.Close()
+
+	// Same noaa consumer is used after reconnecting
+	consumer.refreshToken("9u2bnOuHG8ewnbaERkpa")
+
+	consumer.mu.Lock()
+	got := consumer.noaaConsumer
+	consumer.mu.Unlock()
+
+	if got != nc {
+		t.Fatalf("expect provided noaa consumer to be used")
+	}
+}
+
+func TestRawConsumer_refreshOverlap(t *testing.T) {
+	t.Parallel()
+
+	// connCh receives every websocket connection established
+	connCh := make(chan *websocket.Conn, 2)
+	doneCh := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		connCh <- ws
+		<-doneCh
+	}))
+	defer ts.Close()
+	defer close(doneCh)
+
+	consumer := &rawDefaultConsumer{
+		dopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
+		token:          "n98ubNOIUog9gOPUbvqiur",
+		subscriptionID: "test-go-nozzle-A",
+		tlsConfig:      &tls.Config{InsecureSkipVerify: true},
+		refreshOverlap: 1 * time.Second,
+		logger:         &stdLogger{logger: defaultLogger},
+	}
+
+	eventCh, errCh := consumer.Consume()
+	go func() {
+		for range errCh {
+		}
+	}()
+	defer consumer.Close()
+
+	old := <-connCh
+	consumer.refreshToken("9u2bnOuHG8ewnbaERkpa")
+	<-connCh
+
+	// Events from the previous connection are still delivered
+	// while overlapping.
+	message, err := NewEvent("in flight", 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := old.WriteMessage(websocket.BinaryMessage, message); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	select {
+	case event := <-eventCh:
+		if got, expect := string(event.GetLogMessage().GetMessage()), "in flight"; got != expect {
+			t.Fatalf("expect %q to be eq %q", got, expect)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect event from previous connection to be delivered")
+	}
+}
+
+func TestRawConsumer_staleTimeout(t *testing.T) {
+	t.Parallel()
+
+	// Server accepts connections but sends nothing
+	connCh := make(chan struct{}, 10)
+	doneCh := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		connCh <- struct{}{}
+		<-doneCh
+	}))
+	defer ts.Close()
+	defer close(doneCh)
+
+	consumer := &rawDefaultConsumer{
+		dopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
+		token:          "n98ubNOIUog9gOPUbvqiur",
+		subscriptionID: "test-go-nozzle-A",
+		tlsConfig:      &tls.Config{InsecureSkipVerify: true},
+		staleTimeout:   100 * time.Millisecond,
+		logger:         &stdLogger{logger: defaultLogger},
+	}
+
+	_, errCh := consumer.Consume()
+	go func() {
+		for range errCh {
+		}
+	}()
+	defer consumer.Close()
+
+	// The first connection and the forced one
+	for i := 0; i < 2; i++ {
+		select {
+		case <-connCh:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("#%d expect connection to be established", i)
+		}
+	}
+
+	if got := consumer.connectionState().StaleReconnects; got < 1 {
+		t.Fatalf("expect %d to be at least 1", got)
 	}
 }
 
 func TestRawConsumerClose_no_connection(t *testing.T) {
 	consumer := &rawDefaultConsumer{
-		logger: log.New(ioutil.Discard, "", log.LstdFlags),
+		logger: &stdLogger{logger: defaultLogger},
 	}
 	err := consumer.Close()
 	if err == nil {
@@ -105,6 +1239,24 @@ func TestRawConsumer_validate(t *testing.T) {
 			success: false,
 		},
 
+		{
+			in: &rawDefaultConsumer{
+				dopplerAddr:    "wss://doppler.cloudfoundry.com",
+				token:          "POrr7uofS1TOqaGCpH0skk=",
+				subscriptionID: "go-nozzle/A",
+			},
+			success: false,
+		},
+
+		{
+			in: &rawDefaultConsumer{
+				dopplerAddr:    "wss://doppler.cloudfoundry.com",
+				token:          "POrr7uofS1TOqaGCpH0skk=",
+				subscriptionID: strings.Repeat("A", MaxSubscriptionIDLength+1),
+			},
+			success: false,
+		},
+
 		{
 			in:      &rawDefaultConsumer{},
 			success: false,
@@ -129,3 +1281,42 @@ func TestRawConsumer_validate(t *testing.T) {
 		t.Errorf("#%d expects err not to be nil", i)
 	}
 }
+
+func TestRawConsumer_userAgent(t *testing.T) {
+	t.Parallel()
+
+	uaCh := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case uaCh <- r.Header.Get("User-Agent"):
+		default:
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	consumer := &rawDefaultConsumer{
+		dopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
+		token:          "n98ubNOIUog9gOPUbvqiur",
+		subscriptionID: "test-go-nozzle-A",
+		userAgent:      consumerUserAgent(&Config{ConsumerName: "my-nozzle/1.0"}),
+		logger:         &stdLogger{logger: defaultLogger},
+	}
+	consumer.Consume()
+	defer consumer.Close()
+
+	select {
+	case got := <-uaCh:
+		if expect := "my-nozzle/1.0"; got != expect {
+			t.Fatalf("expect %q to be eq %q", got, expect)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect handshake request")
+	}
+}
+
+func TestConsumerUserAgent_default(t *testing.T) {
+	if got, expect := consumerUserAgent(&Config{}), "go-nozzle/"+Version; got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+}
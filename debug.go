@@ -0,0 +1,63 @@
+package nozzle
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry/noaa"
+)
+
+// debugMessageBufferSize is the buffer size of the channel returned
+// by Consumer.DebugMessages().
+const debugMessageBufferSize = 100
+
+// debugChannelPrinter implements noaa.DebugPrinter. It sends request
+// and response dumps of noaa to the channel. Messages are dropped when
+// the channel is full not to block noaa.
+type debugChannelPrinter struct {
+	// next is DebugPrinter provided by user. It's also called
+	// if it's set.
+	next noaa.DebugPrinter
+
+	// mu protects ch from being sent after it's closed.
+	mu     sync.Mutex
+	ch     chan string
+	closed bool
+}
+
+// newDebugChannelPrinter constructs debugChannelPrinter.
+func newDebugChannelPrinter(next noaa.DebugPrinter) *debugChannelPrinter {
+	return &debugChannelPrinter{
+		next: next,
+		ch:   make(chan string, debugMessageBufferSize),
+	}
+}
+
+// Print sends the dump with its title to the channel.
+func (p *debugChannelPrinter) Print(title, dump string) {
+	if p.next != nil {
+		p.next.Print(title, dump)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+
+	select {
+	case p.ch <- title + "\n" + dump:
+	default:
+	}
+}
+
+// close closes the channel. Print does nothing after that.
+func (p *debugChannelPrinter) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+
+	p.closed = true
+	close(p.ch)
+}
@@ -0,0 +1,58 @@
+package nozzle
+
+import (
+	"testing"
+)
+
+type testDebugPrinter struct {
+	titles []string
+}
+
+func (p *testDebugPrinter) Print(title, dump string) {
+	p.titles = append(p.titles, title)
+}
+
+func TestDebugChannelPrinter(t *testing.T) {
+	next := &testDebugPrinter{}
+	p := newDebugChannelPrinter(next)
+
+	p.Print("WEBSOCKET REQUEST:", "GET /firehose/A HTTP/1.1")
+
+	select {
+	case got := <-p.ch:
+		expect := "WEBSOCKET REQUEST:\nGET /firehose/A HTTP/1.1"
+		if got != expect {
+			t.Fatalf("expect %q to be eq %q", got, expect)
+		}
+	default:
+		t.Fatalf("expect message to be sent")
+	}
+
+	if len(next.titles) != 1 {
+		t.Fatalf("expect provided DebugPrinter to be called")
+	}
+
+	// Messages are dropped when channel is full
+	for i := 0; i < debugMessageBufferSize+1; i++ {
+		p.Print("WEBSOCKET RESPONSE:", "HTTP/1.1 101 Switching Protocols")
+	}
+
+	if got := len(p.ch); got != debugMessageBufferSize {
+		t.Fatalf("expect %d to be eq %d", got, debugMessageBufferSize)
+	}
+
+	// Print after close does nothing
+	p.close()
+	p.Print("WEBSOCKET REQUEST:", "GET /firehose/A HTTP/1.1")
+	p.close()
+}
+
+func TestConsumerDebugMessages_disabled(t *testing.T) {
+	c := &consumer{
+		rawConsumer: &testRawConsumer{},
+	}
+
+	if c.DebugMessages() != nil {
+		t.Fatalf("expect channel not to be allocated")
+	}
+}
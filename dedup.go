@@ -0,0 +1,142 @@
+package nozzle
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// maxDedupEntries is the maximum number of fingerprints kept by
+// deduplicator. The least recently seen one is evicted when it's
+// exceeded even if it's still within window.
+const maxDedupEntries = 100000
+
+// FingerprintFunc returns the key to identify duplicated envelopes.
+// Envelopes which have the same key within Config.DedupWindow are
+// regarded as duplicated.
+type FingerprintFunc func(*events.Envelope) string
+
+// DefaultFingerprint is the default FingerprintFunc. It identifies
+// envelope by its timestamp, origin, event type, payload (e.g., name
+// and value of ValueMetric) and tags. Distinct metrics emitted at the
+// same timestamp by the same origin are not regarded as duplicated.
+func DefaultFingerprint(e *events.Envelope) string {
+	return fmt.Sprintf("%d/%s/%s/%s/%s",
+		e.GetTimestamp(), e.GetOrigin(), e.GetEventType(),
+		proto.CompactTextString(envelopePayload(e)), fingerprintTags(e.GetTags()))
+}
+
+// envelopePayload returns the payload of e for its event type.
+func envelopePayload(e *events.Envelope) proto.Message {
+	switch e.GetEventType() {
+	case events.Envelope_HttpStartStop:
+		return e.GetHttpStartStop()
+	case events.Envelope_LogMessage:
+		return e.GetLogMessage()
+	case events.Envelope_ValueMetric:
+		return e.GetValueMetric()
+	case events.Envelope_CounterEvent:
+		return e.GetCounterEvent()
+	case events.Envelope_Error:
+		return e.GetError()
+	case events.Envelope_ContainerMetric:
+		return e.GetContainerMetric()
+	default:
+		return nil
+	}
+}
+
+// fingerprintTags returns tags as "k=v" pairs sorted by key so that
+// the same tags always produce the same fingerprint.
+func fingerprintTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// dedupEntry is a fingerprint seen by deduplicator.
+type dedupEntry struct {
+	key    string
+	seenAt time.Time
+}
+
+// deduplicator remembers fingerprints of envelopes seen within window
+// and reports duplicated ones. It works as a bounded LRU: a duplicated
+// envelope refreshes its fingerprint, so the window is measured from
+// the last time the fingerprint is seen. It's not goroutine safe and is only used
+// from the goroutine forwarding events.
+type deduplicator struct {
+	window      time.Duration
+	fingerprint FingerprintFunc
+
+	// entries is ordered by seenAt, the least recently seen one is at
+	// front.
+	entries *list.List
+	seen    map[string]*list.Element
+
+	clock Clock
+}
+
+// newDeduplicator constructs deduplicator which measures window by
+// clock. If fingerprint is nil, DefaultFingerprint is used.
+func newDeduplicator(window time.Duration, fingerprint FingerprintFunc, clock Clock) *deduplicator {
+	if fingerprint == nil {
+		fingerprint = DefaultFingerprint
+	}
+
+	return &deduplicator{
+		window:      window,
+		fingerprint: fingerprint,
+		entries:     list.New(),
+		seen:        make(map[string]*list.Element),
+		clock:       clock,
+	}
+}
+
+// isDuplicate records the envelope and returns true if the same
+// fingerprint is already seen within window.
+func (d *deduplicator) isDuplicate(e *events.Envelope) bool {
+	now := d.clock.Now()
+	d.evict(now)
+
+	key := d.fingerprint(e)
+	if elm, ok := d.seen[key]; ok {
+		elm.Value.(*dedupEntry).seenAt = now
+		d.entries.MoveToBack(elm)
+		return true
+	}
+
+	d.seen[key] = d.entries.PushBack(&dedupEntry{
+		key:    key,
+		seenAt: now,
+	})
+
+	if d.entries.Len() > maxDedupEntries {
+		d.remove(d.entries.Front())
+	}
+
+	return false
+}
+
+// evict removes fingerprints which are out of window.
+func (d *deduplicator) evict(now time.Time) {
+	for elm := d.entries.Front(); elm != nil; elm = d.entries.Front() {
+		if now.Sub(elm.Value.(*dedupEntry).seenAt) <= d.window {
+			return
+		}
+		d.remove(elm)
+	}
+}
+
+func (d *deduplicator) remove(elm *list.Element) {
+	entry := d.entries.Remove(elm).(*dedupEntry)
+	delete(d.seen, entry.key)
+}
@@ -0,0 +1,138 @@
+package nozzle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestDeduplicator_isDuplicate(t *testing.T) {
+	clock := newFakeClock()
+	d := newDeduplicator(1*time.Minute, nil, clock)
+
+	envelope := func(ts int64) *events.Envelope {
+		return &events.Envelope{
+			Origin:    proto.String("doppler"),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Timestamp: proto.Int64(ts),
+		}
+	}
+
+	cases := []struct {
+		elapsed time.Duration
+		in      *events.Envelope
+		expect  bool
+	}{
+		{0, envelope(1), false},
+		{0, envelope(1), true},
+		{0, envelope(2), false},
+
+		// Still within window
+		{30 * time.Second, envelope(1), true},
+
+		// Within window from the last time it's seen
+		{31 * time.Second, envelope(1), true},
+
+		// Out of window, it's regarded as new one
+		{61 * time.Second, envelope(1), false},
+	}
+
+	for i, tc := range cases {
+		clock.Advance(tc.elapsed)
+		if got := d.isDuplicate(tc.in); got != tc.expect {
+			t.Fatalf("#%d expect %v to be eq %v", i, got, tc.expect)
+		}
+	}
+}
+
+func TestDefaultFingerprint(t *testing.T) {
+	valueMetric := func(name string, value float64, tags map[string]string) *events.Envelope {
+		return &events.Envelope{
+			Origin:    proto.String("doppler"),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Timestamp: proto.Int64(1),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String(name),
+				Value: proto.Float64(value),
+				Unit:  proto.String("count"),
+			},
+			Tags: tags,
+		}
+	}
+
+	base := valueMetric("cpu", 1, map[string]string{"a": "1", "b": "2"})
+	cases := []struct {
+		in     *events.Envelope
+		expect bool
+	}{
+		{valueMetric("cpu", 1, map[string]string{"b": "2", "a": "1"}), true},
+		{valueMetric("memory", 1, map[string]string{"a": "1", "b": "2"}), false},
+		{valueMetric("cpu", 2, map[string]string{"a": "1", "b": "2"}), false},
+		{valueMetric("cpu", 1, map[string]string{"a": "1", "b": "3"}), false},
+		{valueMetric("cpu", 1, nil), false},
+	}
+
+	for i, tc := range cases {
+		if got := DefaultFingerprint(tc.in) == DefaultFingerprint(base); got != tc.expect {
+			t.Fatalf("#%d expect %v to be eq %v", i, got, tc.expect)
+		}
+	}
+}
+
+func TestDeduplicator_fingerprint(t *testing.T) {
+	// Include deployment to distinguish envelopes
+	d := newDeduplicator(1*time.Minute, func(e *events.Envelope) string {
+		return DefaultFingerprint(e) + "/" + e.GetDeployment()
+	}, newFakeClock())
+
+	a := &events.Envelope{Timestamp: proto.Int64(1), Deployment: proto.String("cf")}
+	b := &events.Envelope{Timestamp: proto.Int64(1), Deployment: proto.String("redis")}
+
+	if d.isDuplicate(a) {
+		t.Fatalf("expect first envelope not to be duplicated")
+	}
+
+	if d.isDuplicate(b) {
+		t.Fatalf("expect envelope of other deployment not to be duplicated")
+	}
+
+	if !d.isDuplicate(a) {
+		t.Fatalf("expect same envelope to be duplicated")
+	}
+}
+
+func TestConsumer_dedup(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:  rc,
+		logger:       &stdLogger{logger: defaultLogger},
+		deduplicator: newDeduplicator(1*time.Minute, nil, realClock{}),
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		for _, ts := range []int64{1, 1, 2} {
+			rc.eventCh <- &events.Envelope{
+				EventType: events.Envelope_ValueMetric.Enum(),
+				Timestamp: proto.Int64(ts),
+			}
+		}
+	}()
+
+	for _, expect := range []int64{1, 2} {
+		select {
+		case event := <-c.Events():
+			if got := event.GetTimestamp(); got != expect {
+				t.Fatalf("expect %d to be eq %d", got, expect)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect not timeout")
+		}
+	}
+}
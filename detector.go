@@ -1,59 +1,197 @@
 package nozzle
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// SlowAlertReasonTruncated is the reason of SlowAlert when doppler
+	// dropped messages (TruncatingBuffer.DroppedMessages) from its queue.
+	SlowAlertReasonTruncated = "TruncatingBuffer"
+
+	// SlowAlertReasonPolicyViolation is the reason of SlowAlert when
+	// websocket connection is closed by ClosePolicyViolation (1008).
+	SlowAlertReasonPolicyViolation = "ClosePolicyViolation"
+)
+
+// SlowAlert is a `slowConsumerAlert` notified on Consumer.Detects().
+type SlowAlert struct {
+	// Reason tells what triggers the alert. It's one of
+	// SlowAlertReasonTruncated or SlowAlertReasonPolicyViolation
+	// for the default detector.
+	Reason string
+
+	// Err describes the alert.
+	Err error
+
+	// Time is the time when the alert is detected.
+	Time time.Time
+}
+
+// DetectorStats is the cumulative number of slowConsumerAlerts
+// detected by each reason.
+type DetectorStats struct {
+	// TruncatedAlerts is the number of alerts by
+	// SlowAlertReasonTruncated (doppler is dropping messages).
+	TruncatedAlerts int64
+
+	// PolicyViolationAlerts is the number of alerts by
+	// SlowAlertReasonPolicyViolation (doppler closed connection).
+	PolicyViolationAlerts int64
+
+	// ClassifiedAlerts is the number of alerts by Config.ClassifyError.
+	ClassifiedAlerts int64
+
+	// DroppedAlerts is the number of alerts dropped because nobody
+	// was ready to receive them. It's only counted when
+	// Config.BlockOnAlert is false.
+	DroppedAlerts int64
+}
+
+// detectorStatsReporter is implemented by SlowDetector which
+// counts alerts by reason.
+type detectorStatsReporter interface {
+	DetectorStats() DetectorStats
+}
+
 // SlowDetectCh is channel used to send `slowConsumerAlert` event.
-type slowDetectCh chan error
+type slowDetectCh chan SlowAlert
 
 // SlowDetector defines the interface for detecting `slowConsumerAlert`
 // event. By default, defaultSlowDetetor is used. It implements same detection
 // logic as https://github.com/cloudfoundry-incubator/datadog-firehose-nozzle.
-type slowDetector interface {
+//
+// You can use your own implementation via Config.SlowDetector.
+type SlowDetector interface {
 	// Detect detects `slowConsumerAlert`. It works as pipe.
 	// It receives events from upstream (RawConsumer) and inspects that events
 	// and pass it to to downstream without modification.
 	//
-	// It returns SlowDetectCh and notify `slowConsumerAlert` there.
-	Detect(<-chan *events.Envelope, <-chan error) (<-chan *events.Envelope, <-chan error, slowDetectCh)
+	// It returns the channel to notify `slowConsumerAlert` as 3rd value.
+	// The channels returned must be closed when the input channels are closed.
+	Detect(<-chan *events.Envelope, <-chan error) (<-chan *events.Envelope, <-chan error, <-chan SlowAlert)
 
 	// Stop stops slow consumer detection. If any returns error.
 	Stop() error
 }
 
+// nopSlowDetector implements SlowDetector without detection. It returns
+// the input channels as they are, so no goroutine or channel hop is
+// added. The channel of slowConsumerAlert is nil.
+type nopSlowDetector struct{}
+
+// Detect returns eventCh and errCh as they are.
+func (nopSlowDetector) Detect(eventCh <-chan *events.Envelope, errCh <-chan error) (<-chan *events.Envelope, <-chan error, <-chan SlowAlert) {
+	return eventCh, errCh, nil
+}
+
+// Stop does nothing.
+func (nopSlowDetector) Stop() error {
+	return nil
+}
+
 // defaultSlowDetector implements SlowDetector interface
 type defaultSlowDetector struct {
+	// The number of alerts by reason. They're accessed atomically
+	// and placed first for 64-bit alignment.
+	truncatedAlerts       int64
+	policyViolationAlerts int64
+	classifiedAlerts      int64
+	droppedAlerts         int64
+
 	doneCh chan struct{}
-	logger *log.Logger
+	logger leveledLogger
+
+	// Buffer sizes of the channels returned by Detect.
+	// 0 means unbuffered.
+	eventBufferSize  int
+	errBufferSize    int
+	detectBufferSize int
+
+	// threshold is the number of truncated events within window
+	// required to notify `slowConsumerAlert`. If it's less than or
+	// equal to 1, every truncated event is notified.
+	threshold int
+
+	// window is the sliding window to count truncated events.
+	// If it's 0, truncated events are counted without time limit.
+	window time.Duration
+
+	// dropAlerts makes sending alerts non-blocking. Alerts are dropped
+	// if nobody is ready to receive them, so that forwarding events is
+	// never stalled by alerts.
+	dropAlerts bool
+
+	// isTruncated reports whether the event tells doppler dropped
+	// messages. If it's nil, isTruncated function is used.
+	isTruncated func(*events.Envelope) bool
+
+	// classifyError reports whether the error is slowConsumerAlert and
+	// its reason. It's consulted before the built-in classification.
+	// If it's nil, only the built-in one is used.
+	classifyError func(error) (bool, string)
+
+	// clock is used to count truncated events within window and
+	// stamp alerts. If it's nil, real time is used.
+	clock Clock
+
+	// truncatedAt keeps timestamps of recent truncated events.
+	// It's only accessed from the goroutine reading events.
+	truncatedAt []time.Time
 }
 
 // Detect start to detect `slowConsumerAlert` event.
-func (sd *defaultSlowDetector) Detect(eventCh <-chan *events.Envelope, errCh <-chan error) (<-chan *events.Envelope, <-chan error, slowDetectCh) {
-	sd.logger.Println("[INFO] Start detecting slowConsumerAlert event")
+func (sd *defaultSlowDetector) Detect(eventCh <-chan *events.Envelope, errCh <-chan error) (<-chan *events.Envelope, <-chan error, <-chan SlowAlert) {
+	sd.logger.Info("Start detecting slowConsumerAlert event")
 
 	// Create new channel to pass producer
-	eventCh_ := make(chan *events.Envelope)
-	errCh_ := make(chan error)
+	eventCh_ := make(chan *events.Envelope, sd.eventBufferSize)
+	errCh_ := make(chan error, sd.errBufferSize)
 
 	// doneCh is used to cancel sending data to
 	// downstream process.
 	sd.doneCh = make(chan struct{})
 
 	// deteCh is used to send `slowConsumerAlert` event
-	detectCh := make(slowDetectCh)
+	detectCh := make(slowDetectCh, sd.detectBufferSize)
+
+	// detectCh is closed after both goroutines below are finished
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		wg.Wait()
+		close(detectCh)
+	}()
 
 	// Detect from from trafficcontroller event messages
 	go func() {
+		defer wg.Done()
 		defer close(eventCh_)
+		truncated := sd.isTruncated
+		if truncated == nil {
+			truncated = isTruncated
+		}
+		clock := orRealClock(sd.clock)
+
 		for event := range eventCh {
 			// Check nozzle can catch up firehose outputs speed.
-			if isTruncated(event) {
-				detectCh <- fmt.Errorf("doppler dropped messages from its queue because nozzle is slow")
+			if now := clock.Now(); truncated(event) && sd.exceedThreshold(now) {
+				atomic.AddInt64(&sd.truncatedAlerts, 1)
+				alert := SlowAlert{
+					Reason: SlowAlertReasonTruncated,
+					Err:    fmt.Errorf("doppler dropped messages from its queue because nozzle is slow"),
+					Time:   now,
+				}
+				if !sd.sendAlert(detectCh, alert) {
+					return
+				}
 			}
 
 			select {
@@ -69,11 +207,29 @@ func (sd *defaultSlowDetector) Detect(eventCh <-chan *events.Envelope, errCh <-c
 
 	// Detect from websocket errors
 	go func() {
+		defer wg.Done()
 		defer close(errCh_)
 		for err := range errCh {
-			switch t := err.(type) {
-			case *websocket.CloseError:
-				if t.Code == websocket.ClosePolicyViolation {
+			if sd.classifyError != nil {
+				if isAlert, reason := sd.classifyError(err); isAlert {
+					atomic.AddInt64(&sd.classifiedAlerts, 1)
+					alert := SlowAlert{
+						Reason: reason,
+						Err:    err,
+						Time:   orRealClock(sd.clock).Now(),
+					}
+					if !sd.sendAlert(detectCh, alert) {
+						return
+					}
+					continue
+				}
+			}
+
+			// Use errors.As since error may be wrapped (e.g., ConsumeError)
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				switch closeErr.Code {
+				case websocket.ClosePolicyViolation:
 					// ClosePolicyViolation (1008)
 					// indicates that an endpoint is terminating the connection
 					// because it has received a message that violates its policy.
@@ -83,8 +239,23 @@ func (sd *defaultSlowDetector) Detect(eventCh <-chan *events.Envelope, errCh <-c
 					// is a need to hide specific details about the policy.
 					//
 					// http://tools.ietf.org/html/rfc6455#section-11.7
-					detectCh <- fmt.Errorf(
-						"websocket terminates the connection because connection is too slow (ClosePolicyViolation)")
+					atomic.AddInt64(&sd.policyViolationAlerts, 1)
+					alert := SlowAlert{
+						Reason: SlowAlertReasonPolicyViolation,
+						Err: fmt.Errorf(
+							"websocket terminates the connection because connection is too slow (ClosePolicyViolation)"),
+						Time: orRealClock(sd.clock).Now(),
+					}
+					if !sd.sendAlert(detectCh, alert) {
+						return
+					}
+
+				// They're not caused by slow consumer but need
+				// different action, so classified as CloseError.
+				case websocket.CloseMessageTooBig:
+					err = &CloseError{Code: closeErr.Code, Reason: CloseReasonMessageTooBig, Err: err}
+				case websocket.CloseInternalServerErr:
+					err = &CloseError{Code: closeErr.Code, Reason: CloseReasonInternalError, Err: err}
 				}
 			}
 			select {
@@ -101,8 +272,32 @@ func (sd *defaultSlowDetector) Detect(eventCh <-chan *events.Envelope, errCh <-c
 	return eventCh_, errCh_, detectCh
 }
 
+// sendAlert sends alert to detectCh. It returns false without sending
+// if detector is stopped, so that goroutines don't block (and leak)
+// when nobody reads detectCh anymore. With dropAlerts, alert is dropped
+// instead of blocking.
+func (sd *defaultSlowDetector) sendAlert(detectCh slowDetectCh, alert SlowAlert) bool {
+	if sd.dropAlerts {
+		select {
+		case detectCh <- alert:
+		case <-sd.doneCh:
+			return false
+		default:
+			atomic.AddInt64(&sd.droppedAlerts, 1)
+		}
+		return true
+	}
+
+	select {
+	case detectCh <- alert:
+		return true
+	case <-sd.doneCh:
+		return false
+	}
+}
+
 func (sd *defaultSlowDetector) Stop() error {
-	sd.logger.Println("[INFO] Stop detecting slowConsumerAlert event")
+	sd.logger.Info("Stop detecting slowConsumerAlert event")
 	if sd.doneCh == nil {
 		return fmt.Errorf("slow detector is not running")
 	}
@@ -111,6 +306,43 @@ func (sd *defaultSlowDetector) Stop() error {
 	return nil
 }
 
+// DetectorStats returns the number of alerts detected by each reason.
+func (sd *defaultSlowDetector) DetectorStats() DetectorStats {
+	return DetectorStats{
+		TruncatedAlerts:       atomic.LoadInt64(&sd.truncatedAlerts),
+		PolicyViolationAlerts: atomic.LoadInt64(&sd.policyViolationAlerts),
+		ClassifiedAlerts:      atomic.LoadInt64(&sd.classifiedAlerts),
+		DroppedAlerts:         atomic.LoadInt64(&sd.droppedAlerts),
+	}
+}
+
+// exceedThreshold records a truncated event at now and reports whether
+// the number of truncated events within window reaches threshold.
+// Recorded events are cleared when it returns true.
+func (sd *defaultSlowDetector) exceedThreshold(now time.Time) bool {
+	if sd.threshold <= 1 {
+		return true
+	}
+
+	sd.truncatedAt = append(sd.truncatedAt, now)
+
+	// Remove events which are out of window
+	if sd.window > 0 {
+		i := 0
+		for i < len(sd.truncatedAt) && now.Sub(sd.truncatedAt[i]) > sd.window {
+			i++
+		}
+		sd.truncatedAt = sd.truncatedAt[i:]
+	}
+
+	if len(sd.truncatedAt) < sd.threshold {
+		return false
+	}
+
+	sd.truncatedAt = sd.truncatedAt[:0]
+	return true
+}
+
 // isTruncated detects message from the Doppler that the nozzle
 // could not consume messages as quickly as the firehose was sending them.
 func isTruncated(envelope *events.Envelope) bool {
@@ -2,12 +2,11 @@ package nozzle
 
 import (
 	"errors"
-	"io/ioutil"
-	"log"
 	"testing"
 	"time"
 
 	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
 	"github.com/gorilla/websocket"
 )
 
@@ -19,18 +18,43 @@ var (
 )
 
 func TestDefaultSlowDetector_implement(t *testing.T) {
-	var _ slowDetector = &defaultSlowDetector{}
+	var _ SlowDetector = &defaultSlowDetector{}
 }
 
 func TestDefaultSlowDetectorClose(t *testing.T) {
 	detector := &defaultSlowDetector{
-		logger: log.New(ioutil.Discard, "", log.LstdFlags),
+		logger: &stdLogger{logger: defaultLogger},
 	}
 	if err := detector.Stop(); err == nil {
 		t.Fatalf("expects to be failed")
 	}
 }
 
+func TestDefaultDetect_bufferSize(t *testing.T) {
+	testDetector := &defaultSlowDetector{
+		logger:           &stdLogger{logger: defaultLogger},
+		eventBufferSize:  100,
+		errBufferSize:    10,
+		detectBufferSize: 1,
+	}
+
+	eventCh, errCh, detectCh := testDetector.Detect(
+		make(chan *events.Envelope), make(chan error))
+	defer testDetector.Stop()
+
+	if got, expect := cap(eventCh), 100; got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+
+	if got, expect := cap(errCh), 10; got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+
+	if got, expect := cap(detectCh), 1; got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+}
+
 func TestDefaultDetect_eventCh(t *testing.T) {
 	t.Parallel()
 
@@ -56,7 +80,7 @@ func TestDefaultDetect_eventCh(t *testing.T) {
 	}
 
 	testDetector := &defaultSlowDetector{
-		logger: log.New(ioutil.Discard, "", log.LstdFlags),
+		logger: &stdLogger{logger: defaultLogger},
 	}
 
 	eventCh := make(chan *events.Envelope)
@@ -70,10 +94,14 @@ func TestDefaultDetect_eventCh(t *testing.T) {
 		}()
 
 		select {
-		case <-detectCh:
+		case alert := <-detectCh:
 			if !tc.Expect {
 				t.Fatalf("expect not to be detected")
 			}
+
+			if alert.Reason != SlowAlertReasonTruncated {
+				t.Fatalf("expect %q to be eq %q", alert.Reason, SlowAlertReasonTruncated)
+			}
 		case <-time.After(1 * time.Second):
 			if tc.Expect {
 				t.Fatalf("expect to be detected")
@@ -81,6 +109,56 @@ func TestDefaultDetect_eventCh(t *testing.T) {
 		}
 	}
 
+	expect := DetectorStats{TruncatedAlerts: 1}
+	if got := testDetector.DetectorStats(); got != expect {
+		t.Fatalf("expect %#v to be eq %#v", got, expect)
+	}
+}
+
+func TestDefaultDetect_isTruncated(t *testing.T) {
+	testDetector := &defaultSlowDetector{
+		logger: &stdLogger{logger: defaultLogger},
+		isTruncated: func(e *events.Envelope) bool {
+			return e.GetOrigin() == "metron"
+		},
+	}
+
+	eventCh := make(chan *events.Envelope)
+	outEventCh, _, detectCh := testDetector.Detect(eventCh, make(chan error))
+	defer testDetector.Stop()
+
+	go func() {
+		for range outEventCh {
+		}
+	}()
+
+	// Default predicate is not used
+	go func() {
+		eventCh <- &events.Envelope{
+			Origin:    &TR_Origin,
+			EventType: &TR_EventType,
+			CounterEvent: &events.CounterEvent{
+				Name: &TR_EventName,
+			},
+		}
+		eventCh <- &events.Envelope{
+			Origin: proto.String("metron"),
+		}
+	}()
+
+	select {
+	case alert := <-detectCh:
+		if alert.Reason != SlowAlertReasonTruncated {
+			t.Fatalf("expect %q to be eq %q", alert.Reason, SlowAlertReasonTruncated)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect to be detected")
+	}
+
+	expect := DetectorStats{TruncatedAlerts: 1}
+	if got := testDetector.DetectorStats(); got != expect {
+		t.Fatalf("expect %#v to be eq %#v", got, expect)
+	}
 }
 
 func TestDefaultDetect_errCh(t *testing.T) {
@@ -97,6 +175,16 @@ func TestDefaultDetect_errCh(t *testing.T) {
 			Expect: true,
 		},
 
+		{
+			// Wrapped error must be detected
+			Input: &ConsumeError{
+				Err: &websocket.CloseError{
+					Code: websocket.ClosePolicyViolation,
+				},
+			},
+			Expect: true,
+		},
+
 		{
 			Input:  errors.New(""),
 			Expect: false,
@@ -104,12 +192,18 @@ func TestDefaultDetect_errCh(t *testing.T) {
 	}
 
 	testDetector := &defaultSlowDetector{
-		logger: log.New(ioutil.Discard, "", log.LstdFlags),
+		logger: &stdLogger{logger: defaultLogger},
 	}
 
 	eventCh := make(chan *events.Envelope)
 	errCh := make(chan error)
-	_, _, detectCh := testDetector.Detect(eventCh, errCh)
+	_, outErrCh, detectCh := testDetector.Detect(eventCh, errCh)
+
+	// Read errors passed to downstream not to block detection
+	go func() {
+		for range outErrCh {
+		}
+	}()
 
 	for _, tc := range cases {
 		// Send the events
@@ -118,10 +212,14 @@ func TestDefaultDetect_errCh(t *testing.T) {
 		}()
 
 		select {
-		case <-detectCh:
+		case alert := <-detectCh:
 			if !tc.Expect {
 				t.Fatalf("expect not to be detected")
 			}
+
+			if alert.Reason != SlowAlertReasonPolicyViolation {
+				t.Fatalf("expect %q to be eq %q", alert.Reason, SlowAlertReasonPolicyViolation)
+			}
 		case <-time.After(1 * time.Second):
 			if tc.Expect {
 				t.Fatalf("expect to be detected")
@@ -129,6 +227,244 @@ func TestDefaultDetect_errCh(t *testing.T) {
 		}
 	}
 
+	expect := DetectorStats{PolicyViolationAlerts: 2}
+	if got := testDetector.DetectorStats(); got != expect {
+		t.Fatalf("expect %#v to be eq %#v", got, expect)
+	}
+}
+
+func TestDefaultDetect_closeError(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		code   int
+		expect string
+	}{
+		{websocket.CloseMessageTooBig, CloseReasonMessageTooBig},
+		{websocket.CloseInternalServerErr, CloseReasonInternalError},
+
+		// Unknown code is passed through
+		{websocket.CloseGoingAway, ""},
+	}
+
+	testDetector := &defaultSlowDetector{
+		logger: &stdLogger{logger: defaultLogger},
+	}
+
+	errCh := make(chan error)
+	_, outErrCh, _ := testDetector.Detect(make(chan *events.Envelope), errCh)
+	defer testDetector.Stop()
+
+	for i, tc := range cases {
+		go func() {
+			errCh <- &ConsumeError{Err: &websocket.CloseError{Code: tc.code}}
+		}()
+
+		var err error
+		select {
+		case err = <-outErrCh:
+		case <-time.After(1 * time.Second):
+			t.Fatalf("#%d expect not timeout", i)
+		}
+
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) {
+			if tc.expect != "" {
+				t.Fatalf("#%d expect %v to be CloseError", i, err)
+			}
+			continue
+		}
+
+		if closeErr.Reason != tc.expect {
+			t.Fatalf("#%d expect %q to be eq %q", i, closeErr.Reason, tc.expect)
+		}
+
+		// Original error is still retrieved
+		var consumeErr *ConsumeError
+		if !errors.As(err, &consumeErr) {
+			t.Fatalf("#%d expect %v to wrap ConsumeError", i, err)
+		}
+	}
+}
+
+func TestDefaultDetect_classifyError(t *testing.T) {
+	t.Parallel()
+
+	errQuota := errors.New("quota exceeded")
+	testDetector := &defaultSlowDetector{
+		logger: &stdLogger{logger: defaultLogger},
+		classifyError: func(err error) (bool, string) {
+			if errors.Is(err, errQuota) {
+				return true, "Quota"
+			}
+			return false, ""
+		},
+	}
+
+	errCh := make(chan error)
+	_, outErrCh, detectCh := testDetector.Detect(make(chan *events.Envelope), errCh)
+	defer testDetector.Stop()
+
+	// Classified error is notified as alert
+	go func() {
+		errCh <- errQuota
+	}()
+
+	select {
+	case alert := <-detectCh:
+		if got, expect := alert.Reason, "Quota"; got != expect {
+			t.Fatalf("expect %q to be eq %q", got, expect)
+		}
+		if alert.Err != errQuota {
+			t.Fatalf("expect %v to be eq %v", alert.Err, errQuota)
+		}
+	case err := <-outErrCh:
+		t.Fatalf("expect %v not to be sent to errCh", err)
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect to be detected")
+	}
+
+	// Others fall through to the built-in classification
+	go func() {
+		errCh <- &websocket.CloseError{Code: websocket.ClosePolicyViolation}
+	}()
+
+	select {
+	case alert := <-detectCh:
+		if alert.Reason != SlowAlertReasonPolicyViolation {
+			t.Fatalf("expect %q to be eq %q", alert.Reason, SlowAlertReasonPolicyViolation)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect to be detected")
+	}
+
+	select {
+	case <-outErrCh:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect error to be sent to errCh")
+	}
+
+	expect := DetectorStats{PolicyViolationAlerts: 1, ClassifiedAlerts: 1}
+	if got := testDetector.DetectorStats(); got != expect {
+		t.Fatalf("expect %#v to be eq %#v", got, expect)
+	}
+}
+
+func TestDefaultDetect_stopWithoutReader(t *testing.T) {
+	testDetector := &defaultSlowDetector{
+		logger: &stdLogger{logger: defaultLogger},
+	}
+
+	eventCh := make(chan *events.Envelope)
+	outEventCh, _, _ := testDetector.Detect(eventCh, make(chan error))
+
+	// Nobody reads detectCh
+	eventCh <- &events.Envelope{
+		Origin:    &TR_Origin,
+		EventType: &TR_EventType,
+		CounterEvent: &events.CounterEvent{
+			Name: &TR_EventName,
+		},
+	}
+
+	if err := testDetector.Stop(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Goroutine blocked on sending alert exits after Stop
+	select {
+	case _, ok := <-outEventCh:
+		if ok {
+			t.Fatalf("expect event not to be forwarded after stop")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect event channel to be closed")
+	}
+}
+
+func TestDefaultDetect_dropAlerts(t *testing.T) {
+	testDetector := &defaultSlowDetector{
+		logger:     &stdLogger{logger: defaultLogger},
+		dropAlerts: true,
+	}
+
+	eventCh := make(chan *events.Envelope)
+	outEventCh, _, _ := testDetector.Detect(eventCh, make(chan error))
+	defer testDetector.Stop()
+
+	// Nobody reads detectCh but events keep flowing
+	go func() {
+		for i := 0; i < 2; i++ {
+			eventCh <- &events.Envelope{
+				Origin:    &TR_Origin,
+				EventType: &TR_EventType,
+				CounterEvent: &events.CounterEvent{
+					Name: &TR_EventName,
+				},
+			}
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-outEventCh:
+		case <-time.After(1 * time.Second):
+			t.Fatalf("#%d expect event to be forwarded", i)
+		}
+	}
+
+	expect := DetectorStats{TruncatedAlerts: 2, DroppedAlerts: 2}
+	if got := testDetector.DetectorStats(); got != expect {
+		t.Fatalf("expect %#v to be eq %#v", got, expect)
+	}
+}
+
+func TestDefaultSlowDetector_exceedThreshold(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		threshold int
+		window    time.Duration
+		in        []time.Time
+		expect    []bool
+	}{
+		// Default, all events are notified
+		{
+			in:     []time.Time{now, now},
+			expect: []bool{true, true},
+		},
+
+		// Without window
+		{
+			threshold: 2,
+			in:        []time.Time{now, now.Add(1 * time.Hour), now.Add(2 * time.Hour)},
+			expect:    []bool{false, true, false},
+		},
+
+		// With window
+		{
+			threshold: 2,
+			window:    1 * time.Minute,
+			in: []time.Time{
+				now,
+				now.Add(2 * time.Minute),
+				now.Add(2*time.Minute + 30*time.Second),
+			},
+			expect: []bool{false, false, true},
+		},
+	}
+
+	for i, tc := range cases {
+		detector := &defaultSlowDetector{
+			threshold: tc.threshold,
+			window:    tc.window,
+		}
+
+		for j, in := range tc.in {
+			if got := detector.exceedThreshold(in); got != tc.expect[j] {
+				t.Fatalf("#%d-%d expects %v to be eq %v", i, j, got, tc.expect[j])
+			}
+		}
+	}
 }
 
 func TestIsTruncated(t *testing.T) {
@@ -160,3 +496,35 @@ func TestIsTruncated(t *testing.T) {
 		}
 	}
 }
+
+func TestConsumer_disableSlowDetector(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:         rc,
+		logger:              &stdLogger{logger: defaultLogger},
+		disableSlowDetector: true,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if c.Detects() != nil {
+		t.Fatalf("expect Detects() to be nil")
+	}
+
+	go func() {
+		rc.eventCh <- &events.Envelope{}
+	}()
+
+	select {
+	case <-c.Events():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	// Remaining events are drained without slowDetector goroutines
+	if err := c.CloseWithTimeout(1 * time.Second); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
@@ -0,0 +1,111 @@
+package nozzle
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// v2Info is the response of CF API /v2/info.
+type v2Info struct {
+	DopplerLoggingEndpoint string `json:"doppler_logging_endpoint"`
+}
+
+// v3Root is the response of CF API / (v3 root).
+type v3Root struct {
+	Links struct {
+		Logging struct {
+			Href string `json:"href"`
+		} `json:"logging"`
+	} `json:"links"`
+}
+
+// setupDopplerAddr sets DopplerAddr of config by discovering it from
+// APIAddr if neither DopplerAddr nor DopplerAddrs is set.
+func setupDopplerAddr(ctx context.Context, config *Config) error {
+	if config.UseRLP || config.DopplerAddr != "" ||
+		len(config.DopplerAddrs) > 0 || config.APIAddr == "" {
+		return nil
+	}
+
+	addr, err := discoverDopplerAddr(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	newLogger(config).Info("Discovered doppler address",
+		"api_addr", config.APIAddr, "doppler_addr", addr)
+	config.DopplerAddr = addr
+	return nil
+}
+
+// discoverDopplerAddr queries CF API at config.APIAddr for the doppler
+// endpoint. /v2/info is tried first and the v3 root is used if it's not
+// available (e.g., v2 API is disabled). The request is bounded by
+// UaaTimeout same as fetching token.
+func discoverDopplerAddr(ctx context.Context, config *Config) (string, error) {
+	timeout := config.UaaTimeout
+	if _, ok := ctx.Deadline(); timeout == 0 && !ok {
+		timeout = defaultUAATimeout
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// CF API is usually served with the same CA as doppler, so
+	// TLSConfig (e.g., RootCAs) and Proxy are shared with it.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = newTLSConfig(config)
+	transport.Proxy = config.Proxy
+	client := &http.Client{Transport: transport}
+
+	apiAddr := strings.TrimSuffix(config.APIAddr, "/")
+
+	var info v2Info
+	v2Err := getJSON(ctx, client, apiAddr+"/v2/info", &info)
+	if v2Err == nil && info.DopplerLoggingEndpoint != "" {
+		return info.DopplerLoggingEndpoint, nil
+	}
+
+	var root v3Root
+	if err := getJSON(ctx, client, apiAddr+"/", &root); err != nil {
+		if v2Err == nil {
+			v2Err = fmt.Errorf("doppler_logging_endpoint is empty")
+		}
+		return "", fmt.Errorf("failed to discover doppler address from %s: %s (v3: %s)",
+			config.APIAddr, v2Err, err)
+	}
+
+	if root.Links.Logging.Href == "" {
+		return "", fmt.Errorf("failed to discover doppler address from %s: logging endpoint is empty",
+			config.APIAddr)
+	}
+
+	return root.Links.Logging.Href, nil
+}
+
+// getJSON requests url and decodes its JSON response to v.
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,129 @@
+package nozzle
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDiscoverDopplerAddr(t *testing.T) {
+	cases := []struct {
+		v2, v3  string
+		expect  string
+		success bool
+	}{
+		{
+			v2:      `{"doppler_logging_endpoint":"wss://doppler.example.com:443"}`,
+			expect:  "wss://doppler.example.com:443",
+			success: true,
+		},
+
+		// v2 API is disabled
+		{
+			v3:      `{"links":{"logging":{"href":"wss://doppler.example.com:443"}}}`,
+			expect:  "wss://doppler.example.com:443",
+			success: true,
+		},
+
+		{
+			v3:      `{"links":{}}`,
+			success: false,
+		},
+
+		{
+			success: false,
+		},
+	}
+
+	for i, tc := range cases {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := tc.v3
+			if r.URL.Path == "/v2/info" {
+				body = tc.v2
+			}
+
+			if body == "" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(body))
+		}))
+
+		addr, err := discoverDopplerAddr(context.Background(), &Config{APIAddr: ts.URL + "/"})
+		ts.Close()
+
+		if !tc.success {
+			if err == nil {
+				t.Fatalf("#%d expect err not to be nil", i)
+			}
+
+			if !strings.Contains(err.Error(), "failed to discover doppler address") {
+				t.Fatalf("#%d expect %q to describe discovery", i, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+
+		if addr != tc.expect {
+			t.Fatalf("#%d expect %q to be eq %q", i, addr, tc.expect)
+		}
+	}
+}
+
+func TestDiscoverDopplerAddr_tlsConfig(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"doppler_logging_endpoint":"wss://doppler.example.com:443"}`))
+	}))
+	defer ts.Close()
+
+	// The server is trusted only by RootCAs of TLSConfig
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	config := &Config{
+		APIAddr:   ts.URL,
+		TLSConfig: &tls.Config{RootCAs: pool},
+	}
+
+	addr, err := discoverDopplerAddr(context.Background(), config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if expect := "wss://doppler.example.com:443"; addr != expect {
+		t.Fatalf("expect %q to be eq %q", addr, expect)
+	}
+
+	config.TLSConfig = nil
+	if _, err := discoverDopplerAddr(context.Background(), config); err == nil {
+		t.Fatalf("expect untrusted certificate to fail")
+	}
+}
+
+func TestNewConsumer_discoverDopplerAddr(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"doppler_logging_endpoint":"wss://doppler.example.com:443"}`))
+	}))
+	defer ts.Close()
+
+	config := &Config{
+		APIAddr:        ts.URL,
+		Token:          "xyz",
+		SubscriptionID: "go-nozzle-A",
+	}
+
+	if _, err := NewConsumer(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if got, expect := config.DopplerAddr, "wss://doppler.example.com:443"; got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+}
@@ -0,0 +1,72 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Environment variables read by NewConsumerFromEnv. They're the ones
+// conventionally used by nozzles (and example/main.go).
+const (
+	EnvDopplerAddr    = "DOPPLER_ADDR"
+	EnvToken          = "CF_ACCESS_TOKEN"
+	EnvUaaAddr        = "UAA_ADDR"
+	EnvUsername       = "CF_USERNAME"
+	EnvPassword       = "CF_PASSWORD"
+	EnvClientID       = "CF_CLIENT_ID"
+	EnvClientSecret   = "CF_CLIENT_SECRET"
+	EnvSubscriptionID = "SUBSCRIPTION_ID"
+)
+
+// NewConsumerFromEnv constructs Consumer by Config read from environment
+// variables (EnvDopplerAddr and so on). DOPPLER_ADDR and SUBSCRIPTION_ID
+// are required. CF_ACCESS_TOKEN or UAA_ADDR with credentials
+// (CF_USERNAME/CF_PASSWORD or CF_CLIENT_ID/CF_CLIENT_SECRET) is also
+// required to get access token. To set other options, use ConfigFromEnv
+// and NewConsumerContext instead.
+func NewConsumerFromEnv(ctx context.Context) (Consumer, error) {
+	config, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewConsumerContext(ctx, config)
+}
+
+// ConfigFromEnv returns Config read from environment variables. It
+// returns error if required variables are not set.
+func ConfigFromEnv() (*Config, error) {
+	return configFromEnv(os.Getenv)
+}
+
+func configFromEnv(getenv func(string) string) (*Config, error) {
+	config := &Config{
+		DopplerAddr:    getenv(EnvDopplerAddr),
+		Token:          getenv(EnvToken),
+		UaaAddr:        getenv(EnvUaaAddr),
+		Username:       getenv(EnvUsername),
+		Password:       getenv(EnvPassword),
+		ClientID:       getenv(EnvClientID),
+		ClientSecret:   getenv(EnvClientSecret),
+		SubscriptionID: getenv(EnvSubscriptionID),
+	}
+
+	if config.DopplerAddr == "" {
+		return nil, fmt.Errorf("%s must be set: %w", EnvDopplerAddr, ErrMissingDopplerAddr)
+	}
+
+	if config.SubscriptionID == "" {
+		return nil, fmt.Errorf("%s must be set: %w", EnvSubscriptionID, ErrMissingSubscriptionID)
+	}
+
+	if config.Token == "" && config.UaaAddr == "" {
+		return nil, fmt.Errorf("%s or %s must be set: %w", EnvToken, EnvUaaAddr, ErrMissingToken)
+	}
+
+	if config.Token == "" && config.Username == "" && config.ClientID == "" {
+		return nil, fmt.Errorf("%s or %s must be set with %s", EnvUsername, EnvClientID, EnvUaaAddr)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,100 @@
+package nozzle
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	cases := []struct {
+		env     map[string]string
+		success bool
+		errStr  string
+		errIs   error
+	}{
+		{
+			env: map[string]string{
+				EnvDopplerAddr:    "wss://doppler.example.com",
+				EnvUaaAddr:        "https://uaa.example.com",
+				EnvUsername:       "admin",
+				EnvPassword:       "secret",
+				EnvSubscriptionID: "go-nozzle-A",
+			},
+			success: true,
+		},
+
+		{
+			env: map[string]string{
+				EnvDopplerAddr:    "wss://doppler.example.com",
+				EnvToken:          "bearer xyz",
+				EnvSubscriptionID: "go-nozzle-A",
+			},
+			success: true,
+		},
+
+		{
+			env: map[string]string{
+				EnvSubscriptionID: "go-nozzle-A",
+			},
+			success: false,
+			errStr:  "DOPPLER_ADDR must be set: DopplerAddr must not be empty",
+			errIs:   ErrMissingDopplerAddr,
+		},
+
+		{
+			env: map[string]string{
+				EnvDopplerAddr: "wss://doppler.example.com",
+				EnvToken:       "bearer xyz",
+			},
+			success: false,
+			errStr:  "SUBSCRIPTION_ID must be set: SubscriptionID must not be empty",
+			errIs:   ErrMissingSubscriptionID,
+		},
+
+		{
+			env: map[string]string{
+				EnvDopplerAddr:    "wss://doppler.example.com",
+				EnvSubscriptionID: "go-nozzle-A",
+			},
+			success: false,
+			errStr:  "CF_ACCESS_TOKEN or UAA_ADDR must be set: Token must not be empty",
+			errIs:   ErrMissingToken,
+		},
+
+		{
+			env: map[string]string{
+				EnvDopplerAddr:    "wss://doppler.example.com",
+				EnvUaaAddr:        "https://uaa.example.com",
+				EnvSubscriptionID: "go-nozzle-A",
+			},
+			success: false,
+			errStr:  "CF_USERNAME or CF_CLIENT_ID must be set with UAA_ADDR",
+		},
+	}
+
+	for i, tc := range cases {
+		config, err := configFromEnv(func(key string) string { return tc.env[key] })
+		if tc.success {
+			if err != nil {
+				t.Fatalf("#%d err: %s", i, err)
+			}
+
+			if got, expect := config.DopplerAddr, tc.env[EnvDopplerAddr]; got != expect {
+				t.Fatalf("#%d expect %q to be eq %q", i, got, expect)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("#%d expect to be failed", i)
+		}
+
+		if got := err.Error(); got != tc.errStr {
+			t.Fatalf("#%d expect %q to be eq %q", i, got, tc.errStr)
+		}
+
+		if tc.errIs != nil && !errors.Is(err, tc.errIs) {
+			t.Fatalf("#%d expect %v to wrap %v", i, err, tc.errIs)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package nozzle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by NewConsumer (and NewRawConsumer) when required
+// fields of Config are missing. They can be checked by errors.Is.
+var (
+	// ErrMissingDopplerAddr is returned when DopplerAddr, DopplerAddrs
+	// and APIAddr are empty (or DopplerAddrs contains empty one).
+	ErrMissingDopplerAddr = errors.New("DopplerAddr must not be empty")
+
+	// ErrMissingToken is returned when Token is empty and it's not
+	// fetched from UAA.
+	ErrMissingToken = errors.New("Token must not be empty")
+
+	// ErrMissingSubscriptionID is returned when SubscriptionID is empty
+	// (and AppGUID is not set).
+	ErrMissingSubscriptionID = errors.New("SubscriptionID must not be empty")
+
+	// ErrStaleConnection is passed to Config.OnReconnect when connection
+	// is forced to reconnect by Config.StaleConnectionTimeout.
+	ErrStaleConnection = errors.New("no envelope received within StaleConnectionTimeout")
+)
+
+// ConsumeError is the error sent to Consumer.Errors() by the default
+// rawConsumer. It tells which connection the error occurred on.
+// The original error (e.g., *websocket.CloseError) can be retrieved
+// by errors.As or errors.Unwrap.
+type ConsumeError struct {
+	// Addr is doppler address of the connection.
+	Addr string
+
+	// SubscriptionID is subscription ID of the connection.
+	SubscriptionID string
+
+	// AppGUID is application GUID of the connection. It's only set
+	// when consuming app stream (Config.AppGUID).
+	AppGUID string
+
+	// Err is the original error.
+	Err error
+}
+
+// Error returns the error message with connection information.
+func (e *ConsumeError) Error() string {
+	if e.AppGUID != "" {
+		return fmt.Sprintf("doppler %s (app GUID %q): %s",
+			e.Addr, e.AppGUID, e.Err)
+	}
+
+	return fmt.Sprintf("doppler %s (subscription ID %q): %s",
+		e.Addr, e.SubscriptionID, e.Err)
+}
+
+// Unwrap returns the original error.
+func (e *ConsumeError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	// CloseReasonMessageTooBig is the reason of CloseError when doppler
+	// closed connection by CloseMessageTooBig (1009).
+	CloseReasonMessageTooBig = "CloseMessageTooBig"
+
+	// CloseReasonInternalError is the reason of CloseError when doppler
+	// closed connection by CloseInternalServerErr (1011).
+	CloseReasonInternalError = "CloseInternalServerErr"
+)
+
+// CloseError is the error sent to Consumer.Errors() by the default
+// SlowDetector when doppler closed websocket connection by the code
+// which needs operator's action other than ClosePolicyViolation.
+// The original error (e.g., *websocket.CloseError) can be retrieved
+// by errors.As or errors.Unwrap.
+type CloseError struct {
+	// Code is the websocket close code.
+	Code int
+
+	// Reason is one of CloseReasonMessageTooBig or
+	// CloseReasonInternalError.
+	Reason string
+
+	// Err is the original error.
+	Err error
+}
+
+// Error returns the message describing the reason.
+func (e *CloseError) Error() string {
+	switch e.Reason {
+	case CloseReasonMessageTooBig:
+		return fmt.Sprintf("doppler closed the connection because message is too big (%s): %s",
+			e.Reason, e.Err)
+	case CloseReasonInternalError:
+		return fmt.Sprintf("doppler closed the connection by its internal error (%s): %s",
+			e.Reason, e.Err)
+	default:
+		return fmt.Sprintf("doppler closed the connection (%s): %s", e.Reason, e.Err)
+	}
+}
+
+// Unwrap returns the original error.
+func (e *CloseError) Unwrap() error {
+	return e.Err
+}
+
+// ContextError is the error sent to Consumer.Errors() when
+// Config.ErrorContext is true. It carries the context passed to
+// StartWithContext so that values in it (e.g., trace span) can be
+// used to handle the error. The original error can be retrieved by
+// errors.As or errors.Unwrap.
+type ContextError struct {
+	// Ctx is the context passed to StartWithContext.
+	Ctx context.Context
+
+	// Err is the original error.
+	Err error
+}
+
+// Error returns the message of the original error.
+func (e *ContextError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the original error.
+func (e *ContextError) Unwrap() error {
+	return e.Err
+}
+
+// Context returns the context passed to StartWithContext.
+func (e *ContextError) Context() context.Context {
+	return e.Ctx
+}
+
+// ErrorContext returns the context attached to err by ContextError.
+// It returns false if err doesn't have it.
+func ErrorContext(err error) (context.Context, bool) {
+	var ctxErr *ContextError
+	if !errors.As(err, &ctxErr) {
+		return nil, false
+	}
+
+	return ctxErr.Ctx, true
+}
+
+// ErrorOverflowPolicy defines what to do with an error when the channel
+// returned by Consumer.Errors() is full (or nobody is receiving from it
+// if it's unbuffered).
+type ErrorOverflowPolicy int
+
+const (
+	// ErrorOverflowBlock blocks forwarding errors until the error is
+	// received. Since upstream is blocked too, consuming events may be
+	// stalled by a slow error reader. This is the default.
+	ErrorOverflowBlock ErrorOverflowPolicy = iota
+
+	// ErrorOverflowDropOldest drops the oldest error buffered in the
+	// channel to make room for the new one. If the channel is unbuffered,
+	// there is nothing to drop and the new one is dropped instead.
+	ErrorOverflowDropOldest
+
+	// ErrorOverflowDropNewest drops the new error.
+	ErrorOverflowDropNewest
+)
+
+// String returns the name of policy.
+func (p ErrorOverflowPolicy) String() string {
+	switch p {
+	case ErrorOverflowBlock:
+		return "Block"
+	case ErrorOverflowDropOldest:
+		return "DropOldest"
+	case ErrorOverflowDropNewest:
+		return "DropNewest"
+	default:
+		return fmt.Sprintf("ErrorOverflowPolicy(%d)", int(p))
+	}
+}
@@ -0,0 +1,172 @@
+package nozzle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConsumeError(t *testing.T) {
+	closeErr := &websocket.CloseError{
+		Code: websocket.ClosePolicyViolation,
+	}
+
+	var err error = &ConsumeError{
+		Addr:           "wss://doppler.cloudfoundry.net",
+		SubscriptionID: "go-nozzle-A",
+		Err:            closeErr,
+	}
+
+	expect := `doppler wss://doppler.cloudfoundry.net (subscription ID "go-nozzle-A"): ` + closeErr.Error()
+	if got := err.Error(); got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+
+	if !errors.Is(err, closeErr) {
+		t.Fatalf("expect %v to be %v", err, closeErr)
+	}
+
+	var target *websocket.CloseError
+	if !errors.As(err, &target) {
+		t.Fatalf("expect %v to be *websocket.CloseError", err)
+	}
+
+	if target.Code != websocket.ClosePolicyViolation {
+		t.Fatalf("expect %d to be eq %d", target.Code, websocket.ClosePolicyViolation)
+	}
+}
+
+func TestConsumeError_appGUID(t *testing.T) {
+	err := &ConsumeError{
+		Addr:    "wss://doppler.cloudfoundry.net",
+		AppGUID: "my-app-guid",
+		Err:     errors.New("connection refused"),
+	}
+
+	expect := `doppler wss://doppler.cloudfoundry.net (app GUID "my-app-guid"): connection refused`
+	if got := err.Error(); got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+}
+
+type testCtxKey struct{}
+
+func TestErrorContext(t *testing.T) {
+	closeErr := &websocket.CloseError{
+		Code: websocket.ClosePolicyViolation,
+	}
+
+	ctx := context.WithValue(context.Background(), testCtxKey{}, "span-A")
+	var err error = &ContextError{
+		Ctx: ctx,
+		Err: &ConsumeError{Err: closeErr},
+	}
+
+	got, ok := ErrorContext(err)
+	if !ok {
+		t.Fatalf("expect context to be attached")
+	}
+
+	if v := got.Value(testCtxKey{}); v != "span-A" {
+		t.Fatalf("expect %v to be eq %v", v, "span-A")
+	}
+
+	// Original error can still be retrieved
+	var target *websocket.CloseError
+	if !errors.As(err, &target) {
+		t.Fatalf("expect %v to be *websocket.CloseError", err)
+	}
+
+	if _, ok := ErrorContext(closeErr); ok {
+		t.Fatalf("expect context not to be attached")
+	}
+}
+
+func TestNewConsumer_missingErrors(t *testing.T) {
+	cases := []struct {
+		in     *Config
+		expect error
+	}{
+		{
+			in: &Config{
+				Token:          "xyz",
+				SubscriptionID: "A",
+			},
+			expect: ErrMissingDopplerAddr,
+		},
+
+		{
+			in: &Config{
+				DopplerAddr: "wss://doppler.cloudfoundry.net",
+				Token:       "xyz",
+			},
+			expect: ErrMissingSubscriptionID,
+		},
+
+		{
+			in: &Config{
+				DopplerAddr:    "wss://doppler.cloudfoundry.net",
+				SubscriptionID: "A",
+			},
+			expect: ErrMissingToken,
+		},
+	}
+
+	for i, tc := range cases {
+		_, err := NewConsumer(tc.in)
+		if !errors.Is(err, tc.expect) {
+			t.Fatalf("#%d expect %v to be %v", i, err, tc.expect)
+		}
+	}
+}
+
+func TestConsumer_errorOverflowPolicy(t *testing.T) {
+	cases := []struct {
+		policy ErrorOverflowPolicy
+		expect []string
+	}{
+		{ErrorOverflowDropOldest, []string{"error 3", "error 4"}},
+		{ErrorOverflowDropNewest, []string{"error 1", "error 2"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			rc := &testRawConsumer{}
+			c := &consumer{
+				rawConsumer:         rc,
+				logger:              &stdLogger{logger: defaultLogger},
+				errBufferSize:       2,
+				errorOverflowPolicy: tc.policy,
+			}
+
+			if err := c.Start(); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			defer c.Close()
+
+			// Errors are not read while sending
+			for i := 1; i <= 4; i++ {
+				rc.errCh <- fmt.Errorf("error %d", i)
+			}
+
+			deadline := time.Now().Add(1 * time.Second)
+			for c.Stats().ErrorsDropped < 2 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if got, expect := c.Stats().ErrorsDropped, int64(2); got != expect {
+				t.Fatalf("expect %d to be eq %d", got, expect)
+			}
+
+			for _, expect := range tc.expect {
+				if got := (<-c.Errors()).Error(); got != expect {
+					t.Fatalf("expect %q to be eq %q", got, expect)
+				}
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
@@ -14,11 +15,11 @@ import (
 )
 
 const (
-	EnvDopplerAddr = "DOPPLER_ADDR"
-	EnvToken       = "CF_ACCESS_TOKEN"
-	EnvUaaAddr     = "UAA_ADDR"
-	EnvUsername    = "CF_USERNAME"
-	EnvPassword    = "CF_PASSWORD"
+	EnvDopplerAddr = nozzle.EnvDopplerAddr
+	EnvToken       = nozzle.EnvToken
+	EnvUaaAddr     = nozzle.EnvUaaAddr
+	EnvUsername    = nozzle.EnvUsername
+	EnvPassword    = nozzle.EnvPassword
 )
 
 const (
@@ -49,6 +50,7 @@ func run(args []string) int {
 		UaaAddr:        os.Getenv(EnvUaaAddr),
 		Username:       os.Getenv(EnvUsername),
 		Password:       os.Getenv(EnvPassword),
+		UaaTimeout:     UAATimeout,
 		SubscriptionID: SubscriptionID,
 		Insecure:       insecure,
 		Logger:         log.New(os.Stdout, "", log.LstdFlags),
@@ -63,36 +65,21 @@ func run(args []string) int {
 	// Start consumer
 	consumer.Start()
 
-	log.Printf("[INFO] Start example producer")
-	doneCh := make(chan struct{})
-	go func() {
-		defer close(doneCh)
-		for {
-			select {
-			case event := <-consumer.Events():
-				if event.GetEventType() != events.Envelope_ValueMetric {
-					continue
-				}
-				log.Printf("[INFO] ValueMetric: %v", event.GetValueMetric())
-			case <-consumer.Detects():
-				log.Printf("[WARN] Detected SlowConsumerAlert")
-			case err := <-consumer.Errors():
-				log.Printf("[ERROR] Failed to consume nozzle events", err)
-				return
-			}
-		}
-	}()
+	// Stop running handler when interrupted or error occurred
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// Handle signaling
-	signalCh := make(chan os.Signal)
+	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, os.Interrupt, os.Kill)
 	go func() {
 		<-signalCh
 		log.Printf("[INFO] Interrupt Received")
-		close(doneCh)
+		cancel()
 	}()
 
-	<-doneCh
+	log.Printf("[INFO] Start example producer")
+	consumer.Run(ctx, &handler{cancel: cancel})
+
 	log.Printf("[INFO] nozzle: close nozzle consumer")
 	if err := consumer.Close(); err != nil {
 		log.Printf("[ERROR] nozzle: failed to close nozzle consumer: %s", err)
@@ -101,3 +88,25 @@ func run(args []string) int {
 
 	return 0
 }
+
+// handler implements nozzle.Handler. It logs ValueMetric events and
+// slowConsumerAlerts and stops on the first error.
+type handler struct {
+	cancel context.CancelFunc
+}
+
+func (h *handler) OnEvent(event *events.Envelope) {
+	if event.GetEventType() != events.Envelope_ValueMetric {
+		return
+	}
+	log.Printf("[INFO] ValueMetric: %v", event.GetValueMetric())
+}
+
+func (h *handler) OnError(err error) {
+	log.Printf("[ERROR] Failed to consume nozzle events: %s", err)
+	h.cancel()
+}
+
+func (h *handler) OnSlowAlert(alert nozzle.SlowAlert) {
+	log.Printf("[WARN] Detected SlowConsumerAlert (%s): %s", alert.Reason, alert.Err)
+}
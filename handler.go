@@ -0,0 +1,118 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Handler is the interface for handling outputs of Consumer.
+// It's used by Consumer.Run as an alternative to reading channels.
+//
+// Methods are called one by one from the goroutine calling Run, so
+// they don't need to be goroutine safe. A slow handler slows consuming.
+type Handler interface {
+	// OnEvent is called for each event from Consumer.Events().
+	// If batching is enabled, it's called for each event of batches
+	// from Consumer.BatchEvents().
+	OnEvent(event *events.Envelope)
+
+	// OnError is called for each error from Consumer.Errors().
+	OnError(err error)
+
+	// OnSlowAlert is called for each alert from Consumer.Detects().
+	OnSlowAlert(alert SlowAlert)
+}
+
+// EventContextHandler is implemented by Handler which accepts context
+// for each event. If Handler implements it, Run calls OnEventContext
+// instead of OnEvent. The context is done when Config.HandlerTimeout
+// is exceeded (or ctx passed to Run is done), so the handler can stop
+// waiting for a stuck sink.
+type EventContextHandler interface {
+	OnEventContext(ctx context.Context, event *events.Envelope)
+}
+
+// Run reads events, errors and slowConsumerAlerts and dispatches them
+// to h until ctx is canceled or Errors() is closed (i.e., consumer is
+// closed). It returns ctx.Err() if ctx is canceled, otherwise nil.
+//
+// Consumer must be started before Run. Run doesn't close consumer.
+func (c *consumer) Run(ctx context.Context, h Handler) error {
+	if ctx == nil {
+		return fmt.Errorf("context must not be nil")
+	}
+
+	if c.doneCh == nil {
+		return fmt.Errorf("consumer is not started")
+	}
+
+	eventCh, errCh, detectCh := c.Events(), c.Errors(), c.Detects()
+	batchCh := c.BatchEvents()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-eventCh:
+			if !ok {
+				// Stop selecting closed channel
+				eventCh = nil
+				continue
+			}
+			c.dispatchEvent(ctx, h, event)
+		case batch, ok := <-batchCh:
+			if !ok {
+				batchCh = nil
+				continue
+			}
+			for _, event := range batch {
+				c.dispatchEvent(ctx, h, event)
+			}
+		case alert, ok := <-detectCh:
+			if !ok {
+				detectCh = nil
+				continue
+			}
+			h.OnSlowAlert(alert)
+		case err, ok := <-errCh:
+			if !ok {
+				return nil
+			}
+			h.OnError(err)
+		}
+	}
+}
+
+// dispatchEvent passes event to h. If handlerTimeout is set, the
+// context passed to EventContextHandler has the deadline and the call
+// exceeding it is logged and counted as slow.
+func (c *consumer) dispatchEvent(ctx context.Context, h Handler, event *events.Envelope) {
+	if c.handlerTimeout <= 0 {
+		if ch, ok := h.(EventContextHandler); ok {
+			ch.OnEventContext(ctx, event)
+			return
+		}
+		h.OnEvent(event)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.handlerTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if ch, ok := h.(EventContextHandler); ok {
+		ch.OnEventContext(ctx, event)
+	} else {
+		h.OnEvent(event)
+	}
+
+	if elapsed := time.Since(start); elapsed > c.handlerTimeout {
+		c.logger.Warn("Handler exceeded HandlerTimeout",
+			"elapsed", elapsed, "timeout", c.handlerTimeout,
+			"event_type", event.GetEventType())
+		atomic.AddInt64(&c.slowHandlers, 1)
+	}
+}
@@ -0,0 +1,155 @@
+package nozzle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+type testHandler struct {
+	events []*events.Envelope
+	errs   []error
+	alerts []SlowAlert
+}
+
+func (h *testHandler) OnEvent(event *events.Envelope) {
+	h.events = append(h.events, event)
+}
+
+func (h *testHandler) OnError(err error) {
+	h.errs = append(h.errs, err)
+}
+
+func (h *testHandler) OnSlowAlert(alert SlowAlert) {
+	h.alerts = append(h.alerts, alert)
+}
+
+func TestConsumerRun(t *testing.T) {
+	t.Parallel()
+
+	rc := &testRawConsumer{}
+	sd := &testSlowDetector{}
+	c := &consumer{
+		rawConsumer:        rc,
+		customSlowDetector: sd,
+		logger:             &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	go func() {
+		rc.eventCh <- &events.Envelope{}
+		rc.errCh <- errors.New("connection lost")
+		sd.detectCh <- SlowAlert{Reason: SlowAlertReasonTruncated}
+
+		// Wait until alert is dispatched then close consumer
+		time.Sleep(100 * time.Millisecond)
+		c.Close()
+	}()
+
+	h := &testHandler{}
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- c.Run(context.Background(), h)
+	}()
+
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect Run to return after consumer is closed")
+	}
+
+	if len(h.events) != 1 || len(h.errs) != 1 || len(h.alerts) != 1 {
+		t.Fatalf("expect all outputs to be dispatched: %d events, %d errors, %d alerts",
+			len(h.events), len(h.errs), len(h.alerts))
+	}
+}
+
+func TestConsumerRun_cancel(t *testing.T) {
+	t.Parallel()
+
+	c := &consumer{
+		rawConsumer: &testRawConsumer{},
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := c.Run(ctx, &testHandler{}); err != context.Canceled {
+		t.Fatalf("expect %v to be eq %v", err, context.Canceled)
+	}
+}
+
+func TestConsumerRun_notStarted(t *testing.T) {
+	c := &consumer{
+		rawConsumer: &testRawConsumer{},
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Run(context.Background(), &testHandler{}); err == nil {
+		t.Fatalf("expect to be failed")
+	}
+}
+
+// testContextHandler blocks each event until ctx is done like a stuck sink.
+type testContextHandler struct {
+	testHandler
+	ctxErrs []error
+}
+
+func (h *testContextHandler) OnEventContext(ctx context.Context, event *events.Envelope) {
+	<-ctx.Done()
+	h.ctxErrs = append(h.ctxErrs, ctx.Err())
+}
+
+func TestConsumerRun_handlerTimeout(t *testing.T) {
+	t.Parallel()
+
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:    rc,
+		logger:         &stdLogger{logger: defaultLogger},
+		handlerTimeout: 20 * time.Millisecond,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	go func() {
+		rc.eventCh <- &events.Envelope{}
+		rc.eventCh <- &events.Envelope{}
+		c.Close()
+	}()
+
+	h := &testContextHandler{}
+	if err := c.Run(context.Background(), h); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(h.ctxErrs) == 0 || h.ctxErrs[0] != context.DeadlineExceeded {
+		t.Fatalf("expect %v to be DeadlineExceeded", h.ctxErrs)
+	}
+
+	if len(h.events) != 0 {
+		t.Fatalf("expect OnEvent not to be called")
+	}
+
+	if got := c.Stats().SlowHandlers; got != int64(len(h.ctxErrs)) {
+		t.Fatalf("expect %d to be eq %d", got, len(h.ctxErrs))
+	}
+}
@@ -0,0 +1,49 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+)
+
+// Handoff closes consumer gracefully so that a replacement instance
+// (e.g., a new one of rolling deploy) can take over the subscription.
+// Firehose has no position to resume from, so it's best-effort: consumer
+// keeps consuming for Config.DrainDelay while the replacement connects
+// with the same SubscriptionID and doppler starts sharding envelopes to
+// it, and then it closes delivering the events remaining in the pipeline.
+//
+// The phases are notified on Lifecycle() as LifecycleHandoffStarted and
+// LifecycleHandoffCompleted. If ctx is done before closing is completed,
+// it returns ctx.Err() and closing is continued in background.
+func (c *consumer) Handoff(ctx context.Context) error {
+	if ctx == nil {
+		return fmt.Errorf("context must not be nil")
+	}
+
+	if c.doneCh == nil {
+		return fmt.Errorf("consumer is not started")
+	}
+
+	c.logger.Info("Handing off subscription", "drain_delay", c.drainDelay)
+	c.emitLifecycle(LifecycleHandoffStarted)
+
+	select {
+	case <-orRealClock(c.clock).After(c.drainDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.CloseWithTimeout(drainTimeout)
+	}()
+
+	select {
+	case err := <-errCh:
+		c.logger.Info("Handed off subscription")
+		c.emitLifecycle(LifecycleHandoffCompleted)
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
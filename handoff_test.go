@@ -0,0 +1,84 @@
+package nozzle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func TestConsumerHandoff(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		drainDelay:  50 * time.Millisecond,
+	}
+
+	if err := c.Handoff(context.Background()); err == nil {
+		t.Fatalf("expect to be failed before started")
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- c.Handoff(context.Background())
+	}()
+
+	// Consuming is continued during DrainDelay
+	select {
+	case rc.eventCh <- &events.Envelope{}:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect consuming to be continued")
+	}
+
+	select {
+	case <-c.Events():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect handoff to be completed")
+	}
+
+	if rc.closed != 1 {
+		t.Fatalf("expect upstream to be closed")
+	}
+
+	for _, expect := range []LifecyclePhase{LifecycleHandoffStarted, LifecycleHandoffCompleted} {
+		if got := (<-c.Lifecycle()).Phase; got != expect {
+			t.Fatalf("expect %s to be eq %s", got, expect)
+		}
+	}
+}
+
+func TestConsumerHandoff_context(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		drainDelay:  1 * time.Hour,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := c.Handoff(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect %v to be DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,107 @@
+package nozzle
+
+import (
+	"context"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// heartbeatMarker is injected into the pipeline by forwardEvents for
+// each heartbeat. It's passed through every stage like envelopes and
+// removed by the last stage, so it's never delivered to Events().
+var heartbeatMarker = &events.Envelope{}
+
+// Heartbeat is notified on Consumer.Heartbeats() every
+// Config.HeartbeatInterval while consumer is running.
+type Heartbeat struct {
+	// Time is the time when the heartbeat reaches the end of the
+	// pipeline and is emitted.
+	Time time.Time
+
+	// LastEventTime is the time when the last envelope is delivered
+	// to Events(). It's zero time if no envelope is delivered yet.
+	LastEventTime time.Time
+
+	// ConnectionState is the state of connection with firehose.
+	ConnectionState ConnectionState
+}
+
+// runHeartbeat injects heartbeatMarker into the pipeline every
+// heartbeatInterval and emits Heartbeat when it reaches the last stage
+// until ctx is done or forwarding is stopped. Since the marker follows
+// the envelopes before it, heartbeats stop while a stage (or the reader
+// of Events()) is stuck even if firehose is quiet. A new marker is not
+// injected until the previous one arrives. Heartbeat is dropped if
+// nobody is ready to receive it not to accumulate stale ones.
+func (c *consumer) runHeartbeat(ctx context.Context) <-chan Heartbeat {
+	heartbeatCh := make(chan Heartbeat, 1)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(heartbeatCh)
+
+		clock := orRealClock(c.clock)
+		tickCh := clock.After(c.heartbeatInterval)
+
+		var inFlight bool
+		for {
+			select {
+			case <-tickCh:
+				tickCh = clock.After(c.heartbeatInterval)
+				if inFlight {
+					continue
+				}
+
+				select {
+				case c.heartbeatMarkCh <- struct{}{}:
+					inFlight = true
+				default:
+				}
+			case reached := <-c.heartbeatDoneCh:
+				inFlight = false
+				if !reached {
+					continue
+				}
+
+				hb := Heartbeat{
+					Time:            clock.Now(),
+					LastEventTime:   c.LastEventTime(),
+					ConnectionState: c.ConnectionState(),
+				}
+
+				select {
+				case heartbeatCh <- hb:
+				default:
+				}
+			case <-ctx.Done():
+				return
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return heartbeatCh
+}
+
+// heartbeatReached reports whether event is heartbeatMarker arrived at
+// stage which is the last one. Then runHeartbeat is notified and the
+// marker must not be forwarded.
+func (c *consumer) heartbeatReached(stage pipelineStage, event *events.Envelope) bool {
+	if event != heartbeatMarker || stage != c.finalStage {
+		return false
+	}
+
+	c.heartbeatDone(true)
+	return true
+}
+
+// heartbeatDone notifies runHeartbeat that the marker in the pipeline
+// reached the last stage or it's dropped (e.g., by backpressurePolicy).
+func (c *consumer) heartbeatDone(reached bool) {
+	select {
+	case c.heartbeatDoneCh <- reached:
+	default:
+	}
+}
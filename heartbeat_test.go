@@ -0,0 +1,152 @@
+package nozzle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestConsumerHeartbeats(t *testing.T) {
+	c := &consumer{
+		rawConsumer:       &testRawConsumer{},
+		logger:            &stdLogger{logger: defaultLogger},
+		heartbeatInterval: 10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := c.StartWithContext(ctx); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	select {
+	case hb := <-c.Heartbeats():
+		if hb.Time.IsZero() {
+			t.Fatalf("expect time to be set")
+		}
+
+		if !hb.LastEventTime.IsZero() {
+			t.Fatalf("expect last event time to be zero")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect heartbeat to be notified")
+	}
+
+	// Heartbeat is stopped when ctx is canceled
+	cancel()
+
+	timeout := time.After(1 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.Heartbeats():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("expect heartbeat channel to be closed")
+		}
+	}
+}
+
+func TestConsumerHeartbeats_stuck(t *testing.T) {
+	clock := newFakeClock()
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:       rc,
+		logger:            &stdLogger{logger: defaultLogger},
+		heartbeatInterval: 10 * time.Second,
+		clock:             clock,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	clock.BlockUntil(t, 1)
+	clock.Advance(10 * time.Second)
+
+	select {
+	case <-c.Heartbeats():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect heartbeat to be notified")
+	}
+
+	// Channels are unbuffered, so the first event is held by
+	// forwardEvents once the second one is sent. Since Events() is not
+	// read, the next marker is stuck behind it.
+	for i := 0; i < 2; i++ {
+		rc.eventCh <- &events.Envelope{}
+	}
+
+	clock.BlockUntil(t, 1)
+	clock.Advance(10 * time.Second)
+
+	select {
+	case <-c.Heartbeats():
+		t.Fatalf("expect heartbeat not to be notified while Events() is not read")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for i := 0; i < 2; i++ {
+		<-c.Events()
+	}
+
+	select {
+	case hb := <-c.Heartbeats():
+		if hb.LastEventTime.IsZero() {
+			t.Fatalf("expect last event time to be set")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect heartbeat to be notified after Events() is read")
+	}
+}
+
+func TestConsumerHeartbeats_stages(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:       rc,
+		logger:            &stdLogger{logger: defaultLogger},
+		heartbeatInterval: 10 * time.Millisecond,
+		reorderWindow:     1 * time.Minute,
+		batchSize:         1,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	// The marker is not held by reorderEvents and not delivered
+	// in batches.
+	select {
+	case <-c.Heartbeats():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect heartbeat to be notified")
+	}
+
+	select {
+	case batch := <-c.BatchEvents():
+		t.Fatalf("expect marker not to be delivered: %v", batch)
+	default:
+	}
+}
+
+func TestConsumerHeartbeats_disabled(t *testing.T) {
+	c := &consumer{
+		rawConsumer: &testRawConsumer{},
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	if c.Heartbeats() != nil {
+		t.Fatalf("expect heartbeat channel to be nil")
+	}
+}
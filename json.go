@@ -0,0 +1,47 @@
+package nozzle
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JSONEvents returns the read channel of envelopes marshaled to JSON
+// by the JSON tags of sonde-go (e.g., {"origin":"router",...}), so that
+// JSON-based sinks share the same shape. Envelopes which fail to be
+// marshaled are skipped and the error is sent to Errors(). Like Tee, it
+// reads Events(), so Events() must not be read by others after it's
+// called. Marshaling is only done when it's called. It must be called
+// after Start. It returns nil if Events() is nil (e.g., consumer is not
+// started or batching is enabled). The channel is closed when Events()
+// is closed.
+func (c *consumer) JSONEvents() <-chan []byte {
+	c.jsonOnce.Do(func() {
+		eventCh := c.Events()
+		if eventCh == nil {
+			return
+		}
+
+		jsonCh := make(chan []byte)
+		go func() {
+			defer close(jsonCh)
+			for event := range eventCh {
+				b, err := json.Marshal(event)
+				if err != nil {
+					c.sendHandlerError(c.startCtx,
+						fmt.Errorf("failed to marshal envelope to JSON: %w", err))
+					continue
+				}
+
+				select {
+				case jsonCh <- b:
+				case <-c.doneCh:
+					return
+				}
+			}
+		}()
+
+		c.jsonCh = jsonCh
+	})
+
+	return c.jsonCh
+}
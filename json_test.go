@@ -0,0 +1,54 @@
+package nozzle
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestConsumerJSONEvents(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	jsonCh := c.JSONEvents()
+	if jsonCh != c.JSONEvents() {
+		t.Fatalf("expect the same channel to be returned")
+	}
+
+	go func() {
+		rc.eventCh <- &events.Envelope{
+			Origin:    proto.String("router"),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			Timestamp: proto.Int64(100),
+		}
+	}()
+
+	select {
+	case b := <-jsonCh:
+		var got map[string]interface{}
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if got["origin"] != "router" {
+			t.Fatalf("expect %s to have origin", b)
+		}
+
+		if got["timestamp"] != float64(100) {
+			t.Fatalf("expect %s to have timestamp", b)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
@@ -0,0 +1,153 @@
+package nozzle
+
+import (
+	"time"
+)
+
+// lifecycleBufferSize is the buffer size of the channel returned by
+// Consumer.Lifecycle(). Events are dropped when it's full.
+const lifecycleBufferSize = 16
+
+// LifecyclePhase is the phase of connection notified on
+// Consumer.Lifecycle().
+type LifecyclePhase int
+
+const (
+	// LifecycleConnecting means consumer starts establishing the first
+	// connection.
+	LifecycleConnecting LifecyclePhase = iota
+
+	// LifecycleConnected means connection is established (including
+	// reconnection).
+	LifecycleConnected
+
+	// LifecycleTokenRefreshed means access token is refreshed and
+	// connection is re-established with it.
+	LifecycleTokenRefreshed
+
+	// LifecycleReconnecting means connection is lost and consumer is
+	// retrying.
+	LifecycleReconnecting
+
+	// LifecycleClosed means connection is closed.
+	LifecycleClosed
+
+	// LifecycleStaleReconnecting means connection is forced to reconnect
+	// because nothing is received within Config.StaleConnectionTimeout.
+	LifecycleStaleReconnecting
+
+	// LifecycleHandoffStarted means Consumer.Handoff is called and
+	// consumer is waiting Config.DrainDelay for the replacement.
+	LifecycleHandoffStarted
+
+	// LifecycleHandoffCompleted means consumer is closed by
+	// Consumer.Handoff.
+	LifecycleHandoffCompleted
+
+	// LifecycleRebalanced means the distribution of envelope origins
+	// changed suddenly within Config.RebalanceWindow, which suggests
+	// doppler rebalanced the shared subscription.
+	LifecycleRebalanced
+)
+
+// String returns the name of the phase.
+func (p LifecyclePhase) String() string {
+	switch p {
+	case LifecycleConnecting:
+		return "connecting"
+	case LifecycleConnected:
+		return "connected"
+	case LifecycleTokenRefreshed:
+		return "token refreshed"
+	case LifecycleReconnecting:
+		return "reconnecting"
+	case LifecycleClosed:
+		return "closed"
+	case LifecycleStaleReconnecting:
+		return "stale reconnecting"
+	case LifecycleHandoffStarted:
+		return "handoff started"
+	case LifecycleHandoffCompleted:
+		return "handoff completed"
+	case LifecycleRebalanced:
+		return "rebalanced"
+	default:
+		return "unknown"
+	}
+}
+
+// LifecycleEvent is notified on Consumer.Lifecycle() when the phase
+// of connection changes.
+type LifecycleEvent struct {
+	// Phase is the new phase.
+	Phase LifecyclePhase
+
+	// Time is the time when the phase changed.
+	Time time.Time
+}
+
+// lifecycleNotifier is implemented by rawConsumer which notifies
+// the phase of its connection to hook.
+type lifecycleNotifier interface {
+	setLifecycleHook(hook func(LifecyclePhase))
+}
+
+// lifecyclePhaseOf returns the phase notified when connection changes
+// to state. It returns false if it's not notified.
+func lifecyclePhaseOf(state State) (LifecyclePhase, bool) {
+	switch state {
+	case StateConnecting:
+		return LifecycleConnecting, true
+	case StateConnected:
+		return LifecycleConnected, true
+	case StateReconnecting:
+		return LifecycleReconnecting, true
+	case StateClosed:
+		return LifecycleClosed, true
+	default:
+		return 0, false
+	}
+}
+
+// Lifecycle returns the read channel of lifecycle events.
+func (c *consumer) Lifecycle() <-chan LifecycleEvent {
+	return c.lifecycleCh
+}
+
+// emitLifecycle sends the lifecycle event of phase. It's dropped if
+// the channel is full not to block connection handling.
+func (c *consumer) emitLifecycle(phase LifecyclePhase) {
+	if phase == LifecycleConnected {
+		c.markReady()
+	}
+
+	event := LifecycleEvent{
+		Phase: phase,
+		Time:  orRealClock(c.clock).Now(),
+	}
+
+	select {
+	case c.lifecycleCh <- event:
+	default:
+	}
+}
+
+// setLifecycleHook sets hook which is called when connection
+// state changes or token is refreshed.
+func (c *rawDefaultConsumer) setLifecycleHook(hook func(LifecyclePhase)) {
+	c.lifecycleHook = hook
+	c.state.onChange = func(state State) {
+		if phase, ok := lifecyclePhaseOf(state); ok {
+			hook(phase)
+		}
+	}
+}
+
+// setLifecycleHook sets hook to all rawConsumers which support it.
+func (c *multiRawConsumer) setLifecycleHook(hook func(LifecyclePhase)) {
+	for _, rc := range c.consumers {
+		if ln, ok := rc.(lifecycleNotifier); ok {
+			ln.setLifecycleHook(hook)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package nozzle
+
+import (
+	"testing"
+	"time"
+)
+
+// testLifecycleRawConsumer is testRawConsumer which keeps
+// the lifecycle hook.
+type testLifecycleRawConsumer struct {
+	testRawConsumer
+	hook func(LifecyclePhase)
+}
+
+func (c *testLifecycleRawConsumer) setLifecycleHook(hook func(LifecyclePhase)) {
+	c.hook = hook
+}
+
+func TestLifecycleNotifier_implement(t *testing.T) {
+	var _ lifecycleNotifier = &rawDefaultConsumer{}
+	var _ lifecycleNotifier = &multiRawConsumer{}
+}
+
+func TestConsumerLifecycle(t *testing.T) {
+	rc := &testLifecycleRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if c.Lifecycle() != nil {
+		t.Fatalf("expect nil before start")
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	if rc.hook == nil {
+		t.Fatalf("expect hook to be set")
+	}
+
+	phases := []LifecyclePhase{
+		LifecycleConnecting,
+		LifecycleConnected,
+		LifecycleTokenRefreshed,
+	}
+	for _, phase := range phases {
+		rc.hook(phase)
+	}
+
+	for i, expect := range phases {
+		select {
+		case event := <-c.Lifecycle():
+			if event.Phase != expect {
+				t.Fatalf("#%d expect %s to be eq %s", i, event.Phase, expect)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("#%d expect not timeout", i)
+		}
+	}
+}
+
+func TestConnectionState_onChange(t *testing.T) {
+	var got []State
+	s := &connectionState{
+		onChange: func(state State) { got = append(got, state) },
+	}
+
+	s.set(StateConnecting)
+	s.set(StateConnected)
+
+	// Same state is not notified again
+	s.set(StateConnected)
+	s.reconnect()
+	s.reconnect()
+
+	expect := []State{StateConnecting, StateConnected, StateReconnecting}
+	if len(got) != len(expect) {
+		t.Fatalf("expect %v to be eq %v", got, expect)
+	}
+
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Fatalf("#%d expect %s to be eq %s", i, got[i], expect[i])
+		}
+	}
+}
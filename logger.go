@@ -0,0 +1,218 @@
+package nozzle
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// LogLevel is the minimum level of log messages written to Config.Logger.
+type LogLevel int
+
+const (
+	// LogLevelDebug writes all messages. This is the default.
+	LogLevelDebug LogLevel = iota
+
+	// LogLevelInfo writes INFO, WARN and ERROR messages.
+	LogLevelInfo
+
+	// LogLevelWarn writes WARN and ERROR messages.
+	LogLevelWarn
+
+	// LogLevelError writes only ERROR messages.
+	LogLevelError
+)
+
+// String returns the name of level.
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarn:
+		return "WARN"
+	case LogLevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+}
+
+// StructuredLogger is the logger set to Config.SlogLogger. Log messages
+// are passed with key-value pairs (e.g., "subscription_id", id) as
+// fields. *slog.Logger (Go 1.21 or later) implements it, so it can be
+// set without this package depending on log/slog.
+type StructuredLogger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// leveledLogger is the logger used inside this package.
+type leveledLogger interface {
+	StructuredLogger
+}
+
+// stdLogger implements leveledLogger by *log.Logger. It writes a line
+// like `[INFO] message key=value` same as previous versions.
+type stdLogger struct {
+	logger *log.Logger
+
+	// level is the minimum level to write.
+	level LogLevel
+}
+
+// Debug writes msg with DEBUG level.
+func (l *stdLogger) Debug(msg string, args ...interface{}) {
+	l.print(LogLevelDebug, msg, args)
+}
+
+// Info writes msg with INFO level.
+func (l *stdLogger) Info(msg string, args ...interface{}) {
+	l.print(LogLevelInfo, msg, args)
+}
+
+// Warn writes msg with WARN level.
+func (l *stdLogger) Warn(msg string, args ...interface{}) {
+	l.print(LogLevelWarn, msg, args)
+}
+
+// Error writes msg with ERROR level.
+func (l *stdLogger) Error(msg string, args ...interface{}) {
+	l.print(LogLevelError, msg, args)
+}
+
+func (l *stdLogger) print(level LogLevel, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s", level, msg)
+	for i := 0; i < len(args); i += 2 {
+		// Key without value is written as it is
+		if i+1 >= len(args) {
+			fmt.Fprintf(&b, " %v", args[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+
+	l.logger.Println(b.String())
+}
+
+// fieldsLogger adds fields to every message written to logger.
+type fieldsLogger struct {
+	logger leveledLogger
+	fields []interface{}
+}
+
+// Debug writes msg with DEBUG level.
+func (l *fieldsLogger) Debug(msg string, args ...interface{}) {
+	l.logger.Debug(msg, l.with(args)...)
+}
+
+// Info writes msg with INFO level.
+func (l *fieldsLogger) Info(msg string, args ...interface{}) {
+	l.logger.Info(msg, l.with(args)...)
+}
+
+// Warn writes msg with WARN level.
+func (l *fieldsLogger) Warn(msg string, args ...interface{}) {
+	l.logger.Warn(msg, l.with(args)...)
+}
+
+// Error writes msg with ERROR level.
+func (l *fieldsLogger) Error(msg string, args ...interface{}) {
+	l.logger.Error(msg, l.with(args)...)
+}
+
+func (l *fieldsLogger) with(args []interface{}) []interface{} {
+	return append(append(make([]interface{}, 0, len(l.fields)+len(args)), l.fields...), args...)
+}
+
+// prefixLogger prepends prefix to every message written to logger.
+type prefixLogger struct {
+	logger leveledLogger
+	prefix string
+}
+
+// Debug writes msg with DEBUG level.
+func (l *prefixLogger) Debug(msg string, args ...interface{}) {
+	l.logger.Debug(l.prefix+msg, args...)
+}
+
+// Info writes msg with INFO level.
+func (l *prefixLogger) Info(msg string, args ...interface{}) {
+	l.logger.Info(l.prefix+msg, args...)
+}
+
+// Warn writes msg with WARN level.
+func (l *prefixLogger) Warn(msg string, args ...interface{}) {
+	l.logger.Warn(l.prefix+msg, args...)
+}
+
+// Error writes msg with ERROR level.
+func (l *prefixLogger) Error(msg string, args ...interface{}) {
+	l.logger.Error(l.prefix+msg, args...)
+}
+
+// newLogger returns leveledLogger by config. SlogLogger takes
+// precedence over Logger. LogLevel is only applied to Logger.
+// Messages are tagged with InstanceIndex and prefixed with LoggerPrefix
+// if they're set.
+func newLogger(config *Config) leveledLogger {
+	var logger leveledLogger
+	switch {
+	case config.SlogLogger != nil:
+		logger = config.SlogLogger
+	case config.Logger == nil:
+		logger = &stdLogger{logger: defaultLogger, level: config.LogLevel}
+	default:
+		logger = &stdLogger{logger: config.Logger, level: config.LogLevel}
+	}
+
+	if config.InstanceIndex > 0 {
+		logger = &fieldsLogger{
+			logger: logger,
+			fields: []interface{}{"instance_index", config.InstanceIndex},
+		}
+	}
+
+	if config.LoggerPrefix != "" {
+		logger = &prefixLogger{
+			logger: logger,
+			prefix: config.LoggerPrefix + " ",
+		}
+	}
+
+	return logger
+}
+
+// newStdLogger returns *log.Logger by config for libraries which
+// only accept it. If SlogLogger is set, lines are written to it with
+// INFO level.
+func newStdLogger(config *Config) *log.Logger {
+	if config.SlogLogger != nil {
+		return log.New(&structuredWriter{logger: config.SlogLogger}, "", 0)
+	}
+
+	if config.Logger == nil {
+		return defaultLogger
+	}
+
+	return config.Logger
+}
+
+// structuredWriter writes each line written by *log.Logger to logger
+// as an INFO message.
+type structuredWriter struct {
+	logger StructuredLogger
+}
+
+func (w *structuredWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
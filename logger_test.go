@@ -0,0 +1,133 @@
+package nozzle
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestStdLogger(t *testing.T) {
+	cases := []struct {
+		fn     func(l leveledLogger)
+		expect string
+	}{
+		{
+			fn: func(l leveledLogger) {
+				l.Info("Start consuming", "subscription_id", "A")
+			},
+			expect: "[INFO] Start consuming subscription_id=A\n",
+		},
+
+		{
+			fn: func(l leveledLogger) {
+				l.Warn("Failed to close", "error", "closed", "count", 2)
+			},
+			expect: "[WARN] Failed to close error=closed count=2\n",
+		},
+
+		{
+			fn: func(l leveledLogger) {
+				l.Debug("Key without value", "orphan")
+			},
+			expect: "[DEBUG] Key without value orphan\n",
+		},
+	}
+
+	for i, tc := range cases {
+		var buf bytes.Buffer
+		tc.fn(&stdLogger{logger: log.New(&buf, "", 0)})
+
+		if got := buf.String(); got != tc.expect {
+			t.Fatalf("#%d expects %q to be eq %q", i, got, tc.expect)
+		}
+	}
+}
+
+func TestStdLogger_level(t *testing.T) {
+	var buf bytes.Buffer
+	l := &stdLogger{logger: log.New(&buf, "", 0), level: LogLevelWarn}
+
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error")
+
+	expect := "[WARN] warn\n[ERROR] error\n"
+	if got := buf.String(); got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+}
+
+// testStructuredLogger implements StructuredLogger by writing
+// messages to stdLogger.
+type testStructuredLogger struct {
+	stdLogger
+}
+
+func TestNewLogger(t *testing.T) {
+	var stdBuf, slogBuf bytes.Buffer
+	config := &Config{
+		Logger: log.New(&stdBuf, "", 0),
+		SlogLogger: &testStructuredLogger{
+			stdLogger{logger: log.New(&slogBuf, "", 0)},
+		},
+	}
+
+	// SlogLogger takes precedence over Logger
+	newLogger(config).Info("Start consuming", "subscription_id", "A")
+
+	if stdBuf.Len() != 0 {
+		t.Fatalf("expect Logger not to be used: %q", stdBuf.String())
+	}
+
+	if !strings.Contains(slogBuf.String(), "subscription_id=A") {
+		t.Fatalf("expect %q to contain subscription_id field", slogBuf.String())
+	}
+}
+
+func TestNewStdLogger_slogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	config := &Config{
+		SlogLogger: &testStructuredLogger{
+			stdLogger{logger: log.New(&buf, "", 0)},
+		},
+	}
+
+	newStdLogger(config).Println("stream closed")
+
+	expect := "[INFO] stream closed\n"
+	if got := buf.String(); got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+}
+
+func TestNewLogger_instanceIndex(t *testing.T) {
+	var buf bytes.Buffer
+	config := &Config{
+		Logger:        log.New(&buf, "", 0),
+		InstanceIndex: 2,
+	}
+
+	newLogger(config).Info("Start consuming", "subscription_id", "A")
+
+	expect := "[INFO] Start consuming instance_index=2 subscription_id=A\n"
+	if got := buf.String(); got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+}
+
+func TestNewLogger_prefix(t *testing.T) {
+	var buf bytes.Buffer
+	config := &Config{
+		Logger:       log.New(&buf, "", 0),
+		LoggerPrefix: "[tenant-a]",
+	}
+
+	newLogger(config).Info("Start consuming", "subscription_id", "A")
+
+	expect := "[INFO] [tenant-a] Start consuming subscription_id=A\n"
+	if got := buf.String(); got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+}
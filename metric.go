@@ -0,0 +1,110 @@
+package nozzle
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Metric is a ValueMetric or CounterEvent envelope decoded as a flat
+// struct.
+type Metric struct {
+	// Name is the name of the metric.
+	Name string
+
+	// Value is the value of ValueMetric or the total of CounterEvent.
+	Value float64
+
+	// Unit is the unit of ValueMetric. It's empty for CounterEvent.
+	Unit string
+
+	// Origin is the origin of the envelope.
+	Origin string
+
+	// Tags are the tags of the envelope. Deployment, job, index and ip
+	// of the envelope are also included as "deployment", "job", "index"
+	// and "ip" unless the envelope has the same tags.
+	Tags map[string]string
+
+	// Time is the timestamp of the envelope.
+	Time time.Time
+}
+
+// MetricFromEnvelope decodes e as Metric. It returns false if e is
+// neither ValueMetric nor CounterEvent.
+func MetricFromEnvelope(e *events.Envelope) (Metric, bool) {
+	var m Metric
+	switch e.GetEventType() {
+	case events.Envelope_ValueMetric:
+		vm := e.GetValueMetric()
+		if vm == nil {
+			return Metric{}, false
+		}
+		m.Name, m.Value, m.Unit = vm.GetName(), vm.GetValue(), vm.GetUnit()
+	case events.Envelope_CounterEvent:
+		ce := e.GetCounterEvent()
+		if ce == nil {
+			return Metric{}, false
+		}
+		m.Name, m.Value = ce.GetName(), float64(ce.GetTotal())
+	default:
+		return Metric{}, false
+	}
+
+	m.Origin = e.GetOrigin()
+	m.Time = time.Unix(0, e.GetTimestamp())
+
+	m.Tags = make(map[string]string, len(e.GetTags())+4)
+	for _, kv := range [][2]string{
+		{"deployment", e.GetDeployment()},
+		{"job", e.GetJob()},
+		{"index", e.GetIndex()},
+		{"ip", e.GetIp()},
+	} {
+		if kv[1] != "" {
+			m.Tags[kv[0]] = kv[1]
+		}
+	}
+
+	for k, v := range e.GetTags() {
+		m.Tags[k] = v
+	}
+
+	return m, true
+}
+
+// Metrics returns the read channel of ValueMetric and CounterEvent
+// envelopes decoded as Metric. Other envelopes are skipped. Like Tee,
+// it reads Events(), so Events() must not be read by others after it's
+// called. It must be called after Start. It returns nil if Events() is
+// nil (e.g., consumer is not started or batching is enabled). The
+// channel is closed when Events() is closed.
+func (c *consumer) Metrics() <-chan Metric {
+	c.metricOnce.Do(func() {
+		eventCh := c.Events()
+		if eventCh == nil {
+			return
+		}
+
+		metricCh := make(chan Metric)
+		go func() {
+			defer close(metricCh)
+			for event := range eventCh {
+				m, ok := MetricFromEnvelope(event)
+				if !ok {
+					continue
+				}
+
+				select {
+				case metricCh <- m:
+				case <-c.doneCh:
+					return
+				}
+			}
+		}()
+
+		c.metricCh = metricCh
+	})
+
+	return c.metricCh
+}
@@ -0,0 +1,141 @@
+package nozzle
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestMetricFromEnvelope(t *testing.T) {
+	ts := time.Unix(1500000000, 0)
+	cases := []struct {
+		in     *events.Envelope
+		ok     bool
+		expect Metric
+	}{
+		{
+			in: &events.Envelope{
+				Origin:     proto.String("rep"),
+				EventType:  events.Envelope_ValueMetric.Enum(),
+				Timestamp:  proto.Int64(ts.UnixNano()),
+				Deployment: proto.String("cf"),
+				Job:        proto.String("diego-cell"),
+				Tags:       map[string]string{"job": "cell", "zone": "z1"},
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("CapacityRemainingMemory"),
+					Value: proto.Float64(1024),
+					Unit:  proto.String("MiB"),
+				},
+			},
+			ok: true,
+			expect: Metric{
+				Name:   "CapacityRemainingMemory",
+				Value:  1024,
+				Unit:   "MiB",
+				Origin: "rep",
+				Tags:   map[string]string{"deployment": "cf", "job": "cell", "zone": "z1"},
+				Time:   ts,
+			},
+		},
+
+		{
+			in: &events.Envelope{
+				Origin:    proto.String("gorouter"),
+				EventType: events.Envelope_CounterEvent.Enum(),
+				Timestamp: proto.Int64(ts.UnixNano()),
+				CounterEvent: &events.CounterEvent{
+					Name:  proto.String("total_requests"),
+					Delta: proto.Uint64(1),
+					Total: proto.Uint64(42),
+				},
+			},
+			ok: true,
+			expect: Metric{
+				Name:   "total_requests",
+				Value:  42,
+				Origin: "gorouter",
+				Tags:   map[string]string{},
+				Time:   ts,
+			},
+		},
+
+		{
+			in: &events.Envelope{
+				EventType: events.Envelope_LogMessage.Enum(),
+			},
+			ok: false,
+		},
+	}
+
+	for i, tc := range cases {
+		got, ok := MetricFromEnvelope(tc.in)
+		if ok != tc.ok {
+			t.Fatalf("#%d expect %v to be eq %v", i, ok, tc.ok)
+		}
+
+		if !ok {
+			continue
+		}
+
+		if got.Time.UnixNano() != tc.expect.Time.UnixNano() {
+			t.Fatalf("#%d expect %s to be eq %s", i, got.Time, tc.expect.Time)
+		}
+		got.Time = tc.expect.Time
+
+		if !reflect.DeepEqual(got, tc.expect) {
+			t.Fatalf("#%d expect %#v to be eq %#v", i, got, tc.expect)
+		}
+	}
+}
+
+func TestConsumerMetrics(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if c.Metrics() != nil {
+		t.Fatalf("expect Metrics() to be nil before started")
+	}
+
+	// Start a new one since the result of Metrics() is kept
+	c = &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	metricCh := c.Metrics()
+	if metricCh != c.Metrics() {
+		t.Fatalf("expect the same channel to be returned")
+	}
+
+	go func() {
+		rc.eventCh <- &events.Envelope{
+			EventType: events.Envelope_LogMessage.Enum(),
+		}
+		rc.eventCh <- &events.Envelope{
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name: proto.String("numCPUS"),
+			},
+		}
+	}()
+
+	select {
+	case m := <-metricCh:
+		if got, expect := m.Name, "numCPUS"; got != expect {
+			t.Fatalf("expect %q to be eq %q", got, expect)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
@@ -0,0 +1,80 @@
+package nozzle
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// metricsNamespace is the namespace of prometheus metrics
+	// exported by consumer.
+	metricsNamespace = "nozzle"
+)
+
+// metrics holds prometheus counters which are incremented in
+// consumer pipeline. It's only constructed when Config.MetricsRegisterer
+// is set.
+type metrics struct {
+	envelopes  *prometheus.CounterVec
+	errors     prometheus.Counter
+	slowAlerts prometheus.Counter
+	reconnects prometheus.CounterFunc
+
+	// rateLimited is only incremented with RateLimitDrop.
+	rateLimited prometheus.Counter
+}
+
+// newMetrics constructs metrics and registers them to reg. reconnects is
+// called when the reconnect counter is collected.
+func newMetrics(reg prometheus.Registerer, reconnects func() float64) (*metrics, error) {
+	m := &metrics{
+		envelopes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "envelopes_total",
+			Help:      "Total number of envelopes consumed from firehose.",
+		}, []string{"event_type"}),
+
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "errors_total",
+			Help:      "Total number of errors occurred while consuming.",
+		}),
+
+		slowAlerts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "slow_consumer_alerts_total",
+			Help:      "Total number of slowConsumerAlerts detected.",
+		}),
+
+		reconnects: prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reconnects_total",
+			Help:      "Total number of reconnect attempts to firehose.",
+		}, reconnects),
+
+		rateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rate_limited_envelopes_total",
+			Help:      "Total number of envelopes dropped by rate limit.",
+		}),
+	}
+
+	collectors := []prometheus.Collector{
+		m.envelopes, m.errors, m.slowAlerts, m.reconnects, m.rateLimited,
+	}
+
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register metrics: %s", err)
+		}
+	}
+
+	return m, nil
+}
+
+// incEnvelope increments the envelopes counter of the event type.
+func (m *metrics) incEnvelope(event *events.Envelope) {
+	m.envelopes.WithLabelValues(event.GetEventType().String()).Inc()
+}
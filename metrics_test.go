@@ -0,0 +1,77 @@
+package nozzle
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewMetrics_duplicate(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reconnects := func() float64 { return 0 }
+
+	if _, err := newMetrics(reg, reconnects); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	_, err := newMetrics(reg, reconnects)
+	if err == nil {
+		t.Fatalf("expect to be failed")
+	}
+
+	expect := "failed to register metrics"
+	if !strings.Contains(err.Error(), expect) {
+		t.Fatalf("expects error message %q to contain %q", err.Error(), expect)
+	}
+}
+
+func TestConsumer_metrics(t *testing.T) {
+	t.Parallel()
+
+	m, err := newMetrics(prometheus.NewRegistry(), func() float64 { return 0 })
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		metrics:     m,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		rc.eventCh <- &events.Envelope{
+			EventType: events.Envelope_ValueMetric.Enum(),
+		}
+		rc.errCh <- errors.New("connection lost")
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-c.Events():
+		case <-c.Errors():
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect not timeout")
+		}
+	}
+
+	got := testutil.ToFloat64(m.envelopes.WithLabelValues("ValueMetric"))
+	if got != 1 {
+		t.Fatalf("expect %v to be eq %v", got, 1)
+	}
+
+	if got := testutil.ToFloat64(m.errors); got != 1 {
+		t.Fatalf("expect %v to be eq %v", got, 1)
+	}
+}
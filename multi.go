@@ -0,0 +1,145 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// multiRawConsumer implements rawConsumer. It consumes events from
+// multiple rawConsumers (e.g., one for each subscription ID) and fans
+// them in to a single pair of channels.
+type multiRawConsumer struct {
+	consumers []RawConsumer
+
+	// doneCh is closed by Close to stop forwarding.
+	doneCh chan struct{}
+}
+
+// Consume starts consuming events by all rawConsumers. The returned
+// channels are closed after all channels of rawConsumers are closed.
+func (c *multiRawConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
+	return c.ConsumeContext(context.Background())
+}
+
+// ConsumeContext is same as Consume but ctx is passed to all rawConsumers.
+func (c *multiRawConsumer) ConsumeContext(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
+	eventCh, errCh := make(chan *events.Envelope), make(chan error)
+	c.doneCh = make(chan struct{})
+
+	var wg sync.WaitGroup
+	for _, rc := range c.consumers {
+		rcEventCh, rcErrCh := rc.ConsumeContext(ctx)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for event := range rcEventCh {
+				select {
+				case eventCh <- event:
+				case <-c.doneCh:
+					return
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for err := range rcErrCh {
+				select {
+				case errCh <- err:
+				case <-c.doneCh:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(eventCh)
+		close(errCh)
+	}()
+
+	return eventCh, errCh
+}
+
+// Close closes all rawConsumers. All of them are closed even if some
+// return error. In that case, the first error is returned.
+func (c *multiRawConsumer) Close() error {
+	if c.doneCh == nil {
+		return fmt.Errorf("no connection with firehose")
+	}
+
+	select {
+	case <-c.doneCh:
+	default:
+		close(c.doneCh)
+	}
+
+	var err error
+	for _, rc := range c.consumers {
+		if cerr := rc.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// refreshToken passes the refreshed token to all rawConsumers which
+// support reconnecting with new token.
+func (c *multiRawConsumer) refreshToken(token string) {
+	for _, rc := range c.consumers {
+		if tr, ok := rc.(tokenReceiver); ok {
+			tr.refreshToken(token)
+		}
+	}
+}
+
+// sendError sends err to the first rawConsumer which supports it.
+// Since events of all rawConsumers are fanned in, it's delivered to
+// same error channel.
+func (c *multiRawConsumer) sendError(err error) {
+	for _, rc := range c.consumers {
+		if tr, ok := rc.(tokenReceiver); ok {
+			tr.sendError(err)
+			return
+		}
+	}
+}
+
+// connectionState returns the aggregated connection state. Reconnects,
+// Failovers and StaleReconnects are the sum of all rawConsumers. State is StateConnected only when all
+// of them are connected. Otherwise, it's the first state which is not
+// StateConnected. If no rawConsumer tracks its state, it's StateIdle.
+func (c *multiRawConsumer) connectionState() ConnectionState {
+	var cs ConnectionState
+	reported := false
+	for _, rc := range c.consumers {
+		sr, ok := rc.(stateReporter)
+		if !ok {
+			continue
+		}
+
+		s := sr.connectionState()
+		cs.Reconnects += s.Reconnects
+		cs.Failovers += s.Failovers
+		cs.StaleReconnects += s.StaleReconnects
+		if !reported || cs.State == StateConnected {
+			cs.State = s.State
+		}
+		reported = true
+	}
+
+	return cs
+}
+
+// newMultiRawConsumer constructs new multiRawConsumer.
+func newMultiRawConsumer(consumers []RawConsumer) *multiRawConsumer {
+	return &multiRawConsumer{
+		consumers: consumers,
+	}
+}
@@ -0,0 +1,118 @@
+package nozzle
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+type testStateConsumer struct {
+	testRawConsumer
+	state ConnectionState
+}
+
+func (c *testStateConsumer) connectionState() ConnectionState {
+	return c.state
+}
+
+func TestMultiRawConsumer(t *testing.T) {
+	rc1, rc2 := &testRawConsumer{}, &testRawConsumer{}
+	mrc := newMultiRawConsumer([]RawConsumer{rc1, rc2})
+
+	eventCh, errCh := mrc.Consume()
+
+	origins := map[string]bool{}
+	go func() {
+		rc1.eventCh <- &events.Envelope{Origin: proto.String("A")}
+		rc2.eventCh <- &events.Envelope{Origin: proto.String("B")}
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-eventCh:
+			origins[event.GetOrigin()] = true
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect event to be fanned in")
+		}
+	}
+
+	if !origins["A"] || !origins["B"] {
+		t.Fatalf("expect events from all consumers: %v", origins)
+	}
+
+	go func() {
+		rc2.errCh <- fmt.Errorf("error from B")
+	}()
+
+	select {
+	case err := <-errCh:
+		if got, want := err.Error(), "error from B"; got != want {
+			t.Fatalf("expect %q to be eq %q", got, want)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect error to be fanned in")
+	}
+
+	if err := mrc.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if rc1.closed != 1 || rc2.closed != 1 {
+		t.Fatalf("expect all consumers to be closed once: %d, %d", rc1.closed, rc2.closed)
+	}
+
+	select {
+	case _, ok := <-eventCh:
+		if ok {
+			t.Fatalf("expect eventCh to be closed")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect eventCh to be closed")
+	}
+}
+
+func TestMultiRawConsumer_closeWithoutConsume(t *testing.T) {
+	mrc := newMultiRawConsumer([]RawConsumer{&testRawConsumer{}})
+	if err := mrc.Close(); err == nil {
+		t.Fatalf("expect to fail")
+	}
+}
+
+func TestMultiRawConsumer_connectionState(t *testing.T) {
+	cases := []struct {
+		consumers []RawConsumer
+		expect    ConnectionState
+	}{
+		{
+			consumers: []RawConsumer{&testRawConsumer{}},
+			expect:    ConnectionState{},
+		},
+
+		{
+			consumers: []RawConsumer{
+				&testStateConsumer{state: ConnectionState{State: StateConnected, Reconnects: 1}},
+				&testStateConsumer{state: ConnectionState{State: StateConnected, Reconnects: 2}},
+			},
+			expect: ConnectionState{State: StateConnected, Reconnects: 3},
+		},
+
+		{
+			consumers: []RawConsumer{
+				&testStateConsumer{state: ConnectionState{State: StateConnected}},
+				&testStateConsumer{state: ConnectionState{State: StateReconnecting, Reconnects: 1}},
+				&testStateConsumer{state: ConnectionState{State: StateConnecting}},
+			},
+			expect: ConnectionState{State: StateReconnecting, Reconnects: 1},
+		},
+	}
+
+	for i, tc := range cases {
+		got := newMultiRawConsumer(tc.consumers).connectionState()
+		if got != tc.expect {
+			t.Fatalf("#%d expect %v to be eq %v", i, got, tc.expect)
+		}
+	}
+}
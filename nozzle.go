@@ -13,12 +13,39 @@
 package nozzle
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/cloudfoundry/noaa"
+	noaaConsumer "github.com/cloudfoundry/noaa/consumer"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Version is the version of go-nozzle. It's used in the default
+// User-Agent sent to doppler.
+const Version = "0.1.0"
+
+// defaultHealthStaleThreshold is used when Config.HealthStaleThreshold
+// is not set.
+const defaultHealthStaleThreshold = 1 * time.Minute
+
+// defaultMinTLSVersion is used when Config.MinTLSVersion is not set.
+const defaultMinTLSVersion = tls.VersionTLS12
+
+const (
+	// minUAARetryBackoff and maxUAARetryBackoff are the bounds of
+	// backoff to retry fetching token for Config.UAARetryLimit.
+	minUAARetryBackoff = 1 * time.Second
+	maxUAARetryBackoff = 30 * time.Second
 )
 
 // By default, all logs goes to ioutil.Discard.
@@ -30,30 +57,91 @@ var defaultLogger = log.New(ioutil.Discard, "", log.LstdFlags)
 type Config struct {
 	// DopplerAddr is a doppler firehose endpoint address to connect.
 	// The address should start with 'wss://' (websocket endopint).
+	// If it's empty, it's discovered from APIAddr.
 	DopplerAddr string
 
+	// DopplerAddrs are doppler addresses to fail over. Consumer connects
+	// to them in order and switches to the next one when connection
+	// fails after noaa retries. When all of them fail, it wraps around
+	// to the first one with ReconnectBackoff (if it's nil, consumer stops
+	// reconnecting). If DopplerAddr is also set, it's tried first.
+	DopplerAddrs []string
+
+	// APIAddr is CF API endpoint address (e.g., "https://api.example.com").
+	// When DopplerAddr and DopplerAddrs are empty, the doppler address is
+	// discovered from /v2/info (or the v3 root) of it while constructing
+	// consumer (or Probe) and DopplerAddr is updated. TLSConfig and
+	// Proxy are also used for it. Either DopplerAddr(s) or APIAddr is
+	// required unless UseRLP is true.
+	APIAddr string
+
 	// Token is an access token to connect to firehose. It's neccesary
 	// to consume logs from doppler.
 	//
 	// If it's empty, the token is feched from UAA server.
 	// To fetch token from UAA server, UaaAddr and Username/Password
-	// for CF admin need to be set.
+	// for CF admin (or ClientID/ClientSecret) need to be set. The token fetched from UAA server
+	// is refreshed in background before it expires and the firehose
+	// connection is re-established with the new token.
+	//
+	// If it's set with the credentials above (or TokenProvider), it's used
+	// for the first connection without fetching and refreshed by the
+	// credentials. Its lifetime is read from the exp claim of the token
+	// (JWT). If it's not JWT, it's not refreshed in background but noaa
+	// still fetches new one when reconnection is unauthorized. If it's
+	// already expired, new one is fetched while constructing.
 	Token string
 
 	// SubscriptionID is unique id for a pool of clients of firehose.
 	// For each SubscriptionID, all data will be distributed evenly
-	// among that subscriber's client pool.
+	// among that subscriber's client pool. It must match
+	// SubscriptionIDPattern and not be longer than MaxSubscriptionIDLength.
 	SubscriptionID string
 
+	// SubscriptionIDs is the list of subscription IDs to consume
+	// in addition to SubscriptionID. A firehose connection is established
+	// for each of them and their events are fanned in to Consumer.Events().
+	// Closing the consumer closes all connections.
+	SubscriptionIDs []string
+
+	// AppGUID is GUID of the application to consume its stream instead
+	// of the firehose (all applications). Slow consumer detection and
+	// filtering work same as firehose. App stream is not shared with
+	// other clients, so SubscriptionID(s) must be empty when it's set.
+	// It can not be used with UseRLP.
+	AppGUID string
+
+	// TokenProvider provides access token instead of the built-in UAA flow.
+	// It's used when Token is empty (or to refresh Token) and takes
+	// precedence over UaaAddr.
+	// It's called again when reconnection needs a fresh token.
+	TokenProvider TokenProvider
+
 	// UaaAddr is UAA endpoint address. This is used for fetching access
 	// token if Token is empty. To get token you also need to set
 	// Username/Password for CloudFoundry admin.
 	UaaAddr string
 
+	// UAAHTTPClient is the HTTP client to request token to UaaAddr, e.g.,
+	// to trust internal CAs or use a proxy. By default, it's nil and a
+	// client which only skips verification by Insecure and enforces
+	// MinTLSVersion is used. It's not used for doppler, so it can only
+	// be used with UaaAddr and not with TokenProvider or UseRLP.
+	UAAHTTPClient *http.Client
+
 	// UaaTimeout is timeout to wait after sending request to uaa server.
-	// The default value is 30 seconds.
+	// It's applied in addition to the context passed to NewConsumerContext.
+	// If it's 0, only the deadline of the context is used, or 30 seconds
+	// if the context has no deadline (e.g., NewConsumer).
 	UaaTimeout time.Duration
 
+	// UAARetryLimit is the maximum number of attempts to fetch token
+	// from UAA (or TokenProvider) while constructing consumer. Attempts
+	// are retried with exponential backoff until the deadline of the
+	// context passed to NewConsumerContext. If it's 0 or 1, token is
+	// fetched only once.
+	UAARetryLimit int
+
 	// Username is admin username of CloudFoundry. This is used for fetching
 	// access token if Token is empty.
 	Username string
@@ -62,6 +150,14 @@ type Config struct {
 	// access token if Token is empty.
 	Password string
 
+	// ClientID and ClientSecret are UAA client credentials for unattended
+	// nozzle (service account). They're used for fetching access token by
+	// client credentials grant if Token is empty. Username/Password are
+	// sent to UAA in the same way, so these are clearer names for the
+	// same credentials. They can not be used with Username/Password.
+	ClientID     string
+	ClientSecret string
+
 	// Insecure is used for skipping verifying insecure connection with doppler
 	// and UAA. Default value is false, not skipping.
 	//
@@ -69,18 +165,482 @@ type Config struct {
 	// We strongly recommend not to set true instead of testing purpose.
 	Insecure bool
 
+	// TLSConfig is TLS configuration for connection with doppler (or RLP).
+	// Use it to provide custom RootCAs or client certificates.
+	//
+	// If it's nil, a config which only sets InsecureSkipVerify by Insecure
+	// is used. If both are set, TLSConfig is used as it is except
+	// InsecureSkipVerify is set to true when Insecure is true. Insecure
+	// false never overrides InsecureSkipVerify of TLSConfig.
+	// TLSConfig is not used for UAA.
+	TLSConfig *tls.Config
+
+	// MinTLSVersion is the minimum TLS version (e.g., tls.VersionTLS13)
+	// negotiated with doppler (or RLP), UAA and APIAddr. By default,
+	// it's tls.VersionTLS12. It overrides MinVersion of TLSConfig if
+	// it's set, otherwise MinVersion of TLSConfig is respected. It's not
+	// applied to UAAHTTPClient and NoaaConsumer.
+	MinTLSVersion uint16
+
+	// Proxy returns the proxy (HTTP or SOCKS5) to use for connection
+	// with doppler, e.g., http.ProxyFromEnvironment. If it's nil, no
+	// proxy is used. It's not applied to NoaaConsumer and UseRLP.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// ConsumerName identifies this nozzle to doppler. It's sent as
+	// User-Agent of the websocket handshake so that operators can
+	// attribute firehose load to nozzle applications in doppler logs.
+	// By default, "go-nozzle/<Version>" is sent. It's not applied to
+	// NoaaConsumer and UseRLP.
+	//
+	// Since noaa has no API to set handshake headers, it's set by the
+	// proxy hook of the websocket dialer. It relies on the current
+	// behavior of gorilla/websocket which is not documented.
+	ConsumerName string
+
+	// IdleTimeout is the read deadline of websocket connection with
+	// doppler. If no message is received within it, noaa closes the
+	// connection, the timeout error is sent to Consumer.Errors() and
+	// noaa reconnects (ReconnectBackoff is used after its retries are
+	// exhausted). It detects half-open connections. By default, it's 0
+	// and noaa default is used. It's not used with UseRLP.
+	//
+	// Since noaa sets the deadline before every read, it works as both
+	// read timeout and idle timeout.
+	IdleTimeout time.Duration
+
+	// MaxRetries is the number of times noaa retries connection with
+	// doppler before ErrMaxRetriesReached is sent to Consumer.Errors()
+	// (and ReconnectBackoff or DopplerAddrs failover takes over). By
+	// default, it's 0 and noaa default (5 times) is used. It's not used
+	// with UseRLP.
+	MaxRetries int
+
+	// StaleConnectionTimeout forces closing and re-establishing firehose
+	// connection when no envelope is received within it while connected.
+	// Unlike IdleTimeout, it doesn't wait for noaa to report error but
+	// starts a fresh connection. Forced reconnects are counted in
+	// ConnectionState.StaleReconnects and notified as
+	// LifecycleStaleReconnecting. By default, it's 0 and disabled. It's
+	// not used with UseRLP.
+	StaleConnectionTimeout time.Duration
+
+	// OnReconnect is called before each reconnect attempt with the number
+	// of attempts since connection is established last (starting from 1)
+	// and the error which caused it (ConsumeError, or ErrStaleConnection
+	// for StaleConnectionTimeout). It's called synchronously on the path
+	// handling the connection, so it must return quickly. A panic in it
+	// is recovered and logged. It's not used with UseRLP.
+	OnReconnect func(attempt int, err error)
+
+	// RefreshOverlap is how long the previous firehose connection is kept
+	// after reconnecting with the refreshed token. Events are read from
+	// both connections while overlapping, so that events in flight are
+	// not lost while switching (at-least-once). Since doppler may deliver
+	// same events to both of them, use DedupWindow to drop duplicated
+	// ones. By default, it's 0 and the previous connection is closed just
+	// after the new one is started (events in flight may be lost). It's
+	// not applied with NoaaConsumer since its connection is reused.
+	RefreshOverlap time.Duration
+
+	// ReplayFile is the path of the file to replay envelopes from instead
+	// of consuming firehose (e.g., to test downstream pipeline without
+	// Cloud Foundry). Each record in the file is an envelope encoded by
+	// protobuf prefixed with its length as uvarint. When it's set, noaa
+	// (or RLP) and UAA are not used at all. Events() is closed after all
+	// envelopes are replayed.
+	ReplayFile string
+
+	// ReplayReader is same as ReplayFile but envelopes are read from it
+	// instead of a file (e.g., a recording in memory in tests). It's
+	// decompressed if CompressRecording is set. It's not closed by
+	// consumer. ReplayFile can not be used with it.
+	ReplayReader io.Reader
+
+	// RecordFile is the path of the file to record every consumed envelope
+	// to (before EventTypes, Filter and so on are applied) in the format
+	// ReplayFile reads. The file is truncated if it exists. Writing is
+	// buffered and flushed by Close. A write error is sent to Errors()
+	// and recording is stopped but consuming is continued.
+	RecordFile string
+
+	// CompressRecording compresses RecordFile by gzip and decompresses
+	// ReplayFile (or ReplayReader) while replaying. Files whose name
+	// ends with ".gz" are (de)compressed even if it's not set. Replaying
+	// streams the file without loading it into memory.
+	CompressRecording bool
+
+	// ReplaySpeed is the speed to replay envelopes of ReplayFile (or
+	// ReplayReader) relative to their original timestamps (e.g., 1 is
+	// original speed and 2 is twice as fast). By default, it's 0 and
+	// envelopes are replayed as fast as possible.
+	ReplaySpeed float64
+
+	// UseRLP enables consuming Loggregator v2 envelopes from Reverse Log
+	// Proxy (RLP) via gRPC instead of the noaa firehose. Envelopes are
+	// converted to v1 envelopes so Consumer works same as before.
+	//
+	// RLP authenticates consumer by mutual TLS, so Token and UAA settings
+	// are not used.
+	UseRLP bool
+
+	// RLPAddr is RLP gRPC endpoint address (e.g., "reverse-log-proxy:8082").
+	// It's required when UseRLP is true.
+	RLPAddr string
+
+	// FirehoseGroup is the shard group to join instead of SubscriptionID.
+	// Consumers with the same FirehoseGroup share envelopes evenly. It's
+	// sent as the shard ID of the RLP egress request, so it can only be
+	// used with UseRLP; noaa has no API for it and the subscription ID
+	// passed to Firehose is the only sharding key there. If it's empty,
+	// SubscriptionID is used as before.
+	FirehoseGroup string
+
+	// ReconnectBackoff is used to reconnect firehose after noaa gives
+	// up retrying connection (it retries 5 times by itself). Reconnection
+	// is retried until it succeeds or consumer is closed, so use e.g.,
+	// ExponentialBackoff for unlimited retries.
+	//
+	// If it's nil, consumer doesn't reconnect and only noaa retries are
+	// done as before. ConstantBackoff is provided for a fixed interval.
+	ReconnectBackoff Backoff
+
+	// PolicyViolationBackoff is the cooldown to reconnect firehose after
+	// doppler closes connection by ClosePolicyViolation (1008) because
+	// consumer is too slow. Reconnection uses the current token (noaa
+	// fetches a new one by TokenProvider or UAA if it's rejected) and is
+	// stopped when consumer is closed or its context is canceled.
+	// By default, it's 0 and consumer doesn't reconnect for it.
+	PolicyViolationBackoff time.Duration
+
+	// NoaaConsumer is noaa consumer used to connect to firehose instead
+	// of constructing it by consumer. Use it to configure noaa directly
+	// (e.g., proxy or idle timeout). TLSConfig and Insecure are not
+	// applied to it. It can not be used with multiple subscription IDs.
+	//
+	// Since consumer tracks connection state by OnConnectCallback, the
+	// callback of it is overwritten. If token is fetched by consumer, it's
+	// also set as token refresher of it. DopplerAddr is still required
+	// and used for logging and errors.
+	NoaaConsumer *noaaConsumer.Consumer
+
 	// DebugPrinter is noaa.DebugPrinter. It's used for debugging
 	// Noaa. Noaa is a client library to consume metric and log
 	// messages from Doppler.
 	DebugPrinter noaa.DebugPrinter
 
+	// CaptureDebug enables sending request and response dumps of noaa
+	// (e.g., websocket handshake) to Consumer.DebugMessages(). If
+	// DebugPrinter is also set, dumps are passed to both. Messages are
+	// dropped when nobody reads them. It's not used with UseRLP.
+	CaptureDebug bool
+
+	// MetricsRegisterer is used to register prometheus metrics of
+	// consumer: the number of consumed envelopes (by event type),
+	// errors, slowConsumerAlerts and reconnect attempts.
+	// If it's nil, no metrics are registered.
+	MetricsRegisterer prometheus.Registerer
+
 	// Logger is logger for go-nozzle. By default, output will be
 	// discarded and not be displayed.
 	Logger *log.Logger
 
+	// SlogLogger is structured logger for go-nozzle, e.g., *slog.Logger.
+	// If it's set, it's used instead of Logger and log lines carry fields
+	// like subscription_id and doppler_addr.
+	SlogLogger StructuredLogger
+
+	// LogLevel is the minimum level of messages written to Logger.
+	// By default, it's LogLevelDebug and all messages are written.
+	// It's not applied to SlogLogger, set level of its handler instead.
+	LogLevel LogLevel
+
+	// LoggerPrefix is prepended to every message written by consumer
+	// (separated by a space) to identify it when multiple consumers share
+	// Logger (e.g., "[tenant-a]"). By default, it's empty and messages are
+	// written as they are. Lines written by libraries (e.g., DebugPrinter
+	// of noaa) are not prefixed.
+	LoggerPrefix string
+
+	// ErrorContext attaches the context passed to StartWithContext to
+	// errors sent to Consumer.Errors() by wrapping them in ContextError.
+	// Use it to extract values like trace span from errors by
+	// ErrorContext. By default, errors are sent as they are.
+	ErrorContext bool
+
+	// RetriableErrors wraps errors sent to Consumer.Errors() in
+	// RetriableError which tells whether the error is transient (e.g.,
+	// network errors and websocket closes) or permanent (e.g., bad
+	// credentials). Use IsTemporary to check it. By default, errors are
+	// sent as they are. It's applied before ErrorContext.
+	RetriableErrors bool
+
+	// DedupErrors collapses identical consecutive errors (compared by
+	// message) sent to Consumer.Errors(), e.g., the same connection
+	// error repeated during a doppler outage. The first one is sent as
+	// it is and the repeated ones are summarized by RepeatedError at most
+	// every DedupErrorsInterval. Summaries are driven by new errors, not
+	// by a timer: it's sent when a repeat arrives after the interval, or
+	// a different error arrives, or Errors() is closed while repeats are
+	// suppressed. By default, every error is sent. It's applied before
+	// RetriableErrors and ErrorContext.
+	DedupErrors bool
+
+	// DedupErrorsInterval is the interval of RepeatedError summaries sent
+	// by DedupErrors. By default, it's 1 minute.
+	DedupErrorsInterval time.Duration
+
+	// EventBufferSize is the buffer size of the channel returned by
+	// Consumer.Events(). By default, it's 0 and the channel is unbuffered.
+	// A buffer absorbs short bursts so that a slow reader does not
+	// immediately push back to the firehose. See also BackpressurePolicy.
+	EventBufferSize int
+
+	// ReorderWindow is how long envelopes are held to deliver them sorted
+	// by timestamp since envelopes from different metrons may arrive out
+	// of order. An envelope is delivered when an envelope newer than it
+	// by ReorderWindow arrives or ReorderWindow elapses after it arrives.
+	// It's applied after Transform. By default, it's 0 and envelopes are
+	// not reordered.
+	ReorderWindow time.Duration
+
+	// DropLateEvents drops envelopes which arrive after newer ones are
+	// delivered by ReorderWindow. By default, they're delivered
+	// immediately (out of order). Either way, they're counted by
+	// Stats.LateEvents.
+	DropLateEvents bool
+
+	// DiskSpillDir is the directory to spill envelopes to when more than
+	// MaxMemoryBuffer envelopes are waiting to be read from
+	// Consumer.Events(). Spilled envelopes are written to temporary files
+	// as protobuf and read back in order once the reader catches up, so
+	// that firehose is read without blocking and nothing is dropped. The
+	// files are removed when consumer is closed. By default, it's empty
+	// and envelopes are not spilled. It can not be used with
+	// BackpressureDropOldest.
+	DiskSpillDir string
+
+	// MaxMemoryBuffer is the number of envelopes buffered in memory
+	// before spilling to DiskSpillDir. By default, it's 10000.
+	MaxMemoryBuffer int
+
+	// RebalanceWindow enables detecting doppler rebalancing the shared
+	// subscription (e.g., instances with the same SubscriptionID are
+	// added or removed). Origins of envelopes are counted for each
+	// window and LifecycleRebalanced is notified on Consumer.Lifecycle()
+	// when their distribution changes suddenly from the previous window.
+	// It's a heuristic for diagnostics, so it may be notified when the
+	// workload of origins changes. By default, it's 0 and disabled.
+	RebalanceWindow time.Duration
+
+	// DrainDelay is how long Consumer.Handoff keeps consuming before
+	// closing so that a replacement instance with the same SubscriptionID
+	// connects and doppler starts sharding envelopes to it. By default,
+	// it's 0 and Handoff closes immediately (still delivering the events
+	// remaining in the pipeline).
+	DrainDelay time.Duration
+
+	// HandlerTimeout is the deadline to handle each event dispatched by
+	// Consumer.Run. It's passed to Handler as context if it implements
+	// EventContextHandler. Since the handler is not interrupted, a call
+	// exceeding it is logged and counted by Stats.SlowHandlers. By
+	// default, it's 0 and there is no deadline.
+	HandlerTimeout time.Duration
+
+	// ValidateEnvelopes drops envelopes which don't have the payload of
+	// their event type (e.g., nil ValueMetric on ValueMetric type) or
+	// whose event type is unknown. Such envelopes may be sent by older
+	// dopplers. Dropped envelopes are counted by Stats.InvalidEvents and
+	// logged at debug level. It's applied before EventTypes and Filter.
+	ValidateEnvelopes bool
+
+	// BackpressurePolicy is what to do with envelopes when the channel
+	// returned by Consumer.Events() is full. By default, it's
+	// BackpressureBlock and back pressure is propagated to firehose.
+	// BackpressureDropOldest keeps the newest EventBufferSize envelopes
+	// (it must be positive) and dropped ones are counted by
+	// Stats.EventsDropped. With batching, it's applied to envelopes
+	// before they're batched.
+	BackpressurePolicy BackpressurePolicy
+
+	// ErrorBufferSize is the buffer size of the channel returned by
+	// Consumer.Errors(). By default, it's 0 and the channel is unbuffered.
+	// See also ErrorOverflowPolicy.
+	ErrorBufferSize int
+
+	// ErrorOverflowPolicy is what to do with errors when the channel
+	// returned by Consumer.Errors() is full. By default, it's
+	// ErrorOverflowBlock and consuming is blocked until errors are read.
+	// With ErrorBufferSize 0, the channel is regarded as full unless the
+	// reader is waiting on it, so both DropOldest and DropNewest drop the
+	// new error then. Dropped errors are counted by Stats.ErrorsDropped.
+	ErrorOverflowPolicy ErrorOverflowPolicy
+
+	// DetectBufferSize is the buffer size of the channel returned by
+	// Consumer.Detects(). By default, it's 0 and the channel is unbuffered.
+	DetectBufferSize int
+
+	// SlowDetector is used for detecting slowConsumerAlert instead of
+	// the default detector. If it's set, the options for the default
+	// detector (SlowDetectThreshold, SlowDetectWindow, TruncatedPredicate,
+	// ClassifyError and BlockOnAlert) are not used.
+	SlowDetector SlowDetector
+
+	// DisableSlowDetector disables slow consumer detection to remove its
+	// overhead (goroutines and a channel hop for every envelope). Events
+	// from RawConsumer are forwarded to Consumer.Events() directly and
+	// Consumer.Detects() returns nil. Errors of websocket close codes
+	// are not wrapped by CloseError either. It can not be used with
+	// SlowDetector.
+	DisableSlowDetector bool
+
+	// SlowDetectThreshold is the number of `TruncatingBuffer.DroppedMessages`
+	// events within SlowDetectWindow required to notify slowConsumerAlert
+	// on Consumer.Detects(). By default, it's 1 and every event is notified.
+	SlowDetectThreshold int
+
+	// TruncatedPredicate reports whether the envelope tells doppler
+	// dropped messages because nozzle is slow. It's used by the default
+	// detector instead of matching origin "doppler" and counter name
+	// "TruncatingBuffer.DroppedMessages" (e.g., to match counters of
+	// other origins). It's called from a single goroutine.
+	TruncatedPredicate func(*events.Envelope) bool
+
+	// ClassifyError decides whether the error from firehose is a
+	// slowConsumerAlert. It's consulted by the default detector for every
+	// error before its built-in classification. If it returns true, the
+	// error is notified on Consumer.Detects() as SlowAlert with the
+	// returned reason and is not sent to Consumer.Errors(). Otherwise the
+	// error is classified by the default detector as before. It's called
+	// from a single goroutine.
+	ClassifyError func(err error) (isAlert bool, reason string)
+
+	// BlockOnAlert makes the default detector wait until the alert is
+	// received before forwarding next envelopes. By default, it's false
+	// and alerts are dropped (counted by Consumer.DetectorStats()) when
+	// the alert is not received immediately (e.g., Consumer.Detects() is
+	// not read), so that envelopes keep flowing. Use DetectBufferSize
+	// to reduce dropped alerts.
+	BlockOnAlert bool
+
+	// AlertAsEnvelope injects a CounterEvent envelope named
+	// AlertEnvelopeName (its origin is AlertEnvelopeOrigin) into
+	// Consumer.Events() for each slowConsumerAlert, in addition to
+	// notifying it on Consumer.Detects(). The reason of the alert is set
+	// as "reason" tag. The envelopes are injected after EventTypes,
+	// Filter and Transform, so they're not dropped by them.
+	AlertAsEnvelope bool
+
+	// SlowDetectWindow is the sliding window to count dropped messages
+	// events for SlowDetectThreshold. By default, it's 0 and events are
+	// counted without time limit.
+	SlowDetectWindow time.Duration
+
+	// EventTypes is the list of envelope types to forward to
+	// Consumer.Events(). Other envelopes are dropped. If it's empty,
+	// all envelopes are forwarded.
+	//
+	// Filtering is done after slow consumer detection, so dropped
+	// envelopes are still used for detecting slowConsumerAlert.
+	EventTypes []events.Envelope_EventType
+
+	// Filter is called for each envelope and only the envelopes for
+	// which it returns true are forwarded to Consumer.Events() (e.g.,
+	// to drop envelopes of a noisy origin, deployment or job). If it's
+	// nil, all envelopes are forwarded.
+	//
+	// Like EventTypes, it's applied after slow consumer detection and
+	// is called from a single goroutine.
+	Filter func(*events.Envelope) bool
+
+	// Transform is called for each envelope just before it's forwarded to
+	// Consumer.Events() (e.g., to add tags of datacenter or environment).
+	// The returned envelope is forwarded instead. If it returns nil, the
+	// envelope is dropped. It's applied after slow consumer detection and
+	// all other filters (including MaxEventsPerSecond), and is called from
+	// a single goroutine.
+	Transform func(*events.Envelope) *events.Envelope
+
+	// MaxEventsPerSecond limits the number of envelopes forwarded to
+	// Consumer.Events() per second. By default, it's 0 and rate is
+	// not limited.
+	//
+	// Like EventTypes, it's applied after slow consumer detection, so
+	// limited envelopes are still used for detecting slowConsumerAlert.
+	MaxEventsPerSecond int
+
+	// RateLimitMode is what to do with envelopes which exceed
+	// MaxEventsPerSecond. By default, it's RateLimitBlock.
+	RateLimitMode RateLimitMode
+
+	// TeeBufferSize is the number of envelopes queued for each channel
+	// returned by Consumer.Tee. Envelopes are dropped for a channel when
+	// its queue is full. By default, it's 0 and only one envelope is
+	// queued, i.e., envelopes are dropped while the reader is behind.
+	TeeBufferSize int
+
+	// PreserveOrderBy returns the key of envelope for Consumer.RunParallel.
+	// Envelopes with the same key (e.g., origin) are processed by the same
+	// worker to keep their order. If it's nil, envelopes are processed by
+	// any worker and the order is not preserved.
+	PreserveOrderBy func(*events.Envelope) string
+
+	// HeartbeatInterval is the interval to notify Heartbeat on
+	// Consumer.Heartbeats(). It tells consumer is alive even when
+	// firehose is quiet. Since a heartbeat is passed through the same
+	// pipeline as envelopes, heartbeats stop when it's stuck (e.g.,
+	// Events() is not read). By default, it's 0 and heartbeat is
+	// disabled.
+	HeartbeatInterval time.Duration
+
+	// BatchSize enables delivering envelopes in batches on
+	// Consumer.BatchEvents() instead of Consumer.Events(). A batch is
+	// flushed when it has BatchSize envelopes or BatchFlushInterval
+	// elapses. By default, it's 0 and batching is disabled.
+	BatchSize int
+
+	// BatchFlushInterval is the maximum time to wait before flushing
+	// a partial batch after its first envelope is added. If it's 0,
+	// a batch is only flushed when it's full or consumer is stopped.
+	BatchFlushInterval time.Duration
+
+	// HealthStaleThreshold is how long Consumer.Healthy() reports true
+	// after the last envelope is delivered to Consumer.Events().
+	// By default, it's 1 minute.
+	HealthStaleThreshold time.Duration
+
+	// DedupWindow enables skipping duplicated envelopes (e.g., replayed
+	// by doppler after reconnecting) which are seen within the window.
+	// The window is measured from the last time the same fingerprint
+	// is seen.
+	// By default, it's 0 and deduplication is disabled. It's applied
+	// after EventTypes and before MaxEventsPerSecond.
+	DedupWindow time.Duration
+
+	// DedupFingerprint is used to identify duplicated envelopes for
+	// DedupWindow. By default, DefaultFingerprint (timestamp, origin,
+	// event type, payload and tags) is used.
+	DedupFingerprint FingerprintFunc
+
+	// Clock is used for time-based features (e.g., SlowDetectWindow,
+	// HeartbeatInterval, DedupWindow, MaxEventsPerSecond,
+	// StaleConnectionTimeout, reconnect delays and token refresh). By
+	// default, real time is used. It's useful to advance time with a
+	// fake clock in tests.
+	Clock Clock
+
+	// InstanceIndex is the index of this nozzle instance when multiple
+	// instances share the same SubscriptionID. It starts from 1. When
+	// it's set, logs and prometheus metrics are tagged with
+	// "instance_index" and reconnection is delayed by an offset derived
+	// from it so that instances don't reconnect in lockstep after
+	// doppler restarts. By default, it's 0 (not set).
+	InstanceIndex int
+
 	// The following fileds are now only for testing.
-	tokenFetcher tokenFetcher
-	rawConsumer  rawConsumer
+	tokenFetcher    tokenFetcher
+	rawConsumer     RawConsumer
+	uaaRetryBackoff Backoff
 }
 
 // NewConsumer constructs a new consumer client for nozzle.
@@ -93,56 +653,153 @@ type Config struct {
 // It returns error if the token is empty or can not fetch token from UAA
 // If token is not empty or successfully getting from UAA, then it returns nozzle.Consumer.
 // (In initial version, it starts consuming here but now Start() should be called).
+//
+// It's same as NewConsumerContext with context.Background(), so fetching
+// token from UAA is only bounded by Config.UaaTimeout (30 seconds if it's 0).
 func NewConsumer(config *Config) (Consumer, error) {
+	return NewConsumerContext(context.Background(), config)
+}
+
+// NewConsumerContext is same as NewConsumer but fetching token from
+// UAA (or TokenProvider) is canceled when ctx is done. The deadline of
+// ctx is also bounded by Config.UaaTimeout.
+//
+// ctx is only used while constructing. To stop consuming, use
+// Consumer.StartWithContext.
+func NewConsumerContext(ctx context.Context, config *Config) (Consumer, error) {
+	if ctx == nil {
+		return nil, fmt.Errorf("context must not be nil")
+	}
+
 	if config.Logger == nil {
 		config.Logger = defaultLogger
 	}
 
-	// If Token is not provided, fetch it by tokenFetcher.
-	if config.Token != "" {
-		config.Logger.Printf("[DEBUG] Using auth token (%s)",
-			maskString(config.Token))
-	} else {
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
 
-		if config.UaaAddr == "" {
-			return nil, fmt.Errorf("both Token and UaaAddr can not be empty")
+	var debugPrinter *debugChannelPrinter
+	if config.CaptureDebug {
+		debugPrinter = newDebugChannelPrinter(config.DebugPrinter)
+	}
+
+	// Create new RawConsumer
+	rc, refresher, err := newRawConsumer(ctx, config, debugPrinter)
+	if err != nil {
+		return nil, err
+	}
+
+	var eventTypes map[events.Envelope_EventType]struct{}
+	if len(config.EventTypes) > 0 {
+		eventTypes = make(map[events.Envelope_EventType]struct{}, len(config.EventTypes))
+		for _, t := range config.EventTypes {
+			eventTypes[t] = struct{}{}
 		}
+	}
 
-		fetcher := config.tokenFetcher
-		if fetcher == nil {
-			var err error
-			fetcher, err = newDefaultTokenFetcher(config)
-			if err != nil {
-				return nil, fmt.Errorf("failed to construct default token fetcher: %s",
-					err)
-			}
+	clock := orRealClock(config.Clock)
+
+	var limiter *rateLimiter
+	if config.MaxEventsPerSecond > 0 {
+		limiter = newRateLimiter(config.MaxEventsPerSecond, clock)
+	}
+
+	var rebalance *rebalanceDetector
+	if config.RebalanceWindow > 0 {
+		rebalance = newRebalanceDetector(config.RebalanceWindow, clock)
+	}
+
+	var dedup *deduplicator
+	if config.DedupWindow > 0 {
+		dedup = newDeduplicator(config.DedupWindow, config.DedupFingerprint, clock)
+	}
+
+	var errorDedup *errorDeduplicator
+	if config.DedupErrors {
+		errorDedup = newErrorDeduplicator(config.DedupErrorsInterval, clock)
+	}
+
+	healthStaleThreshold := config.HealthStaleThreshold
+	if healthStaleThreshold == 0 {
+		healthStaleThreshold = defaultHealthStaleThreshold
+	}
+
+	c := &consumer{
+		rawConsumer:        rc,
+		customSlowDetector: config.SlowDetector,
+		eventTypes:         eventTypes,
+		filter:             config.Filter,
+		transform:          config.Transform,
+		rateLimiter:        limiter,
+		rateLimitMode:      config.RateLimitMode,
+		deduplicator:       dedup,
+		rebalance:          rebalance,
+		errorContext:       config.ErrorContext,
+		retriableErrors:    config.RetriableErrors,
+		errorDedup:         errorDedup,
+		debugPrinter:       debugPrinter,
+		tokenRefresher:     refresher,
+		logger:             newLogger(config),
+		eventBufferSize:    config.EventBufferSize,
+		errBufferSize:      config.ErrorBufferSize,
+		detectBufferSize:   config.DetectBufferSize,
+
+		slowDetectThreshold: config.SlowDetectThreshold,
+		slowDetectWindow:    config.SlowDetectWindow,
+		truncatedPredicate:  config.TruncatedPredicate,
+		classifyError:       config.ClassifyError,
+		dropAlerts:          !config.BlockOnAlert,
+		alertAsEnvelope:     config.AlertAsEnvelope,
+		disableSlowDetector: config.DisableSlowDetector,
+		errorOverflowPolicy: config.ErrorOverflowPolicy,
+		backpressurePolicy:  config.BackpressurePolicy,
+		validateEnvelopes:   config.ValidateEnvelopes,
+		handlerTimeout:      config.HandlerTimeout,
+		drainDelay:          config.DrainDelay,
+		reorderWindow:       config.ReorderWindow,
+		dropLateEvents:      config.DropLateEvents,
+		diskSpillDir:        config.DiskSpillDir,
+		maxMemoryBuffer:     config.MaxMemoryBuffer,
+
+		batchSize:          config.BatchSize,
+		heartbeatInterval:  config.HeartbeatInterval,
+		preserveOrderBy:    config.PreserveOrderBy,
+		teeBufferSize:      config.TeeBufferSize,
+		batchFlushInterval: config.BatchFlushInterval,
+
+		healthStaleThreshold: healthStaleThreshold,
+		clock:                clock,
+		config:               *config,
+	}
+
+	// Register prometheus metrics only when registerer is provided.
+	if config.MetricsRegisterer != nil {
+		reg := config.MetricsRegisterer
+		if config.InstanceIndex > 0 {
+			reg = prometheus.WrapRegistererWith(prometheus.Labels{
+				"instance_index": strconv.Itoa(config.InstanceIndex),
+			}, reg)
 		}
 
-		// Execute tokenFetcher and get token
-		token, err := fetcher.Fetch()
+		m, err := newMetrics(reg, func() float64 {
+			return float64(c.ConnectionState().Reconnects)
+		})
 		if err != nil {
-			return nil, fmt.Errorf("failed to fetch token: %s", err)
+			return nil, err
 		}
-
-		config.Logger.Printf("[DEBUG] Setting auth token (%s)",
-			maskString(token))
-		config.Token = token
+		c.metrics = m
 	}
 
-	// Create new RawConsumer
-	rc := config.rawConsumer
-	if rc == nil {
-		var err error
-		rc, err = newRawDefaultConsumer(config)
+	if config.RecordFile != "" {
+		r, err := newRecorder(config.RecordFile, isCompressed(config, config.RecordFile))
 		if err != nil {
-			return nil, fmt.Errorf("failed to construct default consumer: %s", err)
+			return nil, err
 		}
+		c.recorder = r
 	}
 
-	return &consumer{
-		rawConsumer: rc,
-		logger:      config.Logger,
-	}, nil
+	return c, nil
 }
 
 // Deprecated: NewDefaultConsumer is deprecated, use NewConsumer instead
@@ -150,6 +807,481 @@ func NewDefaultConsumer(config *Config) (Consumer, error) {
 	return NewConsumer(config)
 }
 
+// NewRawConsumer constructs RawConsumer which NewConsumer uses to
+// consume firehose (or RLP) by config. It can be used to test or wrap
+// the default RawConsumer.
+//
+// If Token is empty, it's fetched by TokenProvider or from UAA same as
+// NewConsumer. noaa fetches a new one when it expires while reconnecting
+// but it's not refreshed in background since it's done by Consumer.
+func NewRawConsumer(config *Config) (RawConsumer, error) {
+	if config.Logger == nil {
+		config.Logger = defaultLogger
+	}
+
+	rc, _, err := newRawConsumer(context.Background(), config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+// newRawConsumer sets up access token and constructs RawConsumer by
+// config. It also returns tokenRefresher if the token is fetched.
+// If debugPrinter is not nil, it's used instead of config.DebugPrinter.
+func newRawConsumer(ctx context.Context, config *Config, debugPrinter *debugChannelPrinter) (RawConsumer, *tokenRefresher, error) {
+	// Replaying doesn't connect to anywhere.
+	if config.ReplayFile != "" || config.ReplayReader != nil {
+		rc, err := newFileConsumer(config)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rc, nil, nil
+	}
+
+	if err := setupDopplerAddr(ctx, config); err != nil {
+		return nil, nil, err
+	}
+
+	// RLP authenticates consumer by mutual TLS, so token is
+	// not required for it.
+	var fetcher tokenFetcher
+	var refresher *tokenRefresher
+	if !config.UseRLP {
+		var err error
+		fetcher, refresher, err = setupToken(ctx, config)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if config.rawConsumer != nil {
+		return config.rawConsumer, refresher, nil
+	}
+
+	// Copy not to modify user's config
+	if debugPrinter != nil {
+		cfg := *config
+		cfg.DebugPrinter = debugPrinter
+		config = &cfg
+	}
+
+	rc, err := newSubscriptionsConsumer(config, fetcher)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rc, refresher, nil
+}
+
+// setupToken sets up access token for firehose. If Token is not provided,
+// it's fetched by TokenProvider or from UAA and Config.Token is updated.
+// It returns the fetcher used and tokenRefresher to refresh the token.
+// Both are nil when Token is provided by user without credentials.
+func setupToken(ctx context.Context, config *Config) (tokenFetcher, *tokenRefresher, error) {
+	logger := newLogger(config)
+	if config.Token != "" {
+		logger.Debug("Using auth token", "token", maskString(config.Token))
+		if !hasTokenCredentials(config) {
+			return nil, nil, nil
+		}
+	}
+
+	fetcher, err := newTokenFetcher(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The provided token is used for the first connection and refreshed
+	// by the credentials. Its lifetime is known only if it's JWT.
+	if config.Token != "" {
+		expiresIn := tokenExpiresIn(config.Token, orRealClock(config.Clock).Now())
+		if expiresIn >= 0 {
+			refresher := &tokenRefresher{
+				fetcher: fetcher,
+				clock:   config.Clock,
+				logger:  logger,
+			}
+			refresher.setToken(config.Token, expiresIn)
+			return fetcher, refresher, nil
+		}
+
+		logger.Info("Provided auth token is expired, fetching new one")
+	}
+
+	// Execute tokenFetcher and get token
+	token, expiresIn, err := fetchToken(ctx, config, fetcher, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger.Debug("Setting auth token", "token", maskString(token))
+	config.Token = token
+
+	// Since token is fetched by fetcher, it can be refreshed
+	// by same fetcher before it expires.
+	refresher := &tokenRefresher{
+		fetcher: fetcher,
+		clock:   config.Clock,
+		logger:  logger,
+	}
+	refresher.setToken(token, expiresIn)
+
+	return fetcher, refresher, nil
+}
+
+// hasTokenCredentials returns true if config has credentials to fetch
+// token in addition to Token.
+func hasTokenCredentials(config *Config) bool {
+	if config.TokenProvider != nil {
+		return true
+	}
+
+	return config.UaaAddr != "" &&
+		(config.Username != "" || config.ClientID != "" || config.tokenFetcher != nil)
+}
+
+// newTokenFetcher constructs tokenFetcher by config. TokenProvider takes
+// precedence over UAA.
+func newTokenFetcher(config *Config) (tokenFetcher, error) {
+	if config.TokenProvider != nil {
+		return &providerTokenFetcher{
+			provider: config.TokenProvider,
+		}, nil
+	}
+
+	if config.UaaAddr == "" {
+		return nil, fmt.Errorf("both Token and UaaAddr can not be empty: %w",
+			ErrMissingToken)
+	}
+
+	if config.tokenFetcher != nil {
+		return config.tokenFetcher, nil
+	}
+
+	fetcher, err := newDefaultTokenFetcher(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct default token fetcher: %s",
+			err)
+	}
+
+	return fetcher, nil
+}
+
+// fetchToken fetches token by fetcher. It's retried with backoff up to
+// UAARetryLimit attempts until ctx is done.
+func fetchToken(ctx context.Context, config *Config, fetcher tokenFetcher, logger leveledLogger) (string, time.Duration, error) {
+	if config.UAARetryLimit <= 1 {
+		token, expiresIn, err := fetcher.Fetch(ctx)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to fetch token: %s", err)
+		}
+		return token, expiresIn, nil
+	}
+
+	backoff := config.uaaRetryBackoff
+	if backoff == nil {
+		backoff = &ExponentialBackoff{
+			Min: minUAARetryBackoff,
+			Max: maxUAARetryBackoff,
+		}
+	}
+
+	var attempts int
+	for {
+		attempts++
+		token, expiresIn, err := fetcher.Fetch(ctx)
+		if err == nil {
+			return token, expiresIn, nil
+		}
+
+		if attempts >= config.UAARetryLimit || ctx.Err() != nil {
+			return "", 0, fmt.Errorf("failed to fetch token after %d attempts: %w",
+				attempts, err)
+		}
+
+		d := backoff.Next()
+		logger.Warn("Failed to fetch token, retrying",
+			"attempt", attempts, "delay", d, "error", err)
+
+		select {
+		case <-orRealClock(config.Clock).After(d):
+		case <-ctx.Done():
+			return "", 0, fmt.Errorf("failed to fetch token after %d attempts: %w",
+				attempts, err)
+		}
+	}
+}
+
+// newSubscriptionsConsumer constructs rawConsumer for SubscriptionID and
+// SubscriptionIDs. If more than one subscription ID is provided, a
+// rawConsumer is constructed for each of them and they are fanned in.
+func newSubscriptionsConsumer(config *Config, fetcher tokenFetcher) (RawConsumer, error) {
+	ids := make([]string, 0, len(config.SubscriptionIDs)+1)
+	if config.SubscriptionID != "" {
+		ids = append(ids, config.SubscriptionID)
+	}
+	ids = append(ids, config.SubscriptionIDs...)
+
+	// Keep validation error of single rawConsumer
+	// (e.g., SubscriptionID must not be empty).
+	if len(ids) <= 1 {
+		cfg := *config
+		if len(ids) == 1 {
+			cfg.SubscriptionID = ids[0]
+		}
+		return newSingleRawConsumer(&cfg, fetcher)
+	}
+
+	// Connections of each subscription can not share one noaa consumer.
+	if config.NoaaConsumer != nil {
+		return nil, fmt.Errorf("NoaaConsumer can not be used with multiple subscription IDs")
+	}
+
+	consumers := make([]RawConsumer, 0, len(ids))
+	for _, id := range ids {
+		cfg := *config
+		cfg.SubscriptionID = id
+		rc, err := newSingleRawConsumer(&cfg, fetcher)
+		if err != nil {
+			return nil, err
+		}
+		consumers = append(consumers, rc)
+	}
+
+	return newMultiRawConsumer(consumers), nil
+}
+
+// newSingleRawConsumer constructs rawConsumer for config.SubscriptionID.
+// It's rlpConsumer if UseRLP is true, otherwise rawDefaultConsumer.
+func newSingleRawConsumer(config *Config, fetcher tokenFetcher) (RawConsumer, error) {
+	if config.UseRLP {
+		rc, err := newRLPConsumer(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct RLP consumer: %w", err)
+		}
+		return rc, nil
+	}
+
+	rdc, err := newRawDefaultConsumer(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct default consumer: %w", err)
+	}
+
+	// Fetcher is also used when noaa reconnects with expired token.
+	rdc.tokenFetcher = fetcher
+	return rdc, nil
+}
+
+// newTLSConfig returns TLS config for connection with doppler
+// by TLSConfig and Insecure.
+func newTLSConfig(config *Config) *tls.Config {
+	if config.TLSConfig == nil {
+		return &tls.Config{
+			InsecureSkipVerify: config.Insecure,
+			MinVersion:         minTLSVersion(config),
+		}
+	}
+
+	// Copy not to modify user's config
+	tlsConfig := config.TLSConfig.Clone()
+	if config.Insecure {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if config.MinTLSVersion != 0 || tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = minTLSVersion(config)
+	}
+
+	return tlsConfig
+}
+
+// minTLSVersion returns the minimum TLS version by MinTLSVersion.
+func minTLSVersion(config *Config) uint16 {
+	if config.MinTLSVersion == 0 {
+		return defaultMinTLSVersion
+	}
+	return config.MinTLSVersion
+}
+
+// validateConfig validates the option values of config are valid
+func validateConfig(config *Config) error {
+	if config.EventBufferSize < 0 {
+		return fmt.Errorf("EventBufferSize must not be negative")
+	}
+
+	if config.ErrorBufferSize < 0 {
+		return fmt.Errorf("ErrorBufferSize must not be negative")
+	}
+
+	if config.DetectBufferSize < 0 {
+		return fmt.Errorf("DetectBufferSize must not be negative")
+	}
+
+	if config.SlowDetectThreshold < 0 {
+		return fmt.Errorf("SlowDetectThreshold must not be negative")
+	}
+
+	if config.SlowDetectWindow < 0 {
+		return fmt.Errorf("SlowDetectWindow must not be negative")
+	}
+
+	if config.MaxEventsPerSecond < 0 {
+		return fmt.Errorf("MaxEventsPerSecond must not be negative")
+	}
+
+	if config.AppGUID != "" && config.UseRLP {
+		return fmt.Errorf("AppGUID can not be used with UseRLP")
+	}
+
+	if config.FirehoseGroup != "" && !config.UseRLP {
+		return fmt.Errorf("FirehoseGroup can only be used with UseRLP")
+	}
+
+	switch config.MinTLSVersion {
+	case 0, tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+	default:
+		return fmt.Errorf("MinTLSVersion 0x%04x is not a known TLS version", config.MinTLSVersion)
+	}
+
+	if config.UAAHTTPClient != nil &&
+		(config.UaaAddr == "" || config.TokenProvider != nil || config.UseRLP) {
+		return fmt.Errorf("UAAHTTPClient can only be used with UaaAddr")
+	}
+
+	if config.SlowDetector != nil && config.DisableSlowDetector {
+		return fmt.Errorf("SlowDetector can not be used with DisableSlowDetector")
+	}
+
+	// Provided noaa consumer is bound to its address.
+	if config.NoaaConsumer != nil && len(config.DopplerAddrs) > 0 {
+		return fmt.Errorf("NoaaConsumer can not be used with DopplerAddrs")
+	}
+
+	if config.PolicyViolationBackoff < 0 {
+		return fmt.Errorf("PolicyViolationBackoff must not be negative")
+	}
+
+	if config.IdleTimeout < 0 {
+		return fmt.Errorf("IdleTimeout must not be negative")
+	}
+
+	if config.TeeBufferSize < 0 {
+		return fmt.Errorf("TeeBufferSize must not be negative")
+	}
+
+	if config.ReorderWindow < 0 {
+		return fmt.Errorf("ReorderWindow must not be negative")
+	}
+
+	if config.MaxMemoryBuffer < 0 {
+		return fmt.Errorf("MaxMemoryBuffer must not be negative")
+	}
+
+	if config.DiskSpillDir != "" && config.BackpressurePolicy == BackpressureDropOldest {
+		return fmt.Errorf("DiskSpillDir can not be used with BackpressureDropOldest")
+	}
+
+	if config.RebalanceWindow < 0 {
+		return fmt.Errorf("RebalanceWindow must not be negative")
+	}
+
+	if config.DrainDelay < 0 {
+		return fmt.Errorf("DrainDelay must not be negative")
+	}
+
+	if config.HandlerTimeout < 0 {
+		return fmt.Errorf("HandlerTimeout must not be negative")
+	}
+
+	if config.ReplaySpeed < 0 {
+		return fmt.Errorf("ReplaySpeed must not be negative")
+	}
+
+	if config.ReplayFile != "" && config.ReplayReader != nil {
+		return fmt.Errorf("ReplayFile can not be used with ReplayReader")
+	}
+
+	if config.StaleConnectionTimeout < 0 {
+		return fmt.Errorf("StaleConnectionTimeout must not be negative")
+	}
+
+	if config.RefreshOverlap < 0 {
+		return fmt.Errorf("RefreshOverlap must not be negative")
+	}
+
+	if config.MaxRetries < 0 {
+		return fmt.Errorf("MaxRetries must not be negative")
+	}
+
+	if config.UAARetryLimit < 0 {
+		return fmt.Errorf("UAARetryLimit must not be negative")
+	}
+
+	if config.HeartbeatInterval < 0 {
+		return fmt.Errorf("HeartbeatInterval must not be negative")
+	}
+
+	if config.BatchSize < 0 {
+		return fmt.Errorf("BatchSize must not be negative")
+	}
+
+	if config.BatchFlushInterval < 0 {
+		return fmt.Errorf("BatchFlushInterval must not be negative")
+	}
+
+	if config.HealthStaleThreshold < 0 {
+		return fmt.Errorf("HealthStaleThreshold must not be negative")
+	}
+
+	if config.DedupWindow < 0 {
+		return fmt.Errorf("DedupWindow must not be negative")
+	}
+
+	if config.DedupErrorsInterval < 0 {
+		return fmt.Errorf("DedupErrorsInterval must not be negative")
+	}
+
+	if config.DedupErrorsInterval > 0 && !config.DedupErrors {
+		return fmt.Errorf("DedupErrorsInterval can only be used with DedupErrors")
+	}
+
+	if config.InstanceIndex < 0 {
+		return fmt.Errorf("InstanceIndex must not be negative")
+	}
+
+	switch config.LogLevel {
+	case LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
+	default:
+		return fmt.Errorf("invalid LogLevel: %s", config.LogLevel)
+	}
+
+	switch config.ErrorOverflowPolicy {
+	case ErrorOverflowBlock, ErrorOverflowDropOldest, ErrorOverflowDropNewest:
+	default:
+		return fmt.Errorf("invalid ErrorOverflowPolicy: %s", config.ErrorOverflowPolicy)
+	}
+
+	switch config.BackpressurePolicy {
+	case BackpressureBlock:
+	case BackpressureDropOldest:
+		if config.EventBufferSize == 0 {
+			return fmt.Errorf("EventBufferSize must be positive with BackpressureDropOldest")
+		}
+	default:
+		return fmt.Errorf("invalid BackpressurePolicy: %s", config.BackpressurePolicy)
+	}
+
+	switch config.RateLimitMode {
+	case RateLimitBlock, RateLimitDrop:
+	default:
+		return fmt.Errorf("invalid RateLimitMode: %s", config.RateLimitMode)
+	}
+
+	return nil
+}
+
 // maskString is used to mask string which should not be displayed
 // directly like auth token
 func maskString(s string) string {
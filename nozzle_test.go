@@ -1,9 +1,20 @@
 package nozzle
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	noaaConsumer "github.com/cloudfoundry/noaa/consumer"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestDefaultConsumer(t *testing.T) {
@@ -153,6 +164,231 @@ func TestNewDefaultConsumer(t *testing.T) {
 			errStr:  "Username must not be empty",
 		},
 
+		{
+			in: &Config{
+				Token:           "xyz",
+				rawConsumer:     &testRawConsumer{},
+				EventBufferSize: -1,
+			},
+			success: false,
+			errStr:  "EventBufferSize must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:           "xyz",
+				rawConsumer:     &testRawConsumer{},
+				ErrorBufferSize: -1,
+			},
+			success: false,
+			errStr:  "ErrorBufferSize must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:            "xyz",
+				rawConsumer:      &testRawConsumer{},
+				DetectBufferSize: -1,
+			},
+			success: false,
+			errStr:  "DetectBufferSize must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:               "xyz",
+				rawConsumer:         &testRawConsumer{},
+				SlowDetectThreshold: -1,
+			},
+			success: false,
+			errStr:  "SlowDetectThreshold must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:            "xyz",
+				rawConsumer:      &testRawConsumer{},
+				SlowDetectWindow: -1 * time.Second,
+			},
+			success: false,
+			errStr:  "SlowDetectWindow must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:              "xyz",
+				rawConsumer:        &testRawConsumer{},
+				MaxEventsPerSecond: -1,
+			},
+			success: false,
+			errStr:  "MaxEventsPerSecond must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:         "xyz",
+				rawConsumer:   &testRawConsumer{},
+				InstanceIndex: -1,
+			},
+			success: false,
+			errStr:  "InstanceIndex must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:       "xyz",
+				rawConsumer: &testRawConsumer{},
+				MaxRetries:  -1,
+			},
+			success: false,
+			errStr:  "MaxRetries must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:         "xyz",
+				rawConsumer:   &testRawConsumer{},
+				ReorderWindow: -1,
+			},
+			success: false,
+			errStr:  "ReorderWindow must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:           "xyz",
+				rawConsumer:     &testRawConsumer{},
+				MaxMemoryBuffer: -1,
+			},
+			success: false,
+			errStr:  "MaxMemoryBuffer must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:              "xyz",
+				rawConsumer:        &testRawConsumer{},
+				EventBufferSize:    10,
+				DiskSpillDir:       "/tmp",
+				BackpressurePolicy: BackpressureDropOldest,
+			},
+			success: false,
+			errStr:  "DiskSpillDir can not be used with BackpressureDropOldest",
+		},
+
+		{
+			in: &Config{
+				Token:       "xyz",
+				rawConsumer: &testRawConsumer{},
+				DrainDelay:  -1,
+			},
+			success: false,
+			errStr:  "DrainDelay must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:          "xyz",
+				rawConsumer:    &testRawConsumer{},
+				HandlerTimeout: -1,
+			},
+			success: false,
+			errStr:  "HandlerTimeout must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:       "xyz",
+				rawConsumer: &testRawConsumer{},
+				ReplaySpeed: -1,
+			},
+			success: false,
+			errStr:  "ReplaySpeed must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:        "xyz",
+				rawConsumer:  &testRawConsumer{},
+				ReplayFile:   "events.bin",
+				ReplayReader: &bytes.Buffer{},
+			},
+			success: false,
+			errStr:  "ReplayFile can not be used with ReplayReader",
+		},
+
+		{
+			in: &Config{
+				Token:         "xyz",
+				rawConsumer:   &testRawConsumer{},
+				RateLimitMode: RateLimitMode(10),
+			},
+			success: false,
+			errStr:  "invalid RateLimitMode",
+		},
+
+		{
+			in: &Config{
+				Token:               "xyz",
+				rawConsumer:         &testRawConsumer{},
+				ErrorOverflowPolicy: ErrorOverflowPolicy(10),
+			},
+			success: false,
+			errStr:  "invalid ErrorOverflowPolicy",
+		},
+
+		{
+			in: &Config{
+				Token:              "xyz",
+				rawConsumer:        &testRawConsumer{},
+				BackpressurePolicy: BackpressureDropOldest,
+			},
+			success: false,
+			errStr:  "EventBufferSize must be positive with BackpressureDropOldest",
+		},
+
+		{
+			in: &Config{
+				Token:               "xyz",
+				rawConsumer:         &testRawConsumer{},
+				SlowDetector:        &testSlowDetector{},
+				DisableSlowDetector: true,
+			},
+			success: false,
+			errStr:  "SlowDetector can not be used with DisableSlowDetector",
+		},
+
+		{
+			in: &Config{
+				Token:       "xyz",
+				rawConsumer: &testRawConsumer{},
+				LogLevel:    LogLevel(10),
+			},
+			success: false,
+			errStr:  "invalid LogLevel",
+		},
+
+		{
+			in: &Config{
+				Token:              "xyz",
+				rawConsumer:        &testRawConsumer{},
+				MaxEventsPerSecond: 100,
+				RateLimitMode:      RateLimitDrop,
+			},
+			success: true,
+		},
+
+		{
+			in: &Config{
+				Token:            "xyz",
+				rawConsumer:      &testRawConsumer{},
+				EventBufferSize:  100,
+				ErrorBufferSize:  10,
+				DetectBufferSize: 10,
+			},
+			success: true,
+		},
+
 		{
 			in: &Config{
 				UaaAddr:      "https://uaa.cloudfoundry.net",
@@ -183,6 +419,188 @@ func TestNewDefaultConsumer(t *testing.T) {
 			},
 			success: true,
 		},
+
+		{
+			in: &Config{
+				UseRLP: true,
+			},
+			success: false,
+			errStr:  "RLPAddr must not be empty",
+		},
+
+		{
+			// Token is not required for RLP
+			in: &Config{
+				UseRLP:         true,
+				RLPAddr:        "reverse-log-proxy.service.cf.internal:8082",
+				SubscriptionID: "A",
+			},
+			success: true,
+		},
+
+		{
+			in: &Config{
+				Token:             "xyz",
+				rawConsumer:       &testRawConsumer{},
+				MetricsRegisterer: prometheus.NewRegistry(),
+			},
+			success: true,
+		},
+
+		{
+			// SubscriptionIDs can be used without SubscriptionID
+			in: &Config{
+				DopplerAddr:     "wss://doppler.cf.example.com",
+				Token:           "xyz",
+				SubscriptionIDs: []string{"A", "B"},
+			},
+			success: true,
+		},
+
+		{
+			in: &Config{
+				DopplerAddr:     "wss://doppler.cf.example.com",
+				Token:           "xyz",
+				SubscriptionIDs: []string{"A", ""},
+			},
+			success: false,
+			errStr:  "SubscriptionID must not be empty",
+		},
+
+		{
+			in: &Config{
+				DopplerAddr:    "wss://doppler.cf.example.com",
+				Token:          "xyz",
+				SubscriptionID: "A",
+				NoaaConsumer:   noaaConsumer.New("wss://doppler.cf.example.com", nil, nil),
+			},
+			success: true,
+		},
+
+		{
+			in: &Config{
+				DopplerAddr: "wss://doppler.cf.example.com",
+				Token:       "xyz",
+				AppGUID:     "my-app-guid",
+			},
+			success: true,
+		},
+
+		{
+			in: &Config{
+				DopplerAddr:    "wss://doppler.cf.example.com",
+				Token:          "xyz",
+				SubscriptionID: "A",
+				AppGUID:        "my-app-guid",
+			},
+			success: false,
+			errStr:  "SubscriptionID must be empty when AppGUID is set",
+		},
+
+		{
+			in: &Config{
+				UseRLP:  true,
+				RLPAddr: "reverse-log-proxy:8082",
+				AppGUID: "my-app-guid",
+			},
+			success: false,
+			errStr:  "AppGUID can not be used with UseRLP",
+		},
+
+		{
+			in: &Config{
+				Token:          "xyz",
+				SubscriptionID: "go-nozzle-A",
+				FirehoseGroup:  "go-nozzle-group",
+				rawConsumer:    &testRawConsumer{},
+			},
+			success: false,
+			errStr:  "FirehoseGroup can only be used with UseRLP",
+		},
+
+		{
+			in: &Config{
+				Token:         "xyz",
+				UAAHTTPClient: http.DefaultClient,
+				rawConsumer:   &testRawConsumer{},
+			},
+			success: false,
+			errStr:  "UAAHTTPClient can only be used with UaaAddr",
+		},
+
+		{
+			in: &Config{
+				Token:               "xyz",
+				SubscriptionID:      "go-nozzle-A",
+				DedupErrors:         true,
+				DedupErrorsInterval: -1 * time.Second,
+				rawConsumer:         &testRawConsumer{},
+			},
+			success: false,
+			errStr:  "DedupErrorsInterval must not be negative",
+		},
+
+		{
+			in: &Config{
+				Token:               "xyz",
+				SubscriptionID:      "go-nozzle-A",
+				DedupErrorsInterval: 1 * time.Second,
+				rawConsumer:         &testRawConsumer{},
+			},
+			success: false,
+			errStr:  "DedupErrorsInterval can only be used with DedupErrors",
+		},
+
+		{
+			in: &Config{
+				Token:          "xyz",
+				SubscriptionID: "go-nozzle-A",
+				MinTLSVersion:  0x0305,
+				rawConsumer:    &testRawConsumer{},
+			},
+			success: false,
+			errStr:  "MinTLSVersion 0x0305 is not a known TLS version",
+		},
+
+		{
+			// DopplerAddr is required even with NoaaConsumer
+			in: &Config{
+				Token:          "xyz",
+				SubscriptionID: "A",
+				NoaaConsumer:   noaaConsumer.New("wss://doppler.cf.example.com", nil, nil),
+			},
+			success: false,
+			errStr:  "DopplerAddr must not be empty",
+		},
+
+		{
+			in: &Config{
+				DopplerAddr:     "wss://doppler.cf.example.com",
+				Token:           "xyz",
+				SubscriptionIDs: []string{"A", "B"},
+				NoaaConsumer:    noaaConsumer.New("wss://doppler.cf.example.com", nil, nil),
+			},
+			success: false,
+			errStr:  "NoaaConsumer can not be used with multiple subscription IDs",
+		},
+
+		{
+			in: &Config{
+				TokenProvider: &testTokenProvider{},
+			},
+			success: false,
+			errStr:  "no token provided",
+		},
+
+		{
+			in: &Config{
+				TokenProvider: &testTokenProvider{
+					token: "abc",
+				},
+				rawConsumer: &testRawConsumer{},
+			},
+			success: true,
+		},
 	}
 
 	for i, tc := range cases {
@@ -206,6 +624,338 @@ func TestNewDefaultConsumer(t *testing.T) {
 	}
 }
 
+func TestNewConsumerContext_uaaTimeout(t *testing.T) {
+	t.Parallel()
+
+	// Create server it just waits for timout of client
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1 * time.Second)
+	}))
+	defer ts.Close()
+
+	config := &Config{
+		DopplerAddr:    "wss://doppler.cf.example.com",
+		SubscriptionID: "A",
+		UaaAddr:        ts.URL,
+		Username:       "admin",
+		Password:       "nipr8qhbp89pq",
+
+		// UaaTimeout is shorter than the deadline of ctx
+		UaaTimeout: 10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	_, err := NewConsumerContext(ctx, config)
+	if err == nil {
+		t.Fatalf("expect to be failed")
+	}
+
+	expect := fmt.Sprintf("request timeout to UAA (%s)", ts.URL)
+	if !strings.Contains(err.Error(), expect) {
+		t.Fatalf("expects error message %q to contain %q", err.Error(), expect)
+	}
+}
+
+func TestNewConsumerContext_nil(t *testing.T) {
+	_, err := NewConsumerContext(nil, &Config{Token: "xyz"})
+	if err == nil {
+		t.Fatalf("expect to be failed")
+	}
+}
+
+func TestNewRawConsumer(t *testing.T) {
+	cases := []struct {
+		in      *Config
+		success bool
+		errStr  string
+	}{
+		{
+			in: &Config{
+				DopplerAddr:    "wss://doppler.cf.example.com",
+				Token:          "xyz",
+				SubscriptionID: "A",
+			},
+			success: true,
+		},
+
+		{
+			in: &Config{
+				DopplerAddr:    "wss://doppler.cf.example.com",
+				SubscriptionID: "A",
+				tokenFetcher: &testTokenFetcher{
+					Token: "nabuiebaoijgbeiuabvlrijgbaobq",
+				},
+				UaaAddr: "https://uaa.cloudfoundry.net",
+			},
+			success: true,
+		},
+
+		{
+			in: &Config{
+				Token:          "xyz",
+				SubscriptionID: "A",
+			},
+			success: false,
+			errStr:  "DopplerAddr must not be empty",
+		},
+	}
+
+	for i, tc := range cases {
+		rc, err := NewRawConsumer(tc.in)
+		if tc.success {
+			if err != nil {
+				t.Fatalf("#%d expects %q to be nil", i, err)
+			}
+
+			if _, ok := rc.(*rawDefaultConsumer); !ok {
+				t.Fatalf("#%d expects %T to be *rawDefaultConsumer", i, rc)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("#%d expects to be failed", i)
+		}
+
+		if !strings.Contains(err.Error(), tc.errStr) {
+			t.Fatalf("#%d expects err message %q to contain %q", i, err.Error(), tc.errStr)
+		}
+	}
+}
+
+// testFlakyTokenFetcher fails to fetch token failures times.
+type testFlakyTokenFetcher struct {
+	failures int
+	calls    int
+}
+
+func (f *testFlakyTokenFetcher) Fetch(_ context.Context) (string, time.Duration, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return "", 0, fmt.Errorf("uaa is unavailable")
+	}
+
+	return "nabuiebaoijgbeiuabvlrijgbaobq", 0, nil
+}
+
+func TestFetchToken_retry(t *testing.T) {
+	cases := []struct {
+		limit    int
+		failures int
+		success  bool
+		calls    int
+		errStr   string
+	}{
+		// Single-shot
+		{limit: 0, failures: 1, success: false, calls: 1, errStr: "failed to fetch token: uaa is unavailable"},
+		{limit: 1, failures: 1, success: false, calls: 1, errStr: "failed to fetch token: uaa is unavailable"},
+
+		// Retried
+		{limit: 3, failures: 2, success: true, calls: 3},
+		{limit: 3, failures: 3, success: false, calls: 3, errStr: "failed to fetch token after 3 attempts: uaa is unavailable"},
+	}
+
+	for i, tc := range cases {
+		config := &Config{
+			UAARetryLimit:   tc.limit,
+			uaaRetryBackoff: &ConstantBackoff{Interval: 1 * time.Millisecond},
+		}
+		fetcher := &testFlakyTokenFetcher{failures: tc.failures}
+
+		_, _, err := fetchToken(context.Background(), config, fetcher, &stdLogger{logger: defaultLogger})
+		if fetcher.calls != tc.calls {
+			t.Fatalf("#%d expects %d to be eq %d", i, fetcher.calls, tc.calls)
+		}
+
+		if tc.success {
+			if err != nil {
+				t.Fatalf("#%d err: %s", i, err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("#%d expects to be failed", i)
+		}
+
+		if got := err.Error(); got != tc.errStr {
+			t.Fatalf("#%d expects %q to be eq %q", i, got, tc.errStr)
+		}
+	}
+}
+
+func TestFetchToken_retryContext(t *testing.T) {
+	config := &Config{
+		UAARetryLimit:   10,
+		uaaRetryBackoff: &ConstantBackoff{Interval: 1 * time.Minute},
+	}
+	fetcher := &testFlakyTokenFetcher{failures: 10}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err := fetchToken(ctx, config, fetcher, &stdLogger{logger: defaultLogger})
+	if err == nil {
+		t.Fatalf("expect to be failed")
+	}
+
+	// Retry is stopped by deadline of ctx
+	if fetcher.calls != 1 {
+		t.Fatalf("expects %d to be eq %d", fetcher.calls, 1)
+	}
+}
+
+func TestNewSubscriptionsConsumer(t *testing.T) {
+	cases := []struct {
+		subscriptionID  string
+		subscriptionIDs []string
+		expect          []string
+	}{
+		{
+			subscriptionID: "A",
+			expect:         []string{"A"},
+		},
+
+		{
+			subscriptionIDs: []string{"A"},
+			expect:          []string{"A"},
+		},
+
+		{
+			subscriptionID:  "A",
+			subscriptionIDs: []string{"B", "C"},
+			expect:          []string{"A", "B", "C"},
+		},
+	}
+
+	for i, tc := range cases {
+		config := &Config{
+			DopplerAddr:     "wss://doppler.cf.example.com",
+			Token:           "xyz",
+			SubscriptionID:  tc.subscriptionID,
+			SubscriptionIDs: tc.subscriptionIDs,
+			Logger:          defaultLogger,
+		}
+
+		rc, err := newSubscriptionsConsumer(config, nil)
+		if err != nil {
+			t.Fatalf("#%d expect not to fail: %s", i, err)
+		}
+
+		var consumers []RawConsumer
+		if mrc, ok := rc.(*multiRawConsumer); ok {
+			consumers = mrc.consumers
+		} else {
+			consumers = []RawConsumer{rc}
+		}
+
+		var got []string
+		for _, c := range consumers {
+			got = append(got, c.(*rawDefaultConsumer).subscriptionID)
+		}
+
+		if !reflect.DeepEqual(got, tc.expect) {
+			t.Fatalf("#%d expect %v to be eq %v", i, got, tc.expect)
+		}
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	pool := x509.NewCertPool()
+	tests := []struct {
+		in             *Config
+		expectInsecure bool
+		expectRootCAs  *x509.CertPool
+		expectMinVer   uint16
+	}{
+		{
+			in:             &Config{},
+			expectInsecure: false,
+			expectMinVer:   tls.VersionTLS12,
+		},
+
+		{
+			in:             &Config{Insecure: true},
+			expectInsecure: true,
+			expectMinVer:   tls.VersionTLS12,
+		},
+
+		{
+			in:           &Config{MinTLSVersion: tls.VersionTLS13},
+			expectMinVer: tls.VersionTLS13,
+		},
+
+		{
+			in: &Config{
+				TLSConfig: &tls.Config{RootCAs: pool},
+			},
+			expectInsecure: false,
+			expectRootCAs:  pool,
+			expectMinVer:   tls.VersionTLS12,
+		},
+
+		{
+			// MinVersion of TLSConfig is respected by default
+			in: &Config{
+				TLSConfig: &tls.Config{MinVersion: tls.VersionTLS13},
+			},
+			expectMinVer: tls.VersionTLS13,
+		},
+
+		{
+			in: &Config{
+				TLSConfig:     &tls.Config{MinVersion: tls.VersionTLS13},
+				MinTLSVersion: tls.VersionTLS12,
+			},
+			expectMinVer: tls.VersionTLS12,
+		},
+
+		{
+			// Insecure overrides TLSConfig only when it's true
+			in: &Config{
+				TLSConfig: &tls.Config{RootCAs: pool},
+				Insecure:  true,
+			},
+			expectInsecure: true,
+			expectRootCAs:  pool,
+			expectMinVer:   tls.VersionTLS12,
+		},
+
+		{
+			in: &Config{
+				TLSConfig: &tls.Config{InsecureSkipVerify: true},
+				Insecure:  false,
+			},
+			expectInsecure: true,
+			expectMinVer:   tls.VersionTLS12,
+		},
+	}
+
+	for i, tt := range tests {
+		out := newTLSConfig(tt.in)
+		if out.InsecureSkipVerify != tt.expectInsecure {
+			t.Fatalf("#%d expects %v to be eq %v", i, out.InsecureSkipVerify, tt.expectInsecure)
+		}
+
+		if out.RootCAs != tt.expectRootCAs {
+			t.Fatalf("#%d expects RootCAs to be same", i)
+		}
+
+		if out.MinVersion != tt.expectMinVer {
+			t.Fatalf("#%d expects %x to be eq %x", i, out.MinVersion, tt.expectMinVer)
+		}
+	}
+
+	// User's config must not be modified
+	in := &tls.Config{}
+	newTLSConfig(&Config{TLSConfig: in, Insecure: true})
+	if in.InsecureSkipVerify {
+		t.Fatalf("expect TLSConfig not to be modified")
+	}
+}
+
 func TestMaskString(t *testing.T) {
 	tests := []struct {
 		in, expect string
@@ -0,0 +1,126 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// RunParallel reads events (or batches of events) and passes them to
+// handler on workers goroutines until ctx is canceled or Events() is
+// closed (i.e., consumer is closed). It waits all workers to finish
+// before returning. It returns ctx.Err() if ctx is canceled, otherwise nil.
+//
+// Consumer must be started before RunParallel. RunParallel doesn't close
+// consumer.
+func (c *consumer) RunParallel(ctx context.Context, workers int, handler func(*events.Envelope) error) error {
+	if ctx == nil {
+		return fmt.Errorf("context must not be nil")
+	}
+
+	if workers <= 0 {
+		return fmt.Errorf("workers must be positive")
+	}
+
+	if c.doneCh == nil {
+		return fmt.Errorf("consumer is not started")
+	}
+
+	// Without key, all workers share one channel. Otherwise, each
+	// worker has its own channel so that events of same key are
+	// processed in order.
+	n := 1
+	if c.preserveOrderBy != nil {
+		n = workers
+	}
+
+	workerChs := make([]chan *events.Envelope, n)
+	for i := range workerChs {
+		workerChs[i] = make(chan *events.Envelope)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(ch <-chan *events.Envelope) {
+			defer wg.Done()
+			for event := range ch {
+				if err := handler(event); err != nil {
+					c.sendHandlerError(ctx, err)
+				}
+			}
+		}(workerChs[i%n])
+	}
+
+	defer func() {
+		for _, ch := range workerChs {
+			close(ch)
+		}
+		wg.Wait()
+	}()
+
+	dispatch := func(event *events.Envelope) bool {
+		ch := workerChs[0]
+		if c.preserveOrderBy != nil {
+			ch = workerChs[workerIndex(c.preserveOrderBy(event), n)]
+		}
+
+		select {
+		case ch <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	eventCh, batchCh := c.Events(), c.BatchEvents()
+	for eventCh != nil || batchCh != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-eventCh:
+			if !ok {
+				eventCh = nil
+				continue
+			}
+			if !dispatch(event) {
+				return ctx.Err()
+			}
+		case batch, ok := <-batchCh:
+			if !ok {
+				batchCh = nil
+				continue
+			}
+			for _, event := range batch {
+				if !dispatch(event) {
+					return ctx.Err()
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// sendHandlerError sends err returned by handler to Errors(). If
+// forwarding errors is already finished (e.g., upstream is stopped
+// without Close), err is only logged.
+func (c *consumer) sendHandlerError(ctx context.Context, err error) {
+	select {
+	case c.handlerErrCh <- err:
+	case <-c.errDoneCh:
+		c.logger.Warn("Dropped handler error since forwarding errors is finished", "error", err)
+	case <-c.doneCh:
+	case <-ctx.Done():
+	}
+}
+
+// workerIndex returns the index of worker for key.
+func workerIndex(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
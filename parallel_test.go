@@ -0,0 +1,171 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestConsumerRunParallel_preserveOrder(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		preserveOrderBy: func(e *events.Envelope) string {
+			return e.GetOrigin()
+		},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	origins := []string{"a", "b", "c"}
+	n := 100
+
+	var mu sync.Mutex
+	received := make(map[string][]int64)
+	doneCh := make(chan struct{})
+	handler := func(e *events.Envelope) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received[e.GetOrigin()] = append(received[e.GetOrigin()], e.GetTimestamp())
+		if len(received[e.GetOrigin()]) == n && len(received) == len(origins) {
+			total := 0
+			for _, ts := range received {
+				total += len(ts)
+			}
+			if total == n*len(origins) {
+				close(doneCh)
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.RunParallel(ctx, 4, handler)
+	}()
+
+	go func() {
+		for i := 0; i < n; i++ {
+			for _, origin := range origins {
+				rc.eventCh <- &events.Envelope{
+					Origin:    proto.String(origin),
+					Timestamp: proto.Int64(int64(i)),
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("expect %v to be eq %v", err, context.Canceled)
+	}
+
+	for origin, ts := range received {
+		for i := range ts {
+			if got, expect := ts[i], int64(i); got != expect {
+				t.Fatalf("%s: expect %d to be eq %d", origin, got, expect)
+			}
+		}
+	}
+}
+
+func TestConsumerRunParallel_handlerError(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go c.RunParallel(ctx, 2, func(e *events.Envelope) error {
+		return fmt.Errorf("failed to handle")
+	})
+
+	rc.eventCh <- &events.Envelope{}
+
+	select {
+	case err := <-c.Errors():
+		if got, expect := err.Error(), "failed to handle"; got != expect {
+			t.Fatalf("expect %q to be eq %q", got, expect)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect handler error to be sent to Errors()")
+	}
+}
+
+func TestConsumerRunParallel_handlerErrorAfterUpstreamStopped(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	// Handler fails after forwarding errors is finished
+	handler := func(e *events.Envelope) error {
+		<-c.errDoneCh
+		return fmt.Errorf("failed to handle")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.RunParallel(context.Background(), 2, handler)
+	}()
+
+	rc.eventCh <- &events.Envelope{}
+
+	// Upstream stops without Close
+	close(rc.errCh)
+	rc.errCh = nil
+	close(rc.eventCh)
+	rc.eventCh = nil
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect RunParallel not to hang")
+	}
+}
+
+func TestConsumerRunParallel_invalid(t *testing.T) {
+	c := &consumer{}
+	handler := func(*events.Envelope) error { return nil }
+
+	if err := c.RunParallel(context.Background(), 0, handler); err == nil {
+		t.Fatalf("expect zero workers to fail")
+	}
+
+	if err := c.RunParallel(context.Background(), 1, handler); err == nil {
+		t.Fatalf("expect not started consumer to fail")
+	}
+}
@@ -0,0 +1,48 @@
+package nozzle
+
+// Pause stops forwarding events to Events() until Resume is called.
+// Since events are not read from rawConsumer while paused, doppler
+// buffers them and may drop them (or close connection) by its slow
+// consumer policy when paused for long. Errors and slowConsumerAlerts
+// are still delivered. It does nothing if already paused.
+func (c *consumer) Pause() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+
+	if c.resumeCh == nil {
+		c.logger.Info("Pause consuming events")
+		c.resumeCh = make(chan struct{})
+	}
+}
+
+// Resume restarts forwarding events paused by Pause. It does nothing
+// if not paused.
+func (c *consumer) Resume() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+
+	if c.resumeCh != nil {
+		c.logger.Info("Resume consuming events")
+		close(c.resumeCh)
+		c.resumeCh = nil
+	}
+}
+
+// waitResume blocks while consumer is paused. It returns false if
+// forwarding is stopped while waiting.
+func (c *consumer) waitResume() bool {
+	c.pauseMu.Lock()
+	resumeCh := c.resumeCh
+	c.pauseMu.Unlock()
+
+	if resumeCh == nil {
+		return true
+	}
+
+	select {
+	case <-resumeCh:
+		return true
+	case <-c.doneCh:
+		return false
+	}
+}
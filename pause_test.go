@@ -0,0 +1,80 @@
+package nozzle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func TestConsumerPause(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	c.Pause()
+
+	// Pause multiple times does nothing
+	c.Pause()
+
+	go func() {
+		rc.eventCh <- &events.Envelope{}
+	}()
+
+	select {
+	case <-c.Events():
+		t.Fatalf("expect event not to be forwarded while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c.Resume()
+
+	select {
+	case <-c.Events():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect event to be forwarded after resumed")
+	}
+
+	// Resume without pause does nothing
+	c.Resume()
+}
+
+func TestConsumerPause_close(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c.Pause()
+	go func() {
+		rc.eventCh <- &events.Envelope{}
+	}()
+
+	// Close must not be blocked while paused
+	errCh := make(chan error)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		errCh <- c.Close()
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect close not to be blocked")
+	}
+}
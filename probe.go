@@ -0,0 +1,126 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// probeSubscriptionSuffix is appended to SubscriptionID while probing
+// not to take events from the pool of running nozzles.
+const probeSubscriptionSuffix = "-probe"
+
+// Probe validates config, fetches token (if Token is empty) and opens
+// then immediately closes a connection with every doppler address. It
+// returns the error of the first failure, so that it can be used as
+// preflight check (e.g., in CI or at container startup) before starting
+// consumer. Events received while probing are discarded.
+//
+// Since noaa retries connection by itself, the connection attempt is
+// regarded as failure when the first error is reported. Probing waits
+// until ctx is done at most. It's not supported with UseRLP, ReplayFile
+// or ReplayReader. config is not modified.
+func Probe(ctx context.Context, config *Config) error {
+	if ctx == nil {
+		return fmt.Errorf("context must not be nil")
+	}
+
+	if config.UseRLP {
+		return fmt.Errorf("Probe can not be used with UseRLP")
+	}
+
+	if config.ReplayFile != "" {
+		return fmt.Errorf("Probe can not be used with ReplayFile")
+	}
+
+	if config.ReplayReader != nil {
+		return fmt.Errorf("Probe can not be used with ReplayReader")
+	}
+
+	cfg := *config
+	if cfg.Logger == nil {
+		cfg.Logger = defaultLogger
+	}
+
+	if err := validateConfig(&cfg); err != nil {
+		return err
+	}
+
+	if err := setupDopplerAddr(ctx, &cfg); err != nil {
+		return err
+	}
+
+	if _, _, err := setupToken(ctx, &cfg); err != nil {
+		return err
+	}
+
+	rc, err := newRawDefaultConsumer(&cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range rc.dopplerAddrs {
+		if err := rc.probe(ctx, addr); err != nil {
+			return fmt.Errorf("failed to connect to doppler %s: %w", addr, err)
+		}
+	}
+
+	return nil
+}
+
+// probe opens a connection with addr and closes it when it's
+// established or the first error is reported.
+func (c *rawDefaultConsumer) probe(ctx context.Context, addr string) error {
+	c.logger.Info("Probing doppler", "doppler_addr", addr)
+
+	nc := c.newNoaaConsumer(addr)
+	if c.debugPrinter != nil {
+		nc.SetDebugPrinter(c.debugPrinter)
+	}
+
+	connectedCh := make(chan struct{})
+	var once sync.Once
+	nc.SetOnConnectCallback(func() {
+		once.Do(func() { close(connectedCh) })
+	})
+
+	var eventCh <-chan *events.Envelope
+	var errCh <-chan error
+	if c.appGUID != "" {
+		eventCh, errCh = nc.Stream(c.appGUID, c.token)
+	} else {
+		eventCh, errCh = nc.Firehose(c.subscriptionID+probeSubscriptionSuffix, c.token)
+	}
+
+	// Discard events not to block noaa until it closes
+	// the channels after Close.
+	go func() {
+		for range eventCh {
+		}
+	}()
+
+	defer func() {
+		if err := nc.Close(); err != nil {
+			c.logger.Debug("Failed to close probing connection", "error", err)
+		}
+
+		go func() {
+			for range errCh {
+			}
+		}()
+	}()
+
+	select {
+	case <-connectedCh:
+		return nil
+	case err, ok := <-errCh:
+		if !ok {
+			return fmt.Errorf("connection is closed")
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
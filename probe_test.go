@@ -0,0 +1,167 @@
+package nozzle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	t.Parallel()
+
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+	inputCh := make(chan []byte)
+	ts := NewDopplerServer(t, inputCh, authToken)
+	defer ts.Close()
+	defer close(inputCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	config := &Config{
+		DopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
+		Token:          authToken,
+		SubscriptionID: "test-go-nozzle-A",
+	}
+
+	if err := Probe(ctx, config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProbe_apiAddr(t *testing.T) {
+	t.Parallel()
+
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+	inputCh := make(chan []byte)
+	ts := NewDopplerServer(t, inputCh, authToken)
+	defer ts.Close()
+	defer close(inputCh)
+
+	dopplerAddr := strings.Replace(ts.URL, "http:", "ws:", 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"doppler_logging_endpoint":%q}`, dopplerAddr)
+	}))
+	defer api.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Doppler address is discovered same as NewConsumer
+	config := &Config{
+		APIAddr:        api.URL,
+		Token:          authToken,
+		SubscriptionID: "test-go-nozzle-A",
+	}
+
+	if err := Probe(ctx, config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.DopplerAddr != "" {
+		t.Fatalf("expect config not to be modified")
+	}
+}
+
+func TestRawConsumerProbe_userAgent(t *testing.T) {
+	t.Parallel()
+
+	uaCh := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case uaCh <- r.Header.Get("User-Agent"):
+		default:
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	rc, err := newRawDefaultConsumer(&Config{
+		DopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
+		Token:          "n98ubNOIUog9gOPUbvqiur",
+		SubscriptionID: "test-go-nozzle-A",
+		ConsumerName:   "my-nozzle/1.0",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	rc.probe(ctx, rc.dopplerAddr)
+
+	select {
+	case got := <-uaCh:
+		if expect := "my-nozzle/1.0"; got != expect {
+			t.Fatalf("expect %q to be eq %q", got, expect)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect handshake request")
+	}
+}
+
+func TestProbe_unauthorized(t *testing.T) {
+	t.Parallel()
+
+	inputCh := make(chan []byte)
+	ts := NewDopplerServer(t, inputCh, "n98ubNOIUog9gOPUbvqiur")
+	defer ts.Close()
+	defer close(inputCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	config := &Config{
+		DopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
+		Token:          "invalid",
+		SubscriptionID: "test-go-nozzle-A",
+	}
+
+	err := Probe(ctx, config)
+	if err == nil {
+		t.Fatalf("expect to be failed")
+	}
+
+	if !strings.Contains(err.Error(), "failed to connect to doppler") {
+		t.Fatalf("expect %q to contain address", err.Error())
+	}
+}
+
+func TestProbe_invalid(t *testing.T) {
+	cases := []struct {
+		in     *Config
+		errStr string
+	}{
+		{
+			in:     &Config{UseRLP: true},
+			errStr: "Probe can not be used with UseRLP",
+		},
+
+		{
+			in:     &Config{ReplayFile: "events.bin"},
+			errStr: "Probe can not be used with ReplayFile",
+		},
+
+		{
+			in:     &Config{ReplayReader: &bytes.Buffer{}},
+			errStr: "Probe can not be used with ReplayReader",
+		},
+
+		{
+			in:     &Config{Token: "xyz", SubscriptionID: "A"},
+			errStr: "DopplerAddr must not be empty",
+		},
+	}
+
+	for i, tc := range cases {
+		err := Probe(context.Background(), tc.in)
+		if err == nil || err.Error() != tc.errStr {
+			t.Fatalf("#%d expect %v to be %q", i, err, tc.errStr)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package nozzle
+
+import (
+	"fmt"
+	"time"
+)
+
+// RateLimitMode defines what to do with envelopes which exceed
+// Config.MaxEventsPerSecond.
+type RateLimitMode int
+
+const (
+	// RateLimitBlock blocks forwarding envelopes until rate limit
+	// allows. Back pressure is propagated to upstream (firehose).
+	// This is the default.
+	RateLimitBlock RateLimitMode = iota
+
+	// RateLimitDrop drops envelopes which exceed rate limit.
+	// The number of dropped envelopes is counted by metrics.
+	RateLimitDrop
+)
+
+// String returns the name of mode.
+func (m RateLimitMode) String() string {
+	switch m {
+	case RateLimitBlock:
+		return "Block"
+	case RateLimitDrop:
+		return "Drop"
+	default:
+		return fmt.Sprintf("RateLimitMode(%d)", int(m))
+	}
+}
+
+// rateLimiter is a token bucket which allows perSecond events in one
+// second with burst up to perSecond. It's not goroutine safe and is
+// only used from the goroutine forwarding events.
+type rateLimiter struct {
+	perSecond float64
+	tokens    float64
+	last      time.Time
+	clock     Clock
+}
+
+// newRateLimiter constructs rateLimiter which is filled by clock.
+// Bucket is full at first.
+func newRateLimiter(perSecond int, clock Clock) *rateLimiter {
+	return &rateLimiter{
+		perSecond: float64(perSecond),
+		tokens:    float64(perSecond),
+		clock:     clock,
+	}
+}
+
+// allow consumes a token and returns true if it's available.
+// Otherwise, it returns false without consuming.
+func (l *rateLimiter) allow() bool {
+	l.fill()
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
+
+// reserve consumes a token and returns how long caller needs to wait
+// before the token is available. It returns 0 if it's available now.
+func (l *rateLimiter) reserve() time.Duration {
+	l.fill()
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.perSecond * float64(time.Second))
+}
+
+// fill adds tokens for the time elapsed since last call.
+func (l *rateLimiter) fill() {
+	now := l.clock.Now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.perSecond
+		if l.tokens > l.perSecond {
+			l.tokens = l.perSecond
+		}
+	}
+	l.last = now
+}
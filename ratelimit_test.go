@@ -0,0 +1,153 @@
+package nozzle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimiter_allow(t *testing.T) {
+	clock := newFakeClock()
+	l := newRateLimiter(2, clock)
+
+	cases := []struct {
+		elapsed time.Duration
+		expect  bool
+	}{
+		// Bucket is full at first
+		{0, true},
+		{0, true},
+		{0, false},
+
+		// 1 token is filled in 500ms
+		{500 * time.Millisecond, true},
+		{0, false},
+
+		// Tokens are not filled over the burst
+		{10 * time.Second, true},
+		{0, true},
+		{0, false},
+	}
+
+	for i, tc := range cases {
+		clock.Advance(tc.elapsed)
+		if got := l.allow(); got != tc.expect {
+			t.Fatalf("#%d expect %v to be eq %v", i, got, tc.expect)
+		}
+	}
+}
+
+func TestRateLimiter_reserve(t *testing.T) {
+	clock := newFakeClock()
+	l := newRateLimiter(2, clock)
+
+	cases := []struct {
+		elapsed time.Duration
+		expect  time.Duration
+	}{
+		{0, 0},
+		{0, 0},
+		{0, 500 * time.Millisecond},
+		{0, 1 * time.Second},
+
+		// Reserved tokens are paid back
+		{1 * time.Second, 500 * time.Millisecond},
+	}
+
+	for i, tc := range cases {
+		clock.Advance(tc.elapsed)
+		if got := l.reserve(); got != tc.expect {
+			t.Fatalf("#%d expect %s to be eq %s", i, got, tc.expect)
+		}
+	}
+}
+
+func TestRateLimitMode_String(t *testing.T) {
+	cases := []struct {
+		in     RateLimitMode
+		expect string
+	}{
+		{RateLimitBlock, "Block"},
+		{RateLimitDrop, "Drop"},
+		{RateLimitMode(10), "RateLimitMode(10)"},
+	}
+
+	for i, tc := range cases {
+		if got := tc.in.String(); got != tc.expect {
+			t.Fatalf("#%d expect %q to be eq %q", i, got, tc.expect)
+		}
+	}
+}
+
+func TestConsumer_rateLimitDrop(t *testing.T) {
+	t.Parallel()
+
+	m, err := newMetrics(prometheus.NewRegistry(), func() float64 { return 0 })
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Only first event is allowed in this test
+	limiter := newRateLimiter(1, newFakeClock())
+
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:   rc,
+		logger:        &stdLogger{logger: defaultLogger},
+		metrics:       m,
+		rateLimiter:   limiter,
+		rateLimitMode: RateLimitDrop,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		rc.eventCh <- &events.Envelope{
+			EventType: events.Envelope_ValueMetric.Enum(),
+		}
+
+		// Dropped envelope is still inspected by slow detector
+		rc.eventCh <- &events.Envelope{
+			Origin:    proto.String("doppler"),
+			EventType: events.Envelope_CounterEvent.Enum(),
+			CounterEvent: &events.CounterEvent{
+				Name: proto.String("TruncatingBuffer.DroppedMessages"),
+			},
+		}
+	}()
+
+	select {
+	case event := <-c.Events():
+		if got := event.GetEventType(); got != events.Envelope_ValueMetric {
+			t.Fatalf("expect %s to be eq %s", got, events.Envelope_ValueMetric)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	select {
+	case alert := <-c.Detects():
+		if alert.Reason != SlowAlertReasonTruncated {
+			t.Fatalf("expect %q to be eq %q", alert.Reason, SlowAlertReasonTruncated)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect slowConsumerAlert to be detected")
+	}
+
+	select {
+	case event := <-c.Events():
+		t.Fatalf("expect event to be dropped: %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if got := testutil.ToFloat64(m.rateLimited); got != 1 {
+		t.Fatalf("expect %v to be eq %v", got, 1)
+	}
+}
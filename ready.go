@@ -0,0 +1,73 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+)
+
+// WaitReady blocks until the first connection with firehose is
+// established. It returns immediately if it's already established.
+// If consumer stops before connecting (e.g., noaa gives up retrying),
+// it returns the last error reported on Errors() while connecting.
+func (c *consumer) WaitReady(ctx context.Context) error {
+	if ctx == nil {
+		return fmt.Errorf("context must not be nil")
+	}
+
+	if c.readyCh == nil {
+		return fmt.Errorf("consumer is not started")
+	}
+
+	select {
+	case <-c.readyCh:
+		return nil
+	default:
+	}
+
+	select {
+	case <-c.readyCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.errDoneCh:
+	case <-c.doneCh:
+	}
+
+	// Connection may be established at the same time
+	select {
+	case <-c.readyCh:
+		return nil
+	default:
+	}
+
+	c.readyMu.Lock()
+	defer c.readyMu.Unlock()
+	if c.readyErr != nil {
+		return fmt.Errorf("consumer is stopped before connected: %w", c.readyErr)
+	}
+
+	return fmt.Errorf("consumer is stopped before connected")
+}
+
+// markReady notifies WaitReady that connection is established. It's
+// called when rawConsumer notifies it or the first event is received
+// since not all rawConsumers notify connection.
+func (c *consumer) markReady() {
+	c.readyOnce.Do(func() {
+		close(c.readyCh)
+	})
+}
+
+// observeReadyErr records err reported while connecting to return it
+// from WaitReady.
+func (c *consumer) observeReadyErr(err error) {
+	select {
+	case <-c.readyCh:
+		return
+	default:
+	}
+
+	c.readyMu.Lock()
+	c.readyErr = err
+	c.readyMu.Unlock()
+}
@@ -0,0 +1,103 @@
+package nozzle
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func TestConsumerWaitReady(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.WaitReady(context.Background()); err == nil {
+		t.Fatalf("expect to be failed before started")
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect %v to be DeadlineExceeded", err)
+	}
+
+	// Connection is notified by rawConsumer
+	c.emitLifecycle(LifecycleConnected)
+	if err := c.WaitReady(context.Background()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestConsumerWaitReady_firstEvent(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	readyCh := make(chan error, 1)
+	go func() {
+		readyCh <- c.WaitReady(context.Background())
+	}()
+
+	go func() {
+		rc.eventCh <- &events.Envelope{}
+	}()
+
+	select {
+	case err := <-readyCh:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestConsumerWaitReady_stopped(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:   rc,
+		logger:        &stdLogger{logger: defaultLogger},
+		errBufferSize: 1,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	// noaa gives up connecting
+	connErr := errors.New("connection refused")
+	rc.errCh <- connErr
+	close(rc.errCh)
+	rc.errCh = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	err := c.WaitReady(ctx)
+	if !errors.Is(err, connErr) {
+		t.Fatalf("expect %v to wrap %v", err, connErr)
+	}
+
+	if !strings.Contains(err.Error(), "stopped before connected") {
+		t.Fatalf("expect %q to tell consumer is stopped", err.Error())
+	}
+}
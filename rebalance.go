@@ -0,0 +1,107 @@
+package nozzle
+
+import (
+	"math"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// rebalanceThreshold is the total variation distance between the
+// distributions of origins of two consecutive windows above which
+// rebalance is regarded as detected. 0 means same distribution and
+// 1 means no origin is shared.
+const rebalanceThreshold = 0.5
+
+// rebalanceDetector detects doppler rebalancing a shared subscription
+// by a heuristic: the distribution of envelope origins in a window
+// changes suddenly from the previous window. It's not goroutine safe
+// and is only used from the goroutine forwarding events.
+type rebalanceDetector struct {
+	window time.Duration
+
+	// current counts origins from windowStart and previous is the
+	// distribution of the previous window (nil for the first one).
+	current     map[string]int
+	previous    map[string]float64
+	windowStart time.Time
+
+	clock Clock
+}
+
+// newRebalanceDetector constructs rebalanceDetector which measures
+// window by clock.
+func newRebalanceDetector(window time.Duration, clock Clock) *rebalanceDetector {
+	return &rebalanceDetector{
+		window:  window,
+		current: make(map[string]int),
+		clock:   clock,
+	}
+}
+
+// observe counts origin of e and returns the distance of the
+// distributions of origins if rebalance is detected when a window ends.
+// It returns -1 if it's not detected.
+func (d *rebalanceDetector) observe(e *events.Envelope) float64 {
+	now := d.clock.Now()
+	if d.windowStart.IsZero() {
+		d.windowStart = now
+	}
+
+	distance := -1.0
+	if now.Sub(d.windowStart) >= d.window {
+		dist := distribution(d.current)
+		if d.previous != nil && len(dist) > 0 {
+			if v := variationDistance(d.previous, dist); v > rebalanceThreshold {
+				distance = v
+			}
+		}
+
+		if len(dist) > 0 {
+			d.previous = dist
+		}
+		d.current = make(map[string]int)
+		d.windowStart = now
+	}
+
+	d.current[e.GetOrigin()]++
+	return distance
+}
+
+// distribution returns the ratio of each key of counts.
+func distribution(counts map[string]int) map[string]float64 {
+	var total int
+	for _, n := range counts {
+		total += n
+	}
+
+	dist := make(map[string]float64, len(counts))
+	for k, n := range counts {
+		dist[k] = float64(n) / float64(total)
+	}
+	return dist
+}
+
+// variationDistance returns the total variation distance of p and q.
+func variationDistance(p, q map[string]float64) float64 {
+	var sum float64
+	for k, v := range p {
+		sum += math.Abs(v - q[k])
+	}
+	for k, v := range q {
+		if _, ok := p[k]; !ok {
+			sum += v
+		}
+	}
+	return sum / 2
+}
+
+// observeRebalance passes event to rebalanceDetector and notifies
+// LifecycleRebalanced when rebalance is detected.
+func (c *consumer) observeRebalance(event *events.Envelope) {
+	if distance := c.rebalance.observe(event); distance >= 0 {
+		c.logger.Info("Detected rebalance of subscription",
+			"subscription_id", c.config.SubscriptionID, "distance", distance)
+		c.emitLifecycle(LifecycleRebalanced)
+	}
+}
@@ -0,0 +1,100 @@
+package nozzle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestRebalanceDetector_observe(t *testing.T) {
+	clock := newFakeClock()
+	d := newRebalanceDetector(1*time.Minute, clock)
+
+	origin := func(o string) *events.Envelope {
+		return &events.Envelope{Origin: proto.String(o)}
+	}
+
+	cases := []struct {
+		elapsed time.Duration
+		origin  string
+		expect  bool
+	}{
+		// First window
+		{0, "router", false},
+		{0, "cell", false},
+
+		// Second window has same origins
+		{1 * time.Minute, "router", false},
+		{0, "cell", false},
+
+		// Third window has other origins
+		{1 * time.Minute, "uaa", false},
+		{0, "doppler", false},
+
+		// Rebalance is detected when the third window ends
+		{1 * time.Minute, "uaa", true},
+	}
+
+	for i, tc := range cases {
+		clock.Advance(tc.elapsed)
+		if got := d.observe(origin(tc.origin)) >= 0; got != tc.expect {
+			t.Fatalf("#%d expect %v to be eq %v", i, got, tc.expect)
+		}
+	}
+}
+
+func TestVariationDistance(t *testing.T) {
+	cases := []struct {
+		p, q   map[string]float64
+		expect float64
+	}{
+		{map[string]float64{"a": 1}, map[string]float64{"a": 1}, 0},
+		{map[string]float64{"a": 1}, map[string]float64{"b": 1}, 1},
+		{map[string]float64{"a": 0.5, "b": 0.5}, map[string]float64{"a": 1}, 0.5},
+	}
+
+	for i, tc := range cases {
+		if got := variationDistance(tc.p, tc.q); got != tc.expect {
+			t.Fatalf("#%d expect %v to be eq %v", i, got, tc.expect)
+		}
+	}
+}
+
+func TestConsumer_rebalance(t *testing.T) {
+	clock := newFakeClock()
+	d := newRebalanceDetector(1*time.Minute, clock)
+
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		rebalance:   d,
+		clock:       clock,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	for _, origin := range []string{"router", "cell", "uaa"} {
+		rc.eventCh <- &events.Envelope{Origin: proto.String(origin)}
+		<-c.Events()
+		clock.Advance(1 * time.Minute)
+	}
+
+	// Skip other lifecycle events
+	deadline := time.After(1 * time.Second)
+	for {
+		select {
+		case event := <-c.Lifecycle():
+			if event.Phase == LifecycleRebalanced {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("expect rebalance to be notified")
+		}
+	}
+}
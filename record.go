@@ -0,0 +1,124 @@
+package nozzle
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// recorder writes envelopes to a file in the format fileConsumer
+// replays. Writing is buffered and flushed when it's closed.
+type recorder struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+	f  io.WriteCloser
+
+	// zw compresses w before writing to f. It's nil if the file is
+	// not compressed.
+	zw *gzip.Writer
+
+	// stopped is true after writing failed or recorder is closed.
+	// No more envelopes are written then.
+	stopped bool
+}
+
+// newRecorder creates file at path (it's truncated if it exists)
+// and returns recorder which writes to it. If compress is true, the
+// file is compressed by gzip.
+func newRecorder(path string, compress bool) (*recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create record file: %s", err)
+	}
+
+	if !compress {
+		return &recorder{
+			w: bufio.NewWriter(f),
+			f: f,
+		}, nil
+	}
+
+	zw := gzip.NewWriter(f)
+	return &recorder{
+		w:  bufio.NewWriter(zw),
+		f:  f,
+		zw: zw,
+	}, nil
+}
+
+// write writes e to the file. Once it returns error, recording is
+// stopped since the file may be broken at the middle of a record.
+func (r *recorder) write(e *events.Envelope) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return nil
+	}
+
+	if err := writeEnvelope(r.w, e); err != nil {
+		r.stopped = true
+		return fmt.Errorf("failed to write record file: %w", err)
+	}
+
+	return nil
+}
+
+// close flushes buffered envelopes and closes the file. The gzip
+// stream is finalized so that the file can be replayed to the end.
+func (r *recorder) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	if !r.stopped {
+		err = r.w.Flush()
+	}
+	r.stopped = true
+
+	if r.zw != nil {
+		if zerr := r.zw.Close(); zerr != nil && err == nil {
+			err = zerr
+		}
+	}
+
+	if cerr := r.f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// writeEnvelope writes e to w as a length-prefixed record which
+// readEnvelope reads.
+func writeEnvelope(w io.Writer, e *events.Envelope) error {
+	b, err := proto.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	var size [binary.MaxVarintLen64]byte
+	if _, err := w.Write(size[:binary.PutUvarint(size[:], uint64(len(b)))]); err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// record writes event to recorder. Since consumption must not be
+// stopped by recording, a write error is sent to Errors() without
+// blocking forwarding events.
+func (c *consumer) record(event *events.Envelope) {
+	if err := c.recorder.write(event); err != nil {
+		c.logger.Error("Failed to record event, recording is stopped", "error", err)
+		go c.sendHandlerError(c.startCtx, err)
+	}
+}
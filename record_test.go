@@ -0,0 +1,172 @@
+package nozzle
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// failingWriter fails all writes.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+func (failingWriter) Close() error                { return nil }
+
+func TestConsumer_record(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-nozzle")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.bin")
+	r, err := newRecorder(path, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		recorder:    r,
+
+		// Recorded events include filtered ones
+		filter: func(e *events.Envelope) bool { return e.GetTimestamp() != 1 },
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	go func() {
+		rc.eventCh <- replayEnvelope(1)
+		rc.eventCh <- replayEnvelope(2)
+	}()
+
+	select {
+	case <-c.Events():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	// Buffered events are flushed by Close
+	if err := c.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(b))
+	for _, expect := range []int64{1, 2} {
+		event, err := readEnvelope(reader)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if got := event.GetTimestamp(); got != expect {
+			t.Fatalf("expect %d to be eq %d", got, expect)
+		}
+	}
+}
+
+func TestConsumer_recordError(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+
+		// Small buffer so that the first write fails
+		recorder: &recorder{
+			w: bufio.NewWriterSize(failingWriter{}, 16),
+			f: failingWriter{},
+		},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		rc.eventCh <- replayEnvelope(1)
+		rc.eventCh <- replayEnvelope(2)
+	}()
+
+	// Consuming is continued without reading Errors()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-c.Events():
+		case <-time.After(1 * time.Second):
+			t.Fatalf("#%d expect not timeout", i)
+		}
+	}
+
+	select {
+	case err := <-c.Errors():
+		if !strings.Contains(err.Error(), "failed to write record file") {
+			t.Fatalf("expect %q to be write error", err.Error())
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestRecorder_gzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-nozzle")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.bin.gz")
+	config := &Config{ReplayFile: path}
+
+	r, err := newRecorder(path, isCompressed(config, path))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, ts := range []int64{1, 2} {
+		if err := r.write(replayEnvelope(ts)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	if err := r.close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Replayed by decompressing
+	c, err := newFileConsumer(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	eventCh, errCh := c.Consume()
+
+	var got []int64
+	for event := range eventCh {
+		got = append(got, event.GetTimestamp())
+	}
+
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("expect %v to be [1 2]", got)
+	}
+
+	if err, ok := <-errCh; ok {
+		t.Fatalf("expect no error: %s", err)
+	}
+}
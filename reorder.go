@@ -0,0 +1,152 @@
+package nozzle
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// maxReorderEntries is the maximum number of envelopes held by the
+// reorder buffer. The oldest one is released when it's exceeded even
+// if it's still within window.
+const maxReorderEntries = 100000
+
+// reorderItem is an envelope held by the reorder buffer.
+type reorderItem struct {
+	event     *events.Envelope
+	arrivedAt time.Time
+}
+
+// reorderHeap implements heap.Interface. The envelope which has the
+// oldest timestamp is at top.
+type reorderHeap []reorderItem
+
+func (h reorderHeap) Len() int { return len(h) }
+func (h reorderHeap) Less(i, j int) bool {
+	return h[i].event.GetTimestamp() < h[j].event.GetTimestamp()
+}
+func (h reorderHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *reorderHeap) Push(x interface{}) { *h = append(*h, x.(reorderItem)) }
+func (h *reorderHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// reorderEvents holds events for reorderWindow and forwards them to
+// downstream sorted by timestamp. An event is released when an event
+// newer than it by reorderWindow arrives or reorderWindow elapses after
+// it arrives (so that events are not held while upstream is idle).
+//
+// An event older than the one already released is late. It's forwarded
+// immediately or dropped if dropLateEvents is set, and counted. All held
+// events are released when eventCh is closed.
+func (c *consumer) reorderEvents(eventCh <-chan *events.Envelope) <-chan *events.Envelope {
+	forwardCh := make(chan *events.Envelope, c.eventBufferSize)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(forwardCh)
+
+		clock := orRealClock(c.clock)
+		window := c.reorderWindow
+
+		var held reorderHeap
+		var newest, released int64
+
+		// send forwards event to downstream. It returns false if
+		// forwarding is stopped.
+		send := func(event *events.Envelope) bool {
+			select {
+			case forwardCh <- event:
+				c.sent(stageReorder, forwardCh)
+				return true
+			case <-c.doneCh:
+				return false
+			}
+		}
+
+		// release forwards held events which are ready. If all is true,
+		// all of them are forwarded.
+		release := func(all bool) bool {
+			now := clock.Now()
+			for held.Len() > 0 {
+				top := held[0]
+				ts := top.event.GetTimestamp()
+				ready := all || held.Len() > maxReorderEntries ||
+					ts <= newest-int64(window) || !now.Before(top.arrivedAt.Add(window))
+				if !ready {
+					return true
+				}
+
+				heap.Pop(&held)
+				if ts > released {
+					released = ts
+				}
+
+				if !send(top.event) {
+					return false
+				}
+			}
+			return true
+		}
+
+		// timerCh is started while events are held.
+		var timerCh <-chan time.Time
+		for {
+			if held.Len() > 0 && timerCh == nil {
+				timerCh = clock.After(window / 2)
+			}
+
+			select {
+			case event, ok := <-eventCh:
+				if !ok {
+					release(true)
+					return
+				}
+
+				// The heartbeat marker is not held.
+				if event == heartbeatMarker {
+					if !c.heartbeatReached(stageReorder, event) && !send(event) {
+						return
+					}
+					continue
+				}
+
+				ts := event.GetTimestamp()
+				if ts < released {
+					atomic.AddInt64(&c.lateEvents, 1)
+					if c.dropLateEvents {
+						continue
+					}
+
+					if !send(event) {
+						return
+					}
+					continue
+				}
+
+				if ts > newest {
+					newest = ts
+				}
+
+				heap.Push(&held, reorderItem{event: event, arrivedAt: clock.Now()})
+				if !release(false) {
+					return
+				}
+			case <-timerCh:
+				timerCh = nil
+				if !release(false) {
+					return
+				}
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return forwardCh
+}
@@ -0,0 +1,69 @@
+package nozzle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestConsumer_reorder(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:   rc,
+		logger:        &stdLogger{logger: defaultLogger},
+		clock:         newFakeClock(),
+		reorderWindow: 1 * time.Second,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	envelope := func(ts time.Duration) *events.Envelope {
+		return &events.Envelope{Timestamp: proto.Int64(int64(ts))}
+	}
+
+	go func() {
+		for _, ts := range []time.Duration{3 * time.Second, 1 * time.Second, 2 * time.Second} {
+			rc.eventCh <- envelope(ts)
+		}
+	}()
+
+	// Released when the newer one by window arrives
+	for _, expect := range []time.Duration{1 * time.Second, 2 * time.Second} {
+		select {
+		case event := <-c.Events():
+			if got := time.Duration(event.GetTimestamp()); got != expect {
+				t.Fatalf("expect %s to be eq %s", got, expect)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect not timeout")
+		}
+	}
+
+	// Late one is delivered immediately
+	go func() {
+		rc.eventCh <- envelope(500 * time.Millisecond)
+	}()
+
+	select {
+	case event := <-c.Events():
+		if got, expect := time.Duration(event.GetTimestamp()), 500*time.Millisecond; got != expect {
+			t.Fatalf("expect %s to be eq %s", got, expect)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	if got, expect := c.Stats().LateEvents, int64(1); got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+
+	// Held one is released when upstream is closed
+	remaining := c.Drain()
+	if len(remaining) != 1 || time.Duration(remaining[0].GetTimestamp()) != 3*time.Second {
+		t.Fatalf("expect %v to be the held envelope", remaining)
+	}
+}
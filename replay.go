@@ -0,0 +1,226 @@
+package nozzle
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// maxReplayRecordSize is the maximum size of an envelope record in
+// replay file. It prevents allocating huge buffer for a broken file.
+const maxReplayRecordSize = 16 * 1024 * 1024
+
+// fileConsumer implements RawConsumer. It replays envelopes recorded in
+// a file instead of consuming firehose, e.g., to test downstream
+// pipeline deterministically without Cloud Foundry.
+//
+// Each record is an envelope encoded by protobuf prefixed with its
+// length as uvarint (same as protobuf delimited format).
+type fileConsumer struct {
+	reader io.Reader
+
+	// closer closes the file opened for reader. It's nil if reader
+	// is provided by caller.
+	closer io.Closer
+
+	// speed is the ratio of replay speed to the original timestamps.
+	// If it's 0, envelopes are replayed as fast as possible.
+	speed float64
+
+	// clock is used to wait envelopes by speed. If it's nil, real time
+	// is used.
+	clock Clock
+
+	logger leveledLogger
+
+	// cancel stops replaying.
+	cancel context.CancelFunc
+}
+
+// Consume starts replaying envelopes. The returned channels are closed
+// when all envelopes are replayed.
+func (c *fileConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
+	return c.ConsumeContext(context.Background())
+}
+
+// ConsumeContext is same as Consume but replaying is stopped when ctx
+// is canceled. An error reading the file is sent to the error channel
+// and replaying is stopped.
+func (c *fileConsumer) ConsumeContext(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
+	c.logger.Info("Start replaying envelopes", "speed", c.speed)
+
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+
+	eventCh, errCh := make(chan *events.Envelope), make(chan error)
+	go func() {
+		defer close(eventCh)
+		defer close(errCh)
+
+		r := bufio.NewReader(c.reader)
+		clock := orRealClock(c.clock)
+
+		// startedAt and firstTimestamp are the base to keep
+		// the original intervals of envelopes.
+		var startedAt time.Time
+		var firstTimestamp int64
+		for {
+			event, err := readEnvelope(r)
+			if err == io.EOF {
+				c.logger.Info("All envelopes are replayed")
+				return
+			}
+
+			if err != nil {
+				select {
+				case errCh <- fmt.Errorf("failed to read replay file: %w", err):
+				case <-ctx.Done():
+				}
+				return
+			}
+
+			if c.speed > 0 {
+				if startedAt.IsZero() {
+					startedAt, firstTimestamp = clock.Now(), event.GetTimestamp()
+				}
+
+				elapsed := time.Duration(float64(event.GetTimestamp()-firstTimestamp) / c.speed)
+				if d := startedAt.Add(elapsed).Sub(clock.Now()); d > 0 {
+					select {
+					case <-clock.After(d):
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+
+			select {
+			case eventCh <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return eventCh, errCh
+}
+
+// Close stops replaying and closes the file.
+func (c *fileConsumer) Close() error {
+	c.logger.Info("Stop replaying envelopes")
+	if c.cancel == nil {
+		return fmt.Errorf("replay is not started")
+	}
+
+	c.cancel()
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+
+	return nil
+}
+
+// readEnvelope reads a length-prefixed envelope record from r.
+// It returns io.EOF if no more record is in r.
+func readEnvelope(r *bufio.Reader) (*events.Envelope, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > maxReplayRecordSize {
+		return nil, fmt.Errorf("record size %d exceeds %d bytes", size, maxReplayRecordSize)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	var event events.Envelope
+	if err := proto.Unmarshal(buf, &event); err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// newFileConsumer constructs fileConsumer which replays envelopes
+// from config.ReplayReader or config.ReplayFile. The file is
+// decompressed while reading if isCompressed reports it's
+// gzip-compressed.
+func newFileConsumer(config *Config) (*fileConsumer, error) {
+	if config.ReplayReader != nil {
+		return newReaderConsumer(config, config.ReplayReader, nil, config.CompressRecording)
+	}
+
+	f, err := os.Open(config.ReplayFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replay file: %s", err)
+	}
+
+	c, err := newReaderConsumer(config, f, f, isCompressed(config, config.ReplayFile))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// newReaderConsumer constructs fileConsumer which replays envelopes
+// read from r. If compressed is true, r is decompressed by gzip. closer
+// is closed by Close. It's nil if r is not closed by consumer.
+func newReaderConsumer(config *Config, r io.Reader, closer io.Closer, compressed bool) (*fileConsumer, error) {
+	c := &fileConsumer{
+		reader: r,
+		closer: closer,
+		speed:  config.ReplaySpeed,
+		clock:  config.Clock,
+		logger: newLogger(config),
+	}
+
+	if compressed {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip header of replay file: %s", err)
+		}
+
+		c.reader = zr
+		c.closer = closerFunc(func() error {
+			zr.Close()
+			if closer == nil {
+				return nil
+			}
+			return closer.Close()
+		})
+	}
+
+	return c, nil
+}
+
+// isCompressed returns true if the record (or replay) file at path is
+// gzip-compressed, i.e., path ends with ".gz" or CompressRecording is set.
+func isCompressed(config *Config, path string) bool {
+	return config.CompressRecording || strings.HasSuffix(path, ".gz")
+}
+
+// closerFunc adapts a function to io.Closer.
+type closerFunc func() error
+
+// Close calls f.
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,224 @@
+package nozzle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// writeEnvelopes writes envelopes in replay file format.
+func writeEnvelopes(t *testing.T, buf *bytes.Buffer, envelopes ...*events.Envelope) {
+	for _, e := range envelopes {
+		if err := writeEnvelope(buf, e); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+// replayEnvelope returns an envelope which has timestamp ts.
+func replayEnvelope(ts int64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String("fake-origin-1"),
+		EventType: events.Envelope_ValueMetric.Enum(),
+		Timestamp: proto.Int64(ts),
+	}
+}
+
+func TestFileConsumer(t *testing.T) {
+	var buf bytes.Buffer
+	writeEnvelopes(t, &buf, replayEnvelope(1), replayEnvelope(2), replayEnvelope(3))
+
+	c := &fileConsumer{
+		reader: &buf,
+		logger: &stdLogger{logger: defaultLogger},
+	}
+	defer c.Close()
+
+	eventCh, errCh := c.Consume()
+
+	var got []int64
+	for event := range eventCh {
+		got = append(got, event.GetTimestamp())
+	}
+
+	if len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Fatalf("expect %v to be [1 2 3]", got)
+	}
+
+	if err, ok := <-errCh; ok {
+		t.Fatalf("expect no error: %s", err)
+	}
+}
+
+func TestFileConsumer_speed(t *testing.T) {
+	var buf bytes.Buffer
+	writeEnvelopes(t, &buf, replayEnvelope(0), replayEnvelope(int64(1*time.Minute)))
+
+	clock := newFakeClock()
+	c := &fileConsumer{
+		reader: &buf,
+		speed:  2,
+		clock:  clock,
+		logger: &stdLogger{logger: defaultLogger},
+	}
+	defer c.Close()
+
+	eventCh, _ := c.Consume()
+	<-eventCh
+
+	// Twice as fast as original
+	clock.BlockUntil(t, 1)
+	clock.Advance(29 * time.Second)
+
+	select {
+	case <-eventCh:
+		t.Fatalf("expect envelope not to be replayed yet")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	clock.Advance(1 * time.Second)
+
+	select {
+	case event := <-eventCh:
+		if got, expect := event.GetTimestamp(), int64(1*time.Minute); got != expect {
+			t.Fatalf("expect %d to be eq %d", got, expect)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect envelope to be replayed")
+	}
+}
+
+func TestFileConsumer_truncated(t *testing.T) {
+	var buf bytes.Buffer
+	writeEnvelopes(t, &buf, replayEnvelope(1))
+	buf.Truncate(buf.Len() - 1)
+
+	c := &fileConsumer{
+		reader: &buf,
+		logger: &stdLogger{logger: defaultLogger},
+	}
+	defer c.Close()
+
+	_, errCh := c.Consume()
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "failed to read replay file") {
+			t.Fatalf("expect %q to be read error", err.Error())
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestFileConsumer_cancel(t *testing.T) {
+	var buf bytes.Buffer
+	writeEnvelopes(t, &buf, replayEnvelope(0), replayEnvelope(int64(1*time.Hour)))
+
+	c := &fileConsumer{
+		reader: &buf,
+		speed:  1,
+		logger: &stdLogger{logger: defaultLogger},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	eventCh, _ := c.ConsumeContext(ctx)
+	<-eventCh
+	cancel()
+
+	select {
+	case _, ok := <-eventCh:
+		if ok {
+			t.Fatalf("expect event not to be replayed")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect replaying to be stopped")
+	}
+}
+
+func TestNewConsumer_replayFile(t *testing.T) {
+	var buf bytes.Buffer
+	writeEnvelopes(t, &buf, replayEnvelope(1), replayEnvelope(2))
+
+	dir, err := ioutil.TempDir("", "go-nozzle")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.bin")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Neither token nor doppler address is required
+	c, err := NewConsumer(&Config{
+		SubscriptionID: "replay",
+		ReplayFile:     path,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, expect := range []int64{1, 2} {
+		select {
+		case event := <-c.Events():
+			if got := event.GetTimestamp(); got != expect {
+				t.Fatalf("expect %d to be eq %d", got, expect)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect not timeout")
+		}
+	}
+}
+
+func TestNewConsumer_replayReader(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for _, ts := range []int64{1, 2} {
+		if err := writeEnvelope(zw, replayEnvelope(ts)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c, err := NewConsumer(&Config{
+		SubscriptionID:    "replay",
+		ReplayReader:      &buf,
+		CompressRecording: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, expect := range []int64{1, 2} {
+		select {
+		case event := <-c.Events():
+			if got := event.GetTimestamp(); got != expect {
+				t.Fatalf("expect %d to be eq %d", got, expect)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect not timeout")
+		}
+	}
+}
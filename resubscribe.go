@@ -0,0 +1,28 @@
+package nozzle
+
+import (
+	"fmt"
+)
+
+// resubscriber is implemented by rawConsumer which can change its
+// subscription ID without being reconstructed.
+type resubscriber interface {
+	resubscribe(subscriptionID string) error
+}
+
+// Resubscribe tears down the current firehose connection and starts a
+// new one under subscriptionID, reusing the token and TLS config. Events
+// keep flowing on the same Events() channel, so it can be used to
+// migrate to another subscription ID without downtime. Config() still
+// returns the original SubscriptionID.
+//
+// It's only supported by the default rawConsumer with a single
+// subscription ID (not AppGUID, SubscriptionIDs or UseRLP).
+func (c *consumer) Resubscribe(subscriptionID string) error {
+	rs, ok := c.rawConsumer.(resubscriber)
+	if !ok {
+		return fmt.Errorf("Resubscribe is not supported by the raw consumer")
+	}
+
+	return rs.resubscribe(subscriptionID)
+}
@@ -0,0 +1,59 @@
+package nozzle
+
+import (
+	"testing"
+)
+
+func TestConsumerResubscribe_notSupported(t *testing.T) {
+	c := &consumer{
+		rawConsumer: &testRawConsumer{},
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Resubscribe("new-id"); err == nil {
+		t.Fatalf("expect to be failed")
+	}
+}
+
+func TestRawDefaultConsumerResubscribe(t *testing.T) {
+	rc, err := newRawDefaultConsumer(&Config{
+		DopplerAddr:    "wss://doppler.example.com",
+		Token:          "n98ubNOIUog9gOPUbvqiur",
+		SubscriptionID: "old-id",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := rc.resubscribe("bad id!"); err == nil {
+		t.Fatalf("expect to be failed")
+	}
+
+	if got := rc.currentSubscriptionID(); got != "old-id" {
+		t.Fatalf("expect %q to be eq %q", got, "old-id")
+	}
+
+	// Not consuming yet, the ID is used when it starts.
+	if err := rc.resubscribe("new-id"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if got := rc.currentSubscriptionID(); got != "new-id" {
+		t.Fatalf("expect %q to be eq %q", got, "new-id")
+	}
+}
+
+func TestRawDefaultConsumerResubscribe_appGUID(t *testing.T) {
+	rc, err := newRawDefaultConsumer(&Config{
+		DopplerAddr: "wss://doppler.example.com",
+		Token:       "n98ubNOIUog9gOPUbvqiur",
+		AppGUID:     "app-guid",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := rc.resubscribe("new-id"); err == nil {
+		t.Fatalf("expect to be failed")
+	}
+}
@@ -0,0 +1,91 @@
+package nozzle
+
+import (
+	"errors"
+	"net"
+
+	noaaConsumer "github.com/cloudfoundry/noaa/consumer"
+	noaaErrors "github.com/cloudfoundry/noaa/errors"
+	"github.com/gorilla/websocket"
+)
+
+// RetriableError is the error sent to Consumer.Errors() when
+// Config.RetriableErrors is true. It tells whether consuming recovers
+// from the error by itself (e.g., network errors and websocket closes
+// are recovered by reconnecting) or it's permanent (e.g., bad
+// credentials) and the process needs operator's action or restarting.
+// The original error can be retrieved by errors.As or errors.Unwrap.
+type RetriableError struct {
+	// Retriable is true if the error is transient.
+	Retriable bool
+
+	// Err is the original error.
+	Err error
+}
+
+// Error returns the message of the original error.
+func (e *RetriableError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the original error.
+func (e *RetriableError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the error is transient.
+func (e *RetriableError) Temporary() bool {
+	return e.Retriable
+}
+
+// IsTemporary reports whether err (or an error wrapped by it) has
+// Temporary method (e.g., RetriableError or net.Error) which returns
+// true.
+func IsTemporary(err error) bool {
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
+}
+
+// isRetriable classifies err. Websocket closes (except the ones which
+// won't be resolved by reconnecting) and network errors are transient.
+// Authentication failures and noaa giving up retrying are permanent
+// unless reconnect is true, i.e., consumer reconnects after noaa gives
+// up. Unknown errors are regarded as permanent.
+func isRetriable(err error, reconnect bool) bool {
+	var unauthorized *noaaErrors.UnauthorizedError
+	if errors.As(err, &unauthorized) {
+		return false
+	}
+
+	if errors.Is(err, noaaConsumer.ErrMaxRetriesReached) {
+		return reconnect
+	}
+
+	var nonRetry noaaErrors.NonRetryError
+	if errors.As(err, &nonRetry) {
+		return false
+	}
+
+	var retry noaaErrors.RetryError
+	if errors.As(err, &retry) {
+		return true
+	}
+
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		switch closeErr.Code {
+		case websocket.CloseMessageTooBig, websocket.CloseUnsupportedData,
+			websocket.CloseInvalidFramePayloadData:
+			return false
+		default:
+			return true
+		}
+	}
+
+	if errors.Is(err, ErrStaleConnection) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
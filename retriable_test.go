@@ -0,0 +1,89 @@
+package nozzle
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	noaaConsumer "github.com/cloudfoundry/noaa/consumer"
+	"github.com/gorilla/websocket"
+)
+
+func TestIsRetriable(t *testing.T) {
+	cases := []struct {
+		err       error
+		reconnect bool
+		expect    bool
+	}{
+		{&websocket.CloseError{Code: websocket.ClosePolicyViolation}, false, true},
+		{&websocket.CloseError{Code: websocket.CloseAbnormalClosure}, false, true},
+		{&websocket.CloseError{Code: websocket.CloseMessageTooBig}, false, false},
+
+		// Wrapped error is classified
+		{&ConsumeError{Err: &websocket.CloseError{Code: websocket.CloseGoingAway}}, false, true},
+
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, false, true},
+		{ErrStaleConnection, false, true},
+
+		// noaa gives up retrying
+		{noaaConsumer.ErrMaxRetriesReached, false, false},
+		{noaaConsumer.ErrMaxRetriesReached, true, true},
+
+		{errors.New("unknown"), false, false},
+	}
+
+	for i, tc := range cases {
+		if got := isRetriable(tc.err, tc.reconnect); got != tc.expect {
+			t.Fatalf("#%d expect %v to be eq %v", i, got, tc.expect)
+		}
+	}
+}
+
+func TestIsTemporary(t *testing.T) {
+	if !IsTemporary(&ContextError{Err: &RetriableError{Retriable: true, Err: errors.New("")}}) {
+		t.Fatalf("expect wrapped RetriableError to be temporary")
+	}
+
+	if IsTemporary(&RetriableError{Retriable: false, Err: errors.New("")}) {
+		t.Fatalf("expect permanent error not to be temporary")
+	}
+
+	if IsTemporary(errors.New("")) {
+		t.Fatalf("expect error without Temporary not to be temporary")
+	}
+}
+
+func TestConsumer_retriableErrors(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:     rc,
+		logger:          &stdLogger{logger: defaultLogger},
+		retriableErrors: true,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	closeErr := &websocket.CloseError{Code: websocket.CloseAbnormalClosure}
+	go func() {
+		rc.errCh <- closeErr
+	}()
+
+	select {
+	case err := <-c.Errors():
+		var retriableErr *RetriableError
+		if !errors.As(err, &retriableErr) || !retriableErr.Temporary() {
+			t.Fatalf("expect %#v to be temporary RetriableError", err)
+		}
+
+		// Original error is still retrieved
+		if !errors.Is(err, closeErr) {
+			t.Fatalf("expect %v to wrap %v", err, closeErr)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
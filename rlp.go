@@ -0,0 +1,279 @@
+package nozzle
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/go-loggregator"
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// rlpConsumer implements rawConsumer. It consumes Loggregator v2 envelopes
+// from Reverse Log Proxy (RLP) via gRPC and converts them to v1 envelopes,
+// so it can be used instead of the noaa firehose.
+//
+// It uses https://github.com/cloudfoundry/go-loggregator
+type rlpConsumer struct {
+	rlpAddr        string
+	subscriptionID string
+	firehoseGroup  string
+	tlsConfig      *tls.Config
+
+	logger leveledLogger
+
+	// streamLogger is passed to go-loggregator which
+	// only accepts *log.Logger.
+	streamLogger *log.Logger
+
+	// cancel stops streaming from RLP.
+	cancel context.CancelFunc
+}
+
+// Consume starts consuming envelopes from RLP. Reconnection is handled
+// in go-loggregator. It only reports connection and streaming errors
+// by logging them, so each line is logged by streamLogger and also sent
+// to the returned error channel as *ConsumeError.
+func (c *rlpConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
+	return c.ConsumeContext(context.Background())
+}
+
+// ConsumeContext is same as Consume but streaming is stopped when ctx
+// is canceled.
+func (c *rlpConsumer) ConsumeContext(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
+	c.logger.Info("Start consuming envelopes from RLP",
+		"rlp_addr", c.rlpAddr, "shard_id", c.shardID())
+
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+
+	// streamErrCh is never closed since go-loggregator may still write
+	// to streamErrorWriter after streaming is stopped.
+	streamErrCh := make(chan error)
+	streamLogger := log.New(&streamErrorWriter{
+		ctx:    ctx,
+		logger: c.streamLogger,
+		errCh:  streamErrCh,
+	}, "", 0)
+
+	connector := loggregator.NewEnvelopeStreamConnector(c.rlpAddr, c.tlsConfig,
+		loggregator.WithEnvelopeStreamLogger(streamLogger))
+
+	stream := connector.Stream(ctx, &loggregator_v2.EgressBatchRequest{
+		ShardId:          c.shardID(),
+		UsePreferredTags: true,
+		Selectors: []*loggregator_v2.Selector{
+			{Message: &loggregator_v2.Selector_Log{Log: &loggregator_v2.LogSelector{}}},
+			{Message: &loggregator_v2.Selector_Counter{Counter: &loggregator_v2.CounterSelector{}}},
+			{Message: &loggregator_v2.Selector_Gauge{Gauge: &loggregator_v2.GaugeSelector{}}},
+		},
+	})
+
+	eventCh, errCh := make(chan *events.Envelope), make(chan error)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		wg.Wait()
+		close(errCh)
+	}()
+
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case err := <-streamErrCh:
+				select {
+				case errCh <- &ConsumeError{
+					Addr:           c.rlpAddr,
+					SubscriptionID: c.shardID(),
+					Err:            err,
+				}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer close(eventCh)
+		for {
+			// stream blocks until it receives next batch. It returns
+			// nil after ctx is canceled.
+			batch := stream()
+			if ctx.Err() != nil {
+				return
+			}
+
+			for _, e := range batch {
+				for _, event := range convertEnvelope(e) {
+					select {
+					case eventCh <- event:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return eventCh, errCh
+}
+
+// streamErrorWriter is the output of the logger passed to go-loggregator.
+// It writes each line to logger and sends it to errCh as an error
+// until ctx is done.
+type streamErrorWriter struct {
+	ctx    context.Context
+	logger *log.Logger
+	errCh  chan<- error
+}
+
+func (w *streamErrorWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	w.logger.Print(msg)
+
+	select {
+	case w.errCh <- fmt.Errorf("%s", msg):
+	case <-w.ctx.Done():
+	}
+
+	return len(p), nil
+}
+
+// Close stops consuming envelopes from RLP.
+func (c *rlpConsumer) Close() error {
+	c.logger.Info("Stop consuming envelopes from RLP",
+		"rlp_addr", c.rlpAddr, "subscription_id", c.subscriptionID)
+	if c.cancel == nil {
+		return fmt.Errorf("no connection with RLP")
+	}
+
+	c.cancel()
+	return nil
+}
+
+// validate validates struct has requirement fields or not
+func (c *rlpConsumer) validate() error {
+	if c.rlpAddr == "" {
+		return fmt.Errorf("RLPAddr must not be empty")
+	}
+
+	if c.shardID() == "" {
+		return ErrMissingSubscriptionID
+	}
+
+	return nil
+}
+
+// shardID returns the shard ID to request. firehoseGroup takes
+// precedence over subscriptionID.
+func (c *rlpConsumer) shardID() string {
+	if c.firehoseGroup != "" {
+		return c.firehoseGroup
+	}
+	return c.subscriptionID
+}
+
+// newRLPConsumer constructs new rlpConsumer.
+func newRLPConsumer(config *Config) (*rlpConsumer, error) {
+	c := &rlpConsumer{
+		rlpAddr:        config.RLPAddr,
+		subscriptionID: config.SubscriptionID,
+		firehoseGroup:  config.FirehoseGroup,
+		tlsConfig:      newTLSConfig(config),
+		logger:         newLogger(config),
+		streamLogger:   newStdLogger(config),
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// convertEnvelope converts a v2 envelope to v1 envelopes. Since a v2 gauge
+// can contain multiple metrics, it returns one ValueMetric per metric.
+// It returns nil if the v2 envelope type has no v1 counterpart.
+func convertEnvelope(e *loggregator_v2.Envelope) []*events.Envelope {
+	switch {
+	case e.GetCounter() != nil:
+		counter := e.GetCounter()
+		envelope := newV1Envelope(e, events.Envelope_CounterEvent)
+		envelope.CounterEvent = &events.CounterEvent{
+			Name:  proto.String(counter.GetName()),
+			Delta: proto.Uint64(counter.GetDelta()),
+			Total: proto.Uint64(counter.GetTotal()),
+		}
+		return []*events.Envelope{envelope}
+
+	case e.GetGauge() != nil:
+		metrics := e.GetGauge().GetMetrics()
+
+		// Sort by name to make conversion deterministic
+		names := make([]string, 0, len(metrics))
+		for name := range metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		envelopes := make([]*events.Envelope, 0, len(names))
+		for _, name := range names {
+			envelope := newV1Envelope(e, events.Envelope_ValueMetric)
+			envelope.ValueMetric = &events.ValueMetric{
+				Name:  proto.String(name),
+				Value: proto.Float64(metrics[name].GetValue()),
+				Unit:  proto.String(metrics[name].GetUnit()),
+			}
+			envelopes = append(envelopes, envelope)
+		}
+		return envelopes
+
+	case e.GetLog() != nil:
+		l := e.GetLog()
+		messageType := events.LogMessage_OUT
+		if l.GetType() == loggregator_v2.Log_ERR {
+			messageType = events.LogMessage_ERR
+		}
+
+		envelope := newV1Envelope(e, events.Envelope_LogMessage)
+		envelope.LogMessage = &events.LogMessage{
+			Message:        l.GetPayload(),
+			MessageType:    messageType.Enum(),
+			Timestamp:      proto.Int64(e.GetTimestamp()),
+			AppId:          proto.String(e.GetSourceId()),
+			SourceType:     proto.String(e.GetTags()["source_type"]),
+			SourceInstance: proto.String(e.GetInstanceId()),
+		}
+		return []*events.Envelope{envelope}
+	}
+
+	return nil
+}
+
+// newV1Envelope creates a v1 envelope of the given type with the common
+// fields (origin, deployment, job, etc.) taken from the v2 envelope tags.
+func newV1Envelope(e *loggregator_v2.Envelope, eventType events.Envelope_EventType) *events.Envelope {
+	tags := e.GetTags()
+	return &events.Envelope{
+		Origin:     proto.String(tags["origin"]),
+		EventType:  eventType.Enum(),
+		Timestamp:  proto.Int64(e.GetTimestamp()),
+		Deployment: proto.String(tags["deployment"]),
+		Job:        proto.String(tags["job"]),
+		Index:      proto.String(tags["index"]),
+		Ip:         proto.String(tags["ip"]),
+		Tags:       tags,
+	}
+}
@@ -0,0 +1,235 @@
+package nozzle
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func TestRLPConsumer_implement(t *testing.T) {
+	var _ RawConsumer = &rlpConsumer{}
+}
+
+func TestRLPConsumerClose_no_connection(t *testing.T) {
+	consumer := &rlpConsumer{
+		logger: &stdLogger{logger: defaultLogger},
+	}
+	if err := consumer.Close(); err == nil {
+		t.Fatalf("expects to be failed")
+	}
+}
+
+func TestRLPConsumer_validate(t *testing.T) {
+	tests := []struct {
+		in      *rlpConsumer
+		success bool
+	}{
+		{
+			in: &rlpConsumer{
+				rlpAddr:        "reverse-log-proxy.service.cf.internal:8082",
+				subscriptionID: "go-nozzle-A",
+			},
+			success: true,
+		},
+
+		{
+			in: &rlpConsumer{
+				subscriptionID: "go-nozzle-A",
+			},
+			success: false,
+		},
+
+		{
+			in: &rlpConsumer{
+				rlpAddr: "reverse-log-proxy.service.cf.internal:8082",
+			},
+			success: false,
+		},
+
+		{
+			in: &rlpConsumer{
+				rlpAddr:       "reverse-log-proxy.service.cf.internal:8082",
+				firehoseGroup: "go-nozzle-group",
+			},
+			success: true,
+		},
+	}
+
+	for i, tt := range tests {
+		err := tt.in.validate()
+		if tt.success && err != nil {
+			t.Fatalf("#%d expects '%v' to be nil", i, err)
+		}
+
+		if !tt.success && err == nil {
+			t.Fatalf("#%d expects err not to be nil", i)
+		}
+	}
+}
+
+func TestConvertEnvelope_counter(t *testing.T) {
+	in := &loggregator_v2.Envelope{
+		Timestamp: 1234,
+		Tags: map[string]string{
+			"origin":     "doppler",
+			"deployment": "cf",
+		},
+		Message: &loggregator_v2.Envelope_Counter{
+			Counter: &loggregator_v2.Counter{
+				Name:  "TruncatingBuffer.DroppedMessages",
+				Delta: 1,
+				Total: 10,
+			},
+		},
+	}
+
+	out := convertEnvelope(in)
+	if len(out) != 1 {
+		t.Fatalf("expect 1 envelope but %d", len(out))
+	}
+
+	envelope := out[0]
+	if got := envelope.GetEventType(); got != events.Envelope_CounterEvent {
+		t.Fatalf("expect %s to be eq %s", got, events.Envelope_CounterEvent)
+	}
+
+	if got := envelope.GetCounterEvent().GetTotal(); got != 10 {
+		t.Fatalf("expect %d to be eq %d", got, 10)
+	}
+
+	if got := envelope.GetDeployment(); got != "cf" {
+		t.Fatalf("expect %q to be eq %q", got, "cf")
+	}
+
+	// Converted envelope must be still detected
+	if !isTruncated(envelope) {
+		t.Fatalf("expect %v to be truncated", envelope)
+	}
+}
+
+func TestConvertEnvelope_gauge(t *testing.T) {
+	in := &loggregator_v2.Envelope{
+		Message: &loggregator_v2.Envelope_Gauge{
+			Gauge: &loggregator_v2.Gauge{
+				Metrics: map[string]*loggregator_v2.GaugeValue{
+					"memory": {Unit: "bytes", Value: 1024},
+					"cpu":    {Unit: "percentage", Value: 0.5},
+				},
+			},
+		},
+	}
+
+	out := convertEnvelope(in)
+	if len(out) != 2 {
+		t.Fatalf("expect 2 envelopes but %d", len(out))
+	}
+
+	expects := []string{"cpu", "memory"}
+	for i, envelope := range out {
+		if got := envelope.GetEventType(); got != events.Envelope_ValueMetric {
+			t.Fatalf("#%d expects %s to be eq %s", i, got, events.Envelope_ValueMetric)
+		}
+
+		if got := envelope.GetValueMetric().GetName(); got != expects[i] {
+			t.Fatalf("#%d expects %q to be eq %q", i, got, expects[i])
+		}
+	}
+}
+
+func TestConvertEnvelope_log(t *testing.T) {
+	in := &loggregator_v2.Envelope{
+		SourceId: "my-app-guid",
+		Message: &loggregator_v2.Envelope_Log{
+			Log: &loggregator_v2.Log{
+				Payload: []byte("Hello from RLP"),
+				Type:    loggregator_v2.Log_ERR,
+			},
+		},
+	}
+
+	out := convertEnvelope(in)
+	if len(out) != 1 {
+		t.Fatalf("expect 1 envelope but %d", len(out))
+	}
+
+	logMessage := out[0].GetLogMessage()
+	if got := string(logMessage.GetMessage()); got != "Hello from RLP" {
+		t.Fatalf("expect %q to be eq %q", got, "Hello from RLP")
+	}
+
+	if got := logMessage.GetAppId(); got != "my-app-guid" {
+		t.Fatalf("expect %q to be eq %q", got, "my-app-guid")
+	}
+}
+
+func TestConvertEnvelope_unsupported(t *testing.T) {
+	in := &loggregator_v2.Envelope{
+		Message: &loggregator_v2.Envelope_Timer{
+			Timer: &loggregator_v2.Timer{},
+		},
+	}
+
+	if out := convertEnvelope(in); len(out) != 0 {
+		t.Fatalf("expect %v to be empty", out)
+	}
+}
+
+func TestRLPConsumer_shardID(t *testing.T) {
+	c := &rlpConsumer{subscriptionID: "go-nozzle-A"}
+	if got, expect := c.shardID(), "go-nozzle-A"; got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+
+	c.firehoseGroup = "go-nozzle-group"
+	if got, expect := c.shardID(), "go-nozzle-group"; got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+}
+
+func TestStreamErrorWriter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var buf bytes.Buffer
+	errCh := make(chan error)
+	logger := log.New(&streamErrorWriter{
+		ctx:    ctx,
+		logger: log.New(&buf, "", 0),
+		errCh:  errCh,
+	}, "", 0)
+
+	go logger.Printf("Error connecting to Logs Provider: %s", "refused")
+
+	select {
+	case err := <-errCh:
+		expect := "Error connecting to Logs Provider: refused"
+		if got := err.Error(); got != expect {
+			t.Fatalf("expect %q to be eq %q", got, expect)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	if got, expect := buf.String(), "Error connecting to Logs Provider: refused\n"; got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+
+	// Write must not block after ctx is done
+	cancel()
+	doneCh := make(chan struct{})
+	go func() {
+		logger.Print("Error receiving from Logs Provider")
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
@@ -0,0 +1,41 @@
+package nozzle
+
+// redacted replaces secrets in Config returned by Consumer.Config().
+const redacted = "[REDACTED]"
+
+// Config returns a copy of the configuration consumer is constructed
+// with. Secrets (Password, Token and ClientSecret) are redacted. Slices
+// and TLSConfig are also copied, so modifying the returned value doesn't
+// affect consumer.
+func (c *consumer) Config() Config {
+	config := c.config
+
+	for _, s := range []*string{&config.Password, &config.Token, &config.ClientSecret} {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+
+	if config.DopplerAddrs != nil {
+		config.DopplerAddrs = append([]string(nil), config.DopplerAddrs...)
+	}
+
+	if config.SubscriptionIDs != nil {
+		config.SubscriptionIDs = append([]string(nil), config.SubscriptionIDs...)
+	}
+
+	if config.EventTypes != nil {
+		config.EventTypes = append(config.EventTypes[:0:0], config.EventTypes...)
+	}
+
+	if config.TLSConfig != nil {
+		config.TLSConfig = config.TLSConfig.Clone()
+	}
+
+	// Internal fields for testing are not exposed
+	config.tokenFetcher = nil
+	config.rawConsumer = nil
+	config.uaaRetryBackoff = nil
+
+	return config
+}
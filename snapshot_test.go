@@ -0,0 +1,42 @@
+package nozzle
+
+import (
+	"testing"
+)
+
+func TestConsumerConfig(t *testing.T) {
+	config := &Config{
+		DopplerAddr:     "wss://doppler.cloudfoundry.net",
+		Token:           "n98ubNOIUog9gOPUbvqiur",
+		Password:        "passw0rd",
+		SubscriptionID:  "go-nozzle-A",
+		SubscriptionIDs: []string{"go-nozzle-B"},
+		EventBufferSize: 100,
+		rawConsumer:     &testRawConsumer{},
+	}
+
+	c, err := NewConsumer(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	got := c.Config()
+	if got.Token != redacted || got.Password != redacted {
+		t.Fatalf("expect secrets to be redacted: %q, %q", got.Token, got.Password)
+	}
+
+	// Empty secret is kept empty
+	if got.ClientSecret != "" {
+		t.Fatalf("expect %q to be empty", got.ClientSecret)
+	}
+
+	if got.DopplerAddr != config.DopplerAddr || got.EventBufferSize != config.EventBufferSize {
+		t.Fatalf("expect %#v to have same values with %#v", got, config)
+	}
+
+	// Modifying returned one doesn't affect consumer
+	got.SubscriptionIDs[0] = "modified"
+	if id := c.Config().SubscriptionIDs[0]; id != "go-nozzle-B" {
+		t.Fatalf("expect %q to be eq %q", id, "go-nozzle-B")
+	}
+}
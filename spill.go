@@ -0,0 +1,216 @@
+package nozzle
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// defaultMaxMemoryBuffer is the number of envelopes buffered in memory
+// before spilling to disk when Config.MaxMemoryBuffer is 0.
+const defaultMaxMemoryBuffer = 10000
+
+// spillFile is a temporary file which envelopes overflowing the memory
+// buffer are written to. They're read back in the order they're
+// written. It's only used from the goroutine spilling events.
+type spillFile struct {
+	path string
+
+	w  *bufio.Writer
+	wf *os.File
+
+	r  *bufio.Reader
+	rf *os.File
+
+	// pending is the number of envelopes written but not read yet.
+	pending int
+}
+
+// newSpillFile creates a temporary file in dir.
+func newSpillFile(dir string) (*spillFile, error) {
+	wf, err := ioutil.TempFile(dir, "nozzle-spill-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spill file: %s", err)
+	}
+
+	rf, err := os.Open(wf.Name())
+	if err != nil {
+		wf.Close()
+		os.Remove(wf.Name())
+		return nil, fmt.Errorf("failed to open spill file: %s", err)
+	}
+
+	return &spillFile{
+		path: wf.Name(),
+		w:    bufio.NewWriter(wf),
+		wf:   wf,
+		r:    bufio.NewReader(rf),
+		rf:   rf,
+	}, nil
+}
+
+// write appends e to the file.
+func (s *spillFile) write(e *events.Envelope) error {
+	if err := writeEnvelope(s.w, e); err != nil {
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+	s.pending++
+	return nil
+}
+
+// read reads the oldest envelope which is not read yet. Buffered
+// envelopes are flushed first so that they can be read.
+func (s *spillFile) read() (*events.Envelope, error) {
+	if s.w.Buffered() > 0 {
+		if err := s.w.Flush(); err != nil {
+			return nil, fmt.Errorf("failed to write spill file: %w", err)
+		}
+	}
+
+	e, err := readEnvelope(s.r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spill file: %w", err)
+	}
+	s.pending--
+	return e, nil
+}
+
+// remove closes and removes the file.
+func (s *spillFile) remove() {
+	s.wf.Close()
+	s.rf.Close()
+	os.Remove(s.path)
+}
+
+// spillEvents buffers events in memory up to maxMemoryBuffer so that
+// upstream is read without blocking while downstream is slow. Events
+// overflowing it are written to a temporary file in diskSpillDir and
+// read back in order once downstream catches up. The file is removed
+// when it's fully read or forwarding is stopped.
+//
+// If spilling fails, the error is sent to Errors() and events are
+// only buffered in memory, so that upstream is blocked when it's full.
+func (c *consumer) spillEvents(eventCh <-chan *events.Envelope) <-chan *events.Envelope {
+	forwardCh := make(chan *events.Envelope)
+	c.spillDoneCh = make(chan struct{})
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(c.spillDoneCh)
+		defer close(forwardCh)
+
+		max := c.maxMemoryBuffer
+		if max <= 0 {
+			max = defaultMaxMemoryBuffer
+		}
+
+		var queue []*events.Envelope
+		var spill *spillFile
+		var spillFailed bool
+
+		defer func() {
+			if spill != nil {
+				spill.remove()
+			}
+		}()
+
+		// fail stops spilling. Envelopes which can not be read back
+		// are lost.
+		fail := func(err error) {
+			c.logger.Error("Failed to spill events, spilling is stopped", "error", err)
+			go c.sendHandlerError(c.startCtx, err)
+			spillFailed = true
+			if spill != nil {
+				spill.remove()
+				spill = nil
+			}
+		}
+
+		for {
+			// Refill memory buffer from the file. Envelopes in the
+			// file are always newer than ones in memory.
+			for spill != nil && len(queue) < max {
+				if spill.pending == 0 {
+					spill.remove()
+					spill = nil
+					break
+				}
+
+				event, err := spill.read()
+				if err != nil {
+					fail(err)
+					break
+				}
+				queue = append(queue, event)
+			}
+
+			if eventCh == nil && len(queue) == 0 && spill == nil {
+				return
+			}
+
+			var outCh chan *events.Envelope
+			var head *events.Envelope
+			if len(queue) > 0 {
+				outCh, head = forwardCh, queue[0]
+			}
+
+			// Block upstream while memory buffer is full and
+			// spilling is not available.
+			inCh := eventCh
+			if spillFailed && len(queue) >= max {
+				inCh = nil
+			}
+
+			select {
+			case event, ok := <-inCh:
+				if !ok {
+					eventCh = nil
+					continue
+				}
+
+				// The heartbeat marker is not spilled since it's
+				// identified by its pointer.
+				if event == heartbeatMarker {
+					if !c.heartbeatReached(stageSpill, event) {
+						queue = append(queue, event)
+					}
+					continue
+				}
+
+				if spillFailed || (spill == nil && len(queue) < max) {
+					queue = append(queue, event)
+					continue
+				}
+
+				if spill == nil {
+					s, err := newSpillFile(c.diskSpillDir)
+					if err != nil {
+						fail(err)
+						queue = append(queue, event)
+						continue
+					}
+					spill = s
+				}
+
+				if err := spill.write(event); err != nil {
+					fail(err)
+					queue = append(queue, event)
+					continue
+				}
+				atomic.AddInt64(&c.spilledEvents, 1)
+			case outCh <- head:
+				c.sent(stageSpill, forwardCh)
+				queue[0] = nil
+				queue = queue[1:]
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return forwardCh
+}
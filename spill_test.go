@@ -0,0 +1,104 @@
+package nozzle
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestSpillFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-nozzle")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newSpillFile(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.remove()
+
+	for ts := int64(1); ts <= 3; ts++ {
+		if err := s.write(&events.Envelope{Timestamp: proto.Int64(ts)}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	for expect := int64(1); expect <= 3; expect++ {
+		e, err := s.read()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if got := e.GetTimestamp(); got != expect {
+			t.Fatalf("expect %d to be eq %d", got, expect)
+		}
+	}
+
+	if got, expect := s.pending, 0; got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+}
+
+func TestConsumer_spillEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-nozzle")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:     rc,
+		logger:          &stdLogger{logger: defaultLogger},
+		diskSpillDir:    dir,
+		maxMemoryBuffer: 2,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Upstream is not blocked while nobody reads events
+	for ts := int64(1); ts <= 10; ts++ {
+		select {
+		case rc.eventCh <- &events.Envelope{Timestamp: proto.Int64(ts)}:
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect event %d not to be blocked", ts)
+		}
+	}
+
+	for expect := int64(1); expect <= 5; expect++ {
+		select {
+		case event := <-c.Events():
+			if got := event.GetTimestamp(); got != expect {
+				t.Fatalf("expect %d to be eq %d", got, expect)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect not timeout")
+		}
+	}
+
+	if got := c.Stats().SpilledEvents; got == 0 {
+		t.Fatalf("expect events to be spilled")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Spill files are removed on Close
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(entries) != 0 {
+		t.Fatalf("expect spill files to be removed: %v", entries)
+	}
+}
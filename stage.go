@@ -0,0 +1,63 @@
+package nozzle
+
+import (
+	"sync/atomic"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// pipelineStage is a goroutine of the pipeline which forwards events
+// from slowDetector to downstream. They're chained in this order and
+// the ones which are not enabled are skipped (see StartWithContext).
+type pipelineStage int
+
+const (
+	stageForward pipelineStage = iota // forwardEvents
+	stageAlerts                       // injectAlerts
+	stageReorder                      // reorderEvents
+	stageSpill                        // spillEvents
+	stageBatch                        // batchEvents
+)
+
+// lastStage returns the stage which sends events to the channel read by
+// user, i.e., Events() or BatchEvents(). It must be called after
+// slowDetector is started since injectAlerts is enabled by detectCh.
+func (c *consumer) lastStage() pipelineStage {
+	switch {
+	case c.batchSize > 0:
+		return stageBatch
+	case c.diskSpillDir != "":
+		return stageSpill
+	case c.reorderWindow > 0:
+		return stageReorder
+	case c.alertAsEnvelope && c.detectCh != nil:
+		return stageAlerts
+	default:
+		return stageForward
+	}
+}
+
+// sent records an event is sent to forwardCh by stage. Events sent by
+// stages other than the last one are still in the pipeline (and may be
+// dropped or held later), so they're not recorded as delivered.
+func (c *consumer) sent(stage pipelineStage, forwardCh chan *events.Envelope) {
+	if stage != c.finalStage {
+		return
+	}
+
+	c.delivered(1)
+	observeLen(&c.eventMaxLen, len(forwardCh))
+}
+
+// sentBatch records a batch of n events is sent to batchCh by
+// batchEvents.
+func (c *consumer) sentBatch(batchCh chan []*events.Envelope, n int) {
+	c.delivered(n)
+	observeLen(&c.batchMaxLen, len(batchCh))
+}
+
+// delivered records n events are delivered to downstream.
+func (c *consumer) delivered(n int) {
+	atomic.AddInt64(&c.totalEvents, int64(n))
+	atomic.StoreInt64(&c.lastEventAt, orRealClock(c.clock).Now().UnixNano())
+}
@@ -0,0 +1,26 @@
+package nozzle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsumer_lastStage(t *testing.T) {
+	cases := []struct {
+		c      *consumer
+		expect pipelineStage
+	}{
+		{&consumer{}, stageForward},
+		{&consumer{alertAsEnvelope: true}, stageForward},
+		{&consumer{alertAsEnvelope: true, detectCh: make(chan SlowAlert)}, stageAlerts},
+		{&consumer{reorderWindow: 1 * time.Second}, stageReorder},
+		{&consumer{reorderWindow: 1 * time.Second, diskSpillDir: "/tmp"}, stageSpill},
+		{&consumer{diskSpillDir: "/tmp", batchSize: 10}, stageBatch},
+	}
+
+	for i, tc := range cases {
+		if got := tc.c.lastStage(); got != tc.expect {
+			t.Fatalf("#%d expect %d to be eq %d", i, got, tc.expect)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package nozzle
+
+import (
+	"sync/atomic"
+)
+
+// State is the state of connection with firehose.
+type State int32
+
+const (
+	// StateIdle means consumer is not started yet.
+	StateIdle State = iota
+
+	// StateConnecting means consumer is establishing the first connection.
+	StateConnecting
+
+	// StateConnected means consumer is connected and receiving events.
+	StateConnected
+
+	// StateReconnecting means connection is lost and consumer is retrying.
+	StateReconnecting
+
+	// StateClosed means consumer is closed.
+	StateClosed
+)
+
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnectionState reports the current state of connection with firehose.
+type ConnectionState struct {
+	// State is the current state of connection.
+	State State
+
+	// Reconnects is the number of reconnect attempts occurred
+	// since consumer is started.
+	Reconnects uint64
+
+	// Failovers is the number of times consumer switched to the next
+	// address of Config.DopplerAddrs since consumer is started.
+	Failovers uint64
+
+	// StaleReconnects is the number of times connection is forced to
+	// reconnect because nothing is received within
+	// Config.StaleConnectionTimeout.
+	StaleReconnects uint64
+}
+
+// stateReporter is implemented by rawConsumer which tracks
+// its connection state.
+type stateReporter interface {
+	connectionState() ConnectionState
+}
+
+// connectionState tracks the state of connection.
+// It's safe to use from multiple goroutines.
+type connectionState struct {
+	state      int32
+	reconnects uint64
+	failovers  uint64
+
+	staleReconnects uint64
+
+	// onChange is called when state is changed. It must be set
+	// before state is changed first.
+	onChange func(State)
+}
+
+// set sets the current state.
+func (s *connectionState) set(state State) {
+	old := atomic.SwapInt32(&s.state, int32(state))
+	if s.onChange != nil && State(old) != state {
+		s.onChange(state)
+	}
+}
+
+// reconnect records a reconnect attempt.
+func (s *connectionState) reconnect() {
+	atomic.AddUint64(&s.reconnects, 1)
+	s.set(StateReconnecting)
+}
+
+// failover records switching to the next doppler address.
+func (s *connectionState) failover() {
+	atomic.AddUint64(&s.failovers, 1)
+}
+
+// staleReconnect records a forced reconnect of stale connection.
+func (s *connectionState) staleReconnect() {
+	atomic.AddUint64(&s.staleReconnects, 1)
+}
+
+// snapshot returns the current ConnectionState.
+func (s *connectionState) snapshot() ConnectionState {
+	return ConnectionState{
+		State:      State(atomic.LoadInt32(&s.state)),
+		Reconnects: atomic.LoadUint64(&s.reconnects),
+		Failovers:  atomic.LoadUint64(&s.failovers),
+
+		StaleReconnects: atomic.LoadUint64(&s.staleReconnects),
+	}
+}
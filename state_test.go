@@ -0,0 +1,45 @@
+package nozzle
+
+import (
+	"testing"
+)
+
+func TestConnectionState(t *testing.T) {
+	var s connectionState
+	if got := s.snapshot(); got.State != StateIdle || got.Reconnects != 0 {
+		t.Fatalf("expect %#v to be initial state", got)
+	}
+
+	s.set(StateConnected)
+	s.reconnect()
+	s.reconnect()
+
+	got := s.snapshot()
+	if got.State != StateReconnecting {
+		t.Fatalf("expect %s to be eq %s", got.State, StateReconnecting)
+	}
+
+	if got.Reconnects != 2 {
+		t.Fatalf("expect %d to be eq %d", got.Reconnects, 2)
+	}
+}
+
+func TestStateString(t *testing.T) {
+	tests := []struct {
+		in     State
+		expect string
+	}{
+		{StateIdle, "idle"},
+		{StateConnecting, "connecting"},
+		{StateConnected, "connected"},
+		{StateReconnecting, "reconnecting"},
+		{StateClosed, "closed"},
+		{State(100), "unknown"},
+	}
+
+	for i, tt := range tests {
+		if got := tt.in.String(); got != tt.expect {
+			t.Fatalf("#%d expects %q to be eq %q", i, got, tt.expect)
+		}
+	}
+}
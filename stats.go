@@ -0,0 +1,173 @@
+package nozzle
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// ChannelStats is the saturation of a channel returned by Consumer.
+type ChannelStats struct {
+	// Len is the number of elements queued in the channel.
+	Len int
+
+	// Cap is the buffer size of the channel.
+	Cap int
+
+	// MaxLen is the maximum Len observed since consumer is started.
+	MaxLen int
+}
+
+// Stats is the saturation of the channels returned by Consumer and
+// the overview of consuming. Channel stats are used to tune buffer sizes
+// (e.g., Config.EventBufferSize). If MaxLen of a channel reaches its Cap,
+// downstream can't catch up with it.
+type Stats struct {
+	// Events is the channel returned by Events(). When batching is
+	// enabled, it's zero and Batches is the one returned by
+	// BatchEvents() instead.
+	Events  ChannelStats
+	Batches ChannelStats
+	Errors  ChannelStats
+	Detects ChannelStats
+
+	// TeeDropped is the number of envelopes dropped on each channel
+	// returned by Consumer.Tee because it's full. It's nil if Tee is
+	// not called.
+	TeeDropped []int64
+
+	// ErrorsDropped is the number of errors dropped by
+	// Config.ErrorOverflowPolicy since Errors() is full.
+	ErrorsDropped int64
+
+	// EventsDropped is the number of envelopes dropped by
+	// Config.BackpressurePolicy since Events() is full.
+	EventsDropped int64
+
+	// InvalidEvents is the number of envelopes dropped by
+	// Config.ValidateEnvelopes.
+	InvalidEvents int64
+
+	// Uptime is the elapsed time since consumer is started.
+	Uptime time.Duration
+
+	// TotalEnvelopes is the number of envelopes delivered to Events()
+	// (or BatchEvents()) including ones injected by AlertAsEnvelope.
+	// Envelopes dropped by DropLateEvents or still held in the pipeline
+	// (e.g., by ReorderWindow or DiskSpillDir) are not included.
+	// TotalErrors and TotalSlowAlerts are the number of errors and
+	// slowConsumerAlerts reported (including dropped ones) since consumer
+	// is started.
+	TotalEnvelopes  int64
+	TotalErrors     int64
+	TotalSlowAlerts int64
+
+	// TotalReconnects is same as ConnectionState().Reconnects.
+	TotalReconnects uint64
+
+	// Lag is same as Consumer.Lag().
+	Lag time.Duration
+
+	// SlowHandlers is the number of Handler calls by Consumer.Run which
+	// exceeded Config.HandlerTimeout.
+	SlowHandlers int64
+
+	// LateEvents is the number of envelopes which arrived too late to be
+	// sorted by Config.ReorderWindow.
+	LateEvents int64
+
+	// SpilledEvents is the number of envelopes spilled to
+	// Config.DiskSpillDir.
+	SpilledEvents int64
+
+	// SuppressedErrors is the number of errors not sent to
+	// Consumer.Errors() since they're repeated (see Config.DedupErrors).
+	SuppressedErrors int64
+}
+
+// Stats returns the current saturation of the channels. Zero values
+// are returned before consumer is started.
+func (c *consumer) Stats() Stats {
+	var uptime time.Duration
+	if startedAt := atomic.LoadInt64(&c.startedAt); startedAt > 0 {
+		uptime = orRealClock(c.clock).Now().Sub(time.Unix(0, startedAt))
+	}
+
+	return Stats{
+		Events: ChannelStats{
+			Len:    len(c.eventCh),
+			Cap:    cap(c.eventCh),
+			MaxLen: int(atomic.LoadInt64(&c.eventMaxLen)),
+		},
+		Batches: ChannelStats{
+			Len:    len(c.batchCh),
+			Cap:    cap(c.batchCh),
+			MaxLen: int(atomic.LoadInt64(&c.batchMaxLen)),
+		},
+		Errors: ChannelStats{
+			Len:    len(c.errCh),
+			Cap:    cap(c.errCh),
+			MaxLen: int(atomic.LoadInt64(&c.errMaxLen)),
+		},
+		Detects: ChannelStats{
+			Len:    len(c.detectCh),
+			Cap:    cap(c.detectCh),
+			MaxLen: int(atomic.LoadInt64(&c.detectMaxLen)),
+		},
+		TeeDropped:    c.teeDroppedCounts(),
+		ErrorsDropped: atomic.LoadInt64(&c.errDropped),
+		EventsDropped: atomic.LoadInt64(&c.eventDropped),
+		InvalidEvents: atomic.LoadInt64(&c.invalidEvents),
+
+		Uptime:           uptime,
+		TotalEnvelopes:   atomic.LoadInt64(&c.totalEvents),
+		TotalErrors:      atomic.LoadInt64(&c.totalErrors),
+		TotalSlowAlerts:  atomic.LoadInt64(&c.totalAlerts),
+		TotalReconnects:  c.ConnectionState().Reconnects,
+		Lag:              c.Lag(),
+		SlowHandlers:     atomic.LoadInt64(&c.slowHandlers),
+		LateEvents:       atomic.LoadInt64(&c.lateEvents),
+		SpilledEvents:    atomic.LoadInt64(&c.spilledEvents),
+		SuppressedErrors: atomic.LoadInt64(&c.suppressedErrors),
+	}
+}
+
+// maxEventType is the largest value of events.Envelope_EventType
+// counted by EventCounts. Unknown types larger than it are not counted.
+const maxEventType = events.Envelope_ContainerMetric
+
+// EventCounts returns the number of envelopes received for each event
+// type.
+func (c *consumer) EventCounts() map[events.Envelope_EventType]uint64 {
+	counts := make(map[events.Envelope_EventType]uint64)
+	for i := range c.eventCounts {
+		if n := atomic.LoadUint64(&c.eventCounts[i]); n > 0 {
+			counts[events.Envelope_EventType(i)] = n
+		}
+	}
+
+	return counts
+}
+
+// ErrorCount returns the number of errors forwarded to Errors().
+func (c *consumer) ErrorCount() uint64 {
+	return atomic.LoadUint64(&c.errorCount)
+}
+
+// countEvent increments the count of the type of event.
+func (c *consumer) countEvent(event *events.Envelope) {
+	if t := event.GetEventType(); t >= 0 && t <= maxEventType {
+		atomic.AddUint64(&c.eventCounts[t], 1)
+	}
+}
+
+// observeLen records n as the maximum length in max if it's larger.
+func observeLen(max *int64, n int) {
+	for {
+		cur := atomic.LoadInt64(max)
+		if int64(n) <= cur || atomic.CompareAndSwapInt64(max, cur, int64(n)) {
+			return
+		}
+	}
+}
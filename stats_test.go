@@ -0,0 +1,335 @@
+package nozzle
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestConsumerStats(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:     rc,
+		logger:          &stdLogger{logger: defaultLogger},
+		eventBufferSize: 10,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		rc.eventCh <- &events.Envelope{}
+	}
+
+	// Wait events are forwarded to the buffer
+	deadline := time.Now().Add(1 * time.Second)
+	for len(c.Events()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	<-c.Events()
+
+	stats := c.Stats()
+	expect := ChannelStats{Len: 2, Cap: 10, MaxLen: 3}
+	if stats.Events != expect {
+		t.Fatalf("expect %#v to be eq %#v", stats.Events, expect)
+	}
+
+	if stats.Errors != (ChannelStats{}) {
+		t.Fatalf("expect %#v to be zero", stats.Errors)
+	}
+}
+
+func TestConsumerStats_lastStage(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:     rc,
+		logger:          &stdLogger{logger: defaultLogger},
+		eventBufferSize: 10,
+		reorderWindow:   10 * time.Millisecond,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	for ts := int64(1); ts <= 3; ts++ {
+		rc.eventCh <- &events.Envelope{Timestamp: proto.Int64(ts)}
+	}
+
+	// Measured on Events(), not on the channel between forwardEvents
+	// and reorderEvents which is drained immediately.
+	deadline := time.Now().Add(1 * time.Second)
+	for len(c.Events()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	<-c.Events()
+
+	stats := c.Stats()
+	expect := ChannelStats{Len: 2, Cap: 10, MaxLen: 3}
+	if stats.Events != expect {
+		t.Fatalf("expect %#v to be eq %#v", stats.Events, expect)
+	}
+}
+
+func TestConsumerStats_batch(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:     rc,
+		logger:          &stdLogger{logger: defaultLogger},
+		eventBufferSize: 10,
+		batchSize:       2,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			rc.eventCh <- &events.Envelope{}
+		}
+	}()
+
+	select {
+	case <-c.BatchEvents():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	// Events() is not used
+	stats := c.Stats()
+	if stats.Events != (ChannelStats{}) {
+		t.Fatalf("expect %#v to be zero", stats.Events)
+	}
+
+	if stats.Batches != (ChannelStats{}) {
+		t.Fatalf("expect %#v to be zero since it's unbuffered", stats.Batches)
+	}
+}
+
+func TestObserveLen(t *testing.T) {
+	var max int64
+	for _, n := range []int{1, 3, 2} {
+		observeLen(&max, n)
+	}
+
+	if max != 3 {
+		t.Fatalf("expect %d to be eq %d", max, 3)
+	}
+}
+
+func TestConsumerEventCounts(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+
+		// Filtered events are also counted
+		eventTypes: map[events.Envelope_EventType]struct{}{
+			events.Envelope_LogMessage: {},
+		},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		for _, typ := range []events.Envelope_EventType{
+			events.Envelope_ContainerMetric,
+			events.Envelope_ContainerMetric,
+			events.Envelope_LogMessage,
+		} {
+			rc.eventCh <- &events.Envelope{EventType: typ.Enum()}
+		}
+	}()
+
+	select {
+	case <-c.Events():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	counts := c.EventCounts()
+	if got, expect := counts[events.Envelope_ContainerMetric], uint64(2); got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+
+	if got, expect := counts[events.Envelope_LogMessage], uint64(1); got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+
+	if _, ok := counts[events.Envelope_ValueMetric]; ok {
+		t.Fatalf("expect ValueMetric not to be included")
+	}
+}
+
+func TestConsumerStats_totals(t *testing.T) {
+	clock := newFakeClock()
+	clock.Advance(1 * time.Hour)
+
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		clock:       clock,
+	}
+
+	if got := c.Stats().Uptime; got != 0 {
+		t.Fatalf("expect %s to be zero before started", got)
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		rc.eventCh <- &events.Envelope{}
+		rc.errCh <- errors.New("connection lost")
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-c.Events():
+		case <-c.Errors():
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect not timeout")
+		}
+	}
+
+	clock.Advance(10 * time.Second)
+
+	stats := c.Stats()
+	if got, expect := stats.Uptime, 10*time.Second; got != expect {
+		t.Fatalf("expect %s to be eq %s", got, expect)
+	}
+
+	if stats.TotalEnvelopes != 1 || stats.TotalErrors != 1 || stats.TotalSlowAlerts != 0 {
+		t.Fatalf("expect totals to be counted: %#v", stats)
+	}
+}
+
+func TestConsumerStats_totalsLastStage(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:    rc,
+		logger:         &stdLogger{logger: defaultLogger},
+		reorderWindow:  10 * time.Millisecond,
+		dropLateEvents: true,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	// The one of timestamp 1 arrives late and is dropped by reorderEvents
+	// after it's forwarded by forwardEvents.
+	go func() {
+		for _, ts := range []int64{100, 1, 200} {
+			rc.eventCh <- &events.Envelope{Timestamp: proto.Int64(ts)}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	for _, expect := range []int64{100, 200} {
+		select {
+		case event := <-c.Events():
+			if got := event.GetTimestamp(); got != expect {
+				t.Fatalf("expect %d to be eq %d", got, expect)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect not timeout")
+		}
+	}
+
+	// Counted just after each event is received
+	time.Sleep(50 * time.Millisecond)
+	if got, expect := c.Stats().TotalEnvelopes, int64(2); got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+}
+
+func TestConsumerStats_totalsBatch(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+		batchSize:   3,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			rc.eventCh <- &events.Envelope{}
+		}
+	}()
+
+	select {
+	case <-c.BatchEvents():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	// Counted just after the batch is received
+	deadline := time.Now().Add(1 * time.Second)
+	for c.Stats().TotalEnvelopes < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got, expect := c.Stats().TotalEnvelopes, int64(3); got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+}
+
+func TestConsumerErrorCount(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			rc.errCh <- errors.New("connection lost")
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-c.Errors():
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect not timeout")
+		}
+	}
+
+	// Counted just after each error is received
+	deadline := time.Now().Add(1 * time.Second)
+	for c.ErrorCount() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got, expect := c.ErrorCount(), uint64(3); got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+}
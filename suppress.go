@@ -0,0 +1,104 @@
+package nozzle
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultDedupErrorsInterval is used when Config.DedupErrorsInterval
+// is not set.
+const defaultDedupErrorsInterval = 1 * time.Minute
+
+// RepeatedError is sent to Consumer.Errors() by Config.DedupErrors
+// instead of an error which is repeated consecutively. Count is the
+// number of times Err has been reported in a row including the first
+// one which was sent as it is. The original error can be retrieved by
+// errors.As or errors.Unwrap.
+type RepeatedError struct {
+	Err   error
+	Count int
+}
+
+// Error returns the message of the original error with the count.
+func (e *RepeatedError) Error() string {
+	return fmt.Sprintf("still failing (%d times): %s", e.Count, e.Err)
+}
+
+// Unwrap returns the original error.
+func (e *RepeatedError) Unwrap() error {
+	return e.Err
+}
+
+// errorDeduplicator collapses identical consecutive errors (compared
+// by message). The first one is forwarded and the repeated ones are
+// summarized by RepeatedError at most once per interval. Summaries are
+// driven by new errors, not by a timer: a summary is forwarded when a
+// repeat arrives after the interval, when a different error arrives or
+// when the stream ends (by flush). It's not goroutine safe and is only
+// used from the goroutine forwarding errors.
+type errorDeduplicator struct {
+	interval time.Duration
+
+	// last is the last error and count is the number of times it's
+	// reported in a row. pending is the number of them suppressed since
+	// emittedAt, when it or its summary is forwarded last.
+	last      error
+	count     int
+	pending   int
+	emittedAt time.Time
+
+	clock Clock
+}
+
+// newErrorDeduplicator constructs errorDeduplicator which measures
+// interval by clock. If interval is 0, defaultDedupErrorsInterval is
+// used.
+func newErrorDeduplicator(interval time.Duration, clock Clock) *errorDeduplicator {
+	if interval == 0 {
+		interval = defaultDedupErrorsInterval
+	}
+
+	return &errorDeduplicator{
+		interval: interval,
+		clock:    clock,
+	}
+}
+
+// filter returns the errors to forward for err. It's empty if err is
+// suppressed. When a different error is reported, the summary of the
+// previous one is forwarded before it if some of them are suppressed,
+// so that the count is not lost.
+func (d *errorDeduplicator) filter(err error) []error {
+	now := d.clock.Now()
+	if d.last != nil && d.last.Error() == err.Error() {
+		d.count++
+		if now.Sub(d.emittedAt) < d.interval {
+			d.pending++
+			return nil
+		}
+
+		d.pending = 0
+		d.emittedAt = now
+		return []error{&RepeatedError{Err: err, Count: d.count}}
+	}
+
+	var errs []error
+	if summary := d.flush(); summary != nil {
+		errs = append(errs, summary)
+	}
+
+	d.last, d.count, d.pending, d.emittedAt = err, 1, 0, now
+	return append(errs, err)
+}
+
+// flush returns the summary of repeats suppressed since the last one
+// forwarded, e.g., when the stream of errors ends. It returns nil if
+// nothing is suppressed.
+func (d *errorDeduplicator) flush() error {
+	if d.pending == 0 {
+		return nil
+	}
+
+	d.pending = 0
+	return &RepeatedError{Err: d.last, Count: d.count}
+}
@@ -0,0 +1,179 @@
+package nozzle
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestErrorDeduplicator_filter(t *testing.T) {
+	clock := newFakeClock()
+	d := newErrorDeduplicator(1*time.Minute, clock)
+
+	refused := errors.New("connection refused")
+	reset := errors.New("connection reset")
+
+	cases := []struct {
+		elapsed time.Duration
+		err     error
+		expect  []string
+	}{
+		// The first one is forwarded as it is
+		{0, refused, []string{"connection refused"}},
+
+		// Repeated ones are suppressed within the interval
+		{10 * time.Second, refused, nil},
+		{10 * time.Second, errors.New("connection refused"), nil},
+
+		// Summary is forwarded after the interval
+		{40 * time.Second, refused, []string{"still failing (4 times): connection refused"}},
+		{10 * time.Second, refused, nil},
+
+		// Different error flushes the summary of the previous one
+		{0, reset, []string{
+			"still failing (5 times): connection refused",
+			"connection reset",
+		}},
+
+		// Nothing is suppressed since the last one
+		{0, refused, []string{"connection refused"}},
+	}
+
+	for i, tc := range cases {
+		clock.Advance(tc.elapsed)
+		errs := d.filter(tc.err)
+		if len(errs) != len(tc.expect) {
+			t.Fatalf("#%d expect %v to have %d errors", i, errs, len(tc.expect))
+		}
+
+		for j, err := range errs {
+			if err.Error() != tc.expect[j] {
+				t.Fatalf("#%d expect %q to be eq %q", i, err.Error(), tc.expect[j])
+			}
+		}
+	}
+}
+
+func TestErrorDeduplicator_flush(t *testing.T) {
+	d := newErrorDeduplicator(1*time.Minute, newFakeClock())
+	refused := errors.New("connection refused")
+
+	d.filter(refused)
+	if err := d.flush(); err != nil {
+		t.Fatalf("expect nothing to be flushed: %v", err)
+	}
+
+	d.filter(refused)
+	d.filter(refused)
+
+	err := d.flush()
+	if err == nil || err.Error() != "still failing (3 times): connection refused" {
+		t.Fatalf("expect summary of 3 errors: %v", err)
+	}
+
+	if err := d.flush(); err != nil {
+		t.Fatalf("expect summary to be flushed once: %v", err)
+	}
+}
+
+func TestConsumerDedupErrors_flushOnClose(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:   rc,
+		logger:        &stdLogger{logger: defaultLogger},
+		errBufferSize: 10,
+		errorDedup:    newErrorDeduplicator(0, realClock{}),
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	refused := errors.New("connection refused")
+	for i := 0; i < 3; i++ {
+		rc.errCh <- refused
+	}
+
+	// Upstream stops during the outage
+	close(rc.errCh)
+	rc.errCh = nil
+
+	var got []string
+	timeoutCh := time.After(1 * time.Second)
+	for done := false; !done; {
+		select {
+		case err, ok := <-c.Errors():
+			if !ok {
+				done = true
+				break
+			}
+			got = append(got, err.Error())
+		case <-timeoutCh:
+			t.Fatalf("expect Errors() to be closed")
+		}
+	}
+
+	expect := []string{"connection refused", "still failing (3 times): connection refused"}
+	if len(got) != len(expect) || got[0] != expect[0] || got[1] != expect[1] {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+}
+
+func TestConsumerDedupErrors(t *testing.T) {
+	clock := newFakeClock()
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:   rc,
+		logger:        &stdLogger{logger: defaultLogger},
+		errBufferSize: 10,
+		errorDedup:    newErrorDeduplicator(0, clock),
+		clock:         clock,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	refused := errors.New("connection refused")
+	for i := 0; i < 3; i++ {
+		rc.errCh <- refused
+	}
+
+	select {
+	case err := <-c.Errors():
+		if err != refused {
+			t.Fatalf("expect %v to be eq %v", err, refused)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	// Wait the repeated ones are suppressed before advancing clock
+	deadline := time.Now().Add(1 * time.Second)
+	for c.Stats().SuppressedErrors < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	clock.Advance(defaultDedupErrorsInterval)
+	rc.errCh <- refused
+
+	select {
+	case err := <-c.Errors():
+		var repeated *RepeatedError
+		if !errors.As(err, &repeated) {
+			t.Fatalf("expect %v to be RepeatedError", err)
+		}
+
+		if repeated.Count != 4 || repeated.Err != refused {
+			t.Fatalf("expect %#v to be the summary of 4 errors", repeated)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	if got := c.Stats().SuppressedErrors; got != 2 {
+		t.Fatalf("expect %d to be eq 2", got)
+	}
+}
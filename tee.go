@@ -0,0 +1,234 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// teeBranch forwards envelopes queued by Tee to the channel returned to
+// its reader. The channel is unbuffered, so the branch knows exactly how
+// many envelopes are read, which Flush waits for.
+type teeBranch struct {
+	// queued and delivered are the numbers of envelopes queued by Tee
+	// and read by the reader. They're accessed atomically.
+	queued    int64
+	delivered int64
+
+	queue chan *events.Envelope
+	out   chan *events.Envelope
+
+	// flushCh receives barriers of Flush. doneCh is closed when
+	// forwarding is stopped and out is closed.
+	flushCh chan teeFlush
+	doneCh  chan struct{}
+}
+
+// teeFlush is a barrier of Flush. ack is closed when target envelopes
+// are read from the branch.
+type teeFlush struct {
+	target int64
+	ack    chan struct{}
+}
+
+// newTeeBranch constructs teeBranch which queues up to size envelopes.
+func newTeeBranch(size int) *teeBranch {
+	return &teeBranch{
+		queue:   make(chan *events.Envelope, size),
+		out:     make(chan *events.Envelope),
+		flushCh: make(chan teeFlush),
+		doneCh:  make(chan struct{}),
+	}
+}
+
+// offer queues event without blocking. It returns false if the queue
+// is full. It's only called from the goroutine of Tee.
+func (b *teeBranch) offer(event *events.Envelope) bool {
+	// The envelope held by run is also counted, so that the reader
+	// is behind by at most cap(queue) envelopes. A read is counted
+	// just after it's received, so an envelope may be dropped while
+	// the reader is catching up the last one.
+	if atomic.LoadInt64(&b.queued)-atomic.LoadInt64(&b.delivered) >= int64(cap(b.queue)) {
+		return false
+	}
+
+	b.queue <- event
+	atomic.AddInt64(&b.queued, 1)
+	return true
+}
+
+// run forwards queued envelopes to out until the queue is closed and
+// drained or stopCh is closed, and acks barriers of Flush when the
+// envelopes before them are read.
+func (b *teeBranch) run(stopCh <-chan struct{}) {
+	defer close(b.doneCh)
+	defer close(b.out)
+
+	var head *events.Envelope
+	var barriers []teeFlush
+	queue := b.queue
+	for {
+		var outCh chan *events.Envelope
+		inCh := queue
+		if head != nil {
+			outCh, inCh = b.out, nil
+		} else if queue == nil {
+			return
+		}
+
+		select {
+		case event, ok := <-inCh:
+			if !ok {
+				queue = nil
+				continue
+			}
+			head = event
+		case outCh <- head:
+			head = nil
+			barriers = ackBarriers(barriers, atomic.AddInt64(&b.delivered, 1))
+		case f := <-b.flushCh:
+			barriers = ackBarriers(append(barriers, f), atomic.LoadInt64(&b.delivered))
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// ackBarriers acks barriers reached by delivered and returns the others.
+func ackBarriers(barriers []teeFlush, delivered int64) []teeFlush {
+	pending := barriers[:0]
+	for _, f := range barriers {
+		if f.target <= delivered {
+			close(f.ack)
+			continue
+		}
+		pending = append(pending, f)
+	}
+	return pending
+}
+
+// Tee fans out Events() to n channels. Each channel receives every
+// envelope, so independent pipelines (e.g., metrics and logs) can read
+// the same firehose connection. Up to Config.TeeBufferSize envelopes
+// (at least 1) are queued for each channel. If the queue is full, the
+// envelope is dropped only for it so that a slow reader doesn't block
+// the others. The dropped count of each channel is reported by
+// Stats().TeeDropped.
+//
+// Tee must be called after Start and only once. Events() must not be
+// read by others after that. It returns nil if n is not positive or
+// Events() is nil (e.g., consumer is not started or batching is enabled).
+// The channels are closed when Events() is closed. Envelopes which are
+// not read yet are discarded when consumer is closed.
+func (c *consumer) Tee(n int) []<-chan *events.Envelope {
+	eventCh := c.Events()
+	if n <= 0 || eventCh == nil {
+		return nil
+	}
+
+	size := c.teeBufferSize
+	if size < 1 {
+		size = 1
+	}
+
+	branches := make([]*teeBranch, n)
+	outs := make([]<-chan *events.Envelope, n)
+	for i := range branches {
+		branches[i] = newTeeBranch(size)
+		outs[i] = branches[i].out
+		go branches[i].run(c.doneCh)
+	}
+
+	dropped := make([]int64, n)
+	c.teeMu.Lock()
+	c.teeDropped = dropped
+	c.teeBranches = branches
+	c.teeMu.Unlock()
+
+	go func() {
+		defer func() {
+			for _, b := range branches {
+				close(b.queue)
+			}
+		}()
+
+		for event := range eventCh {
+			for i, b := range branches {
+				if !b.offer(event) {
+					atomic.AddInt64(&dropped[i], 1)
+				}
+			}
+		}
+	}()
+
+	return outs
+}
+
+// Flush is a barrier across the channels of Tee. It blocks until every
+// channel has been read up to the envelopes passed to it before Flush is
+// called, e.g., to take a consistent checkpoint of all sinks. Envelopes
+// dropped for a channel are not waited. It returns ctx.Err() if ctx is
+// done before that, and error if a channel is closed (e.g., consumer is
+// closed) before it's read up to the barrier, so it doesn't block
+// forever on a channel which is not read anymore. It returns error if
+// Tee is not called.
+func (c *consumer) Flush(ctx context.Context) error {
+	c.teeMu.Lock()
+	branches := c.teeBranches
+	c.teeMu.Unlock()
+
+	if branches == nil {
+		return fmt.Errorf("Tee must be called before Flush")
+	}
+
+	barriers := make([]teeFlush, len(branches))
+	for i, b := range branches {
+		barriers[i] = teeFlush{
+			target: atomic.LoadInt64(&b.queued),
+			ack:    make(chan struct{}),
+		}
+	}
+
+	for i, b := range branches {
+		select {
+		case b.flushCh <- barriers[i]:
+		case <-b.doneCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for i, b := range branches {
+		select {
+		case <-barriers[i].ack:
+		case <-b.doneCh:
+			if atomic.LoadInt64(&b.delivered) < barriers[i].target {
+				return fmt.Errorf("Tee channel %d is closed before flushed", i)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// teeDroppedCounts returns the number of envelopes dropped on each
+// channel of Tee. It's nil if Tee is not called.
+func (c *consumer) teeDroppedCounts() []int64 {
+	c.teeMu.Lock()
+	dropped := c.teeDropped
+	c.teeMu.Unlock()
+
+	if dropped == nil {
+		return nil
+	}
+
+	counts := make([]int64, len(dropped))
+	for i := range dropped {
+		counts[i] = atomic.LoadInt64(&dropped[i])
+	}
+	return counts
+}
@@ -0,0 +1,203 @@
+package nozzle
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestConsumerTee(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:   rc,
+		logger:        &stdLogger{logger: defaultLogger},
+		teeBufferSize: 1,
+	}
+
+	if c.Tee(2) != nil {
+		t.Fatalf("expect nil before start")
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	branches := c.Tee(2)
+	if got, expect := len(branches), 2; got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+
+	// The second branch is not read, so only the first envelope
+	// is buffered and the others are dropped for it.
+	for i := int64(0); i < 3; i++ {
+		rc.eventCh <- &events.Envelope{Timestamp: proto.Int64(i)}
+
+		select {
+		case event := <-branches[0]:
+			if got := event.GetTimestamp(); got != i {
+				t.Fatalf("expect %d to be eq %d", got, i)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("#%d expect not timeout", i)
+		}
+
+		// Wait the read to be counted so that the next one is queued
+		deadline := time.Now().Add(1 * time.Second)
+		for atomic.LoadInt64(&c.teeBranches[0].delivered) <= i && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Wait the last envelope to be passed to the second branch
+	deadline := time.Now().Add(1 * time.Second)
+	for c.Stats().TeeDropped[1] < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got, expect := c.Stats().TeeDropped, []int64{0, 2}; got[0] != expect[0] || got[1] != expect[1] {
+		t.Fatalf("expect %v to be eq %v", got, expect)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The queued one may be discarded and then it's closed
+	timeoutCh := time.After(1 * time.Second)
+	for {
+		select {
+		case _, ok := <-branches[1]:
+			if !ok {
+				return
+			}
+		case <-timeoutCh:
+			t.Fatalf("expect branch to be closed")
+		}
+	}
+}
+
+func TestConsumerFlush(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:   rc,
+		logger:        &stdLogger{logger: defaultLogger},
+		teeBufferSize: 10,
+	}
+
+	if err := c.Flush(context.Background()); err == nil {
+		t.Fatalf("expect error before Tee is called")
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	branches := c.Tee(2)
+	for i := int64(0); i < 3; i++ {
+		rc.eventCh <- &events.Envelope{Timestamp: proto.Int64(i)}
+	}
+
+	// Wait the envelopes to be queued in both branches
+	waitQueued(t, c, 3)
+
+	// The second branch is not read yet
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect %v to be eq %v", err, context.DeadlineExceeded)
+	}
+
+	flushedCh := make(chan error, 1)
+	go func() {
+		flushedCh <- c.Flush(context.Background())
+	}()
+
+	for _, branch := range branches {
+		for i := 0; i < 3; i++ {
+			<-branch
+		}
+	}
+
+	select {
+	case err := <-flushedCh:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect Flush to return after all branches are read")
+	}
+}
+
+func TestConsumerFlush_abandonedBranch(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:   rc,
+		logger:        &stdLogger{logger: defaultLogger},
+		teeBufferSize: 10,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	branches := c.Tee(2)
+	for i := int64(0); i < 3; i++ {
+		rc.eventCh <- &events.Envelope{Timestamp: proto.Int64(i)}
+	}
+	waitQueued(t, c, 3)
+
+	// The second branch is never read
+	for i := 0; i < 3; i++ {
+		<-branches[0]
+	}
+
+	flushedCh := make(chan error, 1)
+	go func() {
+		flushedCh <- c.Flush(context.Background())
+	}()
+
+	select {
+	case err := <-flushedCh:
+		t.Fatalf("expect Flush to block: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	select {
+	case err := <-flushedCh:
+		if err == nil {
+			t.Fatalf("expect to be failed")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect Flush to return after consumer is closed")
+	}
+}
+
+// waitQueued waits n envelopes to be queued in all branches of Tee.
+func waitQueued(t *testing.T, c *consumer, n int64) {
+	queued := func() bool {
+		for _, b := range c.teeBranches {
+			if atomic.LoadInt64(&b.queued) < n {
+				return false
+			}
+		}
+		return true
+	}
+
+	deadline := time.Now().Add(1 * time.Second)
+	for !queued() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !queued() {
+		t.Fatalf("expect %d envelopes to be queued", n)
+	}
+}
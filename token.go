@@ -1,66 +1,155 @@
 package nozzle
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
-
-	"github.com/cloudfoundry-incubator/uaago"
 )
 
 const (
 	defaultUAATimeout = 30 * time.Second
+
+	// refreshRatio is the ratio of token lifetime after which
+	// the token is refreshed.
+	refreshRatio = 0.8
+
+	// minRefreshBackoff and maxRefreshBackoff are the bounds of
+	// the interval to retry refreshing token after failure.
+	minRefreshBackoff = 1 * time.Second
+	maxRefreshBackoff = 1 * time.Minute
 )
 
+// TokenProvider is the interface for providing access token to connect
+// to firehose. It can be set via Config.TokenProvider to replace the
+// built-in UAA flow, e.g., to use token file managed by external agent.
+type TokenProvider interface {
+	// Token returns access token. It's called when constructing consumer
+	// and whenever reconnection needs a fresh token. If any, returns error.
+	Token(ctx context.Context) (string, error)
+}
+
 // tokenFetcher is the interface for fetching access token
-// From UAA server. By default, defaultTokenFetcher
-// (which is implemented with https://github.com/cloudfoundry-incubator/uaago)
-// is used
+// From UAA server. By default, defaultTokenFetcher is used
 type tokenFetcher interface {
-	// Fetch fetches the token from Uaa and return it. If any, returns error.
-	Fetch() (string, error)
+	// Fetch fetches the token from Uaa and return it with its lifetime
+	// (expires_in). If lifetime is unknown, it returns 0. If any, returns error.
+	Fetch(ctx context.Context) (string, time.Duration, error)
 }
 
 type defaultTokenFetcher struct {
 	uaaAddr  string
 	username string
 	password string
-	timeout  time.Duration
-	insecure bool
-	logger   *log.Logger
+
+	// clientID and clientSecret are used instead of username and
+	// password when they're set. Both pairs are sent as client
+	// credentials.
+	clientID     string
+	clientSecret string
+
+	timeout time.Duration
+	logger  leveledLogger
+
+	// httpClient is used for requesting token. It's Config.UAAHTTPClient
+	// or the client by newUAAHTTPClient.
+	httpClient *http.Client
 }
 
 // Fetch gets access token from UAA server. This auth token
 // is s used for accessing traffic-controller. It retuns error if any.
-func (tf *defaultTokenFetcher) Fetch() (string, error) {
-	tf.logger.Printf("[INFO] Getting auth token of %q from UAA (%s)", tf.username, tf.uaaAddr)
-	client, err := uaago.NewClient(tf.uaaAddr)
-	if err != nil {
-		return "", err
+func (tf *defaultTokenFetcher) Fetch(ctx context.Context) (string, time.Duration, error) {
+	id, secret := tf.username, tf.password
+	if tf.clientID != "" {
+		id, secret = tf.clientID, tf.clientSecret
+		tf.logger.Info("Getting auth token from UAA",
+			"uaa_addr", tf.uaaAddr, "client_id", tf.clientID)
+	} else {
+		tf.logger.Info("Getting auth token from UAA",
+			"uaa_addr", tf.uaaAddr, "username", tf.username)
 	}
 
-	resCh, errCh := make(chan string), make(chan error)
-	go func() {
-		token, err := client.GetAuthToken(tf.username, tf.password, tf.insecure)
-		if err != nil {
-			errCh <- err
+	// Without timeout, rely on the deadline of ctx if it has.
+	timeout := tf.timeout
+	if _, ok := ctx.Deadline(); timeout == 0 && !ok {
+		timeout = defaultUAATimeout
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	token, expiresIn, err := tf.requestToken(ctx, id, secret)
+	if err != nil {
+		switch ctx.Err() {
+		case nil:
+			return "", 0, err
+		case context.DeadlineExceeded:
+			return "", 0, fmt.Errorf("request timeout to UAA (%s): %s", tf.uaaAddr, ctx.Err())
+		default:
+			return "", 0, ctx.Err()
 		}
-		resCh <- token
-	}()
+	}
+
+	return token, time.Duration(expiresIn) * time.Second, nil
+}
+
+// requestToken requests token to UAA by client credentials grant with
+// httpClient. The token is returned with its type (e.g., "bearer xxx").
+func (tf *defaultTokenFetcher) requestToken(ctx context.Context, id, secret string) (string, int, error) {
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {id},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(tf.uaaAddr, "/")+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.SetBasicAuth(id, secret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	client := tf.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer res.Body.Close()
 
-	timeout := defaultUAATimeout
-	if tf.timeout != 0 {
-		timeout = tf.timeout
+	if res.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("received a status code %s from UAA", res.Status)
 	}
 
-	select {
-	case err := <-errCh:
-		return "", err
-	case <-time.After(timeout):
-		return "", fmt.Errorf("request timeout: %s", timeout)
-	case token := <-resCh:
-		return token, nil
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
 	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", 0, fmt.Errorf("failed to decode UAA response: %s", err)
+	}
+
+	return fmt.Sprintf("%s %s", body.TokenType, body.AccessToken), body.ExpiresIn, nil
+}
+
+// Token implements TokenProvider. It fetches access token from UAA server.
+func (tf *defaultTokenFetcher) Token(ctx context.Context) (string, error) {
+	token, _, err := tf.Fetch(ctx)
+	return token, err
 }
 
 func (tf *defaultTokenFetcher) validate() error {
@@ -69,6 +158,24 @@ func (tf *defaultTokenFetcher) validate() error {
 		return fmt.Errorf("UaaAddr must not be empty")
 	}
 
+	// Both pairs are sent as client credentials, so only one of them
+	// can be set.
+	if tf.clientID != "" || tf.clientSecret != "" {
+		if tf.username != "" || tf.password != "" {
+			return fmt.Errorf("ClientID can not be used with Username")
+		}
+
+		if tf.clientID == "" {
+			return fmt.Errorf("ClientID must not be empty")
+		}
+
+		if tf.clientSecret == "" {
+			return fmt.Errorf("ClientSecret must not be empty")
+		}
+
+		return nil
+	}
+
 	if tf.username == "" {
 		return fmt.Errorf("Username must not be empty")
 	}
@@ -86,8 +193,16 @@ func newDefaultTokenFetcher(config *Config) (*defaultTokenFetcher, error) {
 		timeout:  config.UaaTimeout,
 		username: config.Username,
 		password: config.Password,
-		insecure: config.Insecure,
-		logger:   config.Logger,
+		logger:   newLogger(config),
+
+		httpClient: config.UAAHTTPClient,
+
+		clientID:     config.ClientID,
+		clientSecret: config.ClientSecret,
+	}
+
+	if fetcher.httpClient == nil {
+		fetcher.httpClient = newUAAHTTPClient(config)
 	}
 
 	if err := fetcher.validate(); err != nil {
@@ -96,3 +211,206 @@ func newDefaultTokenFetcher(config *Config) (*defaultTokenFetcher, error) {
 
 	return fetcher, nil
 }
+
+// providerTokenFetcher adapts TokenProvider to tokenFetcher. Since
+// TokenProvider doesn't tell lifetime of token, it's always unknown
+// unless the provider also implements tokenFetcher.
+type providerTokenFetcher struct {
+	provider TokenProvider
+}
+
+// Fetch gets access token from TokenProvider.
+func (f *providerTokenFetcher) Fetch(ctx context.Context) (string, time.Duration, error) {
+	if tf, ok := f.provider.(tokenFetcher); ok {
+		return tf.Fetch(ctx)
+	}
+
+	token, err := f.provider.Token(ctx)
+	return token, 0, err
+}
+
+// noaaTokenRefresher adapts tokenFetcher to noaa TokenRefresher.
+// It's called by noaa when reconnection is rejected as unauthorized.
+type noaaTokenRefresher struct {
+	fetcher tokenFetcher
+}
+
+// RefreshAuthToken fetches a fresh token for noaa.
+func (r *noaaTokenRefresher) RefreshAuthToken() (string, error) {
+	token, _, err := r.fetcher.Fetch(context.Background())
+	return token, err
+}
+
+// tokenReceiver is implemented by rawConsumer which can re-establish
+// its firehose connection with a new token.
+type tokenReceiver interface {
+	// refreshToken reconnects firehose with the given token.
+	refreshToken(token string)
+
+	// sendError sends error to the error channel returned by Consume().
+	sendError(err error)
+}
+
+// tokenRefresher refreshes the access token before it expires
+// and passes the new one to tokenReceiver.
+type tokenRefresher struct {
+	// expiresAt is unix nano time when the current token expires. It's
+	// 0 if it's unknown. It's accessed atomically and placed first for
+	// 64-bit alignment.
+	expiresAt int64
+
+	fetcher tokenFetcher
+
+	// expiresIn is the lifetime of the current token.
+	expiresIn time.Duration
+
+	// clock is used to wait before refreshing. If it's nil, real time
+	// is used.
+	clock Clock
+
+	logger leveledLogger
+}
+
+// run refreshes token at refreshRatio of its lifetime until ctx is canceled.
+// If refreshing fails, the error is sent to tokenReceiver and it's retried
+// with exponential backoff.
+func (tr *tokenRefresher) run(ctx context.Context, r tokenReceiver) {
+	if tr.expiresIn <= 0 {
+		tr.logger.Warn("Token lifetime is unknown, token is not refreshed")
+		return
+	}
+
+	clock := orRealClock(tr.clock)
+	wait := refreshAfter(tr.expiresIn)
+	backoff := minRefreshBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(wait):
+		}
+
+		token, expiresIn, err := tr.fetcher.Fetch(ctx)
+		if err != nil {
+			r.sendError(fmt.Errorf("failed to refresh token: %s", err))
+
+			wait = backoff
+			backoff *= 2
+			if backoff > maxRefreshBackoff {
+				backoff = maxRefreshBackoff
+			}
+			continue
+		}
+
+		// Check again to not reconnect after canceled
+		if ctx.Err() != nil {
+			return
+		}
+
+		tr.logger.Debug("Refreshed auth token",
+			"token", maskString(token), "expires_in", expiresIn)
+		tr.setToken(token, expiresIn)
+		r.refreshToken(token)
+
+		if expiresIn <= 0 {
+			tr.logger.Warn("Token lifetime is unknown, token is not refreshed anymore")
+			return
+		}
+
+		wait = refreshAfter(expiresIn)
+		backoff = minRefreshBackoff
+	}
+}
+
+// setToken records the expiry of token which has lifetime expiresIn.
+// If expiresIn is unknown, it's read from token if it's JWT.
+func (tr *tokenRefresher) setToken(token string, expiresIn time.Duration) {
+	tr.expiresIn = expiresIn
+
+	var expiresAt time.Time
+	if expiresIn > 0 {
+		expiresAt = orRealClock(tr.clock).Now().Add(expiresIn)
+	} else if exp, ok := tokenExpiry(token); ok {
+		expiresAt = exp
+	}
+
+	var nano int64
+	if !expiresAt.IsZero() {
+		nano = expiresAt.UnixNano()
+	}
+	atomic.StoreInt64(&tr.expiresAt, nano)
+}
+
+// expiry returns the time when the current token expires. It's zero
+// if it's unknown.
+func (tr *tokenRefresher) expiry() time.Time {
+	nano := atomic.LoadInt64(&tr.expiresAt)
+	if nano == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nano)
+}
+
+// tokenExpiresIn returns the remaining lifetime of token read from the
+// exp claim of JWT. It returns 0 if the lifetime is unknown (e.g., token
+// is not JWT) and negative if token is already expired.
+func tokenExpiresIn(token string, now time.Time) time.Duration {
+	exp, ok := tokenExpiry(token)
+	if !ok {
+		return 0
+	}
+
+	expiresIn := exp.Sub(now)
+	if expiresIn == 0 {
+		return -1
+	}
+
+	return expiresIn
+}
+
+// tokenExpiry returns the exp claim of token if it's JWT. The signature
+// is not verified since the token is only used by doppler.
+func tokenExpiry(token string) (time.Time, bool) {
+	// Token is passed with its type, e.g., "bearer xxx"
+	if i := strings.LastIndex(token, " "); i >= 0 {
+		token = token[i+1:]
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(claims.Exp, 0), true
+}
+
+// refreshAfter returns the duration to wait before refreshing
+// the token which has the given lifetime.
+func refreshAfter(expiresIn time.Duration) time.Duration {
+	return time.Duration(float64(expiresIn) * refreshRatio)
+}
+
+// newUAAHTTPClient returns the client to request token to UAA when
+// Config.UAAHTTPClient is not set. It skips verification by Insecure
+// and enforces MinTLSVersion.
+func newUAAHTTPClient(config *Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: config.Insecure,
+		MinVersion:         minTLSVersion(config),
+	}
+	return &http.Client{Transport: transport}
+}
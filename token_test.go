@@ -1,6 +1,8 @@
 package nozzle
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"net/http"
@@ -14,18 +16,83 @@ type testTokenFetcher struct {
 	// Token is token to return by Fetch(), If it's empty,
 	// Fetch() returns error
 	Token string
+
+	// ExpiresIn is lifetime of token to return by Fetch().
+	ExpiresIn time.Duration
 }
 
-func (f *testTokenFetcher) Fetch() (string, error) {
+func (f *testTokenFetcher) Fetch(_ context.Context) (string, time.Duration, error) {
 	if f.Token == "" {
-		return "", fmt.Errorf("no token found")
+		return "", 0, fmt.Errorf("no token found")
+	}
+
+	return f.Token, f.ExpiresIn, nil
+}
+
+type testTokenReceiver struct {
+	tokenCh chan string
+	errCh   chan error
+}
+
+func (r *testTokenReceiver) refreshToken(token string) {
+	r.tokenCh <- token
+}
+
+func (r *testTokenReceiver) sendError(err error) {
+	r.errCh <- err
+}
+
+type testTokenProvider struct {
+	// token is token to return by Token(), If it's empty,
+	// Token() returns error
+	token string
+}
+
+func (p *testTokenProvider) Token(_ context.Context) (string, error) {
+	if p.token == "" {
+		return "", fmt.Errorf("no token provided")
 	}
 
-	return f.Token, nil
+	return p.token, nil
 }
 
 func TestDefaultTokenFetcher_implement(t *testing.T) {
 	var _ tokenFetcher = &defaultTokenFetcher{}
+	var _ TokenProvider = &defaultTokenFetcher{}
+}
+
+func TestProviderTokenFetcher(t *testing.T) {
+	fetcher := &providerTokenFetcher{
+		provider: &testTokenProvider{token: "bearer 8vbqu3tnvoq"},
+	}
+
+	token, expiresIn, err := fetcher.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if expect := "bearer 8vbqu3tnvoq"; token != expect {
+		t.Fatalf("expect %q to be eq %q", token, expect)
+	}
+
+	if expiresIn != 0 {
+		t.Fatalf("expect %s to be unknown", expiresIn)
+	}
+}
+
+func TestNoaaTokenRefresher(t *testing.T) {
+	refresher := &noaaTokenRefresher{
+		fetcher: &testTokenFetcher{Token: "bearer iugbqp3b8nvq"},
+	}
+
+	token, err := refresher.RefreshAuthToken()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if expect := "bearer iugbqp3b8nvq"; token != expect {
+		t.Fatalf("expect %q to be eq %q", token, expect)
+	}
 }
 
 func TestDefaultTokenFetcher_fetch(t *testing.T) {
@@ -69,7 +136,7 @@ func TestDefaultTokenFetcher_fetch(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	}
 
-	token, err := fetcher.Fetch()
+	token, expiresIn, err := fetcher.Fetch(context.Background())
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
@@ -79,6 +146,139 @@ func TestDefaultTokenFetcher_fetch(t *testing.T) {
 		t.Fatalf("expect %q to be eq %q", token, expect)
 	}
 
+	if expiresIn != 599*time.Second {
+		t.Fatalf("expect %s to be eq %s", expiresIn, 599*time.Second)
+	}
+
+}
+
+func TestDefaultTokenFetcher_clientCredentials(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validRequest(r) || r.PostForm.Get("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		authValue := "Basic " + base64.StdEncoding.EncodeToString([]byte("nozzle:bpq3hjg0a"))
+		if authValue != r.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(`{"access_token":"p9a8hbqpuiobq","token_type":"bearer","expires_in":599}`))
+	}))
+	defer ts.Close()
+
+	config := &Config{
+		UaaAddr:      ts.URL,
+		ClientID:     "nozzle",
+		ClientSecret: "bpq3hjg0a",
+		Logger:       defaultLogger,
+	}
+
+	fetcher, err := newDefaultTokenFetcher(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	token, _, err := fetcher.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if expect := "bearer p9a8hbqpuiobq"; token != expect {
+		t.Fatalf("expect %q to be eq %q", token, expect)
+	}
+}
+
+func TestDefaultTokenFetcher_httpClient(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validRequest(r) || r.PostForm.Get("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		authValue := "Basic " + base64.StdEncoding.EncodeToString([]byte("nozzle:bpq3hjg0a"))
+		if authValue != r.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(`{"access_token":"p9a8hbqpuiobq","token_type":"bearer","expires_in":599}`))
+	}))
+	defer ts.Close()
+
+	// The client trusts the certificate of test server
+	// without Insecure.
+	config := &Config{
+		UaaAddr:       ts.URL,
+		ClientID:      "nozzle",
+		ClientSecret:  "bpq3hjg0a",
+		UAAHTTPClient: ts.Client(),
+		Logger:        defaultLogger,
+	}
+
+	fetcher, err := newDefaultTokenFetcher(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	token, expiresIn, err := fetcher.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if expect := "bearer p9a8hbqpuiobq"; token != expect {
+		t.Fatalf("expect %q to be eq %q", token, expect)
+	}
+
+	if expect := 599 * time.Second; expiresIn != expect {
+		t.Fatalf("expect %s to be eq %s", expiresIn, expect)
+	}
+}
+
+func TestDefaultTokenFetcher_minTLSVersion(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"p9a8hbqpuiobq","token_type":"bearer","expires_in":599}`))
+	}))
+	ts.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// UAA only supports TLS 1.2
+	config := &Config{
+		UaaAddr:       ts.URL,
+		Username:      "gonozzle",
+		Password:      "passw0rd",
+		Insecure:      true,
+		MinTLSVersion: tls.VersionTLS13,
+		Logger:        defaultLogger,
+	}
+
+	fetcher, err := newDefaultTokenFetcher(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, _, err := fetcher.Fetch(context.Background()); err == nil {
+		t.Fatalf("expect to be failed")
+	}
+
+	config.MinTLSVersion = 0
+	fetcher, err = newDefaultTokenFetcher(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, _, err := fetcher.Fetch(context.Background()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
 }
 
 func TestDefaultTokenFetcher_failed_to_auth(t *testing.T) {
@@ -101,7 +301,7 @@ func TestDefaultTokenFetcher_failed_to_auth(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	}
 
-	_, err = fetcher.Fetch()
+	_, _, err = fetcher.Fetch(context.Background())
 	if err == nil {
 		t.Fatalf("expect to be failed")
 	}
@@ -133,7 +333,7 @@ func TestDefaultTokenFetcher_timeout(t *testing.T) {
 	}
 
 	// Execute fetcher
-	_, err = fetcher.Fetch()
+	_, _, err = fetcher.Fetch(context.Background())
 
 	expect := "timeout"
 	if !strings.Contains(err.Error(), expect) {
@@ -141,6 +341,42 @@ func TestDefaultTokenFetcher_timeout(t *testing.T) {
 	}
 }
 
+func TestDefaultTokenFetcher_contextDeadline(t *testing.T) {
+	t.Parallel()
+
+	// Create server it just waits for timout of client
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1 * time.Second)
+	}))
+	defer ts.Close()
+
+	// UaaTimeout is not set, so deadline of ctx is used
+	config := &Config{
+		UaaAddr:  ts.URL,
+		Username: "admin",
+		Password: "nipr8qhbp89pq",
+		Logger:   defaultLogger,
+	}
+
+	fetcher, err := newDefaultTokenFetcher(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, _, err = fetcher.Fetch(ctx)
+	if err == nil {
+		t.Fatalf("expect to be failed")
+	}
+
+	expect := fmt.Sprintf("request timeout to UAA (%s)", ts.URL)
+	if !strings.Contains(err.Error(), expect) {
+		t.Fatalf("expects error message %q to contain %q", err.Error(), expect)
+	}
+}
+
 func TestDefaultTokenFetcher_validate(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -172,6 +408,43 @@ func TestDefaultTokenFetcher_validate(t *testing.T) {
 			success: false,
 		},
 
+		{
+			in: &defaultTokenFetcher{
+				uaaAddr:      "https://uaa.cloudfoundry.net",
+				clientID:     "nozzle",
+				clientSecret: "bpq3hjg0a",
+			},
+			success: true,
+		},
+
+		{
+			in: &defaultTokenFetcher{
+				uaaAddr:  "https://uaa.cloudfoundry.net",
+				clientID: "nozzle",
+			},
+			success: false,
+		},
+
+		{
+			// Both pairs are sent as client credentials
+			in: &defaultTokenFetcher{
+				uaaAddr:      "https://uaa.cloudfoundry.net",
+				username:     "admin",
+				password:     "npi4Cgupn",
+				clientID:     "nozzle",
+				clientSecret: "bpq3hjg0a",
+			},
+			success: false,
+		},
+
+		{
+			in: &defaultTokenFetcher{
+				uaaAddr:      "https://uaa.cloudfoundry.net",
+				clientSecret: "bpq3hjg0a",
+			},
+			success: false,
+		},
+
 		{
 			in:      &defaultTokenFetcher{},
 			success: false,
@@ -198,6 +471,250 @@ func TestDefaultTokenFetcher_validate(t *testing.T) {
 
 }
 
+func TestTokenRefresher_run(t *testing.T) {
+	t.Parallel()
+
+	refresher := &tokenRefresher{
+		fetcher: &testTokenFetcher{
+			Token:     "bearer aoOuvb8p9q3nrv",
+			ExpiresIn: 50 * time.Millisecond,
+		},
+		expiresIn: 50 * time.Millisecond,
+		logger:    &stdLogger{logger: defaultLogger},
+	}
+
+	receiver := &testTokenReceiver{
+		tokenCh: make(chan string),
+		errCh:   make(chan error),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go refresher.run(ctx, receiver)
+
+	// Token must be refreshed repeatedly
+	for i := 0; i < 2; i++ {
+		select {
+		case token := <-receiver.tokenCh:
+			if expect := "bearer aoOuvb8p9q3nrv"; token != expect {
+				t.Fatalf("expect %q to be eq %q", token, expect)
+			}
+		case err := <-receiver.errCh:
+			t.Fatalf("err: %s", err)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect token to be refreshed")
+		}
+	}
+}
+
+func TestTokenRefresher_run_clock(t *testing.T) {
+	clock := newFakeClock()
+	refresher := &tokenRefresher{
+		fetcher: &testTokenFetcher{
+			Token:     "bearer aoOuvb8p9q3nrv",
+			ExpiresIn: 1 * time.Hour,
+		},
+		expiresIn: 1 * time.Hour,
+		clock:     clock,
+		logger:    &stdLogger{logger: defaultLogger},
+	}
+
+	receiver := &testTokenReceiver{
+		tokenCh: make(chan string),
+		errCh:   make(chan error),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go refresher.run(ctx, receiver)
+
+	// Refreshed at 80% of the lifetime by clock
+	clock.BlockUntil(t, 1)
+	clock.Advance(47 * time.Minute)
+
+	select {
+	case <-receiver.tokenCh:
+		t.Fatalf("expect token not to be refreshed yet")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	clock.Advance(1 * time.Minute)
+
+	select {
+	case <-receiver.tokenCh:
+	case err := <-receiver.errCh:
+		t.Fatalf("err: %s", err)
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect token to be refreshed")
+	}
+
+	if got, expect := refresher.expiry(), clock.Now().Add(1*time.Hour); !got.Equal(expect) {
+		t.Fatalf("expect %s to be eq %s", got, expect)
+	}
+}
+
+func TestTokenRefresher_run_failed(t *testing.T) {
+	t.Parallel()
+
+	refresher := &tokenRefresher{
+		// Returns error because of empty token
+		fetcher:   &testTokenFetcher{},
+		expiresIn: 10 * time.Millisecond,
+		logger:    &stdLogger{logger: defaultLogger},
+	}
+
+	receiver := &testTokenReceiver{
+		tokenCh: make(chan string),
+		errCh:   make(chan error),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go refresher.run(ctx, receiver)
+
+	select {
+	case err := <-receiver.errCh:
+		expect := "failed to refresh token"
+		if !strings.Contains(err.Error(), expect) {
+			t.Fatalf("expects error message %q to contain %q", err.Error(), expect)
+		}
+	case <-receiver.tokenCh:
+		t.Fatalf("expect not to be refreshed")
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect error to be sent")
+	}
+}
+
+func TestRefreshAfter(t *testing.T) {
+	got, expect := refreshAfter(100*time.Second), 80*time.Second
+	if got != expect {
+		t.Fatalf("expect %s to be eq %s", got, expect)
+	}
+}
+
+// testJWT returns unsigned JWT which expires at exp.
+func testJWT(exp time.Time) string {
+	enc := base64.RawURLEncoding
+	payload := fmt.Sprintf(`{"exp":%d}`, exp.Unix())
+	return "bearer " + enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		enc.EncodeToString([]byte(payload)) + ".sig"
+}
+
+func TestTokenExpiresIn(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		in     string
+		expect time.Duration
+	}{
+		{testJWT(now.Add(10 * time.Minute)), 10 * time.Minute},
+		{testJWT(now.Add(-1 * time.Minute)), -1 * time.Minute},
+
+		// Lifetime is unknown
+		{"bearer nabuiebaoijgbeiuabvlrijgbaobq", 0},
+		{"a.!!!.c", 0},
+	}
+
+	for i, tc := range cases {
+		got := tokenExpiresIn(tc.in, now).Round(time.Second)
+		if got != tc.expect {
+			t.Fatalf("#%d expect %s to be eq %s", i, got, tc.expect)
+		}
+	}
+}
+
+func TestSetupToken_tokenWithCredentials(t *testing.T) {
+	token := testJWT(time.Now().Add(10 * time.Minute))
+	config := &Config{
+		Token:    token,
+		UaaAddr:  "https://uaa.example.com",
+		Username: "admin",
+		tokenFetcher: &testTokenFetcher{
+			Token: "bearer refreshed",
+		},
+	}
+
+	fetcher, refresher, err := setupToken(context.Background(), config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Provided token is used without fetching
+	if config.Token != token {
+		t.Fatalf("expect %q to be eq %q", config.Token, token)
+	}
+
+	if fetcher == nil || refresher == nil {
+		t.Fatalf("expect token to be refreshed by credentials")
+	}
+
+	if got := refresher.expiresIn; got <= 9*time.Minute {
+		t.Fatalf("expect %s to be lifetime of provided token", got)
+	}
+}
+
+func TestSetupToken_expiredToken(t *testing.T) {
+	config := &Config{
+		Token:    testJWT(time.Now().Add(-1 * time.Minute)),
+		UaaAddr:  "https://uaa.example.com",
+		Username: "admin",
+		tokenFetcher: &testTokenFetcher{
+			Token: "bearer refreshed",
+		},
+	}
+
+	if _, _, err := setupToken(context.Background(), config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if got, expect := config.Token, "bearer refreshed"; got != expect {
+		t.Fatalf("expect %q to be eq %q", got, expect)
+	}
+}
+
+func TestSetupToken_tokenOnly(t *testing.T) {
+	config := &Config{
+		Token:   "bearer nabuiebaoijgbeiuabvlrijgbaobq",
+		UaaAddr: "https://uaa.example.com",
+	}
+
+	fetcher, refresher, err := setupToken(context.Background(), config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if fetcher != nil || refresher != nil {
+		t.Fatalf("expect token not to be refreshed without credentials")
+	}
+}
+
+func TestConsumerTokenExpiry(t *testing.T) {
+	exp := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+
+	// Read from the token provided by user
+	c := &consumer{config: Config{Token: testJWT(exp)}}
+	if got := c.TokenExpiry(); !got.Equal(exp) {
+		t.Fatalf("expect %s to be eq %s", got, exp)
+	}
+
+	// Updated by refresher
+	tr := &tokenRefresher{logger: &stdLogger{logger: defaultLogger}}
+	c.tokenRefresher = tr
+	if got := c.TokenExpiry(); !got.IsZero() {
+		t.Fatalf("expect %s to be zero before token is set", got)
+	}
+
+	tr.setToken("bearer nabuiebaoijgbeiuabvlrijgbaobq", 1*time.Hour)
+	if got := time.Until(c.TokenExpiry()); got <= 59*time.Minute || got > 1*time.Hour {
+		t.Fatalf("expect %s to be about 1h", got)
+	}
+
+	// Lifetime is unknown but token is JWT
+	tr.setToken(testJWT(exp), 0)
+	if got := c.TokenExpiry(); !got.Equal(exp) {
+		t.Fatalf("expect %s to be eq %s", got, exp)
+	}
+}
+
 // Validate requests of uaa-go.
 // This logic comes from https://github.com/cloudfoundry-incubator/uaago/blob/master/client_test.go
 func validRequest(r *http.Request) bool {
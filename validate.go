@@ -0,0 +1,54 @@
+package nozzle
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// validateEnvelope checks e has the payload of its event type. Envelopes
+// from older dopplers may lack it (e.g., nil ValueMetric on ValueMetric
+// type) and such envelopes crash downstream which doesn't expect it.
+func validateEnvelope(e *events.Envelope) error {
+	if e.EventType == nil {
+		return fmt.Errorf("event type is missing")
+	}
+
+	var ok bool
+	switch e.GetEventType() {
+	case events.Envelope_HttpStartStop:
+		ok = e.GetHttpStartStop() != nil
+	case events.Envelope_LogMessage:
+		ok = e.GetLogMessage() != nil
+	case events.Envelope_ValueMetric:
+		ok = e.GetValueMetric() != nil
+	case events.Envelope_CounterEvent:
+		ok = e.GetCounterEvent() != nil
+	case events.Envelope_Error:
+		ok = e.GetError() != nil
+	case events.Envelope_ContainerMetric:
+		ok = e.GetContainerMetric() != nil
+	default:
+		return fmt.Errorf("unknown event type %s", e.GetEventType())
+	}
+
+	if !ok {
+		return fmt.Errorf("%s is missing", e.GetEventType())
+	}
+
+	return nil
+}
+
+// isValid returns true if event passes validateEnvelope. Invalid
+// events are counted.
+func (c *consumer) isValid(event *events.Envelope) bool {
+	if err := validateEnvelope(event); err != nil {
+		c.logger.Debug("Dropped invalid envelope",
+			"origin", event.GetOrigin(), "error", err)
+		atomic.AddInt64(&c.invalidEvents, 1)
+		return false
+	}
+
+	return true
+}
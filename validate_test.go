@@ -0,0 +1,110 @@
+package nozzle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestValidateEnvelope(t *testing.T) {
+	cases := []struct {
+		in      *events.Envelope
+		success bool
+		errStr  string
+	}{
+		{
+			in: &events.Envelope{
+				EventType:   events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{Name: proto.String("numCPUS")},
+			},
+			success: true,
+		},
+
+		{
+			in: &events.Envelope{
+				EventType: events.Envelope_ValueMetric.Enum(),
+			},
+			success: false,
+			errStr:  "ValueMetric is missing",
+		},
+
+		{
+			in: &events.Envelope{
+				EventType: events.Envelope_ContainerMetric.Enum(),
+			},
+			success: false,
+			errStr:  "ContainerMetric is missing",
+		},
+
+		{
+			in:      &events.Envelope{},
+			success: false,
+			errStr:  "event type is missing",
+		},
+
+		{
+			in: &events.Envelope{
+				EventType: events.Envelope_EventType(100).Enum(),
+			},
+			success: false,
+			errStr:  "unknown event type 100",
+		},
+	}
+
+	for i, tc := range cases {
+		err := validateEnvelope(tc.in)
+		if tc.success {
+			if err != nil {
+				t.Fatalf("#%d err: %s", i, err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("#%d expect to be failed", i)
+		}
+
+		if got := err.Error(); got != tc.errStr {
+			t.Fatalf("#%d expect %q to be eq %q", i, got, tc.errStr)
+		}
+	}
+}
+
+func TestConsumer_validateEnvelopes(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:       rc,
+		logger:            &stdLogger{logger: defaultLogger},
+		validateEnvelopes: true,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	go func() {
+		rc.eventCh <- &events.Envelope{
+			EventType: events.Envelope_ValueMetric.Enum(),
+		}
+		rc.eventCh <- &events.Envelope{
+			EventType:   events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{Name: proto.String("numCPUS")},
+		}
+	}()
+
+	select {
+	case event := <-c.Events():
+		if event.GetValueMetric() == nil {
+			t.Fatalf("expect invalid envelope to be dropped")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	if got, expect := c.Stats().InvalidEvents, int64(1); got != expect {
+		t.Fatalf("expect %d to be eq %d", got, expect)
+	}
+}
@@ -0,0 +1,70 @@
+package nozzle
+
+import (
+	"errors"
+	"fmt"
+
+	noaaConsumer "github.com/cloudfoundry/noaa/consumer"
+)
+
+// Wait blocks until consumer terminates and returns the error which
+// terminated it, similar to http.Server.ListenAndServe. It returns nil
+// when Close is called and the error of the context passed to
+// StartWithContext when it's canceled. Otherwise consumer is terminated
+// when noaa gives up retrying and it's not reconnected (by
+// ReconnectBackoff or DopplerAddrs failover), or upstream stops by
+// itself, and the last error reported on Errors() is returned.
+//
+// Errors() must be read while waiting, otherwise the error which
+// terminates consumer may not be observed.
+func (c *consumer) Wait() error {
+	if c.closedCh == nil {
+		return fmt.Errorf("consumer is not started")
+	}
+
+	select {
+	case <-c.closedCh:
+	case <-c.terminalCh:
+	case <-c.errDoneCh:
+	}
+
+	// Close may be called at the same time
+	select {
+	case <-c.closedCh:
+		return nil
+	default:
+	}
+
+	if err := c.startCtx.Err(); err != nil {
+		return err
+	}
+
+	c.readyMu.Lock()
+	defer c.readyMu.Unlock()
+	if c.lastErr != nil {
+		return fmt.Errorf("consumer is terminated: %w", c.lastErr)
+	}
+
+	return fmt.Errorf("consumer is terminated")
+}
+
+// observeTerminalErr records err as the last error returned by Wait.
+// If consumer doesn't recover from it, Wait is notified.
+func (c *consumer) observeTerminalErr(err error) {
+	c.readyMu.Lock()
+	c.lastErr = err
+	c.readyMu.Unlock()
+
+	if errors.Is(err, noaaConsumer.ErrMaxRetriesReached) && !c.reconnects() {
+		c.terminalOnce.Do(func() {
+			close(c.terminalCh)
+		})
+	}
+}
+
+// markClosed notifies Wait that Close is called.
+func (c *consumer) markClosed() {
+	if c.closedCh != nil {
+		close(c.closedCh)
+	}
+}
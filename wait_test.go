@@ -0,0 +1,145 @@
+package nozzle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	noaaConsumer "github.com/cloudfoundry/noaa/consumer"
+)
+
+func TestConsumerWait_close(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	if err := c.Wait(); err == nil {
+		t.Fatalf("expect to be failed before started")
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- c.Wait()
+	}()
+
+	select {
+	case err := <-waitCh:
+		t.Fatalf("expect to block: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.Close()
+
+	select {
+	case err := <-waitCh:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestConsumerWait_maxRetries(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:   rc,
+		logger:        &stdLogger{logger: defaultLogger},
+		errBufferSize: 1,
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	// noaa gives up retrying and it's not reconnected
+	rc.errCh <- noaaConsumer.ErrMaxRetriesReached
+
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- c.Wait()
+	}()
+
+	select {
+	case err := <-waitCh:
+		if !errors.Is(err, noaaConsumer.ErrMaxRetriesReached) {
+			t.Fatalf("expect %v to wrap %v", err, noaaConsumer.ErrMaxRetriesReached)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestConsumerWait_reconnect(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer:   rc,
+		logger:        &stdLogger{logger: defaultLogger},
+		errBufferSize: 1,
+		config:        Config{ReconnectBackoff: &ExponentialBackoff{}},
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Consumer recovers by reconnecting
+	rc.errCh <- noaaConsumer.ErrMaxRetriesReached
+
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- c.Wait()
+	}()
+
+	select {
+	case err := <-waitCh:
+		t.Fatalf("expect to block: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.Close()
+	if err := <-waitCh; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestConsumerWait_contextCanceled(t *testing.T) {
+	rc := &testRawConsumer{}
+	c := &consumer{
+		rawConsumer: rc,
+		logger:      &stdLogger{logger: defaultLogger},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := c.StartWithContext(ctx); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	// Upstream stops when ctx is canceled
+	cancel()
+	close(rc.errCh)
+	rc.errCh = nil
+
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- c.Wait()
+	}()
+
+	select {
+	case err := <-waitCh:
+		if err != context.Canceled {
+			t.Fatalf("expect %v to be Canceled", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}